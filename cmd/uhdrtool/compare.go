@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	aPath := fs.String("a", "", "first UltraHDR JPEG")
+	bPath := fs.String("b", "", "second UltraHDR JPEG")
+	asJSON := fs.Bool("json", false, "print comparison as JSON")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *aPath == "" || *bPath == "" {
+		return errors.New("missing required arguments")
+	}
+	if err := checkStdio([]string{*aPath, *bPath}, nil); err != nil {
+		return err
+	}
+	a, err := readInput(*aPath)
+	if err != nil {
+		return err
+	}
+	b, err := readInput(*bPath)
+	if err != nil {
+		return err
+	}
+
+	c, err := ultrahdr.CompareContainers(a, b)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	}
+
+	for _, w := range c.Warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	fmt.Printf("container\t%d -> %d bytes (%+d)\n", c.BytesA, c.BytesB, c.BytesB-c.BytesA)
+	for _, d := range []struct {
+		name string
+		diff ultrahdr.ImageDiff
+	}{
+		{name: "primary", diff: c.Primary},
+		{name: "gainmap", diff: c.Gainmap},
+	} {
+		fmt.Printf("%s\t%dx%d -> %dx%d, %d -> %d bytes (%+d), PSNR %.2f dB",
+			d.name, d.diff.WidthA, d.diff.HeightA, d.diff.WidthB, d.diff.HeightB,
+			d.diff.BytesA, d.diff.BytesB, d.diff.BytesB-d.diff.BytesA, d.diff.PSNR)
+		if d.diff.SSIM != 0 {
+			fmt.Printf(", SSIM %.4f", d.diff.SSIM)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("hdr\tPSNR %.2f dB\n", c.HDRPSNR)
+	for _, m := range c.Metadata {
+		fmt.Printf("metadata\t%s: %g -> %g\n", m.Field, m.A, m.B)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+func runDetect(args []string) error {
+	flags := flag.NewFlagSet("detect", flag.ContinueOnError)
+	inPath := flags.String("in", "", "input JPEG")
+	recursive := flags.Bool("r", false, "walk directories recursively")
+	exts := flags.String("ext", ".jpg,.jpeg", "comma-separated file extensions to check in directories")
+	jobs := flags.Int("j", runtime.NumCPU(), "number of files to check concurrently")
+	flags.SetOutput(os.Stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *inPath != "" && flags.NArg() == 0 {
+		return detectSingle(*inPath)
+	}
+	paths := flags.Args()
+	if *inPath != "" {
+		paths = append([]string{*inPath}, paths...)
+	}
+	if len(paths) == 0 {
+		return errors.New("missing required arguments")
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	extSet := map[string]bool{}
+	for _, e := range strings.Split(*exts, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		extSet[e] = true
+	}
+
+	files := make(chan string)
+	var (
+		mu                   sync.Mutex
+		total, hdr, sdr, bad int
+		wg                   sync.WaitGroup
+	)
+	report := func(path, result string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(os.Stdout, "%s\t%s\n", path, result)
+	}
+	for i := 0; i < *jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				ok, err := detectFile(path)
+				mu.Lock()
+				total++
+				switch {
+				case err != nil:
+					bad++
+				case ok:
+					hdr++
+				default:
+					sdr++
+				}
+				mu.Unlock()
+				switch {
+				case err != nil:
+					report(path, "error: "+err.Error())
+				case ok:
+					report(path, "ultrahdr")
+				default:
+					report(path, "not ultrahdr")
+				}
+			}
+		}()
+	}
+
+	for _, p := range paths {
+		if err := collectDetectPaths(p, *recursive, extSet, files, func(path string, err error) {
+			mu.Lock()
+			total++
+			bad++
+			mu.Unlock()
+			report(path, "error: "+err.Error())
+		}); err != nil {
+			close(files)
+			wg.Wait()
+			return err
+		}
+	}
+	close(files)
+	wg.Wait()
+
+	fmt.Fprintf(os.Stderr, "total: %d, ultrahdr: %d, not ultrahdr: %d, errors: %d\n", total, hdr, sdr, bad)
+	return nil
+}
+
+func detectSingle(path string) error {
+	ok, err := detectFile(path)
+	if err != nil {
+		return err
+	}
+	if ok {
+		fmt.Fprintln(os.Stdout, "ultrahdr")
+		return nil
+	}
+	fmt.Fprintln(os.Stdout, "not ultrahdr")
+	return nil
+}
+
+func detectFile(path string) (bool, error) {
+	f, err := openInput(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if soi, err := br.Peek(2); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return false, ultrahdr.ErrNotJPEG
+	}
+	return ultrahdr.IsUltraHDR(br)
+}
+
+// collectDetectPaths sends files to check, "-" reads newline-separated paths from stdin.
+func collectDetectPaths(path string, recursive bool, exts map[string]bool, files chan<- string, fail func(string, error)) error {
+	if path == "-" {
+		return readPathList(os.Stdin, files)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		fail(path, err)
+		return nil
+	}
+	if !info.IsDir() {
+		files <- path
+		return nil
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fail(p, err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if p != path && !recursive {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if exts[strings.ToLower(filepath.Ext(p))] {
+			files <- p
+		}
+		return nil
+	})
+}
+
+func readPathList(r io.Reader, files chan<- string) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			files <- line
+		}
+	}
+	return sc.Err()
+}
@@ -37,6 +37,32 @@ func main() {
 		if err := runRebase(os.Args[2:]); err != nil {
 			fail(err)
 		}
+	case "rebase-hdr":
+		if err := runRebaseHDR(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "rotate":
+		if err := runRotate(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "flip":
+		if err := runFlip(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "tone":
+		if err := runTone(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "compare":
+		if err := runCompare(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "set-capacity":
+		if err := runSetCapacity(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "validate":
+		os.Exit(runValidate(os.Args[2:]))
 	case "detect":
 		if err := runDetect(os.Args[2:]); err != nil {
 			fail(err)
@@ -64,16 +90,27 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "Commands:")
 	fmt.Fprintln(os.Stderr, "  crop  -in input.jpg -out output.jpg -x 0 -y 0 -w 800 -h 600 [-tw 800] [-th 600] [-q 85] [-gq 75] [-keep-meta]")
 	fmt.Fprintln(os.Stderr, "  resize -in input.jpg -out output.jpg -w 2400 -h 1600 [-q 85] [-gq 75] [-primary-out p.jpg] [-gainmap-out g.jpg]")
+	fmt.Fprintln(os.Stderr, "        (or) resize -in input.jpg -size 1200x800:l.jpg -size 300x200:s.jpg:80:70 [-spec sizes.json] [-strict]")
 	fmt.Fprintln(os.Stderr, "  grid  -in a.jpg -in b.jpg -cols 2 -cell-w 400 -cell-h 300 -out grid.jpg [-q 85] [-bg #000000] [-interp lanczos2]")
-	fmt.Fprintln(os.Stderr, "  rebase -in uhdr.jpg -primary better_sdr.jpg -out output.jpg [-q 95] [-gq 85] [-primary-out p.jpg] [-gainmap-out g.jpg]")
-	fmt.Fprintln(os.Stderr, "  rebase -primary sdr.jpg -exr hdr.exr -out output.jpg [-q 95] [-gq 85] [-primary-out p.jpg] [-gainmap-out g.jpg]")
-	fmt.Fprintln(os.Stderr, "  rebase -primary sdr.jpg -tiff hdr.tif -out output.jpg [-q 95] [-gq 85] [-primary-out p.jpg] [-gainmap-out g.jpg]")
+	fmt.Fprintln(os.Stderr, "  rebase -in uhdr.jpg -primary better_sdr.jpg -out output.jpg [-q 95] [-gq 85] [-dither] [-primary-out p.jpg] [-gainmap-out g.jpg]")
+	fmt.Fprintln(os.Stderr, "  rebase -primary sdr.jpg -exr hdr.exr -out output.jpg [-q 95] [-gq 85] [-auto-gamma] [-dither] [-bg #RRGGBB] [-primary-out p.jpg] [-gainmap-out g.jpg]")
+	fmt.Fprintln(os.Stderr, "  rebase -primary sdr.jpg -tiff hdr.tif -out output.jpg [-q 95] [-gq 85] [-auto-gamma] [-dither] [-primary-out p.jpg] [-gainmap-out g.jpg]")
+	fmt.Fprintln(os.Stderr, "  rebase-hdr [-in uhdr.jpg] -sdr new_sdr.jpg -exr master.exr -out output.jpg [-q 95] [-gq 85] [-scale 1] [-auto-gamma] [-dither] [-multichannel]")
+	fmt.Fprintln(os.Stderr, "  rotate -in input.jpg -out output.jpg -degrees 90|180|270 [-q 90] [-gq 85]")
+	fmt.Fprintln(os.Stderr, "        (or) rotate -in input.jpg -out output.jpg -auto")
+	fmt.Fprintln(os.Stderr, "  flip  -in input.jpg -out output.jpg -h|-v [-q 90] [-gq 85]")
+	fmt.Fprintln(os.Stderr, "  tone  -in uhdr.jpg -out preview.jpg [-boost 2] [-q 90]  (SDR preview at display headroom)")
+	fmt.Fprintln(os.Stderr, "  compare -a one.jpg -b two.jpg [-json]  (PSNR/SSIM, metadata and size deltas)")
+	fmt.Fprintln(os.Stderr, "  set-capacity -in in.jpg -out out.jpg -max 2.0 [-min 1.0]  (rewrites metadata only)")
+	fmt.Fprintln(os.Stderr, "  validate -in input.jpg [-json] [-strict]  (exit 0 ok, 1 warnings with -strict, 2 fatal)")
 	fmt.Fprintln(os.Stderr, "  detect -in input.jpg")
-	fmt.Fprintln(os.Stderr, "  split  -in input.jpg -primary-out primary.jpg -gainmap-out gainmap.jpg [-meta-out meta.json]")
-	fmt.Fprintln(os.Stderr, "  join   -meta meta.json -primary primary.jpg -gainmap gainmap.jpg -out output.jpg")
+	fmt.Fprintln(os.Stderr, "  detect [-r] [-ext .jpg,.jpeg] [-j 8] path... (use - to read paths from stdin)")
+	fmt.Fprintln(os.Stderr, "  split  -in input.jpg -primary-out primary.jpg -gainmap-out gainmap.jpg [-meta-out meta.json] [-display-without-meta]")
+	fmt.Fprintln(os.Stderr, "  join   -meta meta.json -primary primary.jpg -gainmap gainmap.jpg|gainmap.png -out output.jpg [-gq 85]")
 	fmt.Fprintln(os.Stderr, "        (or) join -template input.jpg -primary primary.jpg -gainmap gainmap.jpg -out output.jpg")
 	fmt.Fprintln(os.Stderr, "        (or) join -primary primary.jpg -gainmap gainmap.jpg -out output.jpg")
 	fmt.Fprintln(os.Stderr, "  gmstats -in gainmap.jpg")
+	fmt.Fprintln(os.Stderr, "Use - as a path to read input from stdin or write output to stdout (one of each per command).")
 }
 
 func runCrop(args []string) error {
@@ -89,7 +126,7 @@ func runCrop(args []string) error {
 	q := fs.Int("q", 85, "base quality")
 	gq := fs.Int("gq", 75, "gainmap quality")
 	keepMeta := fs.Bool("keep-meta", false, "keep SDR metadata (EXIF/ICC)")
-	interp := fs.String("interp", "lanczos2", "resize interpolation method, one of: nearest, bilinear, bicubic, mitchell, lanczos2, lanczos3")
+	interp := fs.String("interp", "lanczos2", "resize interpolation method, one of: nearest, box, bilinear, bicubic, mitchell, hermite, lanczos2, lanczos3, lanczos4")
 	fs.SetOutput(os.Stderr)
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -107,14 +144,14 @@ func runCrop(args []string) error {
 	rect := image.Rect(*x, *y, *x+*w, *y+*h)
 	interpMode := parseInterpolation(*interp)
 
-	f, err := os.Open(*inPath)
+	data, err := readInput(*inPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	f := bytes.NewReader(data)
 
 	ok, err := ultrahdr.IsUltraHDR(f)
-	if err != nil {
+	if err != nil && !errors.Is(err, ultrahdr.ErrNotJPEG) {
 		return err
 	}
 	if _, err := f.Seek(0, 0); err != nil {
@@ -142,7 +179,7 @@ func runCrop(args []string) error {
 		if out == nil || out.Container == nil {
 			return errors.New("crop produced no output")
 		}
-		return os.WriteFile(*outPath, out.Container, 0o644)
+		return writeOutput(*outPath, out.Container)
 	}
 
 	var out *ultrahdr.Result
@@ -165,7 +202,7 @@ func runCrop(args []string) error {
 	if out == nil || out.Primary == nil {
 		return errors.New("crop produced no output")
 	}
-	return os.WriteFile(*outPath, out.Primary, 0o644)
+	return writeOutput(*outPath, out.Primary)
 }
 
 func runResize(args []string) error {
@@ -176,28 +213,66 @@ func runResize(args []string) error {
 	height := fs.Uint("h", 0, "target height")
 	q := fs.Int("q", 85, "base quality")
 	gq := fs.Int("gq", 75, "gainmap quality")
+	gainmapMax := fs.Uint("gainmap-max", 0, "cap gainmap long edge (0 keeps primary size)")
 	primaryOut := fs.String("primary-out", "", "write primary JPEG")
 	gainmapOut := fs.String("gainmap-out", "", "write gainmap JPEG")
-	interp := fs.String("interp", "lanczos2", "resize interpolation method, one of: nearest, bilinear, bicubic, mitchell, lanczos2, lanczos3")
+	interp := fs.String("interp", "lanczos2", "resize interpolation method, one of: nearest, box, bilinear, bicubic, mitchell, hermite, lanczos2, lanczos3, lanczos4")
+	var sizes multiFlag
+	fs.Var(&sizes, "size", "output WxH:out.jpg[:q[:gq]] (repeat for multiple sizes from one decode)")
+	specPath := fs.String("spec", "", "JSON file with outputs: [{\"width\":W,\"height\":H,\"out\":\"out.jpg\",\"q\":85,\"gq\":75}]")
+	strict := fs.Bool("strict", false, "multi-size: fail if any output fails (default fails only if all fail)")
 	fs.SetOutput(os.Stderr)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	interpMode := parseInterpolation(*interp)
+	if len(sizes) > 0 || *specPath != "" {
+		if *inPath == "" {
+			return errors.New("missing required arguments")
+		}
+		if err := checkStdio([]string{*inPath, *specPath}, nil); err != nil {
+			return err
+		}
+		var outputs []resizeOutput
+		if *specPath != "" {
+			fromFile, err := readResizeSpecFile(*specPath)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, fromFile...)
+		}
+		for _, v := range sizes {
+			o, err := parseSizeFlag(v)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, o)
+		}
+		return resizeMulti(*inPath, outputs, ultrahdr.ResizeSpec{
+			Quality:        *q,
+			GainmapQuality: *gq,
+			GainmapMaxDim:  *gainmapMax,
+			Interpolation:  interpMode,
+		}, *strict)
+	}
 	if *inPath == "" || *outPath == "" || *width <= 0 || *height <= 0 {
 		return errors.New("missing required arguments")
 	}
-	f, err := os.Open(*inPath)
+	if err := checkStdio(nil, []string{*outPath, *primaryOut, *gainmapOut}); err != nil {
+		return err
+	}
+	f, err := openInput(*inPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	interpMode := parseInterpolation(*interp)
 	var resized *ultrahdr.Result
 	err = ultrahdr.ResizeHDR(f, ultrahdr.ResizeSpec{
 		Width:          *width,
 		Height:         *height,
 		Quality:        *q,
 		GainmapQuality: *gq,
+		GainmapMaxDim:  *gainmapMax,
 		Interpolation:  interpMode,
 		ReceiveResult: func(res *ultrahdr.Result, err error) {
 			if err == nil {
@@ -211,20 +286,7 @@ func runResize(args []string) error {
 	if resized == nil {
 		return errors.New("resize produced no output")
 	}
-	if err := os.WriteFile(*outPath, resized.Container, 0o644); err != nil {
-		return err
-	}
-	if *primaryOut != "" {
-		if err := os.WriteFile(*primaryOut, resized.Primary, 0o644); err != nil {
-			return err
-		}
-	}
-	if *gainmapOut != "" {
-		if err := os.WriteFile(*gainmapOut, resized.Gainmap, 0o644); err != nil {
-			return err
-		}
-	}
-	return nil
+	return writeResultOutputs(resized, *outPath, *primaryOut, *gainmapOut)
 }
 
 func runGrid(args []string) error {
@@ -237,7 +299,7 @@ func runGrid(args []string) error {
 	outPath := fs.String("out", "", "output JPEG")
 	q := fs.Int("q", 85, "base quality")
 	bg := fs.String("bg", "", "background color (#RRGGBB or r,g,b)")
-	interp := fs.String("interp", "lanczos2", "resize interpolation method, one of: nearest, bilinear, bicubic, mitchell, lanczos2, lanczos3")
+	interp := fs.String("interp", "lanczos2", "resize interpolation method, one of: nearest, box, bilinear, bicubic, mitchell, hermite, lanczos2, lanczos3, lanczos4")
 	primaryOut := fs.String("primary-out", "", "write primary JPEG")
 	gainmapOut := fs.String("gainmap-out", "", "write gainmap JPEG")
 	fs.SetOutput(os.Stderr)
@@ -307,73 +369,116 @@ func runRebase(args []string) error {
 	primaryPath := fs.String("primary", "", "new SDR JPEG")
 	exrPath := fs.String("exr", "", "HDR OpenEXR input")
 	tiffPath := fs.String("tiff", "", "HDR TIFF input")
+	hdrInPath := fs.String("hdr", "", "HDR Radiance RGBE (.hdr) input")
 	outPath := fs.String("out", "", "output UltraHDR JPEG")
 	q := fs.Int("q", 95, "base quality")
 	gq := fs.Int("gq", 85, "gainmap quality")
 	primaryOut := fs.String("primary-out", "", "write primary JPEG")
 	gainmapOut := fs.String("gainmap-out", "", "write gainmap JPEG")
+	interp := fs.String("interp", "lanczos2", "resampling when new SDR dimensions differ, one of: nearest, box, bilinear, bicubic, mitchell, hermite, lanczos2, lanczos3, lanczos4")
+	autoGamma := fs.Bool("auto-gamma", false, "pick gainmap gamma for -exr/-tiff/-hdr from gain distribution")
+	dither := fs.Bool("dither", false, "apply ordered dithering when quantizing gainmap (reduces banding)")
+	bg := fs.String("bg", "", "background for transparent -exr/-tiff and SDR inputs (#RRGGBB or r,g,b, default black)")
 	fs.SetOutput(os.Stderr)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	var opts []ultrahdr.RebaseOption
+	opts := []ultrahdr.RebaseOption{
+		ultrahdr.WithInterpolation(parseInterpolation(*interp)),
+		ultrahdr.WithAutoGainmapGamma(*autoGamma),
+		ultrahdr.WithGainmapDither(*dither),
+	}
+	if *bg != "" {
+		c, err := parseColor(*bg)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, ultrahdr.WithBackground(c))
+	}
 	if *q > 0 {
 		opts = append(opts, ultrahdr.WithBaseQuality(*q))
 	}
 	if *gq > 0 {
 		opts = append(opts, ultrahdr.WithGainmapQuality(*gq))
 	}
-	if *primaryOut != "" {
-		opts = append(opts, ultrahdr.WithPrimaryOut(*primaryOut))
-	}
-	if *gainmapOut != "" {
-		opts = append(opts, ultrahdr.WithGainmapOut(*gainmapOut))
-	}
-	if *exrPath != "" && *tiffPath != "" {
-		return errors.New("use only one of -exr or -tiff")
-	}
-	if *exrPath != "" {
-		if *primaryPath == "" || *outPath == "" {
-			return errors.New("missing required arguments")
+	hdrInputs := 0
+	for _, p := range []string{*exrPath, *tiffPath, *hdrInPath} {
+		if p != "" {
+			hdrInputs++
 		}
-		return ultrahdr.RebaseFromEXRFile(*primaryPath, *exrPath, *outPath, opts...)
 	}
-	if *tiffPath != "" {
-		if *primaryPath == "" || *outPath == "" {
-			return errors.New("missing required arguments")
-		}
-		return ultrahdr.RebaseFromTIFFFile(*primaryPath, *tiffPath, *outPath, opts...)
+	if hdrInputs > 1 {
+		return errors.New("use only one of -exr, -tiff or -hdr")
 	}
-	if *inPath == "" || *primaryPath == "" || *outPath == "" {
+	hdrPath := *exrPath + *tiffPath + *hdrInPath
+	if *primaryPath == "" || *outPath == "" || (hdrPath == "" && *inPath == "") {
 		return errors.New("missing required arguments")
 	}
-	return ultrahdr.RebaseFile(*inPath, *primaryPath, *outPath, opts...)
-}
-
-func runDetect(args []string) error {
-	fs := flag.NewFlagSet("detect", flag.ContinueOnError)
-	inPath := fs.String("in", "", "input JPEG")
-	fs.SetOutput(os.Stderr)
-	if err := fs.Parse(args); err != nil {
+	if err := checkStdio([]string{*inPath, *primaryPath, hdrPath}, []string{*outPath, *primaryOut, *gainmapOut}); err != nil {
 		return err
 	}
-	if *inPath == "" {
-		return errors.New("missing required arguments")
-	}
-	f, err := os.Open(*inPath)
+	primary, err := readInput(*primaryPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	ok, err := ultrahdr.IsUltraHDR(f)
-	if err != nil {
+
+	var res *ultrahdr.Result
+	switch {
+	case *exrPath != "":
+		exr, err := readInput(*exrPath)
+		if err != nil {
+			return err
+		}
+		res, err = ultrahdr.RebaseFromEXR(primary, exr, opts...)
+		if err != nil {
+			return err
+		}
+	case *tiffPath != "":
+		tiff, err := readInput(*tiffPath)
+		if err != nil {
+			return err
+		}
+		res, err = ultrahdr.RebaseFromTIFF(primary, tiff, opts...)
+		if err != nil {
+			return err
+		}
+	case *hdrInPath != "":
+		hdr, err := readInput(*hdrInPath)
+		if err != nil {
+			return err
+		}
+		res, err = ultrahdr.RebaseFromRadianceHDR(primary, hdr, opts...)
+		if err != nil {
+			return err
+		}
+	default:
+		data, err := readInput(*inPath)
+		if err != nil {
+			return err
+		}
+		res, err = ultrahdr.RebaseJPEG(data, primary, opts...)
+		if err != nil {
+			return err
+		}
+	}
+	return writeResultOutputs(res, *outPath, *primaryOut, *gainmapOut)
+}
+
+// writeResultOutputs writes container and optional primary and gainmap components.
+func writeResultOutputs(res *ultrahdr.Result, outPath, primaryOut, gainmapOut string) error {
+	if err := writeOutput(outPath, res.Container); err != nil {
 		return err
 	}
-	if ok {
-		fmt.Fprintln(os.Stdout, "ultrahdr")
-		return nil
+	if primaryOut != "" {
+		if err := writeOutput(primaryOut, res.Primary); err != nil {
+			return err
+		}
+	}
+	if gainmapOut != "" {
+		if err := writeOutput(gainmapOut, res.Gainmap); err != nil {
+			return err
+		}
 	}
-	fmt.Fprintln(os.Stdout, "not ultrahdr")
 	return nil
 }
 
@@ -383,6 +488,7 @@ func runSplit(args []string) error {
 	primaryOut := fs.String("primary-out", "", "primary output JPEG")
 	gainmapOut := fs.String("gainmap-out", "", "gainmap output JPEG")
 	metaOut := fs.String("meta-out", "", "metadata json output")
+	displayWithoutMeta := fs.Bool("display-without-meta", false, "take image without gainmap metadata as primary regardless of MPF")
 	fs.SetOutput(os.Stderr)
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -390,19 +496,25 @@ func runSplit(args []string) error {
 	if *inPath == "" || *primaryOut == "" || *gainmapOut == "" {
 		return errors.New("missing required arguments")
 	}
-	f, err := os.Open(*inPath)
+	if err := checkStdio(nil, []string{*primaryOut, *gainmapOut, *metaOut}); err != nil {
+		return err
+	}
+	f, err := openInput(*inPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	split, err := ultrahdr.Split(f)
+	split, err := ultrahdr.SplitWithOptions(f, &ultrahdr.SplitOptions{DisplayWithoutMetadata: *displayWithoutMeta})
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(*primaryOut, split.Primary, 0o644); err != nil {
+	for _, msg := range split.Warnings {
+		fmt.Fprintln(os.Stderr, "warning:", msg)
+	}
+	if err := writeOutput(*primaryOut, split.Primary); err != nil {
 		return err
 	}
-	if err := os.WriteFile(*gainmapOut, split.Gainmap, 0o644); err != nil {
+	if err := writeOutput(*gainmapOut, split.Gainmap); err != nil {
 		return err
 	}
 	if *metaOut != "" {
@@ -414,7 +526,7 @@ func runSplit(args []string) error {
 		if err != nil {
 			return err
 		}
-		if err := os.WriteFile(*metaOut, payload, 0o644); err != nil {
+		if err := writeOutput(*metaOut, payload); err != nil {
 			return err
 		}
 	}
@@ -426,8 +538,10 @@ func runJoin(args []string) error {
 	templatePath := fs.String("template", "", "template UltraHDR JPEG for metadata")
 	metaPath := fs.String("meta", "", "metadata json")
 	primaryPath := fs.String("primary", "", "primary JPEG")
-	gainmapPath := fs.String("gainmap", "", "gainmap JPEG")
+	gainmapPath := fs.String("gainmap", "", "gainmap JPEG or PNG")
 	outPath := fs.String("out", "", "output UltraHDR JPEG")
+	gq := fs.Int("gq", 85, "gainmap quality (PNG gainmap only)")
+	keepApp := fs.Bool("keep-app", false, "keep custom APP segments of primary JPEG (other than EXIF, XMP, ICC, MPF, ISO)")
 	fs.SetOutput(os.Stderr)
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -435,50 +549,53 @@ func runJoin(args []string) error {
 	if *primaryPath == "" || *gainmapPath == "" || *outPath == "" {
 		return errors.New("missing required arguments")
 	}
-	primary, err := os.ReadFile(*primaryPath)
+	if err := checkStdio([]string{*primaryPath, *gainmapPath, *metaPath, *templatePath}, nil); err != nil {
+		return err
+	}
+	primary, err := readInput(*primaryPath)
 	if err != nil {
 		return err
 	}
-	gainmap, err := os.ReadFile(*gainmapPath)
+	gainmap, err := readInput(*gainmapPath)
 	if err != nil {
 		return err
 	}
+	opt := &ultrahdr.JoinOptions{
+		GainmapQuality:         *gq,
+		KeepPrimaryAppSegments: *keepApp,
+		Warn: func(msg string) {
+			fmt.Fprintln(os.Stderr, "warning:", msg)
+		},
+	}
+	var (
+		bundle   *ultrahdr.MetadataBundle
+		template *ultrahdr.Result
+	)
 	if *metaPath != "" {
-		metaData, err := os.ReadFile(*metaPath)
+		metaData, err := readInput(*metaPath)
 		if err != nil {
 			return err
 		}
-		var bundle ultrahdr.MetadataBundle
-		if err := json.Unmarshal(metaData, &bundle); err != nil {
+		bundle = &ultrahdr.MetadataBundle{}
+		if err := json.Unmarshal(metaData, bundle); err != nil {
 			return err
 		}
-		container, err := ultrahdr.Join(primary, gainmap, &bundle, nil)
+	} else if *templatePath != "" {
+		f, err := openInput(*templatePath)
 		if err != nil {
 			return err
 		}
-		return os.WriteFile(*outPath, container, 0o644)
-	}
-	if *templatePath == "" {
-		container, err := ultrahdr.Join(primary, gainmap, nil, nil)
+		defer f.Close()
+		template, err = ultrahdr.Split(f)
 		if err != nil {
 			return err
 		}
-		return os.WriteFile(*outPath, container, 0o644)
-	}
-	template, err := os.Open(*templatePath)
-	if err != nil {
-		return err
-	}
-	defer template.Close()
-	split, err := ultrahdr.Split(template)
-	if err != nil {
-		return err
 	}
-	container, err := ultrahdr.Join(primary, gainmap, nil, split)
+	container, err := ultrahdr.JoinWithOptions(primary, gainmap, bundle, template, opt)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(*outPath, container, 0o644)
+	return writeOutput(*outPath, container)
 }
 
 func runGainmapStats(args []string) error {
@@ -491,7 +608,7 @@ func runGainmapStats(args []string) error {
 	if *inPath == "" {
 		return errors.New("missing required arguments")
 	}
-	data, err := os.ReadFile(*inPath)
+	data, err := readInput(*inPath)
 	if err != nil {
 		return err
 	}
@@ -577,6 +694,12 @@ func parseInterpolation(name string) ultrahdr.Interpolation {
 		return ultrahdr.InterpolationLanczos2
 	case "lanczos3":
 		return ultrahdr.InterpolationLanczos3
+	case "lanczos4":
+		return ultrahdr.InterpolationLanczos4
+	case "hermite":
+		return ultrahdr.InterpolationHermite
+	case "box":
+		return ultrahdr.InterpolationBox
 	default:
 		return ultrahdr.InterpolationNearest
 	}
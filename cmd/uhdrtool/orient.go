@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+func runRotate(args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	inPath := fs.String("in", "", "input UltraHDR JPEG")
+	outPath := fs.String("out", "", "output UltraHDR JPEG")
+	degrees := fs.Int("degrees", 0, "clockwise rotation: 90, 180 or 270")
+	auto := fs.Bool("auto", false, "apply EXIF orientation instead of -degrees")
+	q := fs.Int("q", 90, "base quality")
+	gq := fs.Int("gq", 85, "gainmap quality")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *inPath == "" || *outPath == "" || (*degrees == 0 && !*auto) {
+		return errors.New("missing required arguments")
+	}
+	if *degrees != 0 && *auto {
+		return errors.New("-degrees and -auto are mutually exclusive")
+	}
+
+	f, err := openInput(*inPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	opt := &ultrahdr.OrientOptions{Quality: *q, GainmapQuality: *gq}
+	var res *ultrahdr.Result
+	if *auto {
+		res, err = ultrahdr.AutoOrientHDR(f, opt)
+	} else {
+		res, err = ultrahdr.RotateHDR(f, *degrees, opt)
+	}
+	if err != nil {
+		return err
+	}
+	return writeOutput(*outPath, res.Container)
+}
+
+func runFlip(args []string) error {
+	fs := flag.NewFlagSet("flip", flag.ContinueOnError)
+	inPath := fs.String("in", "", "input UltraHDR JPEG")
+	outPath := fs.String("out", "", "output UltraHDR JPEG")
+	horizontal := fs.Bool("h", false, "flip horizontally (mirror left to right)")
+	vertical := fs.Bool("v", false, "flip vertically (mirror top to bottom)")
+	q := fs.Int("q", 90, "base quality")
+	gq := fs.Int("gq", 85, "gainmap quality")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *inPath == "" || *outPath == "" || *horizontal == *vertical {
+		return errors.New("missing required arguments, exactly one of -h or -v is required")
+	}
+
+	f, err := openInput(*inPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	res, err := ultrahdr.FlipHDR(f, *horizontal, &ultrahdr.OrientOptions{Quality: *q, GainmapQuality: *gq})
+	if err != nil {
+		return err
+	}
+	return writeOutput(*outPath, res.Container)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+func runRebaseHDR(args []string) error {
+	fs := flag.NewFlagSet("rebase-hdr", flag.ContinueOnError)
+	inPath := fs.String("in", "", "original UltraHDR JPEG, new SDR and EXR must match its dimensions")
+	sdrPath := fs.String("sdr", "", "new SDR JPEG")
+	exrPath := fs.String("exr", "", "HDR OpenEXR master")
+	outPath := fs.String("out", "", "output UltraHDR JPEG")
+	q := fs.Int("q", 95, "base quality")
+	gq := fs.Int("gq", 85, "gainmap quality")
+	scale := fs.Int("scale", 1, "gainmap downscale factor")
+	downscale := fs.String("downscale", "box", "gainmap downscale filter when -scale > 1, one of: nearest, box, bilinear, bicubic, mitchell, hermite, lanczos2, lanczos3, lanczos4")
+	multi := fs.Bool("multichannel", false, "encode RGB gainmap")
+	autoGamma := fs.Bool("auto-gamma", false, "pick gainmap gamma from gain distribution")
+	dither := fs.Bool("dither", false, "apply ordered dithering when quantizing gainmap (reduces banding)")
+	primaryOut := fs.String("primary-out", "", "write primary JPEG")
+	gainmapOut := fs.String("gainmap-out", "", "write gainmap JPEG")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *inPath == "" || *sdrPath == "" || *exrPath == "" || *outPath == "" {
+		return errors.New("missing required arguments")
+	}
+
+	if err := checkStdio([]string{*inPath, *sdrPath, *exrPath}, []string{*outPath, *primaryOut, *gainmapOut}); err != nil {
+		return err
+	}
+
+	data, err := readInput(*inPath)
+	if err != nil {
+		return err
+	}
+	sdr, err := readInput(*sdrPath)
+	if err != nil {
+		return fmt.Errorf("read SDR: %w", err)
+	}
+	exr, err := readInput(*exrPath)
+	if err != nil {
+		return err
+	}
+
+	// Dimensions of all inputs are checked up front, each mismatch is reported by name.
+	origCfg, err := ultrahdr.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("read %s: %w", *inPath, err)
+	}
+	sdrCfg, _, err := image.DecodeConfig(bytes.NewReader(sdr))
+	if err != nil {
+		return fmt.Errorf("read SDR %s: %w", *sdrPath, err)
+	}
+	exrW, exrH, err := ultrahdr.DecodeEXRConfig(exr)
+	if err != nil {
+		return fmt.Errorf("read EXR %s: %w", *exrPath, err)
+	}
+	var mismatches []error
+	if sdrCfg.Width != origCfg.Width || sdrCfg.Height != origCfg.Height {
+		mismatches = append(mismatches, fmt.Errorf("new SDR %s is %dx%d, original %s is %dx%d",
+			*sdrPath, sdrCfg.Width, sdrCfg.Height, *inPath, origCfg.Width, origCfg.Height))
+	}
+	if exrW != origCfg.Width || exrH != origCfg.Height {
+		mismatches = append(mismatches, fmt.Errorf("EXR %s is %dx%d, original %s is %dx%d",
+			*exrPath, exrW, exrH, *inPath, origCfg.Width, origCfg.Height))
+	}
+	if err := errors.Join(mismatches...); err != nil {
+		return err
+	}
+
+	opts := []ultrahdr.RebaseOption{
+		ultrahdr.WithBaseQuality(*q),
+		ultrahdr.WithGainmapQuality(*gq),
+		ultrahdr.WithGainmapScale(*scale),
+		ultrahdr.WithGainmapDownscale(parseInterpolation(*downscale)),
+		ultrahdr.WithMultiChannelGainmap(*multi),
+		ultrahdr.WithAutoGainmapGamma(*autoGamma),
+		ultrahdr.WithGainmapDither(*dither),
+	}
+	res, err := ultrahdr.RebaseFromEXR(sdr, exr, opts...)
+	if err != nil {
+		return fmt.Errorf("rebase %s on %s: %w", *sdrPath, *exrPath, err)
+	}
+	return writeResultOutputs(res, *outPath, *primaryOut, *gainmapOut)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+// resizeOutput is one output of a multi-size resize.
+type resizeOutput struct {
+	Width          uint   `json:"width"`
+	Height         uint   `json:"height"`
+	Out            string `json:"out"`
+	Quality        int    `json:"q,omitempty"`
+	GainmapQuality int    `json:"gq,omitempty"`
+}
+
+// parseSizeFlag parses WxH:out.jpg[:q[:gq]].
+func parseSizeFlag(v string) (resizeOutput, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) < 2 || len(parts) > 4 {
+		return resizeOutput{}, fmt.Errorf("invalid -size %q, expected WxH:out.jpg[:q[:gq]]", v)
+	}
+	var o resizeOutput
+	if _, err := fmt.Sscanf(parts[0], "%dx%d", &o.Width, &o.Height); err != nil {
+		return resizeOutput{}, fmt.Errorf("invalid -size %q dimensions: %w", v, err)
+	}
+	o.Out = parts[1]
+	var err error
+	if len(parts) > 2 {
+		if o.Quality, err = strconv.Atoi(parts[2]); err != nil {
+			return resizeOutput{}, fmt.Errorf("invalid -size %q quality: %w", v, err)
+		}
+	}
+	if len(parts) > 3 {
+		if o.GainmapQuality, err = strconv.Atoi(parts[3]); err != nil {
+			return resizeOutput{}, fmt.Errorf("invalid -size %q gainmap quality: %w", v, err)
+		}
+	}
+	return o, nil
+}
+
+func readResizeSpecFile(path string) ([]resizeOutput, error) {
+	data, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []resizeOutput
+	if err := json.Unmarshal(data, &outputs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return outputs, nil
+}
+
+// resizeMulti produces all outputs from a single split and decode of the input.
+// Failures are reported per output, error is returned if all outputs fail or if any fails in strict mode.
+func resizeMulti(inPath string, outputs []resizeOutput, base ultrahdr.ResizeSpec, strict bool) error {
+	failed := 0
+	report := func(o resizeOutput, err error) {
+		failed++
+		fmt.Fprintf(os.Stderr, "%s\terror: %v\n", o.Out, err)
+	}
+
+	paths := make([]string, 0, len(outputs))
+	for _, o := range outputs {
+		paths = append(paths, o.Out)
+	}
+	if err := checkStdio(nil, paths); err != nil {
+		return err
+	}
+
+	var (
+		specs   = make([]ultrahdr.ResizeSpec, 0, len(outputs))
+		planned = make([]resizeOutput, 0, len(outputs))
+		done    int
+	)
+	for _, o := range outputs {
+		if o.Width == 0 || o.Height == 0 || o.Out == "" {
+			report(o, errors.New("width, height and output path are required"))
+			continue
+		}
+		spec := base
+		spec.Width = o.Width
+		spec.Height = o.Height
+		if o.Quality > 0 {
+			spec.Quality = o.Quality
+		}
+		if o.GainmapQuality > 0 {
+			spec.GainmapQuality = o.GainmapQuality
+		}
+		spec.ReceiveResult = func(res *ultrahdr.Result, err error) {
+			done++
+			if err == nil {
+				err = writeOutput(o.Out, res.Container)
+			}
+			if err != nil {
+				report(o, err)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%s\t%dx%d\n", o.Out, o.Width, o.Height)
+		}
+		specs = append(specs, spec)
+		planned = append(planned, o)
+	}
+
+	if len(specs) > 0 {
+		f, err := openInput(inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Per-spec errors are reported via ReceiveResult, split/decode errors fail
+		// before any output is produced.
+		if err := ultrahdr.ResizeHDR(f, specs...); err != nil {
+			for _, o := range planned[done:] {
+				report(o, fmt.Errorf("not processed: %w", err))
+			}
+		}
+	}
+
+	if failed > 0 && (strict || failed == len(outputs)) {
+		return fmt.Errorf("%d of %d outputs failed", failed, len(outputs))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+func runSetCapacity(args []string) error {
+	fs := flag.NewFlagSet("set-capacity", flag.ContinueOnError)
+	inPath := fs.String("in", "", "input UltraHDR JPEG")
+	outPath := fs.String("out", "", "output UltraHDR JPEG")
+	maxCap := fs.Float64("max", 0, "new HDRCapacityMax (linear headroom, e.g. 2.0)")
+	minCap := fs.Float64("min", 0, "new HDRCapacityMin (linear, default keeps current)")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *inPath == "" || *outPath == "" || (*maxCap <= 0 && *minCap <= 0) {
+		return errors.New("missing required arguments")
+	}
+	data, err := readInput(*inPath)
+	if err != nil {
+		return err
+	}
+	sr, err := ultrahdr.Split(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if sr.Meta == nil {
+		return errors.New("gainmap metadata missing")
+	}
+	meta := *sr.Meta
+	if *maxCap > 0 {
+		meta.HDRCapacityMax = float32(*maxCap)
+	}
+	if *minCap > 0 {
+		meta.HDRCapacityMin = float32(*minCap)
+	}
+	if meta.HDRCapacityMin < 1 || meta.HDRCapacityMax < meta.HDRCapacityMin {
+		return fmt.Errorf("invalid capacity range %g..%g", meta.HDRCapacityMin, meta.HDRCapacityMax)
+	}
+	maxBoost := max(meta.MaxContentBoost[0], meta.MaxContentBoost[1], meta.MaxContentBoost[2])
+	if meta.HDRCapacityMax < maxBoost {
+		fmt.Fprintf(os.Stderr, "warning: HDRCapacityMax %g is below MaxContentBoost %g, highlights are scaled down on HDR displays\n",
+			meta.HDRCapacityMax, maxBoost)
+	}
+
+	out, err := ultrahdr.RewriteGainmapMetadata(data, &meta)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*outPath, out)
+}
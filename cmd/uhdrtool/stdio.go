@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// stdioPath in place of a file path reads input from stdin or writes output to stdout.
+const stdioPath = "-"
+
+// readInput reads the whole file, or stdin for "-".
+func readInput(path string) ([]byte, error) {
+	if path == stdioPath {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// openInput opens the file, or stdin for "-".
+func openInput(path string) (io.ReadCloser, error) {
+	if path == stdioPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// writeOutput writes data to the file, or to stdout for "-".
+func writeOutput(path string, data []byte) error {
+	if path == stdioPath {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// checkStdio rejects more than one input reading stdin or more than one output writing stdout.
+func checkStdio(inputs, outputs []string) error {
+	count := func(paths []string) int {
+		n := 0
+		for _, p := range paths {
+			if p == stdioPath {
+				n++
+			}
+		}
+		return n
+	}
+	if count(inputs) > 1 {
+		return errors.New("only one input can be read from stdin (-)")
+	}
+	if count(outputs) > 1 {
+		return errors.New("only one output can be written to stdout (-)")
+	}
+	return nil
+}
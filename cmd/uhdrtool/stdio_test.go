@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+// withStdio runs fn with stdin fed from input and returns what fn wrote to stdout.
+func withStdio(t *testing.T, input []byte, fn func() error) ([]byte, error) {
+	t.Helper()
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inR, outW
+	defer func() {
+		os.Stdin, os.Stdout = stdin, stdout
+		inR.Close()
+		outR.Close()
+	}()
+
+	go func() {
+		_, _ = inW.Write(input)
+		inW.Close()
+	}()
+	captured := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(outR)
+		captured <- data
+	}()
+
+	err = fn()
+	outW.Close()
+	return <-captured, err
+}
+
+func TestResizeStdio(t *testing.T) {
+	input, err := os.ReadFile("../../testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	out, err := withStdio(t, input, func() error {
+		return runResize([]string{"-in", "-", "-out", "-", "-w", "64", "-h", "48"})
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	ok, err := ultrahdr.IsUltraHDR(bytes.NewReader(out))
+	if err != nil || !ok {
+		t.Fatalf("stdout is not UltraHDR: %v", err)
+	}
+}
+
+func TestSplitJoinStdio(t *testing.T) {
+	input, err := os.ReadFile("../../testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	dir := t.TempDir()
+	gainmapPath := dir + "/gainmap.jpg"
+	primary, err := withStdio(t, input, func() error {
+		return runSplit([]string{"-in", "-", "-primary-out", "-", "-gainmap-out", gainmapPath})
+	})
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+
+	out, err := withStdio(t, primary, func() error {
+		return runJoin([]string{"-template", "../../testdata/small_uhdr.jpg", "-primary", "-", "-gainmap", gainmapPath, "-out", "-"})
+	})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	ok, err := ultrahdr.IsUltraHDR(bytes.NewReader(out))
+	if err != nil || !ok {
+		t.Fatalf("stdout is not UltraHDR: %v", err)
+	}
+}
+
+func TestStdioConflicts(t *testing.T) {
+	for name, run := range map[string]func() error{
+		"split outputs": func() error {
+			return runSplit([]string{"-in", "x.jpg", "-primary-out", "-", "-gainmap-out", "-"})
+		},
+		"resize outputs": func() error {
+			return runResize([]string{"-in", "x.jpg", "-out", "-", "-gainmap-out", "-", "-w", "10", "-h", "10"})
+		},
+		"resize sizes": func() error {
+			return runResize([]string{"-in", "x.jpg", "-size", "10x10:-", "-size", "20x20:-"})
+		},
+		"join inputs": func() error {
+			return runJoin([]string{"-primary", "-", "-gainmap", "-", "-out", "out.jpg"})
+		},
+	} {
+		err := run()
+		if err == nil || !strings.Contains(err.Error(), "stdin") && !strings.Contains(err.Error(), "stdout") {
+			t.Fatalf("%s: expected stdio conflict error, got %v", name, err)
+		}
+	}
+}
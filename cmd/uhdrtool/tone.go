@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+func runTone(args []string) error {
+	fs := flag.NewFlagSet("tone", flag.ContinueOnError)
+	inPath := fs.String("in", "", "input UltraHDR JPEG")
+	outPath := fs.String("out", "", "output SDR JPEG preview")
+	boost := fs.Float64("boost", 2, "simulated display headroom, 1 reproduces the SDR base image")
+	q := fs.Int("q", 90, "output quality")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *inPath == "" || *outPath == "" {
+		return errors.New("missing required arguments")
+	}
+	data, err := readInput(*inPath)
+	if err != nil {
+		return err
+	}
+	out, err := ultrahdr.RenderSDR(data, &ultrahdr.RenderOptions{MaxDisplayBoost: float32(*boost), Quality: *q})
+	if err != nil {
+		return err
+	}
+	return writeOutput(*outPath, out)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vearutop/ultrahdr"
+)
+
+// runValidate returns process exit code: 0 for a clean container, 1 for warnings
+// in strict mode, 2 for fatal problems or invalid invocation.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	inPath := fs.String("in", "", "input UltraHDR JPEG")
+	asJSON := fs.Bool("json", false, "print findings as JSON")
+	strict := fs.Bool("strict", false, "exit with 1 on warnings")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *inPath == "" {
+		fmt.Fprintln(os.Stderr, "error: missing required arguments")
+		return 2
+	}
+	data, err := readInput(*inPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+
+	findings := ultrahdr.ValidateContainer(data)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if findings == nil {
+			findings = []ultrahdr.Finding{}
+		}
+		if err := enc.Encode(struct {
+			File     string             `json:"file"`
+			Findings []ultrahdr.Finding `json:"findings"`
+		}{File: *inPath, Findings: findings}); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 2
+		}
+	} else {
+		for _, f := range findings {
+			if f.Offset >= 0 {
+				fmt.Printf("%s\t@%d\t%s\n", f.Severity, f.Offset, f.Message)
+			} else {
+				fmt.Printf("%s\t-\t%s\n", f.Severity, f.Message)
+			}
+		}
+		if len(findings) == 0 {
+			fmt.Println("ok")
+		}
+	}
+
+	switch s := ultrahdr.MaxSeverity(findings); {
+	case s >= ultrahdr.SeverityFatal:
+		return 2
+	case s >= ultrahdr.SeverityWarning && *strict:
+		return 1
+	default:
+		return 0
+	}
+}
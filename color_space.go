@@ -2,42 +2,75 @@ package ultrahdr
 
 import (
 	"bytes"
+	"fmt"
 	"sort"
 )
 
-type colorGamut int
+// ColorGamut identifies RGB color primaries (all with D65 white point).
+type ColorGamut int
 
-type colorTransfer int
+// ColorTransfer identifies a transfer function (OETF/EOTF) of encoded values.
+type ColorTransfer int
 
+// Supported color gamuts.
 const (
-	colorGamutSRGB colorGamut = iota
-	colorGamutDisplayP3
-	colorGamutAdobeRGB
+	ColorGamutSRGB ColorGamut = iota
+	ColorGamutDisplayP3
+	ColorGamutAdobeRGB
+	ColorGamutBT2020
 )
 
+// Supported transfer functions.
 const (
-	colorTransferSRGB colorTransfer = iota
-	colorTransferGamma22
+	ColorTransferSRGB ColorTransfer = iota
+	ColorTransferGamma22
+	ColorTransferLinear
+	ColorTransferPQ
+	ColorTransferHLG
 )
 
 type colorProfile struct {
-	gamut    colorGamut
-	transfer colorTransfer
+	gamut    ColorGamut
+	transfer ColorTransfer
 }
 
 func detectColorProfileFromICCProfile(profile []byte) colorProfile {
 	if len(profile) == 0 {
-		return colorProfile{gamut: colorGamutSRGB, transfer: colorTransferSRGB}
+		return colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
 	}
 	lower := bytes.ToLower(profile)
 	// Simple heuristic: enough for common camera/jpeg workflows.
 	if bytes.Contains(lower, []byte("display p3")) || bytes.Contains(lower, []byte("dci-p3")) {
-		return colorProfile{gamut: colorGamutDisplayP3, transfer: colorTransferSRGB}
+		return colorProfile{gamut: ColorGamutDisplayP3, transfer: ColorTransferSRGB}
 	}
 	if bytes.Contains(lower, []byte("adobe rgb")) || bytes.Contains(lower, []byte("adobergb")) {
-		return colorProfile{gamut: colorGamutAdobeRGB, transfer: colorTransferGamma22}
+		return colorProfile{gamut: ColorGamutAdobeRGB, transfer: ColorTransferGamma22}
 	}
-	return colorProfile{gamut: colorGamutSRGB, transfer: colorTransferSRGB}
+	return colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+}
+
+// jpegColorProfile returns color profile declared by ICC profile of JPEG, sRGB is assumed without ICC.
+func jpegColorProfile(jpegData []byte) colorProfile {
+	_, icc, err := extractExifAndIcc(jpegData)
+	if err != nil || len(icc) == 0 {
+		return colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	}
+	return detectColorProfileFromICCProfile(collectICCProfile(icc))
+}
+
+// gainApplicationGamut returns gamut multi-channel gains are applied in. With UseBaseCG it is
+// the gamut of the base image, otherwise the alternate gamut declared by ICC profile of gainmap
+// JPEG, base gamut is assumed without ICC. Transfer of the profile is ignored, gain encoding
+// is defined by metadata.
+func gainApplicationGamut(meta *GainMapMetadata, base colorProfile, gainmapJPEG []byte) ColorGamut {
+	if meta == nil || meta.UseBaseCG {
+		return base.gamut
+	}
+	_, icc, err := extractExifAndIcc(gainmapJPEG)
+	if err != nil || len(icc) == 0 {
+		return base.gamut
+	}
+	return detectColorProfileFromICCProfile(collectICCProfile(icc)).gamut
 }
 
 func collectICCProfile(icc [][]byte) []byte {
@@ -67,7 +100,32 @@ func collectICCProfile(icc [][]byte) []byte {
 	return out
 }
 
-func convertLinearGamut(v rgb, from, to colorGamut) rgb {
+// iccChunkSize is the largest profile part that fits APP2 payload after "ICC_PROFILE\0", seq and total.
+const iccChunkSize = maxAppPayload - 12 - 2
+
+// buildICCSegments splits profile into ICC APP2 payloads numbered from 1, collectICCProfile
+// of the result yields profile back. Empty profile yields no segments, profile that needs
+// more than 255 chunks fails.
+func buildICCSegments(profile []byte) ([][]byte, error) {
+	if len(profile) == 0 {
+		return nil, nil
+	}
+	total := (len(profile) + iccChunkSize - 1) / iccChunkSize
+	if total > 255 {
+		return nil, fmt.Errorf("ICC profile of %d bytes does not fit in 255 APP2 segments", len(profile))
+	}
+	segs := make([][]byte, 0, total)
+	for i := range total {
+		part := profile[i*iccChunkSize : min((i+1)*iccChunkSize, len(profile))]
+		seg := make([]byte, 0, len(iccSig)+2+len(part))
+		seg = append(seg, iccSig...)
+		seg = append(seg, byte(i+1), byte(total))
+		segs = append(segs, append(seg, part...))
+	}
+	return segs, nil
+}
+
+func convertLinearGamut(v rgb, from, to ColorGamut) rgb {
 	if from == to {
 		return v
 	}
@@ -76,16 +134,20 @@ func convertLinearGamut(v rgb, from, to colorGamut) rgb {
 	return xyzToRGB(x, y, z, to)
 }
 
-func rgbToXYZ(v rgb, from colorGamut) (float32, float32, float32) {
+func rgbToXYZ(v rgb, from ColorGamut) (float32, float32, float32) {
 	switch from {
-	case colorGamutDisplayP3:
+	case ColorGamutDisplayP3:
 		return 0.48657095*v.r + 0.2656677*v.g + 0.19821729*v.b,
 			0.22897457*v.r + 0.69173855*v.g + 0.07928691*v.b,
 			0.04511338*v.g + 1.0439444*v.b
-	case colorGamutAdobeRGB:
+	case ColorGamutAdobeRGB:
 		return 0.5767309*v.r + 0.185554*v.g + 0.1881852*v.b,
 			0.2973769*v.r + 0.6273491*v.g + 0.0752741*v.b,
 			0.0270343*v.r + 0.0706872*v.g + 0.9911085*v.b
+	case ColorGamutBT2020:
+		return 0.63695806*v.r + 0.1446169*v.g + 0.16888098*v.b,
+			0.2627002*v.r + 0.6779981*v.g + 0.05930172*v.b,
+			0.02807269*v.g + 1.0609851*v.b
 	default:
 		return 0.4123908*v.r + 0.35758433*v.g + 0.1804808*v.b,
 			0.212639*v.r + 0.71516865*v.g + 0.07219232*v.b,
@@ -93,20 +155,26 @@ func rgbToXYZ(v rgb, from colorGamut) (float32, float32, float32) {
 	}
 }
 
-func xyzToRGB(x, y, z float32, to colorGamut) rgb {
+func xyzToRGB(x, y, z float32, to ColorGamut) rgb {
 	switch to {
-	case colorGamutDisplayP3:
+	case ColorGamutDisplayP3:
 		return rgb{
 			r: 2.493497*x - 0.9313836*y - 0.4027108*z,
 			g: -0.829489*x + 1.7626641*y + 0.023624685*z,
 			b: 0.03584583*x - 0.07617239*y + 0.9568845*z,
 		}
-	case colorGamutAdobeRGB:
+	case ColorGamutAdobeRGB:
 		return rgb{
 			r: 2.041369*x - 0.5649464*y - 0.3446944*z,
 			g: -0.969266*x + 1.8760108*y + 0.041556*z,
 			b: 0.0134474*x - 0.1183897*y + 1.0154096*z,
 		}
+	case ColorGamutBT2020:
+		return rgb{
+			r: 1.7166512*x - 0.35567078*y - 0.25336629*z,
+			g: -0.66668433*x + 1.6164813*y + 0.015768545*z,
+			b: 0.017639857*x - 0.042770613*y + 0.94210315*z,
+		}
 	default:
 		return rgb{
 			r: 3.24097*x - 1.5373832*y - 0.49861076*z,
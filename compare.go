@@ -0,0 +1,218 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+)
+
+const (
+	// maxPSNR is reported for identical images instead of infinity.
+	maxPSNR = 100
+
+	// compareGridMaxDim caps the long edge of HDR reconstruction grid in CompareContainers.
+	compareGridMaxDim = 256
+)
+
+// ImageDiff compares one image of two containers.
+type ImageDiff struct {
+	WidthA  int     `json:"width_a"`
+	HeightA int     `json:"height_a"`
+	WidthB  int     `json:"width_b"`
+	HeightB int     `json:"height_b"`
+	BytesA  int     `json:"bytes_a"`
+	BytesB  int     `json:"bytes_b"`
+	PSNR    float64 `json:"psnr"`           // RGB PSNR in dB, 100 for identical images.
+	SSIM    float64 `json:"ssim,omitempty"` // Mean luma SSIM over 8x8 blocks (primary only).
+}
+
+// MetadataDiff is a gainmap metadata value that differs between containers.
+type MetadataDiff struct {
+	Field string  `json:"field"`
+	A     float32 `json:"a"`
+	B     float32 `json:"b"`
+}
+
+// Comparison is a result of CompareContainers.
+type Comparison struct {
+	BytesA   int            `json:"bytes_a"`
+	BytesB   int            `json:"bytes_b"`
+	Primary  ImageDiff      `json:"primary"`
+	Gainmap  ImageDiff      `json:"gainmap"`
+	Metadata []MetadataDiff `json:"metadata,omitempty"`
+	// HDRPSNR is PSNR of reconstructed HDR on a downsampled grid, computed on PQ-encoded values
+	// with SDR white at 203 nits.
+	HDRPSNR  float64  `json:"hdr_psnr"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// CompareContainers splits two UltraHDR JPEGs and measures their difference to quantify
+// damage of processing pipelines. Images of different dimensions are compared after
+// resizing the smaller one, with a warning.
+func CompareContainers(a, b []byte) (*Comparison, error) {
+	srA, err := Split(bytes.NewReader(a))
+	if err != nil {
+		return nil, fmt.Errorf("split a: %w", err)
+	}
+	srB, err := Split(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("split b: %w", err)
+	}
+	if srA.Meta == nil || srB.Meta == nil {
+		return nil, ErrNoGainmapMetadata
+	}
+	c := &Comparison{BytesA: len(a), BytesB: len(b)}
+
+	primaryA, primaryB, err := c.compareImages("primary", &c.Primary, srA.Primary, srB.Primary)
+	if err != nil {
+		return nil, err
+	}
+	c.Primary.SSIM = meanSSIM(primaryA, primaryB)
+	gainmapA, gainmapB, err := c.compareImages("gainmap", &c.Gainmap, srA.Gainmap, srB.Gainmap)
+	if err != nil {
+		return nil, err
+	}
+	// Images are compared at common dimensions, gainmaps are checked against primaries as decoded.
+	if err := checkGainmapDimensions(image.Rect(0, 0, c.Primary.WidthA, c.Primary.HeightA),
+		image.Rect(0, 0, c.Gainmap.WidthA, c.Gainmap.HeightA)); err != nil {
+		return nil, fmt.Errorf("a: %w", err)
+	}
+	if err := checkGainmapDimensions(image.Rect(0, 0, c.Primary.WidthB, c.Primary.HeightB),
+		image.Rect(0, 0, c.Gainmap.WidthB, c.Gainmap.HeightB)); err != nil {
+		return nil, fmt.Errorf("b: %w", err)
+	}
+	c.Metadata = diffMetadata(srA.Meta, srB.Meta)
+
+	// Reconstruct both on the same grid, gainmaps are sampled by relative position.
+	w, h := gainmapTargetDims(uint(primaryA.Bounds().Dx()), uint(primaryA.Bounds().Dy()), compareGridMaxDim)
+	gridA := resizeImageInterpolated(primaryA, int(w), int(h), InterpolationBilinear)
+	gridB := resizeImageInterpolated(primaryB, int(w), int(h), InterpolationBilinear)
+	profileA, profileB := jpegColorProfile(srA.Primary), jpegColorProfile(srB.Primary)
+	hdrA, err := reconstructHDR(gridA, profileA, gainmapA, gainApplicationGamut(srA.Meta, profileA, srA.Gainmap), srA.Meta, 1, false)
+	if err != nil {
+		return nil, fmt.Errorf("reconstruct a: %w", err)
+	}
+	hdrB, err := reconstructHDR(gridB, profileB, gainmapB, gainApplicationGamut(srB.Meta, profileB, srB.Gainmap), srB.Meta, 1, false)
+	if err != nil {
+		return nil, fmt.Errorf("reconstruct b: %w", err)
+	}
+	var sum float64
+	for i := range hdrA.Pix {
+		d := float64(pqInvEOTF(hdrA.Pix[i]*kSdrWhiteNits/pqMaxNits) - pqInvEOTF(hdrB.Pix[i]*kSdrWhiteNits/pqMaxNits))
+		sum += d * d
+	}
+	c.HDRPSNR = psnr(sum/float64(len(hdrA.Pix)), 1)
+	return c, nil
+}
+
+// compareImages decodes a pair of images, fills sizes and PSNR of d and returns decoded images
+// of the same dimensions.
+func (c *Comparison) compareImages(name string, d *ImageDiff, a, b []byte) (image.Image, image.Image, error) {
+	d.BytesA, d.BytesB = len(a), len(b)
+	imgA, _, err := image.Decode(bytes.NewReader(a))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode %s a: %w", name, err)
+	}
+	imgB, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode %s b: %w", name, err)
+	}
+	d.WidthA, d.HeightA = imgA.Bounds().Dx(), imgA.Bounds().Dy()
+	d.WidthB, d.HeightB = imgB.Bounds().Dx(), imgB.Bounds().Dy()
+	if d.WidthA != d.WidthB || d.HeightA != d.HeightB {
+		if d.WidthA*d.HeightA < d.WidthB*d.HeightB {
+			imgA = resizeImageInterpolated(imgA, d.WidthB, d.HeightB, InterpolationBilinear)
+		} else {
+			imgB = resizeImageInterpolated(imgB, d.WidthA, d.HeightA, InterpolationBilinear)
+		}
+		c.Warnings = append(c.Warnings, fmt.Sprintf("%s dimensions differ: %dx%d vs %dx%d, smaller one is resized",
+			name, d.WidthA, d.HeightA, d.WidthB, d.HeightB))
+	}
+
+	ba, bb := imgA.Bounds(), imgB.Bounds()
+	var sum float64
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			r1, g1, b1, _ := imgA.At(ba.Min.X+x, ba.Min.Y+y).RGBA()
+			r2, g2, b2, _ := imgB.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, v := range [3]float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += v * v
+			}
+		}
+	}
+	d.PSNR = psnr(sum/float64(3*ba.Dx()*ba.Dy()), 255)
+	return imgA, imgB, nil
+}
+
+// psnr converts mean squared error to PSNR in dB for given peak value.
+func psnr(mse, peak float64) float64 {
+	if mse <= 0 {
+		return maxPSNR
+	}
+	return min(10*math.Log10(peak*peak/mse), maxPSNR)
+}
+
+// meanSSIM computes mean luma SSIM over non-overlapping 8x8 blocks of equally sized images.
+func meanSSIM(a, b image.Image) float64 {
+	const (
+		block = 8
+		c1    = (0.01 * 255) * (0.01 * 255)
+		c2    = (0.03 * 255) * (0.03 * 255)
+	)
+	luma := func(img image.Image, x, y int) float64 {
+		r, g, b, _ := img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y).RGBA()
+		return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+	}
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	var total float64
+	blocks := 0
+	for by := 0; by+block <= h; by += block {
+		for bx := 0; bx+block <= w; bx += block {
+			var sa, sb, saa, sbb, sab float64
+			for y := by; y < by+block; y++ {
+				for x := bx; x < bx+block; x++ {
+					va, vb := luma(a, x, y), luma(b, x, y)
+					sa += va
+					sb += vb
+					saa += va * va
+					sbb += vb * vb
+					sab += va * vb
+				}
+			}
+			n := float64(block * block)
+			ma, mb := sa/n, sb/n
+			varA, varB, cov := saa/n-ma*ma, sbb/n-mb*mb, sab/n-ma*mb
+			total += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (varA + varB + c2))
+			blocks++
+		}
+	}
+	if blocks == 0 {
+		return 1
+	}
+	return total / float64(blocks)
+}
+
+// diffMetadata lists gainmap metadata values that differ between a and b.
+func diffMetadata(a, b *GainMapMetadata) []MetadataDiff {
+	var diffs []MetadataDiff
+	add := func(field string, va, vb float32) {
+		if math.Abs(float64(va-vb)) > 1e-4*max(1, math.Abs(float64(va))) {
+			diffs = append(diffs, MetadataDiff{Field: field, A: va, B: vb})
+		}
+	}
+	for i := 0; i < 3; i++ {
+		add(fmt.Sprintf("min_content_boost[%d]", i), a.MinContentBoost[i], b.MinContentBoost[i])
+		add(fmt.Sprintf("max_content_boost[%d]", i), a.MaxContentBoost[i], b.MaxContentBoost[i])
+		add(fmt.Sprintf("gamma[%d]", i), a.Gamma[i], b.Gamma[i])
+		add(fmt.Sprintf("offset_sdr[%d]", i), a.OffsetSDR[i], b.OffsetSDR[i])
+		add(fmt.Sprintf("offset_hdr[%d]", i), a.OffsetHDR[i], b.OffsetHDR[i])
+	}
+	add("hdr_capacity_min", a.HDRCapacityMin, b.HDRCapacityMin)
+	add("hdr_capacity_max", a.HDRCapacityMax, b.HDRCapacityMax)
+	return diffs
+}
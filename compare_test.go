@@ -0,0 +1,54 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestCompareContainers(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+
+	same, err := CompareContainers(data, data)
+	if err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+	if same.Primary.PSNR != maxPSNR || same.Gainmap.PSNR != maxPSNR || same.HDRPSNR != maxPSNR {
+		t.Fatalf("identical containers: unexpected PSNR %+v", same)
+	}
+	if same.Primary.SSIM < 0.9999 || len(same.Metadata) != 0 || len(same.Warnings) != 0 {
+		t.Fatalf("identical containers: unexpected diff %+v", same)
+	}
+
+	var resized *Result
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width:   uint(same.Primary.WidthA / 2),
+		Height:  uint(same.Primary.HeightA / 2),
+		Quality: 70,
+		ReceiveResult: func(res *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			resized = res
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	diff, err := CompareContainers(data, resized.Container)
+	if err != nil {
+		t.Fatalf("compare resized: %v", err)
+	}
+	if len(diff.Warnings) != 2 {
+		t.Fatalf("expected dimension warnings for primary and gainmap, got %v", diff.Warnings)
+	}
+	if diff.Primary.PSNR >= maxPSNR || diff.Primary.PSNR < 20 || diff.HDRPSNR >= maxPSNR || diff.HDRPSNR < 20 {
+		t.Fatalf("unexpected PSNR for resized container: %+v", diff)
+	}
+	if diff.Primary.SSIM <= 0 || diff.Primary.SSIM >= 1 {
+		t.Fatalf("unexpected SSIM for resized container: %v", diff.Primary.SSIM)
+	}
+}
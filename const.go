@@ -8,3 +8,24 @@ const (
 const (
 	jpegrVersion = "1.0"
 )
+
+// DefaultOptions holds values used when options and specs leave them at zero.
+type DefaultOptions struct {
+	PrimaryQuality   int           // JPEG quality of primary/SDR outputs.
+	GainmapQuality   int           // JPEG quality of gainmap outputs.
+	GainmapScale     int           // Downscale factor for gainmap generation from HDR.
+	GainmapDownscale Interpolation // Filter of gains when GainmapScale > 1, InterpolationNearest point-samples.
+	GainmapGamma     float32       // Gamma of gainmap encoding, 1 stores log gains linearly.
+	SDRWhiteNits     float32       // Luminance of SDR white (1.0) when linearizing PQ/HLG inputs.
+}
+
+// Defaults are process-wide defaults, set them once at startup (e.g. Defaults.PrimaryQuality = 95)
+// before any processing, changing them concurrently with processing is not safe.
+var Defaults = DefaultOptions{
+	PrimaryQuality:   defaultPrimaryQuality,
+	GainmapQuality:   defaultGainMapQuality,
+	GainmapScale:     1,
+	GainmapDownscale: InterpolationBox,
+	GainmapGamma:     1,
+	SDRWhiteNits:     kSdrWhiteNits,
+}
@@ -4,14 +4,28 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"regexp"
 )
 
 var itemLengthRe = regexp.MustCompile(`Item:Length="\d+"`)
 
+// assembleContainerWithSegments assembles a container with raw metadata segments, see writeContainerWithSegments.
 func assembleContainerWithSegments(primaryJPEG, gainmapJPEG []byte, segs *MetadataSegments) ([]byte, error) {
+	var out bytes.Buffer
+	if err := writeContainerWithSegments(&out, primaryJPEG, gainmapJPEG, segs); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeContainerWithSegments writes a container with primary XMP, primary ISO and MPF before primary image data
+// and secondary XMP and ISO before gainmap image data. Only segment headers are buffered, image data is written
+// to w as is.
+func writeContainerWithSegments(w io.Writer, primaryJPEG, gainmapJPEG []byte, segs *MetadataSegments) error {
 	if len(primaryJPEG) < 2 || len(gainmapJPEG) < 2 {
-		return nil, errors.New("invalid JPEG data")
+		return errors.New("invalid JPEG data")
 	}
 
 	secondaryImageSize := len(gainmapJPEG) + appSize(segs.SecondaryXMP) + appSize(segs.SecondaryISO)
@@ -20,252 +34,293 @@ func assembleContainerWithSegments(primaryJPEG, gainmapJPEG []byte, segs *Metada
 	if len(primaryXMP) > 0 {
 		updated, err := updatePrimaryXmpLength(primaryXMP, secondaryImageSize)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		primaryXMP = updated
 	}
 
-	var out bytes.Buffer
-	writeSOI := func() {
-		out.WriteByte(markerStart)
-		out.WriteByte(markerSOI)
-	}
-
-	writeSOI()
+	var primary bytes.Buffer
+	primary.Write([]byte{markerStart, markerSOI})
 	if len(primaryXMP) > 0 {
-		writeAppSegment(&out, markerAPP1, primaryXMP)
+		if err := writeAppSegment(&primary, markerAPP1, primaryXMP); err != nil {
+			return err
+		}
 	}
 	if len(segs.PrimaryISO) > 0 {
-		writeAppSegment(&out, markerAPP2, segs.PrimaryISO)
+		if err := writeAppSegment(&primary, markerAPP2, segs.PrimaryISO); err != nil {
+			return err
+		}
 	}
 
 	mpfLen := 2 + calculateMpfSize()
-	primaryImageSize := out.Len() + mpfLen + len(primaryJPEG)
-	secondaryOffset := primaryImageSize - out.Len() - 8
+	primaryImageSize := primary.Len() + mpfLen + len(primaryJPEG)
+	secondaryOffset := primaryImageSize - primary.Len() - 8
 	mpf := generateMpf(primaryImageSize, secondaryImageSize, secondaryOffset)
-	writeAppSegment(&out, markerAPP2, mpf)
-
-	out.Write(primaryJPEG[2:])
+	if err := writeAppSegment(&primary, markerAPP2, mpf); err != nil {
+		return err
+	}
 
-	writeSOI()
+	var secondary bytes.Buffer
+	secondary.Write([]byte{markerStart, markerSOI})
 	if len(segs.SecondaryXMP) > 0 {
-		writeAppSegment(&out, markerAPP1, segs.SecondaryXMP)
+		if err := writeAppSegment(&secondary, markerAPP1, segs.SecondaryXMP); err != nil {
+			return err
+		}
 	}
 	if len(segs.SecondaryISO) > 0 {
-		writeAppSegment(&out, markerAPP2, segs.SecondaryISO)
+		if err := writeAppSegment(&secondary, markerAPP2, segs.SecondaryISO); err != nil {
+			return err
+		}
 	}
-	out.Write(gainmapJPEG[2:])
 
-	return out.Bytes(), nil
+	for _, b := range [][]byte{primary.Bytes(), primaryJPEG[2:], secondary.Bytes(), gainmapJPEG[2:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// assembleContainerVipsLike mimics vips marker ordering: EXIF, ISO(version), MPF, ICC.
-func assembleContainerVipsLike(primaryJPEG, gainmapJPEG []byte, exif []byte, icc [][]byte, secondaryXMP []byte, secondaryISO []byte) ([]byte, error) {
-	if len(primaryJPEG) < 2 || len(gainmapJPEG) < 2 {
-		return nil, errors.New("invalid JPEG data")
-	}
+// containerParts holds images and metadata of a container written by writeContainerVipsLike.
+type containerParts struct {
+	primary, gainmap []byte // Encoded JPEG images, their APP segments are replaced.
+	exif             []byte
+	icc, comments    [][]byte
+	primaryXMP       []byte // Optional, gainmap item length is updated on write.
+	secondaryXMP     []byte
+	secondaryISO     []byte
+	leading          []appSegment // Written right after primary SOI, e.g. custom APP segments of primary.
+}
 
-	primaryStripped, err := stripAppSegments(primaryJPEG)
-	if err != nil {
-		return nil, err
-	}
-	gainmapStripped, err := stripAppSegments(gainmapJPEG)
-	if err != nil {
+// assembleContainerVipsLike is like writeContainerVipsLike, but returns the container.
+func assembleContainerVipsLike(c containerParts) ([]byte, error) {
+	var out bytes.Buffer
+	if err := writeContainerVipsLike(&out, c); err != nil {
 		return nil, err
 	}
+	return out.Bytes(), nil
+}
 
-	secondaryImageSize := len(gainmapStripped) + appSize(secondaryXMP) + appSize(secondaryISO)
-
-	var out bytes.Buffer
-	writeSOI := func() {
-		out.WriteByte(markerStart)
-		out.WriteByte(markerSOI)
+// writeContainerVipsLike writes a container with vips marker ordering: EXIF, primary XMP, ISO(version), MPF, ICC,
+// followed by COM segments of primary image. MPF is computed up front from segment sizes, so compressed image data
+// is written to w as is, without concatenating a full container in memory.
+func writeContainerVipsLike(w io.Writer, c containerParts) error {
+	if len(c.primary) < 2 || len(c.gainmap) < 2 {
+		return errors.New("invalid JPEG data")
 	}
 
-	writeSOI()
-	if len(exif) > 0 {
-		writeAppSegment(&out, markerAPP1, exif)
+	primaryHead, primaryTail, err := stripAppSegmentsHead(c.primary)
+	if err != nil {
+		return err
 	}
-	isoPrimary := secondaryISO
-	if len(isoPrimary) == 0 {
-		isoPrimary = buildIsoVersionOnly()
-	} else if len(isoPrimary) > len(isoNamespace)+1+4 {
-		// If this is full ISO metadata, keep only version (4 bytes) for primary.
-		isoPrimary = append([]byte(nil), isoPrimary[:len(isoNamespace)+1+4]...)
+	gainmapHead, gainmapTail, err := stripAppSegmentsHead(c.gainmap)
+	if err != nil {
+		return err
 	}
 
-	if len(isoPrimary) > 0 {
-		writeAppSegment(&out, markerAPP2, isoPrimary)
+	var secondary bytes.Buffer
+	secondary.Write(gainmapHead[:2])
+	if len(c.secondaryXMP) > 0 {
+		if err := writeAppSegment(&secondary, markerAPP1, c.secondaryXMP); err != nil {
+			return err
+		}
 	}
-
-	mpfLen := 2 + calculateMpfSize()
-	primaryImageSize := out.Len() + mpfLen + len(primaryStripped)
-	secondaryOffset := primaryImageSize - out.Len() - 8
-	mpf := generateMpf(primaryImageSize, secondaryImageSize, secondaryOffset)
-	writeAppSegment(&out, markerAPP2, mpf)
-
-	for _, seg := range icc {
-		writeAppSegment(&out, markerAPP2, seg)
+	if len(c.secondaryISO) > 0 {
+		if err := writeAppSegment(&secondary, markerAPP2, c.secondaryISO); err != nil {
+			return err
+		}
 	}
+	secondary.Write(gainmapHead[2:])
+	secondaryImageSize := secondary.Len() + len(gainmapTail)
 
-	out.Write(primaryStripped[2:])
+	if len(c.primaryXMP) > 0 {
+		updated, err := updatePrimaryXmpLength(c.primaryXMP, secondaryImageSize)
+		if err != nil {
+			return err
+		}
+		c.primaryXMP = updated
+	}
 
-	writeSOI()
-	if len(secondaryXMP) > 0 {
-		writeAppSegment(&out, markerAPP1, secondaryXMP)
+	var primary bytes.Buffer
+	primary.Write(primaryHead[:2])
+	if err := writeAppSegments(&primary, c.leading); err != nil {
+		return err
 	}
-	if len(secondaryISO) > 0 {
-		writeAppSegment(&out, markerAPP2, secondaryISO)
+	if len(c.exif) > 0 {
+		if err := writeExifSegments(&primary, c.exif); err != nil {
+			return err
+		}
 	}
-	out.Write(gainmapStripped[2:])
-
-	final := out.Bytes()
-	if err := replaceMpfPayload(final); err != nil {
-		return nil, err
+	if len(c.primaryXMP) > 0 {
+		if err := writeAppSegment(&primary, markerAPP1, c.primaryXMP); err != nil {
+			return err
+		}
 	}
-	return final, nil
-}
-
-// assembleContainerVipsLikeWithPrimaryXMP is like assembleContainerVipsLike, but also writes primary XMP.
-func assembleContainerVipsLikeWithPrimaryXMP(primaryJPEG, gainmapJPEG []byte, exif []byte, icc [][]byte, primaryXMP []byte, secondaryXMP []byte, secondaryISO []byte) ([]byte, error) {
-	if len(primaryJPEG) < 2 || len(gainmapJPEG) < 2 {
-		return nil, errors.New("invalid JPEG data")
+	if err := writeAppSegment(&primary, markerAPP2, primaryIsoVersion(c.secondaryISO)); err != nil {
+		return err
 	}
 
-	primaryStripped, err := stripAppSegments(primaryJPEG)
+	// Chunks are renumbered, so that stored or concatenated profiles are written consistently.
+	iccSegs, err := buildICCSegments(collectICCProfile(c.icc))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	gainmapStripped, err := stripAppSegments(gainmapJPEG)
-	if err != nil {
-		return nil, err
+	afterMpfSize := 0
+	for _, seg := range iccSegs {
+		afterMpfSize += appSize(seg)
 	}
-
-	secondaryImageSize := len(gainmapStripped) + appSize(secondaryXMP) + appSize(secondaryISO)
-	if len(primaryXMP) > 0 {
-		updated, err := updatePrimaryXmpLength(primaryXMP, secondaryImageSize)
-		if err != nil {
-			return nil, err
-		}
-		primaryXMP = updated
+	for _, com := range c.comments {
+		afterMpfSize += appSize(com)
 	}
-
-	var out bytes.Buffer
-	writeSOI := func() {
-		out.WriteByte(markerStart)
-		out.WriteByte(markerSOI)
+	// Offsets are relative to MPF TIFF header that follows APP2 marker, length and MPF signature.
+	mpfHeader := primary.Len() + 4 + len(mpfSig)
+	primaryImageSize := primary.Len() + 4 + calculateMpfSize() + afterMpfSize + len(primaryHead) - 2 + len(primaryTail)
+	if err := writeAppSegment(&primary, markerAPP2, generateMpf(primaryImageSize, secondaryImageSize, primaryImageSize-mpfHeader)); err != nil {
+		return err
 	}
 
-	writeSOI()
-	if len(exif) > 0 {
-		writeAppSegment(&out, markerAPP1, exif)
-	}
-	if len(primaryXMP) > 0 {
-		writeAppSegment(&out, markerAPP1, primaryXMP)
+	for _, seg := range iccSegs {
+		if err := writeAppSegment(&primary, markerAPP2, seg); err != nil {
+			return err
+		}
 	}
-
-	isoPrimary := secondaryISO
-	if len(isoPrimary) == 0 {
-		isoPrimary = buildIsoVersionOnly()
-	} else if len(isoPrimary) > len(isoNamespace)+1+4 {
-		// If this is full ISO metadata, keep only version (4 bytes) for primary.
-		isoPrimary = append([]byte(nil), isoPrimary[:len(isoNamespace)+1+4]...)
+	for _, com := range c.comments {
+		if len(com) == 0 {
+			continue // Not counted by appSize.
+		}
+		if err := writeAppSegment(&primary, markerCOM, com); err != nil {
+			return err
+		}
 	}
+	primary.Write(primaryHead[2:])
 
-	if len(isoPrimary) > 0 {
-		writeAppSegment(&out, markerAPP2, isoPrimary)
+	for _, b := range [][]byte{primary.Bytes(), primaryTail, secondary.Bytes(), gainmapTail} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	mpfLen := 2 + calculateMpfSize()
-	primaryImageSize := out.Len() + mpfLen + len(primaryStripped)
-	secondaryOffset := primaryImageSize - out.Len() - 8
-	mpf := generateMpf(primaryImageSize, secondaryImageSize, secondaryOffset)
-	writeAppSegment(&out, markerAPP2, mpf)
-
-	for _, seg := range icc {
-		writeAppSegment(&out, markerAPP2, seg)
+// containerSizeVipsLike returns the size of container written by writeContainerVipsLike
+// for the same parts. The container is written to a counter, JPEG payloads are not copied.
+func containerSizeVipsLike(c containerParts) (int, error) {
+	var n byteCounter
+	if err := writeContainerVipsLike(&n, c); err != nil {
+		return 0, err
 	}
+	return int(n), nil
+}
 
-	out.Write(primaryStripped[2:])
-
-	writeSOI()
-	if len(secondaryXMP) > 0 {
-		writeAppSegment(&out, markerAPP1, secondaryXMP)
-	}
-	if len(secondaryISO) > 0 {
-		writeAppSegment(&out, markerAPP2, secondaryISO)
-	}
-	out.Write(gainmapStripped[2:])
+// byteCounter is an io.Writer that discards data and counts written bytes.
+type byteCounter int
 
-	final := out.Bytes()
-	if err := replaceMpfPayload(final); err != nil {
-		return nil, err
-	}
-	return final, nil
+func (n *byteCounter) Write(p []byte) (int, error) {
+	*n += byteCounter(len(p))
+	return len(p), nil
 }
 
+// isoVersionSize is the size of ISO 21496-1 version header: minimum_version and writer_version (uint16 each).
+const isoVersionSize = 4
+
+// buildIsoVersionOnly returns a version-only ISO 21496-1 payload with zero minimum and writer versions.
 func buildIsoVersionOnly() []byte {
 	payload := append(append([]byte{}, []byte(isoNamespace)...), 0)
-	payload = append(payload, 0, 0, 0, 0)
+	payload = append(payload, make([]byte, isoVersionSize)...)
 	return payload
 }
 
+// primaryIsoVersion returns the ISO 21496-1 payload for the primary image.
+// Per spec (and libultrahdr) primary image carries only the version header, which signals gainmap
+// presence to readers, while full metadata lives in the gainmap image. Full secondary metadata starts
+// with the same header, so it is truncated to keep writer versions consistent between the two.
+func primaryIsoVersion(secondaryISO []byte) []byte {
+	if len(secondaryISO) < len(isoPrefix)+isoVersionSize || !bytes.HasPrefix(secondaryISO, isoPrefix) {
+		return buildIsoVersionOnly()
+	}
+	return append([]byte(nil), secondaryISO[:len(isoPrefix)+isoVersionSize]...)
+}
+
 // stripAppSegments removes APP0-APP15 and COM segments from a JPEG.
 func stripAppSegments(jpegData []byte) ([]byte, error) {
-	if len(jpegData) < 4 || jpegData[0] != markerStart || jpegData[1] != markerSOI {
-		return nil, errors.New("invalid jpeg")
+	head, tail, err := stripAppSegmentsHead(jpegData)
+	if err != nil {
+		return nil, err
+	}
+	return append(head, tail...), nil
+}
+
+// stripAppSegmentsHead removes APP0-APP15 and COM segments from a JPEG, it returns a copy of remaining
+// headers up to and including SOS segment and the rest of jpegData (not copied).
+// APP14 Adobe segments are kept, they define color transform of CMYK/YCCK image data.
+func stripAppSegmentsHead(jpegData []byte) (head, tail []byte, err error) {
+	r, err := newSegmentReader(jpegData)
+	if err != nil {
+		return nil, nil, err
 	}
 	var out bytes.Buffer
-	out.WriteByte(markerStart)
-	out.WriteByte(markerSOI)
-	pos := 2
-	for pos+3 < len(jpegData) {
-		if jpegData[pos] != markerStart {
-			out.WriteByte(jpegData[pos])
-			pos++
-			continue
+	out.Write(jpegData[:2])
+	for {
+		prev := r.pos
+		seg, ok, err := r.next()
+		if err != nil {
+			return nil, nil, err
 		}
-		for pos < len(jpegData) && jpegData[pos] == markerStart {
-			pos++
+		if !ok {
+			return out.Bytes(), nil, nil
 		}
-		if pos >= len(jpegData) {
-			break
+		out.Write(jpegData[prev:seg.offset])
+		if (seg.isApp() || seg.marker == markerCOM) && !(seg.marker == markerAPP14 && bytes.HasPrefix(seg.payload, adobeSig)) {
+			continue
 		}
-		marker := jpegData[pos]
-		pos++
-		if marker == markerSOS || marker == markerEOI {
-			out.WriteByte(markerStart)
-			out.WriteByte(marker)
-			out.Write(jpegData[pos:]) // include rest
-			return out.Bytes(), nil
+		out.Write(jpegData[seg.offset:seg.end])
+		if seg.marker == markerSOS || seg.marker == markerEOI {
+			return out.Bytes(), jpegData[seg.end:], nil
 		}
-		if marker >= 0xD0 && marker <= 0xD7 {
-			out.WriteByte(markerStart)
-			out.WriteByte(marker)
-			continue
+	}
+}
+
+// customAppSegments returns copies of APP segments of jpegData that container assembly does not
+// manage: everything except EXIF, XMP, ICC, MPF, ISO 21496-1 and APP14 Adobe (kept in image data).
+// Extended XMP segments are dropped too, they are orphaned without the replaced main XMP packet.
+func customAppSegments(jpegData []byte) ([]appSegment, error) {
+	r, err := newSegmentReader(jpegData)
+	if err != nil {
+		return nil, err
+	}
+	var segs []appSegment
+	for {
+		seg, ok, err := r.next()
+		if err != nil {
+			return nil, err
 		}
-		if pos+1 >= len(jpegData) {
-			return nil, errors.New("truncated marker")
+		if !ok || seg.marker == markerSOS || seg.marker == markerEOI {
+			return segs, nil
 		}
-		segLen := int(binary.BigEndian.Uint16(jpegData[pos:]))
-		if segLen < 2 || pos+segLen > len(jpegData) {
-			return nil, errors.New("invalid segment length")
+		if !seg.isApp() {
+			continue
 		}
-		segStart := pos + 2
-		segEnd := pos + segLen
-		if marker == 0xFE || (marker >= markerAPP0 && marker <= 0xEF) {
-			// skip
-			pos = segEnd
+		payload := seg.payload
+		switch {
+		case seg.marker == markerAPP1 && (bytes.HasPrefix(payload, exifSig) || bytes.HasPrefix(payload, xmpPrefix) || bytes.HasPrefix(payload, xmpExtensionSig)),
+			seg.marker == markerAPP2 && (bytes.HasPrefix(payload, iccSig) || bytes.HasPrefix(payload, mpfSig) || bytes.HasPrefix(payload, isoPrefix)),
+			seg.marker == markerAPP14 && bytes.HasPrefix(payload, adobeSig):
 			continue
 		}
-		// keep other markers
-		out.WriteByte(markerStart)
-		out.WriteByte(marker)
-		out.Write(jpegData[pos : pos+2]) // length
-		out.Write(jpegData[segStart:segEnd])
-		pos = segEnd
+		segs = append(segs, appSegment{marker: seg.marker, payload: append([]byte(nil), payload...)})
 	}
-	return out.Bytes(), nil
+}
+
+// insertContainerAppSegments inserts APP segments after primary SOI and updates MPF offsets.
+func insertContainerAppSegments(container []byte, segs []appSegment) ([]byte, error) {
+	out, err := insertAppSegments(container, segs)
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceMpfPayload(out); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
 func replaceMpfPayload(data []byte) error {
@@ -292,7 +347,7 @@ func replaceMpfPayload(data []byte) error {
 			continue
 		}
 		if i+1 >= len(data) {
-			return errors.New("truncated marker")
+			return fmt.Errorf("%w marker", ErrTruncated)
 		}
 		segLen := int(binary.BigEndian.Uint16(data[i:]))
 		segStart := i + 2
@@ -305,7 +360,7 @@ func replaceMpfPayload(data []byte) error {
 		i = segEnd
 	}
 	if mpfStart < 0 || mpfLen <= 0 {
-		return errors.New("mpf not found")
+		return fmt.Errorf("%w: MPF segment not found", ErrInvalidMPF)
 	}
 
 	// Find JPEG ranges.
@@ -319,12 +374,27 @@ func replaceMpfPayload(data []byte) error {
 
 	newMpf := generateMpf(primarySize, secondarySize, secondaryOffset)
 	if len(newMpf) != mpfLen {
-		return errors.New("mpf size mismatch")
+		return fmt.Errorf("%w: MPF size mismatch", ErrInvalidMPF)
 	}
 	copy(data[mpfStart:mpfStart+mpfLen], newMpf)
 	return nil
 }
 
+// UpdateContainerGainmapLength returns a copy of primary XMP APP1 payload (with XMP namespace
+// prefix) with Item:Length of the gainmap item set to newSecondarySize. It keeps the declared
+// length consistent after the gainmap of a container is replaced out of band, payload
+// without Item:Length is returned unchanged. MPF entries must be updated separately.
+func UpdateContainerGainmapLength(primaryXMP []byte, newSecondarySize int) ([]byte, error) {
+	if newSecondarySize <= 0 {
+		return nil, fmt.Errorf("invalid gainmap size: %d", newSecondarySize)
+	}
+	out, err := updatePrimaryXmpLength(primaryXMP, newSecondarySize)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), out...), nil
+}
+
 func updatePrimaryXmpLength(payload []byte, newLen int) ([]byte, error) {
 	idx := bytes.Index(payload, []byte(xmpNamespace))
 	if idx == -1 {
@@ -0,0 +1,158 @@
+package ultrahdr
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Config describes dimensions and HDR capability of a JPEG or UltraHDR container.
+type Config struct {
+	Width, Height int // Primary image dimensions.
+
+	HasGainmap                  bool
+	GainmapWidth, GainmapHeight int
+
+	// HDRCapacityMax is taken from gainmap metadata (gainmap image segments take precedence
+	// over primary ones), it is 0 when metadata is missing or can not be decoded.
+	HDRCapacityMax float32
+}
+
+// DecodeConfig reads image dimensions and gainmap presence with a streaming marker walk.
+// Only headers and APP segments are parsed, entropy-coded data of the primary image is skipped
+// without decoding and reading stops at the frame header of the second image.
+// A JPEG without gainmap gives HasGainmap == false, input without SOI marker fails with ErrNotJPEG.
+// Truncated gainmap fails with ErrTruncatedGainmap, the primary part of Config is still filled.
+func DecodeConfig(r io.Reader) (Config, error) {
+	var cfg Config
+	if r == nil {
+		return cfg, errors.New("missing reader")
+	}
+	br := bufio.NewReader(r)
+	found, err := findSOI(br)
+	if err != nil {
+		return cfg, err
+	}
+	if !found {
+		return cfg, fmt.Errorf("%w: SOI marker missing", ErrNotJPEG)
+	}
+
+	first, err := readConfigHeaders(br, true)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return cfg, errTruncatedPrimary
+		}
+		return cfg, err
+	}
+	if found, err = findSOI(br); err != nil || !found {
+		cfg.Width, cfg.Height = first.info.Width, first.info.Height
+		return cfg, err
+	}
+	second, err := readConfigHeaders(br, false)
+	if err != nil {
+		cfg.Width, cfg.Height = first.info.Width, first.info.Height
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return cfg, ErrTruncatedGainmap
+		}
+		return cfg, err
+	}
+
+	primary, gainmap := first, second
+	if !firstImageIsPrimary(first.app2) {
+		primary, gainmap = second, first
+	}
+	cfg.Width, cfg.Height = primary.info.Width, primary.info.Height
+	if !primary.declaresGainmap && gainmap.meta == nil {
+		// Second image is not a gainmap, e.g. MPF burst or depth map.
+		return cfg, nil
+	}
+	cfg.HasGainmap = true
+	cfg.GainmapWidth, cfg.GainmapHeight = gainmap.info.Width, gainmap.info.Height
+	switch {
+	case gainmap.meta != nil:
+		cfg.HDRCapacityMax = gainmap.meta.HDRCapacityMax
+	case primary.meta != nil:
+		cfg.HDRCapacityMax = primary.meta.HDRCapacityMax
+	}
+	return cfg, nil
+}
+
+// configHeaders holds header data of a single image collected by readConfigHeaders.
+type configHeaders struct {
+	info            JPEGInfo
+	app2            [][]byte // MPF segment only.
+	meta            *GainMapMetadata
+	declaresGainmap bool // XMP Container:Directory with GainMap item or ISO version.
+}
+
+// readConfigHeaders reads markers of an image after SOI up to the frame header.
+// With skipToEOI, it continues to the end of the image, skipping entropy-coded data,
+// so that the reader is positioned for the next image.
+func readConfigHeaders(br *bufio.Reader, skipToEOI bool) (configHeaders, error) {
+	var (
+		h      configHeaders
+		hasSOF bool
+		xmp    []byte
+		iso    []byte
+	)
+	for {
+		marker, err := readMarker(br)
+		if err != nil {
+			return h, err
+		}
+		switch {
+		case marker == markerEOI || marker == markerSOS:
+			if !hasSOF {
+				return h, errors.New("frame header missing")
+			}
+			if marker == markerSOS && skipToEOI {
+				if err := skipScanToEOI(br); err != nil {
+					return h, err
+				}
+			}
+			h.meta = primaryGainmapMetadata(&MetadataSegments{PrimaryXMP: xmp, PrimaryISO: iso})
+			return h, nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// TEM and RST have no length.
+		case marker == markerAPP1 || marker == markerAPP2 ||
+			(!hasSOF && marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC):
+			length, err := readU16(br)
+			if err != nil {
+				return h, err
+			}
+			if length < 2 {
+				return h, errors.New("invalid segment length")
+			}
+			payload := make([]byte, length-2)
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return h, err
+			}
+			switch {
+			case marker == markerAPP1 && bytes.HasPrefix(payload, xmpPrefix):
+				xmp = payload
+				h.declaresGainmap = h.declaresGainmap ||
+					bytes.Contains(payload, containerDirectory) && bytes.Contains(payload, gainmapItemSemantic)
+			case marker == markerAPP2 && bytes.HasPrefix(payload, isoPrefix):
+				iso = payload
+				h.declaresGainmap = true
+			case marker == markerAPP2 && bytes.HasPrefix(payload, mpfSig):
+				h.app2 = append(h.app2, payload)
+			case marker != markerAPP1 && marker != markerAPP2:
+				if h.info, err = parseSOF(marker, payload); err != nil {
+					return h, err
+				}
+				hasSOF = true
+				if !skipToEOI {
+					h.meta = primaryGainmapMetadata(&MetadataSegments{PrimaryXMP: xmp, PrimaryISO: iso})
+					return h, nil
+				}
+			}
+		default:
+			if err := discardSegment(br); err != nil {
+				return h, err
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	for _, name := range []string{"testdata/small_uhdr.jpg", "testdata/uhdr.jpg", "testdata/progressive_uhdr.jpg"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		sr := mustSplit(t, data)
+		cfg, err := DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: decode config: %v", name, err)
+		}
+		primary, err := jpeg.DecodeConfig(bytes.NewReader(sr.Primary))
+		if err != nil {
+			t.Fatalf("%s: primary config: %v", name, err)
+		}
+		gainmap, err := jpeg.DecodeConfig(bytes.NewReader(sr.Gainmap))
+		if err != nil {
+			t.Fatalf("%s: gainmap config: %v", name, err)
+		}
+		want := Config{
+			Width: primary.Width, Height: primary.Height,
+			HasGainmap: true, GainmapWidth: gainmap.Width, GainmapHeight: gainmap.Height,
+			HDRCapacityMax: sr.Meta.HDRCapacityMax,
+		}
+		if cfg != want {
+			t.Fatalf("%s: got %+v, want %+v", name, cfg, want)
+		}
+
+		// Plain JPEG has no gainmap.
+		cfg, err = DecodeConfig(bytes.NewReader(sr.Primary))
+		if err != nil {
+			t.Fatalf("%s: decode primary config: %v", name, err)
+		}
+		if cfg != (Config{Width: primary.Width, Height: primary.Height}) {
+			t.Fatalf("%s: unexpected plain JPEG config %+v", name, cfg)
+		}
+	}
+
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	cfg, err := DecodeConfig(bytes.NewReader(data[:len(sr.Primary)+20]))
+	if !errors.Is(err, ErrTruncatedGainmap) || cfg.Width == 0 {
+		t.Fatalf("expected ErrTruncatedGainmap with primary dimensions, got %+v, %v", cfg, err)
+	}
+	if _, err := DecodeConfig(bytes.NewReader([]byte("not a jpeg"))); !errors.Is(err, ErrNotJPEG) {
+		t.Fatalf("expected ErrNotJPEG, got %v", err)
+	}
+}
+
+func BenchmarkDecodeConfig(b *testing.B) {
+	for _, name := range []string{"testdata/small_uhdr.jpg", "testdata/uhdr.jpg"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			b.Fatalf("read %s: %v", name, err)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeConfig(bytes.NewReader(data)); err != nil {
+					b.Fatalf("decode config: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -3,17 +3,27 @@ package ultrahdr
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
 var (
 	xmpPrefix = append([]byte(xmpNamespace), 0)
 	isoPrefix = append([]byte(isoNamespace), 0)
+
+	hdrgmNamespaceURI = []byte("http://ns.adobe.com/hdr-gain-map/1.0/")
+	hdrgmProperty     = []byte("hdrgm:")
+
+	containerDirectory  = []byte("Container:Directory")
+	gainmapItemSemantic = []byte(`Item:Semantic="GainMap"`)
 )
 
 // IsUltraHDR performs a streaming UltraHDR check without loading the full image.
-// It reads until the gainmap header is reached and scans APP metadata for XMP/ISO.
+// It scans primary APP metadata for a gainmap reference (XMP Container:Directory or ISO version),
+// and otherwise reads until the gainmap header is reached and scans its XMP/ISO metadata.
+// Input without SOI marker fails with ErrNotJPEG, a JPEG without gainmap is (false, nil).
 func IsUltraHDR(r io.Reader) (bool, error) {
 	br := bufio.NewReader(r)
 	found, err := findSOI(br)
@@ -21,10 +31,11 @@ func IsUltraHDR(r io.Reader) (bool, error) {
 		return false, err
 	}
 	if !found {
-		return false, nil
+		return false, fmt.Errorf("%w: SOI marker missing", ErrNotJPEG)
 	}
-	if err := skipJPEG(br); err != nil {
-		return false, err
+	match, err := checkPrimaryHeader(br)
+	if err != nil || match {
+		return match, err
 	}
 	found, err = findSOI(br)
 	if err != nil {
@@ -36,6 +47,32 @@ func IsUltraHDR(r io.Reader) (bool, error) {
 	return checkGainmapHeader(br)
 }
 
+// checkPrimaryHeader reports whether the primary image declares a gainmap, with a GainMap item
+// of XMP Container:Directory or an ISO version box. Otherwise, the primary is skipped to EOI.
+func checkPrimaryHeader(br *bufio.Reader) (bool, error) {
+	for {
+		marker, err := readMarker(br)
+		if err != nil {
+			return false, err
+		}
+		switch marker {
+		case markerEOI:
+			return false, nil
+		case markerSOS:
+			return false, skipScanToEOI(br)
+		case markerAPP1, markerAPP2:
+			match, err := segmentHasGainmapMetadata(br, marker, true)
+			if err != nil || match {
+				return match, err
+			}
+		default:
+			if err := discardSegment(br); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
 func findSOI(br *bufio.Reader) (bool, error) {
 	var prev byte
 	for {
@@ -53,25 +90,6 @@ func findSOI(br *bufio.Reader) (bool, error) {
 	}
 }
 
-func skipJPEG(br *bufio.Reader) error {
-	for {
-		marker, err := readMarker(br)
-		if err != nil {
-			return err
-		}
-		switch marker {
-		case markerEOI:
-			return nil
-		case markerSOS:
-			return skipScanToEOI(br)
-		default:
-			if err := discardSegment(br); err != nil {
-				return err
-			}
-		}
-	}
-}
-
 func checkGainmapHeader(br *bufio.Reader) (bool, error) {
 	for {
 		marker, err := readMarker(br)
@@ -84,7 +102,7 @@ func checkGainmapHeader(br *bufio.Reader) (bool, error) {
 		case markerSOS:
 			return false, nil
 		case markerAPP1, markerAPP2:
-			match, err := segmentHasGainmapMetadata(br, marker)
+			match, err := segmentHasGainmapMetadata(br, marker, false)
 			if err != nil {
 				return false, err
 			}
@@ -131,7 +149,12 @@ func discardSegment(br *bufio.Reader) error {
 	return discardN(br, int(length-2))
 }
 
-func segmentHasGainmapMetadata(br *bufio.Reader, marker byte) (bool, error) {
+// segmentHasGainmapMetadata reports whether an APP1/APP2 segment carries gainmap metadata.
+// XMP payloads must reference the hdr-gain-map namespace, ordinary XMP (e.g. in MPF bursts)
+// does not count, primary XMP must list a GainMap item in Container:Directory.
+// ISO payloads must start with a supported version.
+// At most one segment (64 KiB) is buffered.
+func segmentHasGainmapMetadata(br *bufio.Reader, marker byte, primary bool) (bool, error) {
 	length, err := readU16(br)
 	if err != nil {
 		return false, err
@@ -140,22 +163,30 @@ func segmentHasGainmapMetadata(br *bufio.Reader, marker byte) (bool, error) {
 		return false, errors.New("invalid segment length")
 	}
 	payloadLen := int(length - 2)
-	var prefix []byte
+	var readLen int
 	if marker == markerAPP1 {
-		prefix = xmpPrefix
+		readLen = payloadLen
 	} else {
-		prefix = isoPrefix
-	}
-	maxPrefix := len(prefix)
-	readLen := payloadLen
-	if readLen > maxPrefix {
-		readLen = maxPrefix
+		// Namespace followed by minimum_version and writer_version.
+		readLen = min(payloadLen, len(isoPrefix)+4)
 	}
 	buf := make([]byte, readLen)
 	if _, err := io.ReadFull(br, buf); err != nil {
 		return false, err
 	}
-	match := bytes.HasPrefix(buf, prefix)
+	var match bool
+	if marker == markerAPP1 {
+		switch {
+		case !bytes.HasPrefix(buf, xmpPrefix):
+		case primary:
+			match = bytes.Contains(buf, containerDirectory) && bytes.Contains(buf, gainmapItemSemantic)
+		default:
+			match = bytes.Contains(buf, hdrgmNamespaceURI) || bytes.Contains(buf, hdrgmProperty)
+		}
+	} else {
+		match = len(buf) == len(isoPrefix)+4 && bytes.HasPrefix(buf, isoPrefix) &&
+			binary.BigEndian.Uint16(buf[len(isoPrefix):]) == 0
+	}
 	if payloadLen > readLen {
 		if err := discardN(br, payloadLen-readLen); err != nil {
 			return false, err
@@ -186,13 +217,13 @@ func discardN(br *bufio.Reader, n int) error {
 
 func skipScanToEOI(br *bufio.Reader) error {
 	for {
-		b, err := br.ReadByte()
-		if err != nil {
+		// Skip entropy-coded data up to and including the next 0xFF.
+		if _, err := br.ReadSlice(markerStart); err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				continue
+			}
 			return err
 		}
-		if b != markerStart {
-			continue
-		}
 		m, err := br.ReadByte()
 		if err != nil {
 			return err
@@ -1,6 +1,9 @@
 package ultrahdr
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	_ "image/jpeg" // Register JPEG decoder.
@@ -10,7 +13,141 @@ type rgb struct {
 	r, g, b float32
 }
 
-func sampleSDRInProfile(img image.Image, x, y int, src colorProfile, dstGamut colorGamut) rgb {
+// DecodeOptions controls UltraHDR decoding.
+type DecodeOptions struct {
+	// MaxDisplayBoost is the HDR headroom of the target display (linear ratio to SDR white),
+	// zero means full HDRCapacityMax.
+	MaxDisplayBoost float32
+	// SkipReconstruction returns only SDR base image and metadata, HDR image is nil.
+	SkipReconstruction bool
+	// RawOrientation keeps stored pixel orientation, by default HDR and SDR images are
+	// rotated to display orientation according to EXIF Orientation of the primary image.
+	RawOrientation bool
+	// Warn receives non-fatal warnings, e.g. invalid ISO metadata with valid XMP fallback.
+	Warn func(msg string)
+	// ExactTransfer computes transfer functions with math.Pow instead of lookup tables,
+	// which stay within 1 LSB of exact 8-bit results.
+	ExactTransfer bool
+}
+
+// Decode decodes an UltraHDR JPEG/R container into linear HDR image (1.0 is SDR white),
+// SDR base image and gainmap metadata. Images are in display orientation unless
+// DecodeOptions.RawOrientation is set.
+func Decode(data []byte, opt *DecodeOptions) (*HDRImage, image.Image, *GainMapMetadata, error) {
+	if opt == nil {
+		opt = &DecodeOptions{}
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("split: %w", err)
+	}
+	if opt.Warn != nil {
+		for _, msg := range sr.Warnings {
+			opt.Warn(msg)
+		}
+	}
+	sdr, err := decodeJPEG(sr.Primary)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("decode primary: %w", err)
+	}
+	orientation := orientationNormal
+	if !opt.RawOrientation {
+		if exif, _, err := extractExifAndIcc(sr.Primary); err == nil {
+			if o, _ := exifOrientation(exif); o > orientationNormal && o <= orientationRotate270 {
+				orientation = o
+			}
+		}
+	}
+	if opt.SkipReconstruction {
+		if orientation != orientationNormal {
+			sdr = orientImage(sdr, orientation)
+		}
+		return nil, sdr, sr.Meta, nil
+	}
+	gainmap, err := decodeJPEG(sr.Gainmap)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("decode gainmap: %w", err)
+	}
+	if err := checkGainmapDimensions(sdr.Bounds(), gainmap.Bounds()); err != nil {
+		return nil, nil, nil, err
+	}
+	sdrProfile := jpegColorProfile(sr.Primary)
+	gainGamut := gainApplicationGamut(sr.Meta, sdrProfile, sr.Gainmap)
+	hdr, err := reconstructHDR(sdr, sdrProfile, gainmap, gainGamut, sr.Meta, displayBoostWeight(sr.Meta, opt.MaxDisplayBoost), opt.ExactTransfer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if orientation != orientationNormal {
+		hdr = orientHDRImage(hdr, orientation)
+		sdr = orientImage(sdr, orientation)
+	}
+	return hdr, sdr, sr.Meta, nil
+}
+
+// checkGainmapDimensions rejects gainmap larger than SDR base or with different aspect ratio,
+// such gainmaps come from corrupt or mismatched files and would reconstruct garbage.
+func checkGainmapDimensions(sb, gb image.Rectangle) error {
+	if msg := gainmapScaleMismatch(sb.Dx(), sb.Dy(), gb.Dx(), gb.Dy()); msg != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidGainmapDimensions, msg)
+	}
+	return nil
+}
+
+// displayBoostWeight returns gainmap application weight for a display with given headroom.
+func displayBoostWeight(meta *GainMapMetadata, maxDisplayBoost float32) float32 {
+	if maxDisplayBoost <= 0 || maxDisplayBoost >= meta.HDRCapacityMax {
+		return 1
+	}
+	capMin := boostLog2(meta.HDRCapacityMin)
+	capMax := boostLog2(meta.HDRCapacityMax)
+	if capMax <= capMin {
+		// Zero (or invalid) capacity range, gainmap is applied in full.
+		return 1
+	}
+	if maxDisplayBoost <= meta.HDRCapacityMin {
+		return 0
+	}
+	return clamp01((log2f(maxDisplayBoost) - capMin) / (capMax - capMin))
+}
+
+// reconstructHDR applies gainmap to SDR base image encoded with sdrProfile.
+// Multi-channel gains are applied in gainGamut, HDR result is in sRGB gamut.
+func reconstructHDR(sdr image.Image, sdrProfile colorProfile, gainmap image.Image, gainGamut ColorGamut, meta *GainMapMetadata, weight float32, exact bool) (*HDRImage, error) {
+	if meta == nil {
+		return nil, errors.New("gainmap metadata missing")
+	}
+	b := sdr.Bounds()
+	w, h := b.Dx(), b.Dy()
+	gmBounds := gainmap.Bounds()
+	gmW, gmH := gmBounds.Dx(), gmBounds.Dy()
+	if w <= 0 || h <= 0 || gmW <= 0 || gmH <= 0 {
+		return nil, errors.New("invalid image dimensions")
+	}
+	mapScaleX := float32(w) / float32(gmW)
+	mapScaleY := float32(h) / float32(gmH)
+	isGray := isGrayImage(gainmap)
+	if isGray {
+		// Equal gains in all channels are gamut independent.
+		gainGamut = ColorGamutSRGB
+	}
+
+	out := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+	dec := newGainDecoder(meta)
+	for y := 0; y < h; y++ {
+		gy := min(max(int(float32(y)/mapScaleY+0.5), 0), gmH-1)
+		for x := 0; x < w; x++ {
+			gx := min(max(int(float32(x)/mapScaleX+0.5), 0), gmW-1)
+			v := sampleSDRInProfile(sdr, b.Min.X+x, b.Min.Y+y, sdrProfile, gainGamut, exact)
+			v = applyGainmapWeighted(v, gainmap, dec, gx, gy, isGray, weight)
+			out.set(x, y, clampRGB(convertLinearGamut(v, gainGamut, ColorGamutSRGB)))
+		}
+	}
+	return out, nil
+}
+
+// sampleSDRInProfile linearizes SDR pixel x, y clamped to bounds and converts it to dstGamut,
+// exact disables lookup tables for 16-bit inputs.
+func sampleSDRInProfile(img image.Image, x, y int, src colorProfile, dstGamut ColorGamut, exact bool) rgb {
 	b := img.Bounds()
 	if x < b.Min.X {
 		x = b.Min.X
@@ -24,11 +161,19 @@ func sampleSDRInProfile(img image.Image, x, y int, src colorProfile, dstGamut co
 	if y >= b.Max.Y {
 		y = b.Max.Y - 1
 	}
-	r, g, b2, _ := img.At(x, y).RGBA()
-	v := rgb{
-		r: invOETF(float32(r)/65535.0, src.transfer),
-		g: invOETF(float32(g)/65535.0, src.transfer),
-		b: invOETF(float32(b2)/65535.0, src.transfer),
+	var v rgb
+	switch m := img.(type) {
+	case *image.YCbCr:
+		// Fast path: read planes directly instead of color conversion via interface.
+		ci := m.COffset(x, y)
+		r, g, b := color.YCbCrToRGB(m.Y[m.YOffset(x, y)], m.Cb[ci], m.Cr[ci])
+		v = rgb{r: invOETF8(r, src.transfer), g: invOETF8(g, src.transfer), b: invOETF8(b, src.transfer)}
+	case *image.Gray:
+		l := invOETF8(m.Pix[m.PixOffset(x, y)], src.transfer)
+		v = rgb{r: l, g: l, b: l}
+	default:
+		r, g, b2, _ := img.At(x, y).RGBA()
+		v = rgb{r: invOETF16(r, src.transfer, exact), g: invOETF16(g, src.transfer, exact), b: invOETF16(b2, src.transfer, exact)}
 	}
 	return convertLinearGamut(v, src.gamut, dstGamut)
 }
@@ -43,11 +188,19 @@ func isGrayImage(img image.Image) bool {
 }
 
 func grayAt(img image.Image, x, y int) uint8 {
+	if m, ok := img.(*image.Gray); ok {
+		return m.Pix[m.PixOffset(m.Rect.Min.X+x, m.Rect.Min.Y+y)]
+	}
 	c := color.GrayModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y)).(color.Gray)
 	return c.Y
 }
 
 func rgbAt(img image.Image, x, y int) (uint8, uint8, uint8) {
+	if m, ok := img.(*image.YCbCr); ok {
+		x, y = m.Rect.Min.X+x, m.Rect.Min.Y+y
+		ci := m.COffset(x, y)
+		return color.YCbCrToRGB(m.Y[m.YOffset(x, y)], m.Cb[ci], m.Cr[ci])
+	}
 	r, g, b, _ := img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y).RGBA()
 	return uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)
 }
@@ -0,0 +1,297 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+
+	hdr, sdr, meta, err := Decode(data, nil)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if sdr == nil || meta == nil || hdr == nil {
+		t.Fatalf("missing decode output")
+	}
+	b := sdr.Bounds()
+	if hdr.W != b.Dx() || hdr.H != b.Dy() {
+		t.Fatalf("hdr dims mismatch: got %dx%d want %dx%d", hdr.W, hdr.H, b.Dx(), b.Dy())
+	}
+	var peak float32
+	for _, v := range hdr.Pix {
+		peak = max(peak, v)
+	}
+	if peak <= 1 {
+		t.Fatalf("expected HDR values above SDR white, peak %v", peak)
+	}
+
+	// Display without headroom renders the SDR base.
+	sdrOnly, _, _, err := Decode(data, &DecodeOptions{MaxDisplayBoost: 1})
+	if err != nil {
+		t.Fatalf("decode sdr: %v", err)
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	for _, p := range [][2]int{{0, 0}, {b.Dx() / 2, b.Dy() / 2}, {b.Dx() - 1, b.Dy() - 1}} {
+		want := sampleSDRInProfile(sdr, b.Min.X+p[0], b.Min.Y+p[1], profile, ColorGamutSRGB, false)
+		got := sdrOnly.at(p[0], p[1])
+		if d := got.g - want.g; d > 1e-3 || d < -1e-3 {
+			t.Fatalf("pixel %v: got %v want %v", p, got.g, want.g)
+		}
+	}
+}
+
+func TestDecodeSkipReconstruction(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	hdr, sdr, meta, err := Decode(data, &DecodeOptions{SkipReconstruction: true})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if hdr != nil {
+		t.Fatalf("expected nil HDR image")
+	}
+	if sdr == nil || meta == nil {
+		t.Fatalf("missing base image or metadata")
+	}
+}
+
+func TestDecodeGainmapDimensions(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(sr.Primary))
+	if err != nil {
+		t.Fatalf("primary config: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		w, h int
+		want string
+	}{
+		{name: "quarter", w: cfg.Width / 4, h: cfg.Height / 4},
+		{name: "rounded up", w: (cfg.Width + 2) / 3, h: (cfg.Height + 2) / 3},
+		{name: "larger than primary", w: cfg.Width + 8, h: cfg.Height + 6, want: "is larger than primary"},
+		{name: "aspect mismatch", w: cfg.Width / 2, h: cfg.Height / 8, want: "aspect ratio does not match"},
+	} {
+		gm, err := encodeWithQuality(image.NewGray(image.Rect(0, 0, tc.w, tc.h)), 85)
+		if err != nil {
+			t.Fatalf("%s: encode gainmap: %v", tc.name, err)
+		}
+		c, err := AssembleWithMetadata(sr.Primary, gm, sr.Meta)
+		if err != nil {
+			t.Fatalf("%s: assemble: %v", tc.name, err)
+		}
+		_, _, _, decodeErr := Decode(c, nil)
+		_, renderErr := RenderSDR(c, nil)
+		_, rebaseErr := RebaseJPEG(c, sr.Primary)
+		_, compareErr := CompareContainers(data, c)
+		for _, err := range []error{decodeErr, renderErr, rebaseErr, compareErr} {
+			if tc.want == "" && err != nil {
+				t.Fatalf("%s: unexpected error %v", tc.name, err)
+			}
+			if tc.want != "" && (!errors.Is(err, ErrInvalidGainmapDimensions) || !strings.Contains(err.Error(), tc.want)) {
+				t.Fatalf("%s: error %v does not mention %q", tc.name, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestDecodeWideGamutBase(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	p3, err := os.ReadFile("testdata/sample_display_p3.jpg")
+	if err != nil {
+		t.Fatalf("read p3 sample: %v", err)
+	}
+	_, icc, err := extractExifAndIcc(p3)
+	if err != nil || len(icc) == 0 {
+		t.Fatalf("extract icc: %v", err)
+	}
+	segs := make([]appSegment, 0, len(icc))
+	for _, seg := range icc {
+		segs = append(segs, appSegment{marker: markerAPP2, payload: seg})
+	}
+	tagged, err := insertContainerAppSegments(data, segs)
+	if err != nil {
+		t.Fatalf("insert icc: %v", err)
+	}
+
+	// Without headroom HDR is the linearized base, P3 values are converted to sRGB gamut.
+	opt := &DecodeOptions{MaxDisplayBoost: 1}
+	srgb, _, _, err := Decode(data, opt)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	wide, _, _, err := Decode(tagged, opt)
+	if err != nil {
+		t.Fatalf("decode tagged: %v", err)
+	}
+	var diff bool
+	for y := 0; y < srgb.H; y++ {
+		for x := 0; x < srgb.W; x++ {
+			want := clampRGB(convertLinearGamut(srgb.at(x, y), ColorGamutDisplayP3, ColorGamutSRGB))
+			got := wide.at(x, y)
+			for i, v := range [3]float32{got.r, got.g, got.b} {
+				w := [3]float32{want.r, want.g, want.b}[i]
+				if math.Abs(float64(v-w)) > 1e-4 {
+					t.Fatalf("pixel %d,%d channel %d: got %v want %v", x, y, i, v, w)
+				}
+			}
+			diff = diff || got != srgb.at(x, y)
+		}
+	}
+	if !diff {
+		t.Fatalf("ICC profile of base image ignored")
+	}
+}
+
+func TestDegenerateGainRange(t *testing.T) {
+	for _, f := range []float32{0, 0.5, 1, 2, 8, float32(math.NaN())} {
+		if v := gainFromFactor(f, 2, 2, 1, 0.5); v != 0 {
+			t.Fatalf("gainFromFactor(%v) with zero range: got %d", f, v)
+		}
+	}
+	for _, g := range []float32{-1, 0, 0.5, 3} {
+		if v := affineMapGain(g, 1, 1, 1, 0.5); v != 0 {
+			t.Fatalf("affineMapGain(%v) with zero range: got %d", g, v)
+		}
+	}
+	meta := &GainMapMetadata{HDRCapacityMin: 4, HDRCapacityMax: 4}
+	for _, boost := range []float32{1, 2, 4, 8} {
+		if w := displayBoostWeight(meta, boost); w != 1 {
+			t.Fatalf("weight for boost %v with zero capacity range: got %v", boost, w)
+		}
+	}
+}
+
+// FuzzGainmapMetadata checks that arbitrary boost, capacity and gamma values never produce NaN pixels.
+func FuzzGainmapMetadata(f *testing.F) {
+	f.Add(float32(1), float32(4), float32(1), float32(4), float32(1), float32(2))
+	f.Add(float32(2), float32(2), float32(3), float32(3), float32(1), float32(2))
+	f.Add(float32(0), float32(0), float32(0), float32(0), float32(0), float32(0))
+	f.Add(float32(-1), float32(math.Inf(1)), float32(math.NaN()), float32(1), float32(-2), float32(math.NaN()))
+	f.Add(float32(1e-30), float32(1e30), float32(1), float32(1e30), float32(1e-3), float32(1e20))
+
+	sdr := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	gainmap := image.NewGray(image.Rect(0, 0, 2, 2))
+	for i := range sdr.Pix {
+		sdr.Pix[i] = uint8(i * 17)
+	}
+	for i := range gainmap.Pix {
+		gainmap.Pix[i] = uint8(i * 85)
+	}
+	// Ranges beyond float32 overflow to +Inf pixels, only NaN is checked.
+	f.Fuzz(func(t *testing.T, minBoost, maxBoost, capMin, capMax, gamma, displayBoost float32) {
+		meta := &GainMapMetadata{HDRCapacityMin: capMin, HDRCapacityMax: capMax}
+		for c := range 3 {
+			meta.MinContentBoost[c], meta.MaxContentBoost[c] = minBoost, maxBoost
+			meta.Gamma[c] = gamma
+			meta.OffsetSDR[c], meta.OffsetHDR[c] = 1.0/64, 1.0/64
+		}
+		w := displayBoostWeight(meta, displayBoost)
+		if !(w >= 0 && w <= 1) {
+			t.Fatalf("weight out of range: %v", w)
+		}
+		hdr, err := reconstructHDR(sdr, colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}, gainmap, ColorGamutSRGB, meta, w, false)
+		if err != nil {
+			t.Fatalf("reconstruct: %v", err)
+		}
+		for i, v := range hdr.Pix {
+			if math.IsNaN(float64(v)) {
+				t.Fatalf("NaN pixel at %d, weight %v", i, w)
+			}
+		}
+		for _, factor := range []float32{0, 0.5, 1, 3, float32(math.Inf(1)), float32(math.NaN())} {
+			v := gainFromFactor(factor, minBoost, maxBoost, gamma, 0.5)
+			if boostLog2(minBoost) == boostLog2(maxBoost) && v != 0 {
+				t.Fatalf("zero range factor %v encoded as %d", factor, v)
+			}
+		}
+	})
+}
+
+// opaqueImage hides concrete image type to force generic sampling path.
+type opaqueImage struct{ image.Image }
+
+func TestSampleSDRFastPath(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := jpeg.Decode(bytes.NewReader(sr.Primary))
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	gainmap, err := jpeg.Decode(bytes.NewReader(sr.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap: %v", err)
+	}
+	if _, ok := primary.(*image.YCbCr); !ok {
+		t.Fatalf("unexpected primary type %T", primary)
+	}
+
+	toByte := func(v float32) int { return int(clampToByte(srgbOetf(clamp01(v))*255 + 0.5)) }
+	near := func(a, b float32) bool {
+		d := toByte(a) - toByte(b)
+		return d >= -1 && d <= 1
+	}
+
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	b := primary.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			fast := sampleSDRInProfile(primary, x, y, profile, ColorGamutSRGB, false)
+			slow := sampleSDRInProfile(opaqueImage{primary}, x, y, profile, ColorGamutSRGB, false)
+			if !near(fast.r, slow.r) || !near(fast.g, slow.g) || !near(fast.b, slow.b) {
+				t.Fatalf("sample mismatch at %d,%d: %+v vs %+v", x, y, fast, slow)
+			}
+		}
+	}
+
+	fast, err := reconstructHDR(primary, profile, gainmap, ColorGamutSRGB, sr.Meta, 1, false)
+	if err != nil {
+		t.Fatalf("reconstruct: %v", err)
+	}
+	slow, err := reconstructHDR(opaqueImage{primary}, profile, opaqueImage{gainmap}, ColorGamutSRGB, sr.Meta, 1, false)
+	if err != nil {
+		t.Fatalf("reconstruct generic: %v", err)
+	}
+	for i := range fast.Pix {
+		// Compare in SDR-relative range scaled down to [0, 1].
+		a, b := fast.Pix[i]/sr.Meta.HDRCapacityMax, slow.Pix[i]/sr.Meta.HDRCapacityMax
+		if !near(a, b) {
+			t.Fatalf("hdr mismatch at %d: %v vs %v", i, fast.Pix[i], slow.Pix[i])
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		b.Fatalf("read uhdr: %v", err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := Decode(data, nil); err != nil {
+			b.Fatalf("decode: %v", err)
+		}
+	}
+}
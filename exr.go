@@ -6,13 +6,18 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"image/color"
 	"io"
 	"math"
 	"strings"
+	"sync"
 )
 
 const exrMagic = 20000630
 
+// defaultEXRMegapixels is the default of EXRDecodeOptions.MaxMegapixels.
+const defaultEXRMegapixels = 256
+
 const (
 	exrCompressionNone = 0
 	exrCompressionZips = 2
@@ -31,15 +36,46 @@ const (
 	exrChanR     = 0
 	exrChanG     = 1
 	exrChanB     = 2
+	exrChanA     = 3
 )
 
-// hdrImage holds linear HDR pixel data in RGB order.
-type hdrImage struct {
+// HDRImage holds linear HDR pixel data in RGB order, 1.0 is SDR white.
+type HDRImage struct {
 	W, H int
 	Pix  []float32
+	// Gamut describes color primaries of Pix, zero value is sRGB (BT.709).
+	Gamut ColorGamut
+	// Alpha is optional coverage (0..1) per pixel, nil means opaque. As in OpenEXR,
+	// Pix is premultiplied by Alpha, see Flatten.
+	Alpha []float32
+}
+
+// Flatten returns an opaque copy of h composited over background (sRGB encoded, nil is black),
+// h is returned as is when it has no Alpha.
+func (h *HDRImage) Flatten(background color.Color) *HDRImage {
+	if h.Alpha == nil {
+		return h
+	}
+	bg := color.NRGBA{A: 0xFF}
+	if background != nil {
+		bg = color.NRGBAModel.Convert(background).(color.NRGBA)
+	}
+	lin := convertLinearGamut(rgb{
+		r: invOETF8(bg.R, ColorTransferSRGB),
+		g: invOETF8(bg.G, ColorTransferSRGB),
+		b: invOETF8(bg.B, ColorTransferSRGB),
+	}, ColorGamutSRGB, h.Gamut)
+	out := &HDRImage{W: h.W, H: h.H, Pix: make([]float32, len(h.Pix)), Gamut: h.Gamut}
+	for i, a := range h.Alpha {
+		k := 1 - clamp01(a)
+		out.Pix[i*3] = h.Pix[i*3] + k*lin.r
+		out.Pix[i*3+1] = h.Pix[i*3+1] + k*lin.g
+		out.Pix[i*3+2] = h.Pix[i*3+2] + k*lin.b
+	}
+	return out
 }
 
-func (h *hdrImage) at(x, y int) rgb {
+func (h *HDRImage) at(x, y int) rgb {
 	if x < 0 {
 		x = 0
 	}
@@ -64,116 +100,202 @@ type exrChannel struct {
 	role      int
 }
 
-func decodeEXR(data []byte) (*hdrImage, error) {
-	r := bytes.NewReader(data)
+// EXRAttribute is a header attribute of OpenEXR image.
+type EXRAttribute struct {
+	Name string
+	Type string // Attribute type name, e.g. "float", "string", "timecode".
+	Data []byte // Raw little-endian attribute value as stored in file.
+}
+
+// EXRDecodeOptions controls OpenEXR decoding.
+type EXRDecodeOptions struct {
+	// MaxMegapixels limits dimensions of decoded images, so that a crafted header does not
+	// allocate gigabytes of pixel data. Zero uses 256, negative disables the limit.
+	MaxMegapixels int
+}
+
+// maxPixels returns pixel count limit, zero means no limit.
+func (opt *EXRDecodeOptions) maxPixels() int64 {
+	mp := defaultEXRMegapixels
+	if opt != nil && opt.MaxMegapixels != 0 {
+		mp = opt.MaxMegapixels
+	}
+	if mp < 0 {
+		return 0
+	}
+	return int64(mp) * 1000000
+}
+
+// DecodeEXR decodes a single-part scanline OpenEXR image (uncompressed, ZIPS or ZIP compression)
+// with RGB or Y channels into linear HDRImage, nil opt uses defaults.
+func DecodeEXR(data []byte, opt *EXRDecodeOptions) (*HDRImage, error) {
+	return decodeEXRImage(data, nil, opt)
+}
+
+// DecodeEXRWithAttributes is like DecodeEXR, but also returns all header attributes by name,
+// e.g. to read exposure, owner or timeCode without parsing the header again.
+func DecodeEXRWithAttributes(data []byte, opt *EXRDecodeOptions) (*HDRImage, map[string]EXRAttribute, error) {
+	attrs := make(map[string]EXRAttribute)
+	hdr, err := decodeEXRImage(data, attrs, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, attrs, nil
+}
+
+// DecodeEXRConfig reads dimensions of an OpenEXR image from its header without decoding pixels.
+func DecodeEXRConfig(data []byte) (width, height int, err error) {
+	h, err := readEXRHeader(bytes.NewReader(data), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	return h.width, h.height, nil
+}
+
+func decodeEXR(data []byte) (*HDRImage, error) {
+	return decodeEXRImage(data, nil, nil)
+}
+
+// exrHeader holds header data of a single-part scanline OpenEXR image.
+type exrHeader struct {
+	channels      []exrChannel
+	dataWindow    [4]int32
+	compression   byte
+	width, height int
+}
+
+// readEXRHeader reads OpenEXR header from r, attributes are stored to attrs when it is not nil.
+func readEXRHeader(r *bytes.Reader, attrs map[string]EXRAttribute) (exrHeader, error) {
+	var h exrHeader
 	magic, err := readU32(r)
 	if err != nil {
-		return nil, err
+		return h, err
 	}
 	if magic != exrMagic {
-		return nil, errors.New("not an OpenEXR file")
+		return h, errors.New("not an OpenEXR file")
 	}
 	version, err := readU32(r)
 	if err != nil {
-		return nil, err
+		return h, err
 	}
 	if version&0x00000200 != 0 {
-		return nil, errors.New("tiled OpenEXR not supported")
+		return h, errors.New("tiled OpenEXR not supported")
 	}
 	if version&0x00000800 != 0 {
-		return nil, errors.New("multipart OpenEXR not supported")
+		return h, errors.New("multipart OpenEXR not supported")
 	}
 	if version&0x00000400 != 0 {
-		return nil, errors.New("deep OpenEXR not supported")
+		return h, errors.New("deep OpenEXR not supported")
 	}
 
-	var channels []exrChannel
-	var dataWindow [4]int32
 	var hasDataWindow bool
-	var compression byte = exrCompressionNone
+	h.compression = exrCompressionNone
 
 	for {
 		name, err := readNullString(r)
 		if err != nil {
-			return nil, err
+			return h, err
 		}
 		if name == "" {
 			break
 		}
 		typ, err := readNullString(r)
 		if err != nil {
-			return nil, err
+			return h, err
 		}
 		size, err := readI32(r)
 		if err != nil {
-			return nil, err
+			return h, err
 		}
 		if size < 0 {
-			return nil, errors.New("invalid EXR attribute size")
+			return h, errors.New("invalid EXR attribute size")
+		}
+		if int64(size) > int64(r.Len()) {
+			return h, fmt.Errorf("EXR attribute %q size %d exceeds remaining %d bytes", name, size, r.Len())
 		}
 		payload := make([]byte, size)
 		if _, err := io.ReadFull(r, payload); err != nil {
-			return nil, err
+			return h, err
+		}
+		if attrs != nil {
+			attrs[name] = EXRAttribute{Name: name, Type: typ, Data: payload}
 		}
 
 		switch name {
 		case "channels":
 			if typ != "chlist" {
-				return nil, errors.New("unexpected channels attribute type")
+				return h, errors.New("unexpected channels attribute type")
 			}
 			ch, err := parseEXRChannels(payload)
 			if err != nil {
-				return nil, err
+				return h, err
 			}
-			channels = ch
+			h.channels = ch
 		case "dataWindow":
 			if typ != "box2i" {
-				return nil, errors.New("unexpected dataWindow attribute type")
+				return h, errors.New("unexpected dataWindow attribute type")
 			}
 			if len(payload) != 16 {
-				return nil, errors.New("invalid dataWindow payload")
+				return h, errors.New("invalid dataWindow payload")
 			}
-			dataWindow[0] = int32(binary.LittleEndian.Uint32(payload[0:4]))
-			dataWindow[1] = int32(binary.LittleEndian.Uint32(payload[4:8]))
-			dataWindow[2] = int32(binary.LittleEndian.Uint32(payload[8:12]))
-			dataWindow[3] = int32(binary.LittleEndian.Uint32(payload[12:16]))
+			h.dataWindow[0] = int32(binary.LittleEndian.Uint32(payload[0:4]))
+			h.dataWindow[1] = int32(binary.LittleEndian.Uint32(payload[4:8]))
+			h.dataWindow[2] = int32(binary.LittleEndian.Uint32(payload[8:12]))
+			h.dataWindow[3] = int32(binary.LittleEndian.Uint32(payload[12:16]))
 			hasDataWindow = true
 		case "compression":
 			if typ != "compression" || len(payload) < 1 {
-				return nil, errors.New("invalid compression attribute")
+				return h, errors.New("invalid compression attribute")
 			}
-			compression = payload[0]
+			h.compression = payload[0]
 		case "tiles":
-			return nil, errors.New("tiled OpenEXR not supported")
+			return h, errors.New("tiled OpenEXR not supported")
 		}
 	}
 
-	if len(channels) == 0 {
-		return nil, errors.New("OpenEXR missing channels")
+	if len(h.channels) == 0 {
+		return h, errors.New("OpenEXR missing channels")
 	}
 	if !hasDataWindow {
-		return nil, errors.New("OpenEXR missing dataWindow")
+		return h, errors.New("OpenEXR missing dataWindow")
 	}
-	for _, ch := range channels {
+	for _, ch := range h.channels {
 		if ch.xSampling != 1 || ch.ySampling != 1 {
-			return nil, errors.New("OpenEXR subsampled channels are not supported")
+			return h, errors.New("OpenEXR subsampled channels are not supported")
 		}
 	}
-	if compression != exrCompressionNone && compression != exrCompressionZips && compression != exrCompressionZip {
-		return nil, fmt.Errorf("unsupported OpenEXR compression %d", compression)
+	if h.compression != exrCompressionNone && h.compression != exrCompressionZips && h.compression != exrCompressionZip {
+		return h, fmt.Errorf("unsupported OpenEXR compression %d", h.compression)
 	}
 
-	width := int(dataWindow[2]-dataWindow[0]) + 1
-	height := int(dataWindow[3]-dataWindow[1]) + 1
-	if width <= 0 || height <= 0 {
-		return nil, errors.New("invalid OpenEXR dimensions")
+	h.width = int(h.dataWindow[2]-h.dataWindow[0]) + 1
+	h.height = int(h.dataWindow[3]-h.dataWindow[1]) + 1
+	if h.width <= 0 || h.height <= 0 {
+		return h, errors.New("invalid OpenEXR dimensions")
+	}
+	return h, nil
+}
+
+// decodeEXRImage decodes OpenEXR data, header attributes are stored to attrs when it is not nil.
+func decodeEXRImage(data []byte, attrs map[string]EXRAttribute, opt *EXRDecodeOptions) (*HDRImage, error) {
+	r := bytes.NewReader(data)
+	h, err := readEXRHeader(r, attrs)
+	if err != nil {
+		return nil, err
+	}
+	width, height := h.width, h.height
+	if limit := opt.maxPixels(); limit > 0 && int64(width)*int64(height) > limit {
+		return nil, fmt.Errorf("OpenEXR dimensions %dx%d exceed %d megapixels limit", width, height, limit/1000000)
 	}
 
 	blockLines := 1
-	if compression == exrCompressionZip {
+	if h.compression == exrCompressionZip {
 		blockLines = 16
 	}
 	blockCount := (height + blockLines - 1) / blockLines
+	if int64(blockCount)*8 > int64(r.Len()) {
+		return nil, fmt.Errorf("OpenEXR offset table of %d blocks exceeds remaining %d bytes", blockCount, r.Len())
+	}
 	offsets := make([]uint64, blockCount)
 	for i := range offsets {
 		v, err := readU64(r)
@@ -183,13 +305,19 @@ func decodeEXR(data []byte) (*hdrImage, error) {
 		offsets[i] = v
 	}
 
-	hdr := &hdrImage{
+	hdr := &HDRImage{
 		W:   width,
 		H:   height,
 		Pix: make([]float32, width*height*3),
 	}
+	for _, ch := range h.channels {
+		if ch.role == exrChanA {
+			hdr.Alpha = make([]float32, width*height)
+			break
+		}
+	}
 
-	baseY := int(dataWindow[1])
+	baseY := int(h.dataWindow[1])
 	for block := 0; block < blockCount; block++ {
 		if offsets[block] == 0 {
 			continue
@@ -208,6 +336,9 @@ func decodeEXR(data []byte) (*hdrImage, error) {
 		if dataSize < 0 {
 			return nil, errors.New("invalid OpenEXR block size")
 		}
+		if int64(dataSize) > int64(r.Len()) {
+			return nil, fmt.Errorf("OpenEXR block size %d exceeds remaining %d bytes", dataSize, r.Len())
+		}
 		raw := make([]byte, dataSize)
 		if _, err := io.ReadFull(r, raw); err != nil {
 			return nil, err
@@ -222,18 +353,18 @@ func decodeEXR(data []byte) (*hdrImage, error) {
 			lines = height - startY
 		}
 
-		expected := exrExpectedBlockBytes(width, lines, channels)
-		unpacked, err := exrDecompress(compression, raw, expected)
+		expected := exrExpectedBlockBytes(width, lines, h.channels)
+		unpacked, err := exrDecompress(h.compression, raw, expected)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := exrDecodeBlock(hdr, channels, startY, width, lines, unpacked); err != nil {
+		if err := exrDecodeBlock(hdr, h.channels, startY, width, lines, unpacked); err != nil {
 			return nil, err
 		}
 	}
 
-	if !hasRGBOrY(channels) {
+	if !hasRGBOrY(h.channels) {
 		return nil, errors.New("OpenEXR missing R/G/B or Y channels")
 	}
 	return hdr, nil
@@ -281,6 +412,8 @@ func parseEXRChannels(data []byte) ([]exrChannel, error) {
 			role = exrChanB
 		case "Y":
 			role = exrChanY
+		case "A":
+			role = exrChanA
 		}
 		channels = append(channels, exrChannel{
 			name:      name,
@@ -321,7 +454,12 @@ func exrDecompress(compression byte, data []byte, expected int) ([]byte, error)
 			return nil, err
 		}
 		defer zr.Close()
-		uncompressed, err := io.ReadAll(zr)
+		// One byte over expected size is enough to detect mismatch, larger output is not inflated.
+		var src io.Reader = zr
+		if expected > 0 {
+			src = io.LimitReader(zr, int64(expected)+1)
+		}
+		uncompressed, err := io.ReadAll(src)
 		if err != nil {
 			return nil, err
 		}
@@ -354,7 +492,7 @@ func unshuffleBytes(data []byte) []byte {
 	return out
 }
 
-func exrDecodeBlock(dst *hdrImage, channels []exrChannel, startY, width, lines int, data []byte) error {
+func exrDecodeBlock(dst *HDRImage, channels []exrChannel, startY, width, lines int, data []byte) error {
 	offset := 0
 	for row := 0; row < lines; row++ {
 		y := startY + row
@@ -376,7 +514,7 @@ func exrDecodeBlock(dst *hdrImage, channels []exrChannel, startY, width, lines i
 			offset += lineBytes
 
 			switch ch.role {
-			case exrChanR, exrChanG, exrChanB, exrChanY:
+			case exrChanR, exrChanG, exrChanB, exrChanY, exrChanA:
 				if err := exrApplyLine(dst, ch.role, y, width, ch.pixelType, line); err != nil {
 					return err
 				}
@@ -388,13 +526,17 @@ func exrDecodeBlock(dst *hdrImage, channels []exrChannel, startY, width, lines i
 	return nil
 }
 
-func exrApplyLine(dst *hdrImage, role int, y, width int, pixelType int32, line []byte) error {
+func exrApplyLine(dst *HDRImage, role int, y, width int, pixelType int32, line []byte) error {
+	var half *[1 << 16]float32
+	if pixelType == exrPixelHalf {
+		half = halfFloatTable()
+	}
 	for x := 0; x < width; x++ {
 		var v float32
 		switch pixelType {
 		case exrPixelHalf:
 			off := x * 2
-			v = halfToFloat32(binary.LittleEndian.Uint16(line[off : off+2]))
+			v = half[binary.LittleEndian.Uint16(line[off:off+2])]
 		case exrPixelFloat:
 			off := x * 4
 			v = math.Float32frombits(binary.LittleEndian.Uint32(line[off : off+4]))
@@ -406,6 +548,8 @@ func exrApplyLine(dst *hdrImage, role int, y, width int, pixelType int32, line [
 		}
 		idx := (y*dst.W + x) * 3
 		switch role {
+		case exrChanA:
+			dst.Alpha[y*dst.W+x] = v
 		case exrChanR:
 			dst.Pix[idx] = v
 		case exrChanG:
@@ -466,7 +610,18 @@ func readI32(r *bytes.Reader) (int32, error) {
 	return int32(v), err
 }
 
-func halfToFloat32(h uint16) float32 {
+// halfFloatTable maps all half-float bit patterns to float32, it is built on first EXR decode.
+var halfFloatTable = sync.OnceValue(func() *[1 << 16]float32 {
+	var t [1 << 16]float32
+	for i := range t {
+		t[i] = HalfToFloat32(uint16(i))
+	}
+	return &t
+})
+
+// HalfToFloat32 converts IEEE 754 half-float bits to float32, exactly.
+// Subnormals are normalized, infinities and NaN (with payload) are preserved.
+func HalfToFloat32(h uint16) float32 {
 	sign := uint32(h>>15) & 0x1
 	exp := int32(h>>10) & 0x1F
 	mant := int32(h & 0x03FF)
@@ -494,3 +649,49 @@ func halfToFloat32(h uint16) float32 {
 	bits := (sign << 31) | (uint32(exp) << 23) | uint32(mant)
 	return math.Float32frombits(bits)
 }
+
+// Float32ToHalf converts float32 to IEEE 754 half-float bits, rounding to nearest even.
+// Values beyond half range become infinity, values below half of the smallest subnormal become zero,
+// NaN stays NaN with the upper payload bits.
+func Float32ToHalf(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int32(bits>>23) & 0xFF
+	mant := bits & 0x7FFFFF
+
+	if exp == 0xFF {
+		if mant == 0 {
+			return sign | 0x7C00
+		}
+		m := uint16(mant >> 13)
+		if m == 0 {
+			m = 0x0200
+		}
+		return sign | 0x7C00 | m
+	}
+
+	e := exp - 127 + 15
+	if e >= 31 {
+		return sign | 0x7C00
+	}
+	if e <= 0 {
+		// Subnormal half, shift the significand with implicit bit to units of 2^-24.
+		shift := uint32(14 - e)
+		if shift > 24 {
+			return sign
+		}
+		m := mant | 0x800000
+		r := m >> shift
+		rem, halfway := m&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > halfway || rem == halfway && r&1 == 1 {
+			r++ // May carry into the smallest normal.
+		}
+		return sign | uint16(r)
+	}
+
+	r := uint32(e)<<10 | mant>>13
+	if rem := mant & 0x1FFF; rem > 0x1000 || rem == 0x1000 && r&1 == 1 {
+		r++ // May carry into exponent, up to infinity.
+	}
+	return sign | uint16(r)
+}
@@ -1,6 +1,16 @@
 package ultrahdr
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
 
 func TestRebaseFromEXRFile(t *testing.T) {
 	if err := RebaseFromEXRFile("testdata/BrightRings.jpg", "testdata/BrightRings.exr",
@@ -8,3 +18,374 @@ func TestRebaseFromEXRFile(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// buildTestEXR encodes an uncompressed scanline OpenEXR with float channels,
+// planes are keyed by channel name and hold w*h values.
+func buildTestEXR(w, h int, names []string, planes map[string][]float32) []byte {
+	var buf bytes.Buffer
+	le := func(v any) { _ = binary.Write(&buf, binary.LittleEndian, v) }
+	attr := func(name, typ string, payload []byte) {
+		buf.WriteString(name + "\x00" + typ + "\x00")
+		le(int32(len(payload)))
+		buf.Write(payload)
+	}
+	var chlist bytes.Buffer
+	for _, n := range names {
+		chlist.WriteString(n + "\x00")
+		_ = binary.Write(&chlist, binary.LittleEndian, []int32{exrPixelFloat, 0, 1, 1})
+	}
+	chlist.WriteByte(0)
+	window := make([]byte, 16)
+	binary.LittleEndian.PutUint32(window[8:], uint32(w-1))
+	binary.LittleEndian.PutUint32(window[12:], uint32(h-1))
+
+	le(uint32(exrMagic))
+	le(uint32(2))
+	attr("channels", "chlist", chlist.Bytes())
+	attr("compression", "compression", []byte{exrCompressionNone})
+	attr("dataWindow", "box2i", window)
+	buf.WriteByte(0)
+
+	blockSize := 8 + w*len(names)*4
+	first := buf.Len() + h*8
+	for y := range h {
+		le(uint64(first + y*blockSize))
+	}
+	for y := range h {
+		le(int32(y))
+		le(int32(w * len(names) * 4))
+		for _, n := range names {
+			le(planes[n][y*w : (y+1)*w])
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeEXRAlpha(t *testing.T) {
+	// Left pixel is opaque white, right one is half transparent premultiplied red.
+	data := buildTestEXR(2, 1, []string{"A", "B", "G", "R"}, map[string][]float32{
+		"A": {1, 0.5},
+		"B": {1, 0},
+		"G": {1, 0},
+		"R": {1, 0.5},
+	})
+	hdr, err := decodeEXR(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(hdr.Alpha) != 2 || hdr.Alpha[0] != 1 || hdr.Alpha[1] != 0.5 {
+		t.Fatalf("unexpected alpha: %v", hdr.Alpha)
+	}
+
+	flat := hdr.Flatten(color.White)
+	if flat.Alpha != nil {
+		t.Fatalf("flattened image has alpha")
+	}
+	if got := flat.at(0, 0); got != (rgb{1, 1, 1}) {
+		t.Fatalf("opaque pixel changed: %v", got)
+	}
+	if got := flat.at(1, 0); got != (rgb{1, 0.5, 0.5}) {
+		t.Fatalf("unexpected flattened pixel: %v", got)
+	}
+	if got := hdr.Flatten(nil).at(1, 0); got != (rgb{0.5, 0, 0}) {
+		t.Fatalf("unexpected pixel over black: %v", got)
+	}
+
+	noAlpha, err := decodeEXR(buildTestEXR(1, 1, []string{"Y"}, map[string][]float32{"Y": {2}}))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if noAlpha.Alpha != nil || noAlpha.Flatten(color.White) != noAlpha {
+		t.Fatalf("opaque image must be kept as is")
+	}
+}
+
+func TestRebaseFromEXRAlphaBackground(t *testing.T) {
+	const w, h = 16, 16
+	planes := map[string][]float32{}
+	for _, n := range []string{"A", "B", "G", "R"} {
+		planes[n] = make([]float32, w*h)
+	}
+	// Transparent left half, opaque right half 4x brighter in HDR.
+	sdr := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := w / 2; x < w; x++ {
+			i := y*w + x
+			planes["A"][i] = 1
+			planes["R"][i], planes["G"][i], planes["B"][i] = 0.8, 0.8, 0.8
+			sdr.SetNRGBA(x, y, color.NRGBA{R: 124, G: 124, B: 124, A: 0xFF})
+		}
+	}
+	exr := buildTestEXR(w, h, []string{"A", "B", "G", "R"}, planes)
+	hdr, err := decodeEXR(exr)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	res, err := RebaseFromHDR(sdr, hdr, WithBackground(color.White))
+	if err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	primary, _, err := image.Decode(bytes.NewReader(res.Primary))
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	if r, _, _, _ := primary.At(1, 1).RGBA(); r>>8 < 240 {
+		t.Fatalf("transparent SDR not flattened over white: %d", r>>8)
+	}
+	gainmap, _, err := image.Decode(bytes.NewReader(res.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap: %v", err)
+	}
+	// Background matches in SDR and HDR, so transparent area gets no boost.
+	left := color.GrayModel.Convert(gainmap.At(1, 1)).(color.Gray).Y
+	right := color.GrayModel.Convert(gainmap.At(w-2, 1)).(color.Gray).Y
+	if left >= right {
+		t.Fatalf("background boosted: left %d right %d", left, right)
+	}
+}
+
+func TestHalfToFloat32(t *testing.T) {
+	half := halfFloatTable()
+	for i := range 1 << 16 {
+		h := uint16(i)
+		sign, exp, mant := h>>15, int(h>>10&0x1F), float64(h&0x3FF)
+		var want float64
+		switch exp {
+		case 0:
+			want = mant * math.Exp2(-24)
+		case 31:
+			want = math.Inf(1)
+			if mant != 0 {
+				want = math.NaN()
+			}
+		default:
+			want = (1 + mant/1024) * math.Exp2(float64(exp-15))
+		}
+		if sign == 1 {
+			want = -want
+		}
+		got := half[h]
+		if math.IsNaN(want) {
+			// NaN payload and sign are preserved.
+			if bits := math.Float32bits(got); !math.IsNaN(float64(got)) || bits>>31 != uint32(sign) || bits&0x7FFFFF != uint32(mant)<<13 {
+				t.Fatalf("%#04x: got %#08x, want NaN", h, bits)
+			}
+			continue
+		}
+		if math.Float32bits(got) != math.Float32bits(float32(want)) {
+			t.Fatalf("%#04x: got %v, want %v", h, got, want)
+		}
+	}
+}
+
+func TestFloat32ToHalf(t *testing.T) {
+	// All half values round-trip, including subnormals, infinities and NaN payloads.
+	for i := range 1 << 16 {
+		h := uint16(i)
+		if got := Float32ToHalf(HalfToFloat32(h)); got != h {
+			t.Fatalf("%#04x: round trip gives %#04x", h, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		f    float32
+		want uint16
+	}{
+		{f: 0, want: 0x0000},
+		{f: float32(math.Copysign(0, -1)), want: 0x8000},
+		{f: 1, want: 0x3C00},
+		{f: -2, want: 0xC000},
+		{f: 0.1, want: 0x2E66},
+		{f: 65504, want: 0x7BFF},
+		{f: 65519, want: 0x7BFF},
+		{f: 65520, want: 0x7C00}, // Halfway to 65536 rounds to even, which is infinity.
+		{f: math.MaxFloat32, want: 0x7C00},
+		{f: float32(math.Inf(-1)), want: 0xFC00},
+		{f: 1 + 1.0/2048, want: 0x3C00},   // Halfway, rounds to even.
+		{f: 1 + 3.0/2048, want: 0x3C02},   // Halfway, rounds to even.
+		{f: 0x1p-14, want: 0x0400},        // Smallest normal.
+		{f: 0x1p-24, want: 0x0001},        // Smallest subnormal.
+		{f: 0x1.8p-24, want: 0x0002},      // Halfway between subnormals, rounds to even.
+		{f: 0x1p-25, want: 0x0000},        // Halfway to smallest subnormal, rounds to even zero.
+		{f: 0x1.000002p-25, want: 0x0001}, // Just above halfway.
+		{f: -0x1.ffcp-15, want: 0x8400},   // Halfway above largest subnormal carries into smallest normal.
+		{f: math.SmallestNonzeroFloat32, want: 0x0000},
+	} {
+		if got := Float32ToHalf(tc.f); got != tc.want {
+			t.Fatalf("%v: got %#04x, want %#04x", tc.f, got, tc.want)
+		}
+	}
+
+	// NaN with payload only in low bits stays NaN.
+	if h := Float32ToHalf(math.Float32frombits(0x7F800001)); h&0x7C00 != 0x7C00 || h&0x03FF == 0 {
+		t.Fatalf("NaN converted to %#04x", h)
+	}
+	if !math.IsNaN(float64(HalfToFloat32(Float32ToHalf(float32(math.NaN()))))) {
+		t.Fatalf("NaN round trip failed")
+	}
+}
+
+func BenchmarkHalfToFloat32(b *testing.B) {
+	// Pseudo-random half values, including subnormals that need normalization.
+	src := make([]uint16, 4096)
+	for i := range src {
+		src[i] = uint16(i * 40503)
+	}
+	dst := make([]float32, len(src))
+	b.Run("bits", func(b *testing.B) {
+		b.SetBytes(int64(len(src) * 2))
+		for i := 0; i < b.N; i++ {
+			for j, h := range src {
+				dst[j] = HalfToFloat32(h)
+			}
+		}
+	})
+	b.Run("table", func(b *testing.B) {
+		b.SetBytes(int64(len(src) * 2))
+		half := halfFloatTable()
+		for i := 0; i < b.N; i++ {
+			for j, h := range src {
+				dst[j] = half[h]
+			}
+		}
+	})
+}
+
+func TestDecodeEXRAllocationLimits(t *testing.T) {
+	header := func(attrs ...[]byte) []byte {
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.LittleEndian, []uint32{exrMagic, 2})
+		for _, a := range attrs {
+			buf.Write(a)
+		}
+		return buf.Bytes()
+	}
+	attr := func(name, typ string, size int32, payload []byte) []byte {
+		var buf bytes.Buffer
+		buf.WriteString(name + "\x00" + typ + "\x00")
+		_ = binary.Write(&buf, binary.LittleEndian, size)
+		buf.Write(payload)
+		return buf.Bytes()
+	}
+	var chlist bytes.Buffer
+	chlist.WriteString("R\x00")
+	_ = binary.Write(&chlist, binary.LittleEndian, []int32{exrPixelFloat, 0, 1, 1})
+	chlist.WriteByte(0)
+	channels := attr("channels", "chlist", int32(chlist.Len()), chlist.Bytes())
+	window := func(w, h int) []byte {
+		p := make([]byte, 16)
+		binary.LittleEndian.PutUint32(p[8:], uint32(w-1))
+		binary.LittleEndian.PutUint32(p[12:], uint32(h-1))
+		return attr("dataWindow", "box2i", 16, p)
+	}
+
+	// Scanline blocks (y, data size, 2 pixels of RGB floats) end the file, data size of the first one is patched.
+	hugeBlock := buildTestEXR(2, 2, []string{"R", "G", "B"}, map[string][]float32{
+		"R": make([]float32, 4), "G": make([]float32, 4), "B": make([]float32, 4),
+	})
+	first := len(hugeBlock) - 2*(8+2*3*4)
+	binary.LittleEndian.PutUint32(hugeBlock[first+4:], 2_000_000_000)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "attribute size", data: header(attr("channels", "chlist", 2_000_000_000, nil)), want: "exceeds remaining"},
+		{name: "offset table", data: header(channels, window(1, 100_000_000), []byte{0}), want: "offset table of 100000000 blocks"},
+		{name: "block size", data: hugeBlock, want: "block size 2000000000 exceeds remaining"},
+		{name: "megapixels", data: header(channels, window(20000, 20000), []byte{0}), want: "exceed 256 megapixels limit"},
+	} {
+		var err error
+		checkAllocBound(t, len(tc.data), func() { _, err = decodeEXR(tc.data) })
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error with %q, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	huge := header(channels, window(20000, 20000), []byte{0})
+	if _, err := DecodeEXR(huge, &EXRDecodeOptions{MaxMegapixels: 100}); err == nil || !strings.Contains(err.Error(), "exceed 100 megapixels limit") {
+		t.Fatalf("expected custom megapixels limit error, got %v", err)
+	}
+	if _, err := DecodeEXR(huge, &EXRDecodeOptions{MaxMegapixels: -1}); err == nil || !strings.Contains(err.Error(), "offset table") {
+		t.Fatalf("expected offset table error without megapixels limit, got %v", err)
+	}
+	sdr, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sdr: %v", err)
+	}
+	if _, err := RebaseFromEXR(sdr, huge, WithEXRDecodeOptions(EXRDecodeOptions{MaxMegapixels: 100})); err == nil || !strings.Contains(err.Error(), "exceed 100 megapixels limit") {
+		t.Fatalf("expected rebase megapixels limit error, got %v", err)
+	}
+}
+
+func FuzzDecodeEXR(f *testing.F) {
+	f.Add(buildTestEXR(2, 2, []string{"A", "B", "G", "R"}, map[string][]float32{
+		"A": {1, 1, 0.5, 0}, "B": {1, 2, 3, 4}, "G": {1, 2, 3, 4}, "R": {1, 2, 3, 4},
+	}))
+	if data, err := os.ReadFile("testdata/BrightRings.exr"); err == nil {
+		f.Add(data)
+	}
+
+	// Pixel data is bounded by the megapixels limit, everything else by input size.
+	opt := &EXRDecodeOptions{MaxMegapixels: 1}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAllocBound(t, len(data)+(32<<20)/64, func() { _, _ = DecodeEXR(data, opt) })
+	})
+}
+
+func TestDecodeEXRConfig(t *testing.T) {
+	data := buildTestEXR(3, 2, []string{"Y"}, map[string][]float32{"Y": make([]float32, 6)})
+	w, h, err := DecodeEXRConfig(data)
+	if err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	if w != 3 || h != 2 {
+		t.Fatalf("unexpected dimensions: %dx%d", w, h)
+	}
+	// Header is enough, pixel data is not read.
+	if _, _, err := DecodeEXRConfig(data[:len(data)-4]); err != nil {
+		t.Fatalf("decode config of truncated data: %v", err)
+	}
+	if _, _, err := DecodeEXRConfig([]byte("not exr")); err == nil {
+		t.Fatalf("expected error for non-EXR data")
+	}
+}
+
+func TestDecodeEXRWithAttributes(t *testing.T) {
+	data, err := os.ReadFile("testdata/BrightRings.exr")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	hdr, attrs, err := DecodeEXRWithAttributes(data, nil)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	plain, err := DecodeEXR(data, nil)
+	if err != nil {
+		t.Fatalf("decode without attributes: %v", err)
+	}
+	if hdr.W != plain.W || hdr.H != plain.H || !slices.Equal(hdr.Pix, plain.Pix) {
+		t.Fatalf("decoded images differ")
+	}
+	for name, typ := range map[string]string{
+		"channels":         "chlist",
+		"compression":      "compression",
+		"dataWindow":       "box2i",
+		"displayWindow":    "box2i",
+		"lineOrder":        "lineOrder",
+		"pixelAspectRatio": "float",
+	} {
+		if a := attrs[name]; a.Name != name || a.Type != typ || len(a.Data) == 0 {
+			t.Fatalf("attribute %s: %+v", name, a)
+		}
+	}
+	if v := math.Float32frombits(binary.LittleEndian.Uint32(attrs["pixelAspectRatio"].Data)); v != 1 {
+		t.Fatalf("pixel aspect ratio %v", v)
+	}
+
+	if _, _, err := DecodeEXRWithAttributes(data[:100], nil); err == nil {
+		t.Fatalf("expected error for truncated input")
+	}
+}
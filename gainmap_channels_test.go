@@ -0,0 +1,493 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func asymmetricGammaMeta() *GainMapMetadata {
+	return &GainMapMetadata{
+		Version:         jpegrVersion,
+		MinContentBoost: [3]float32{1, 1, 1},
+		MaxContentBoost: [3]float32{4, 4, 4},
+		Gamma:           [3]float32{1, 2, 0.5},
+		OffsetSDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		OffsetHDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		HDRCapacityMin:  1,
+		HDRCapacityMax:  4,
+		UseBaseCG:       true,
+	}
+}
+
+func TestApplyGainmapPerChannelGamma(t *testing.T) {
+	meta := asymmetricGammaMeta()
+	sdr := rgb{r: 0.5, g: 0.5, b: 0.5}
+
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	gray.SetGray(0, 0, color.Gray{Y: 128})
+	rgba := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	rgba.SetRGBA(0, 0, color.RGBA{R: 128, G: 128, B: 128, A: 0xff})
+
+	want := [3]float32{}
+	for i := range want {
+		gv := math.Pow(128.0/255, 1/float64(meta.Gamma[i]))
+		want[i] = (0.5+meta.OffsetSDR[i])*float32(math.Pow(4, gv)) - meta.OffsetHDR[i]
+	}
+
+	for _, tc := range []struct {
+		name   string
+		img    image.Image
+		isGray bool
+	}{
+		{name: "gray", img: gray, isGray: true},
+		{name: "rgb", img: rgba, isGray: false},
+	} {
+		got := applyGainmapToSDR(sdr, tc.img, newGainDecoder(meta), 0, 0, tc.isGray)
+		for i, v := range [3]float32{got.r, got.g, got.b} {
+			if math.Abs(float64(v-want[i])) > 1e-4 {
+				t.Fatalf("%s channel %d: got %v want %v", tc.name, i, v, want[i])
+			}
+		}
+	}
+}
+
+func TestPerChannelMetadataRoundTrip(t *testing.T) {
+	meta := asymmetricGammaMeta()
+	meta.MaxContentBoost = [3]float32{4, 2, 8}
+	meta.OffsetSDR[2] = 0.03125
+
+	parsed, err := parseXMP(buildGainmapXMP(meta))
+	if err != nil {
+		t.Fatalf("parse xmp: %v", err)
+	}
+	iso, err := buildIsoPayload(meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+	decoded, err := decodeGainmapMetadataISO(iso[len(isoPrefix):])
+	if err != nil {
+		t.Fatalf("decode iso: %v", err)
+	}
+
+	for name, got := range map[string]*GainMapMetadata{"xmp": parsed, "iso": decoded} {
+		for i := 0; i < 3; i++ {
+			if math.Abs(float64(got.Gamma[i]-meta.Gamma[i])) > 1e-3 {
+				t.Fatalf("%s gamma[%d]: got %v want %v", name, i, got.Gamma[i], meta.Gamma[i])
+			}
+			if math.Abs(float64(got.MaxContentBoost[i]-meta.MaxContentBoost[i])) > 1e-3 {
+				t.Fatalf("%s max boost[%d]: got %v want %v", name, i, got.MaxContentBoost[i], meta.MaxContentBoost[i])
+			}
+			if math.Abs(float64(got.OffsetSDR[i]-meta.OffsetSDR[i])) > 1e-5 {
+				t.Fatalf("%s offset sdr[%d]: got %v want %v", name, i, got.OffsetSDR[i], meta.OffsetSDR[i])
+			}
+		}
+	}
+}
+
+func TestSingleChannelISOMetadata(t *testing.T) {
+	meta := asymmetricGammaMeta()
+	meta.Gamma = [3]float32{2, 2, 2}
+
+	iso, err := buildIsoPayload(meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+	decoded, err := decodeGainmapMetadataISO(iso[len(isoPrefix):])
+	if err != nil {
+		t.Fatalf("decode iso: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if decoded.Gamma[i] != 2 || decoded.MaxContentBoost[i] != 4 || decoded.OffsetSDR[i] != meta.OffsetSDR[i] {
+			t.Fatalf("channel %d not replicated: %+v", i, decoded)
+		}
+	}
+}
+
+func TestGainmapDither(t *testing.T) {
+	// Gain that maps to 8-bit level 100.25, block average must keep the fraction with dither.
+	minLog, maxLog := float32(0), float32(2)
+	gain := minLog + (maxLog-minLog)*100.25/255
+	var plain, dithered float64
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			plain += float64(affineMapGain(gain, minLog, maxLog, 1, quantizeBias(x, y, false)))
+			dithered += float64(affineMapGain(gain, minLog, maxLog, 1, quantizeBias(x, y, true)))
+		}
+	}
+	if plain/16 != 100 {
+		t.Fatalf("unexpected rounding without dither: %v", plain/16)
+	}
+	if math.Abs(dithered/16-100.25) > 0.01 {
+		t.Fatalf("dithered block average %v, want 100.25", dithered/16)
+	}
+
+	hdr := &HDRImage{W: 64, H: 64, Pix: make([]float32, 64*64*3)}
+	sdr := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			sdr.SetGray(x, y, color.Gray{Y: 128})
+			v := 1 + 3*float32(x)/63
+			hdr.set(x, y, rgb{r: v * 0.2158, g: v * 0.2158, b: v * 0.2158})
+		}
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	a, _, err := generateGainmapFromHDR(sdr, profile, hdr, &RebaseOptions{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	b, _, err := generateGainmapFromHDR(sdr, profile, hdr, &RebaseOptions{DitherGainmap: true})
+	if err != nil {
+		t.Fatalf("generate dithered: %v", err)
+	}
+	diff := 0
+	for i, v := range a.(*image.Gray).Pix {
+		d := int(v) - int(b.(*image.Gray).Pix[i])
+		if d > 1 || d < -1 {
+			t.Fatalf("dithered value differs by %d at %d", d, i)
+		}
+		if d != 0 {
+			diff++
+		}
+	}
+	if diff == 0 {
+		t.Fatalf("dithering had no effect")
+	}
+}
+
+func TestGenerateGainmapAutoGamma(t *testing.T) {
+	// Gains are crowded at the low end of the range, log2 gain is 4*(x/63)^3.
+	const w, h = 64, 4
+	sdr := image.NewGray(image.Rect(0, 0, w, h))
+	hdr := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sdr.SetGray(x, y, color.Gray{Y: 128})
+			f := float64(x) / (w - 1)
+			v := srgbInvOetf(128.0/255) * float32(math.Exp2(4*f*f*f))
+			hdr.set(x, y, rgb{r: v, g: v, b: v})
+		}
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+
+	_, meta, err := generateGainmapFromHDR(sdr, profile, hdr, &RebaseOptions{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if meta.Gamma[0] != 1 {
+		t.Fatalf("default gamma %v, want 1", meta.Gamma[0])
+	}
+
+	for _, multi := range []bool{false, true} {
+		gm, meta, err := generateGainmapFromHDR(sdr, profile, hdr, &RebaseOptions{GainmapGamma: 2, AutoGainmapGamma: true, UseMultiChannel: multi})
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		if g := meta.Gamma[0]; g < 0.25 || g > 0.5 || meta.Gamma[1] != g || meta.Gamma[2] != g {
+			t.Fatalf("multichannel %v: auto gamma %v", multi, meta.Gamma)
+		}
+		// Median gain (middle column) is encoded close to mid-range.
+		r, _, _, _ := gm.At(w/2, 0).RGBA()
+		if v := r >> 8; v < 112 || v > 144 {
+			t.Fatalf("multichannel %v: median gain encoded as %d", multi, v)
+		}
+	}
+}
+
+func TestGenerateGainmapDownscale(t *testing.T) {
+	// Checkerboard of 1x and 4x boosts averages to log2 gain of 1 (2x boost).
+	const w, h = 16, 12
+	sdr := image.NewGray(image.Rect(0, 0, w, h))
+	hdr := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sdr.SetGray(x, y, color.Gray{Y: 128})
+			v := srgbInvOetf(128.0 / 255)
+			if (x+y)%2 == 1 {
+				v *= 4
+			}
+			hdr.set(x, y, rgb{r: v, g: v, b: v})
+		}
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	boost := func(opt *RebaseOptions) float32 {
+		t.Helper()
+		gm, meta, err := generateGainmapFromHDR(sdr, profile, hdr, opt)
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		if b := gm.Bounds(); b.Dx() != w/2 || b.Dy() != h/2 {
+			t.Fatalf("unexpected gainmap size %v", b)
+		}
+		return meta.MinContentBoost[0]
+	}
+
+	for _, opt := range []*RebaseOptions{{GainmapScale: 2}, applyRebaseOptions([]RebaseOption{WithGainmapScale(2), WithGainmapDownscale(InterpolationBox)})} {
+		if got := boost(opt); math.Abs(float64(got)-2) > 1e-3 {
+			t.Fatalf("downscale %v: min boost %v, want 2", opt.GainmapDownscale, got)
+		}
+	}
+
+	// Nearest is the zero Interpolation, but still selects point sampling per call.
+	nearest := InterpolationNearest
+	if got := boost(&RebaseOptions{GainmapScale: 2, GainmapDownscale: &nearest}); math.Abs(float64(got)-1) > 1e-3 {
+		t.Fatalf("point sampling: min boost %v, want 1", got)
+	}
+}
+
+func TestGenerateGainmapHDRGamut(t *testing.T) {
+	const w, h = 32, 16
+	sdr := image.NewRGBA(image.Rect(0, 0, w, h))
+	srgbHDR := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+	wideHDR := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3), Gamut: ColorGamutBT2020}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: uint8(255 - 4*x), G: uint8(64 + 8*y), B: uint8(48 + 4*x), A: 255}
+			sdr.SetRGBA(x, y, c)
+			boost := 1 + 3*float32(x)/(w-1)
+			v := rgb{r: boost * srgbInvOetf(float32(c.R)/255), g: boost * srgbInvOetf(float32(c.G)/255), b: boost * srgbInvOetf(float32(c.B)/255)}
+			srgbHDR.set(x, y, v)
+			wideHDR.set(x, y, convertLinearGamut(v, ColorGamutSRGB, ColorGamutBT2020))
+		}
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	for _, multi := range []bool{false, true} {
+		opt := &RebaseOptions{GainmapScale: 1, UseMultiChannel: multi}
+		want, wantMeta, err := generateGainmapFromHDR(sdr, profile, srgbHDR, opt)
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		got, gotMeta, err := generateGainmapFromHDR(sdr, profile, wideHDR, opt)
+		if err != nil {
+			t.Fatalf("generate from Rec.2020: %v", err)
+		}
+		for c := 0; c < 3; c++ {
+			if math.Abs(float64(gotMeta.MaxContentBoost[c]/wantMeta.MaxContentBoost[c]-1)) > 1e-3 ||
+				math.Abs(float64(gotMeta.MinContentBoost[c]/wantMeta.MinContentBoost[c]-1)) > 1e-3 {
+				t.Fatalf("multi %v: boost range of channel %d differs: %v..%v vs %v..%v", multi, c,
+					gotMeta.MinContentBoost[c], gotMeta.MaxContentBoost[c], wantMeta.MinContentBoost[c], wantMeta.MaxContentBoost[c])
+			}
+		}
+		b := want.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r1, g1, b1, _ := want.At(x, y).RGBA()
+				r2, g2, b2, _ := got.At(x, y).RGBA()
+				for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+					if d > 1 || d < -1 {
+						t.Fatalf("multi %v: gainmap differs by %d at %d,%d", multi, d, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGainmapICCGamut(t *testing.T) {
+	p3, err := os.ReadFile("testdata/sample_display_p3.jpg")
+	if err != nil {
+		t.Fatalf("read p3 sample: %v", err)
+	}
+	_, icc, err := extractExifAndIcc(p3)
+	if err != nil || len(icc) == 0 {
+		t.Fatalf("extract icc: %v", err)
+	}
+
+	gm := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < len(gm.Pix); i += 4 {
+		copy(gm.Pix[i:], []byte{255, 0, 0, 255}) // Boost red only.
+	}
+	gainmapJPEG, err := encodeWithQuality(gm, 100)
+	if err != nil {
+		t.Fatalf("encode gainmap: %v", err)
+	}
+	meta := asymmetricGammaMeta()
+	meta.Gamma = [3]float32{1, 1, 1}
+	meta.UseBaseCG = false
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	if g := gainApplicationGamut(meta, profile, gainmapJPEG); g != ColorGamutSRGB {
+		t.Fatalf("gainmap without ICC: got gamut %v", g)
+	}
+	segs := make([]appSegment, 0, len(icc))
+	for _, seg := range icc {
+		segs = append(segs, appSegment{marker: markerAPP2, payload: seg})
+	}
+	gainmapJPEG, err = insertAppSegments(gainmapJPEG, segs)
+	if err != nil {
+		t.Fatalf("insert icc: %v", err)
+	}
+	if g := gainApplicationGamut(meta, profile, gainmapJPEG); g != ColorGamutDisplayP3 {
+		t.Fatalf("gainmap with P3 ICC: got gamut %v", g)
+	}
+	// Base color space ignores alternate gamut of the gainmap.
+	base := *meta
+	base.UseBaseCG = true
+	if g := gainApplicationGamut(&base, profile, gainmapJPEG); g != ColorGamutSRGB {
+		t.Fatalf("base color space with P3 gainmap ICC: got gamut %v", g)
+	}
+	if g := gainApplicationGamut(&base, colorProfile{gamut: ColorGamutAdobeRGB, transfer: ColorTransferGamma22}, gainmapJPEG); g != ColorGamutAdobeRGB {
+		t.Fatalf("base color space of Adobe RGB base: got gamut %v", g)
+	}
+
+	sdr := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < len(sdr.Pix); i += 4 {
+		copy(sdr.Pix[i:], []byte{200, 120, 60, 255})
+	}
+	linear := sampleSDRInProfile(sdr, 0, 0, profile, ColorGamutDisplayP3, false)
+	want := convertLinearGamut(applyGainmapToSDR(linear, gm, newGainDecoder(meta), 0, 0, false), ColorGamutDisplayP3, ColorGamutSRGB)
+
+	hdr, err := reconstructHDR(sdr, profile, gm, ColorGamutDisplayP3, meta, 1, false)
+	if err != nil {
+		t.Fatalf("reconstruct: %v", err)
+	}
+	srgb, err := reconstructHDR(sdr, profile, gm, ColorGamutSRGB, meta, 1, false)
+	if err != nil {
+		t.Fatalf("reconstruct srgb: %v", err)
+	}
+	got := hdr.at(0, 0)
+	for i, v := range [3]float32{got.r, got.g, got.b} {
+		w := [3]float32{want.r, want.g, want.b}[i]
+		if math.Abs(float64(v-w)) > 1e-4 {
+			t.Fatalf("channel %d: got %v want %v", i, v, w)
+		}
+	}
+	if s := srgb.at(0, 0); math.Abs(float64(s.g-got.g)) < 1e-3 {
+		t.Fatalf("expected P3 gains to affect green in sRGB, got %v and %v", s, got)
+	}
+}
+
+func TestDecodeUseBaseCG(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	p3, err := os.ReadFile("testdata/sample_display_p3.jpg")
+	if err != nil {
+		t.Fatalf("read p3 sample: %v", err)
+	}
+	_, icc, err := extractExifAndIcc(p3)
+	if err != nil || len(icc) == 0 {
+		t.Fatalf("extract icc: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmapJPEG, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	segs := make([]appSegment, 0, len(icc))
+	for _, seg := range icc {
+		segs = append(segs, appSegment{marker: markerAPP2, payload: seg})
+	}
+	// Gainmap ICC declares Display P3 alternate color space.
+	if gainmapJPEG, err = insertAppSegments(gainmapJPEG, segs); err != nil {
+		t.Fatalf("insert icc: %v", err)
+	}
+	sdr, _, err := image.Decode(bytes.NewReader(primary))
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	gainmap, _, err := image.Decode(bytes.NewReader(gainmapJPEG))
+	if err != nil {
+		t.Fatalf("decode gainmap: %v", err)
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+
+	var decoded [2]*HDRImage
+	for i, useBase := range []bool{true, false} {
+		meta := *sr.Meta
+		meta.UseBaseCG = useBase
+		iso, err := buildIsoPayload(&meta)
+		if err != nil {
+			t.Fatalf("build iso: %v", err)
+		}
+		container, err := assembleContainerWithSegments(primary, gainmapJPEG, &MetadataSegments{SecondaryISO: iso})
+		if err != nil {
+			t.Fatalf("assemble: %v", err)
+		}
+		hdr, _, got, err := Decode(container, nil)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if got.UseBaseCG != useBase {
+			t.Fatalf("UseBaseCG not preserved: %v", got.UseBaseCG)
+		}
+		gamut := ColorGamutSRGB
+		if !useBase {
+			gamut = ColorGamutDisplayP3
+		}
+		want, err := reconstructHDR(sdr, profile, gainmap, gamut, got, 1, false)
+		if err != nil {
+			t.Fatalf("reconstruct: %v", err)
+		}
+		if !reflect.DeepEqual(hdr.Pix, want.Pix) {
+			t.Fatalf("UseBaseCG %v: gains not applied in %v", useBase, gamut)
+		}
+		decoded[i] = hdr
+	}
+	if reflect.DeepEqual(decoded[0].Pix, decoded[1].Pix) {
+		t.Fatalf("UseBaseCG has no effect on reconstruction")
+	}
+}
+
+func TestParallelGainmapDeterministic(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	hdr, sdr, _, err := Decode(data, &DecodeOptions{RawOrientation: true})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+
+	for _, opt := range []*RebaseOptions{
+		{},
+		{UseMultiChannel: true, DitherGainmap: true},
+	} {
+		procs := runtime.GOMAXPROCS(1)
+		serial, serialMeta, err := generateGainmapFromHDR(sdr, profile, hdr, opt)
+		runtime.GOMAXPROCS(max(procs, 4))
+		if err != nil {
+			runtime.GOMAXPROCS(procs)
+			t.Fatalf("generate serial: %v", err)
+		}
+		parallel, parallelMeta, err := generateGainmapFromHDR(sdr, profile, hdr, opt)
+		runtime.GOMAXPROCS(procs)
+		if err != nil {
+			t.Fatalf("generate parallel: %v", err)
+		}
+		if *serialMeta != *parallelMeta {
+			t.Fatalf("metadata differs: %+v vs %+v", serialMeta, parallelMeta)
+		}
+		if !reflect.DeepEqual(serial, parallel) {
+			t.Fatalf("gainmap differs between serial and parallel generation (multi-channel %v)", opt.UseMultiChannel)
+		}
+	}
+}
+
+func BenchmarkGenerateGainmap(b *testing.B) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		b.Fatalf("read uhdr: %v", err)
+	}
+	hdr, sdr, _, err := Decode(data, &DecodeOptions{RawOrientation: true})
+	if err != nil {
+		b.Fatalf("decode: %v", err)
+	}
+	profile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := generateGainmapFromHDR(sdr, profile, hdr, &RebaseOptions{UseMultiChannel: true}); err != nil {
+			b.Fatalf("generate: %v", err)
+		}
+	}
+}
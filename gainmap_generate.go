@@ -14,7 +14,9 @@ const (
 	kHdrOffset    = 1e-7
 )
 
-func generateGainmapFromHDR(sdr image.Image, sdrProfile colorProfile, hdr *hdrImage, opt *RebaseOptions) (image.Image, *GainMapMetadata, error) {
+// generateGainmapFromHDR computes gainmap and metadata that map sdr (encoded with sdrProfile) to hdr,
+// HDR samples are converted from hdr.Gamut to the SDR gamut.
+func generateGainmapFromHDR(sdr image.Image, sdrProfile colorProfile, hdr *HDRImage, opt *RebaseOptions) (image.Image, *GainMapMetadata, error) {
 	if sdr == nil || hdr == nil {
 		return nil, nil, errors.New("missing SDR or HDR input")
 	}
@@ -22,16 +24,26 @@ func generateGainmapFromHDR(sdr image.Image, sdrProfile colorProfile, hdr *hdrIm
 	if b.Dx() != hdr.W || b.Dy() != hdr.H {
 		return nil, nil, fmt.Errorf("SDR and HDR dimensions must match: %dx%d vs %dx%d", b.Dx(), b.Dy(), hdr.W, hdr.H)
 	}
-	scale := 1
-	gamma := float32(1.0)
+	scale := Defaults.GainmapScale
+	gamma := Defaults.GainmapGamma
+	downscale := Defaults.GainmapDownscale
 	useMulti := false
+	dither := false
+	autoGamma := false
+	exact := false
 	if opt != nil {
+		exact = opt.ExactTransfer
+		autoGamma = opt.AutoGainmapGamma
+		dither = opt.DitherGainmap
 		if opt.GainmapScale > 0 {
 			scale = opt.GainmapScale
 		}
 		if opt.GainmapGamma > 0 {
 			gamma = opt.GainmapGamma
 		}
+		if opt.GainmapDownscale != nil {
+			downscale = *opt.GainmapDownscale
+		}
 		if opt.UseMultiChannel {
 			useMulti = true
 		}
@@ -49,52 +61,72 @@ func generateGainmapFromHDR(sdr image.Image, sdrProfile colorProfile, hdr *hdrIm
 	if useMulti {
 		channels = 3
 	}
-	gainmapData := make([]float32, mapW*mapH*channels)
+
+	// gainAt stores log2 gains of pixel x, y (relative to bounds) to dst.
+	gainAt := func(x, y int, dst []float32) {
+		sdrRGB := sampleSDRInProfile(sdr, b.Min.X+x, b.Min.Y+y, sdrProfile, sdrProfile.gamut, exact)
+		// Gains are computed in SDR gamut, as reconstruction applies them there.
+		hdrRGB := convertLinearGamut(hdr.at(x, y), hdr.Gamut, sdrProfile.gamut)
+		hdrRGB = clampRGB(hdrRGB)
+		sdrRGB = clampRGB(sdrRGB)
+
+		if useMulti {
+			dst[0] = computeGain(float32(kSdrWhiteNits)*sdrRGB.r, float32(kSdrWhiteNits)*hdrRGB.r)
+			dst[1] = computeGain(float32(kSdrWhiteNits)*sdrRGB.g, float32(kSdrWhiteNits)*hdrRGB.g)
+			dst[2] = computeGain(float32(kSdrWhiteNits)*sdrRGB.b, float32(kSdrWhiteNits)*hdrRGB.b)
+		} else {
+			sdrY := float32(kSdrWhiteNits) * max3(sdrRGB.r, sdrRGB.g, sdrRGB.b)
+			hdrY := float32(kSdrWhiteNits) * max3(hdrRGB.r, hdrRGB.g, hdrRGB.b)
+			dst[0] = computeGain(sdrY, hdrY)
+		}
+	}
+
+	var gainmapData []float32
+	if scale > 1 && downscale != InterpolationNearest {
+		// Per-pixel gains are filtered down to gainmap size, rows are computed as resampler needs them.
+		gainmapData = resampleRowsF32(b.Dx(), b.Dy(), channels, mapW, mapH, kernelForInterpolation(downscale), func(y int, row []float32) {
+			for x := 0; x < b.Dx(); x++ {
+				gainAt(x, y, row[x*channels:])
+			}
+		})
+	} else {
+		gainmapData = make([]float32, mapW*mapH*channels)
+		parallelFor(mapH, func(_, startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := 0; x < mapW; x++ {
+					gainAt(x*scale, y*scale, gainmapData[(y*mapW+x)*channels:])
+				}
+			}
+		})
+	}
+
 	gainMin := make([]float32, channels)
 	gainMax := make([]float32, channels)
 	for i := 0; i < channels; i++ {
 		gainMin[i] = float32(math.MaxFloat32)
 		gainMax[i] = -float32(math.MaxFloat32)
 	}
-
-	for y := 0; y < mapH; y++ {
-		srcY := b.Min.Y + y*scale
-		for x := 0; x < mapW; x++ {
-			srcX := b.Min.X + x*scale
-			sdrRGB := sampleSDRInProfile(sdr, srcX, srcY, sdrProfile, sdrProfile.gamut)
-			hdrRGB := hdr.at(srcX-b.Min.X, srcY-b.Min.Y)
-			hdrRGB = clampRGB(hdrRGB)
-			sdrRGB = clampRGB(sdrRGB)
-
+	// Rows are split between workers, min/max are reduced per worker and merged afterwards.
+	partMin := make([][]float32, parallelChunks(mapH))
+	partMax := make([][]float32, len(partMin))
+	parallelFor(mapH, func(chunk, startY, endY int) {
+		minv := append([]float32(nil), gainMin...)
+		maxv := append([]float32(nil), gainMax...)
+		for i := startY * mapW * channels; i < endY*mapW*channels; i += channels {
+			g := gainmapData[i : i+channels]
 			if useMulti {
-				sdrR := float32(kSdrWhiteNits) * sdrRGB.r
-				sdrG := float32(kSdrWhiteNits) * sdrRGB.g
-				sdrB := float32(kSdrWhiteNits) * sdrRGB.b
-				hdrR := float32(kSdrWhiteNits) * hdrRGB.r
-				hdrG := float32(kSdrWhiteNits) * hdrRGB.g
-				hdrB := float32(kSdrWhiteNits) * hdrRGB.b
-				g0 := computeGain(sdrR, hdrR)
-				g1 := computeGain(sdrG, hdrG)
-				g2 := computeGain(sdrB, hdrB)
-				idx := (y*mapW + x) * 3
-				gainmapData[idx] = g0
-				gainmapData[idx+1] = g1
-				gainmapData[idx+2] = g2
-				updateMinMax(gainMin, gainMax, g0, g1, g2)
+				updateMinMax(minv, maxv, g[0], g[1], g[2])
 			} else {
-				sdrY := float32(kSdrWhiteNits) * max3(sdrRGB.r, sdrRGB.g, sdrRGB.b)
-				hdrY := float32(kSdrWhiteNits) * max3(hdrRGB.r, hdrRGB.g, hdrRGB.b)
-				g := computeGain(sdrY, hdrY)
-				idx := y*mapW + x
-				gainmapData[idx] = g
-				if g < gainMin[0] {
-					gainMin[0] = g
-				}
-				if g > gainMax[0] {
-					gainMax[0] = g
-				}
+				updateMinMax(minv, maxv, g[0], 0, 0)
 			}
 		}
+		partMin[chunk], partMax[chunk] = minv, maxv
+	})
+	for c := range partMin {
+		for i := 0; i < channels; i++ {
+			gainMin[i] = min(gainMin[i], partMin[c][i])
+			gainMax[i] = max(gainMax[i], partMax[c][i])
+		}
 	}
 
 	for i := 0; i < channels; i++ {
@@ -104,29 +136,37 @@ func generateGainmapFromHDR(sdr image.Image, sdrProfile colorProfile, hdr *hdrIm
 			gainMax[i] = gainMin[i] + 0.1
 		}
 	}
+	if autoGamma {
+		gamma = autoGainmapGamma(gainmapData, gainMin, gainMax)
+	}
 
 	var gainmap image.Image
 	if useMulti {
 		out := image.NewRGBA(image.Rect(0, 0, mapW, mapH))
-		for y := 0; y < mapH; y++ {
-			for x := 0; x < mapW; x++ {
-				idx := (y*mapW + x) * 3
-				r := affineMapGain(gainmapData[idx], gainMin[0], gainMax[0], gamma)
-				g := affineMapGain(gainmapData[idx+1], gainMin[1], gainMax[1], gamma)
-				bc := affineMapGain(gainmapData[idx+2], gainMin[2], gainMax[2], gamma)
-				out.SetRGBA(x, y, color.RGBA{R: r, G: g, B: bc, A: 0xFF})
+		parallelFor(mapH, func(_, startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := 0; x < mapW; x++ {
+					idx := (y*mapW + x) * 3
+					bias := quantizeBias(x, y, dither)
+					r := affineMapGain(gainmapData[idx], gainMin[0], gainMax[0], gamma, bias)
+					g := affineMapGain(gainmapData[idx+1], gainMin[1], gainMax[1], gamma, bias)
+					bc := affineMapGain(gainmapData[idx+2], gainMin[2], gainMax[2], gamma, bias)
+					out.SetRGBA(x, y, color.RGBA{R: r, G: g, B: bc, A: 0xFF})
+				}
 			}
-		}
+		})
 		gainmap = out
 	} else {
 		out := image.NewGray(image.Rect(0, 0, mapW, mapH))
-		for y := 0; y < mapH; y++ {
-			for x := 0; x < mapW; x++ {
-				idx := y*mapW + x
-				v := affineMapGain(gainmapData[idx], gainMin[0], gainMax[0], gamma)
-				out.SetGray(x, y, color.Gray{Y: v})
+		parallelFor(mapH, func(_, startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := 0; x < mapW; x++ {
+					idx := y*mapW + x
+					v := affineMapGain(gainmapData[idx], gainMin[0], gainMax[0], gamma, quantizeBias(x, y, dither))
+					out.SetGray(x, y, color.Gray{Y: v})
+				}
 			}
-		}
+		})
 		gainmap = out
 	}
 
@@ -192,18 +232,59 @@ func clampGainLog2(v float32) float32 {
 	return v
 }
 
-func affineMapGain(gainlog2, minlog2, maxlog2, gamma float32) uint8 {
-	denom := maxlog2 - minlog2
-	if denom == 0 {
-		denom = 1
+// autoGainmapGamma returns gamma that maps median of normalized gains to the middle of 8-bit range,
+// so that common gains get more quantization levels. Gains are interleaved by len(gainMin) channels.
+func autoGainmapGamma(gains, gainMin, gainMax []float32) float32 {
+	const bins = 256
+	var hist [bins]int
+	channels := len(gainMin)
+	for i, g := range gains {
+		c := i % channels
+		v := clamp01((g - gainMin[c]) / (gainMax[c] - gainMin[c]))
+		hist[min(int(v*bins), bins-1)]++
+	}
+	var (
+		median float64
+		seen   int
+	)
+	for b, n := range hist {
+		seen += n
+		if 2*seen >= len(gains) {
+			median = (float64(b) + 0.5) / bins
+			break
+		}
 	}
-	mapped := (gainlog2 - minlog2) / denom
-	if mapped < 0 {
-		mapped = 0
+	gamma := math.Log(0.5) / math.Log(median)
+	// Extreme gammas starve either end of the range, round to keep metadata fractions simple.
+	gamma = min(max(gamma, 0.25), 4)
+	return float32(math.Round(gamma*100) / 100)
+}
+
+// bayer4 is 4x4 ordered dithering threshold matrix.
+var bayer4 = [4][4]float32{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// quantizeBias returns rounding bias for 8-bit gainmap quantization at x, y: 0.5 rounds to
+// nearest, with dither ordered thresholds in (0, 1) break banding of smooth gradients.
+func quantizeBias(x, y int, dither bool) float32 {
+	if !dither {
+		return 0.5
 	}
-	if mapped > 1 {
-		mapped = 1
+	return (bayer4[y&3][x&3] + 0.5) / 16
+}
+
+// affineMapGain quantizes log2 gain within min..max range to 8-bit, bias is added before truncation.
+func affineMapGain(gainlog2, minlog2, maxlog2, gamma, bias float32) uint8 {
+	denom := maxlog2 - minlog2
+	if denom == 0 || math.IsNaN(float64(denom)) {
+		// Zero range carries no gain information, encode it as 0.
+		return 0
 	}
+	mapped := clamp01((gainlog2 - minlog2) / denom)
 	if gamma != 1 {
 		mapped = float32(math.Pow(float64(mapped), float64(gamma)))
 	}
@@ -214,7 +295,7 @@ func affineMapGain(gainlog2, minlog2, maxlog2, gamma float32) uint8 {
 	if val > 255 {
 		val = 255
 	}
-	return uint8(val + 0.5)
+	return uint8(min(val+bias, 255))
 }
 
 func updateMinMax(minv, maxv []float32, r, g, b float32) {
@@ -0,0 +1,106 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Validate checks metadata against ranges allowed by ISO 21496-1 and Adobe gainmap specs,
+// the returned error joins all violated constraints:
+//   - MinContentBoost and MaxContentBoost are finite and positive, MaxContentBoost >= MinContentBoost,
+//   - Gamma is finite and positive,
+//   - OffsetSDR and OffsetHDR are finite (ISO allows negative offsets, Adobe XMP does not),
+//   - HDRCapacityMin is finite and at least 1, HDRCapacityMax is finite and at least HDRCapacityMin.
+func (m *GainMapMetadata) Validate() error {
+	if m == nil {
+		return errors.New("gainmap metadata missing")
+	}
+	finite := func(v float32) bool {
+		return !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0)
+	}
+	var errs []error
+	for c := 0; c < 3; c++ {
+		minB, maxB := m.MinContentBoost[c], m.MaxContentBoost[c]
+		if !finite(minB) || minB <= 0 {
+			errs = append(errs, fmt.Errorf("MinContentBoost[%d]: %v must be finite and positive", c, minB))
+		}
+		if !finite(maxB) || maxB <= 0 {
+			errs = append(errs, fmt.Errorf("MaxContentBoost[%d]: %v must be finite and positive", c, maxB))
+		} else if maxB < minB {
+			errs = append(errs, fmt.Errorf("MaxContentBoost[%d]: %v is below MinContentBoost %v", c, maxB, minB))
+		}
+		if g := m.Gamma[c]; !finite(g) || g <= 0 {
+			errs = append(errs, fmt.Errorf("Gamma[%d]: %v must be finite and positive", c, g))
+		}
+		if o := m.OffsetSDR[c]; !finite(o) {
+			errs = append(errs, fmt.Errorf("OffsetSDR[%d]: %v must be finite", c, o))
+		}
+		if o := m.OffsetHDR[c]; !finite(o) {
+			errs = append(errs, fmt.Errorf("OffsetHDR[%d]: %v must be finite", c, o))
+		}
+	}
+	if !finite(m.HDRCapacityMin) || m.HDRCapacityMin < 1 {
+		errs = append(errs, fmt.Errorf("HDRCapacityMin: %v must be finite and at least 1", m.HDRCapacityMin))
+	}
+	if !finite(m.HDRCapacityMax) {
+		errs = append(errs, fmt.Errorf("HDRCapacityMax: %v must be finite", m.HDRCapacityMax))
+	} else if m.HDRCapacityMax < m.HDRCapacityMin {
+		errs = append(errs, fmt.Errorf("HDRCapacityMax: %v is below HDRCapacityMin %v", m.HDRCapacityMax, m.HDRCapacityMin))
+	}
+	return errors.Join(errs...)
+}
+
+// validateMetadata validates meta and wraps violations.
+func validateMetadata(meta *GainMapMetadata) error {
+	if err := meta.Validate(); err != nil {
+		return fmt.Errorf("invalid gainmap metadata: %w", err)
+	}
+	return nil
+}
+
+// validateSegmentMetadata validates gainmap metadata of raw gainmap XMP/ISO payloads that readers use:
+// ISO when it can be decoded, XMP otherwise, as by Split. Missing metadata is not an error.
+func validateSegmentMetadata(xmp, iso []byte) error {
+	var (
+		meta *GainMapMetadata
+		err  error
+	)
+	if bytes.HasPrefix(iso, isoPrefix) {
+		meta, err = decodeGainmapMetadataISO(iso[len(isoPrefix):])
+	}
+	if meta == nil && len(xmp) > 0 {
+		var xmpErr error
+		if meta, xmpErr = parseXMP(xmp); err == nil {
+			err = xmpErr
+		}
+	}
+	if meta == nil {
+		if err != nil {
+			return fmt.Errorf("invalid gainmap metadata: %w", err)
+		}
+		return nil
+	}
+	return validateMetadata(meta)
+}
+
+// completeSegmentMetadata synthesizes gainmap XMP from ISO 21496-1 payload or ISO from XMP when only
+// one of them is present, so that both XMP-only and ISO-only readers find gainmap metadata.
+// With synthesized XMP, primaryXMP carries the container directory that XMP readers need to find
+// the gainmap, it is nil otherwise. Payloads are returned as is when they can not be converted.
+func completeSegmentMetadata(xmp, iso []byte) (primaryXMP, secondaryXMP, secondaryISO []byte) {
+	switch {
+	case len(xmp) == 0 && bytes.HasPrefix(iso, isoPrefix):
+		if meta, err := decodeGainmapMetadataISO(iso[len(isoPrefix):]); err == nil {
+			return buildPrimaryXMP(meta, 0), buildGainmapXMP(meta), iso
+		}
+	case len(iso) == 0 && len(xmp) > 0:
+		if meta, err := parseXMP(xmp); err == nil {
+			if payload, err := buildIsoPayload(meta); err == nil {
+				return nil, xmp, payload
+			}
+		}
+	}
+	return nil, xmp, iso
+}
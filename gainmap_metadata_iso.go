@@ -1,8 +1,10 @@
 package ultrahdr
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math"
 )
 
@@ -35,12 +37,71 @@ func decodeGainmapMetadataISO(data []byte) (*GainMapMetadata, error) {
 	if err := frac.decode(data); err != nil {
 		return nil, err
 	}
+	if err := frac.checkDenominators(); err != nil {
+		return nil, err
+	}
 	meta := GainMapMetadata{Version: jpegrVersion}
 	fracToFloat(&frac, &meta)
-
+	if err := checkISOGainmapMetadata(&meta); err != nil {
+		return nil, err
+	}
 	return &meta, nil
 }
 
+// checkDenominators rejects zero denominators that would turn into infinite values.
+func (m *gainmapMetadataFrac) checkDenominators() error {
+	for c := 0; c < 3; c++ {
+		for _, f := range []struct {
+			name string
+			d    uint32
+		}{
+			{name: "gainmap min", d: m.GainMapMinD[c]},
+			{name: "gainmap max", d: m.GainMapMaxD[c]},
+			{name: "gamma", d: m.GainMapGammaD[c]},
+			{name: "base offset", d: m.BaseOffsetD[c]},
+			{name: "alternate offset", d: m.AltOffsetD[c]},
+		} {
+			if f.d == 0 {
+				return fmt.Errorf("%s (channel %d): %w", f.name, c, errFractionZeroDenominator)
+			}
+		}
+	}
+	if m.BaseHdrHeadroomD == 0 {
+		return fmt.Errorf("base headroom: %w", errFractionZeroDenominator)
+	}
+	if m.AltHdrHeadroomD == 0 {
+		return fmt.Errorf("alternate headroom: %w", errFractionZeroDenominator)
+	}
+	return nil
+}
+
+// checkISOGainmapMetadata validates decoded values: boosts and capacities must be
+// representable as positive finite floats, HDRCapacityMax >= HDRCapacityMin >= 1 and gamma > 0.
+func checkISOGainmapMetadata(meta *GainMapMetadata) error {
+	valid := func(v float32) bool { return v > 0 && !math.IsInf(float64(v), 0) }
+	for c := 0; c < 3; c++ {
+		if !valid(meta.MinContentBoost[c]) {
+			return fmt.Errorf("gainmap min (channel %d): boost %v out of range", c, meta.MinContentBoost[c])
+		}
+		if !valid(meta.MaxContentBoost[c]) {
+			return fmt.Errorf("gainmap max (channel %d): boost %v out of range", c, meta.MaxContentBoost[c])
+		}
+		if !(meta.Gamma[c] > 0) {
+			return fmt.Errorf("gamma (channel %d): %v is not positive", c, meta.Gamma[c])
+		}
+	}
+	if !valid(meta.HDRCapacityMin) || meta.HDRCapacityMin < 1 {
+		return fmt.Errorf("base headroom: capacity %v out of range", meta.HDRCapacityMin)
+	}
+	if !valid(meta.HDRCapacityMax) {
+		return fmt.Errorf("alternate headroom: capacity %v out of range", meta.HDRCapacityMax)
+	}
+	if meta.HDRCapacityMax < meta.HDRCapacityMin {
+		return fmt.Errorf("alternate headroom: capacity %v is below base capacity %v", meta.HDRCapacityMax, meta.HDRCapacityMin)
+	}
+	return nil
+}
+
 func encodeGainmapMetadataISO(meta *GainMapMetadata) ([]byte, error) {
 	if meta == nil {
 		return nil, errors.New("gainmap metadata missing")
@@ -52,6 +113,37 @@ func encodeGainmapMetadataISO(meta *GainMapMetadata) ([]byte, error) {
 	return frac.encode()
 }
 
+// DecodeISOGainmapMetadata decodes ISO 21496-1 gainmap metadata, as stored in APP2 segment of gainmap image
+// after the "urn:iso:std:iso:ts:21496:-1\x00" namespace header. A payload that still starts with the header is
+// accepted as well.
+//
+// Payload layout (big-endian): minimum version u16, writer version u16, flags u8 (0x80 multi-channel,
+// 0x40 use base color space, 0x08 common denominator, 0x04 backward direction), then base and alternate
+// HDR headroom followed by gain min, gain max, gamma, base offset and alternate offset of one or three
+// channels. Values are fractions, u32 denominator is written once after flags with common denominator,
+// or after each numerator otherwise. Headrooms and gain min/max are log2 values.
+func DecodeISOGainmapMetadata(payload []byte) (*GainMapMetadata, error) {
+	return decodeGainmapMetadataISO(bytes.TrimPrefix(payload, isoPrefix))
+}
+
+// EncodeISOGainmapMetadata validates meta and encodes it as ISO 21496-1 payload without namespace header,
+// see DecodeISOGainmapMetadata for layout. Single-channel payload is written when all channels are equal.
+func EncodeISOGainmapMetadata(meta *GainMapMetadata) ([]byte, error) {
+	if err := validateMetadata(meta); err != nil {
+		return nil, err
+	}
+	return encodeGainmapMetadataISO(meta)
+}
+
+// BuildISOSegment is like EncodeISOGainmapMetadata, but prepends the namespace header, result is
+// a complete APP2 payload for gainmap image.
+func BuildISOSegment(meta *GainMapMetadata) ([]byte, error) {
+	if err := validateMetadata(meta); err != nil {
+		return nil, err
+	}
+	return buildIsoPayload(meta)
+}
+
 func buildIsoPayload(meta *GainMapMetadata) ([]byte, error) {
 	encoded, err := encodeGainmapMetadataISO(meta)
 	if err != nil {
@@ -68,7 +160,7 @@ func (m *gainmapMetadataFrac) decode(in []byte) error {
 	pos := 0
 	readU16 := func() (uint16, error) {
 		if pos+2 > len(in) {
-			return 0, errors.New("iso metadata truncated")
+			return 0, fmt.Errorf("iso metadata %w", ErrTruncated)
 		}
 		v := binary.BigEndian.Uint16(in[pos:])
 		pos += 2
@@ -76,7 +168,7 @@ func (m *gainmapMetadataFrac) decode(in []byte) error {
 	}
 	readU32 := func() (uint32, error) {
 		if pos+4 > len(in) {
-			return 0, errors.New("iso metadata truncated")
+			return 0, fmt.Errorf("iso metadata %w", ErrTruncated)
 		}
 		v := binary.BigEndian.Uint32(in[pos:])
 		pos += 4
@@ -88,7 +180,7 @@ func (m *gainmapMetadataFrac) decode(in []byte) error {
 	}
 	readU8 := func() (uint8, error) {
 		if pos+1 > len(in) {
-			return 0, errors.New("iso metadata truncated")
+			return 0, fmt.Errorf("iso metadata %w", ErrTruncated)
 		}
 		v := in[pos]
 		pos++
@@ -100,7 +192,7 @@ func (m *gainmapMetadataFrac) decode(in []byte) error {
 		return err
 	}
 	if minVer != 0 {
-		return errors.New("unsupported iso min_version")
+		return fmt.Errorf("unsupported iso min_version %d: %w", minVer, ErrUnsupportedMetadata)
 	}
 	if _, err = readU16(); err != nil {
 		return err
@@ -158,6 +250,9 @@ func (m *gainmapMetadataFrac) decode(in []byte) error {
 			}
 			m.AltOffsetD[c] = common
 		}
+		if channelCount == 1 {
+			m.replicateFirstChannel()
+		}
 		return nil
 	}
 
@@ -205,9 +300,23 @@ func (m *gainmapMetadataFrac) decode(in []byte) error {
 			return err
 		}
 	}
+	if channelCount == 1 {
+		m.replicateFirstChannel()
+	}
 	return nil
 }
 
+// replicateFirstChannel copies single-channel values to all channels.
+func (m *gainmapMetadataFrac) replicateFirstChannel() {
+	for c := 1; c < 3; c++ {
+		m.GainMapMinN[c], m.GainMapMinD[c] = m.GainMapMinN[0], m.GainMapMinD[0]
+		m.GainMapMaxN[c], m.GainMapMaxD[c] = m.GainMapMaxN[0], m.GainMapMaxD[0]
+		m.GainMapGammaN[c], m.GainMapGammaD[c] = m.GainMapGammaN[0], m.GainMapGammaD[0]
+		m.BaseOffsetN[c], m.BaseOffsetD[c] = m.BaseOffsetN[0], m.BaseOffsetD[0]
+		m.AltOffsetN[c], m.AltOffsetD[c] = m.AltOffsetN[0], m.AltOffsetD[0]
+	}
+}
+
 func (m *gainmapMetadataFrac) encode() ([]byte, error) {
 	const minVersion uint16 = 0
 	const writerVersion uint16 = 0
@@ -318,19 +427,19 @@ func gainmapMetadataFloatToFraction(from *GainMapMetadata, to *gainmapMetadataFr
 
 	for i := 0; i < channelCount; i++ {
 		if err := floatToSignedFraction(log2f(from.MaxContentBoost[i]), &to.GainMapMaxN[i], &to.GainMapMaxD[i]); err != nil {
-			return err
+			return fmt.Errorf("gainmap max: %w", err)
 		}
 		if err := floatToSignedFraction(log2f(from.MinContentBoost[i]), &to.GainMapMinN[i], &to.GainMapMinD[i]); err != nil {
-			return err
+			return fmt.Errorf("gainmap min: %w", err)
 		}
 		if err := floatToUnsignedFraction(from.Gamma[i], &to.GainMapGammaN[i], &to.GainMapGammaD[i]); err != nil {
-			return err
+			return fmt.Errorf("gamma: %w", err)
 		}
 		if err := floatToSignedFraction(from.OffsetSDR[i], &to.BaseOffsetN[i], &to.BaseOffsetD[i]); err != nil {
-			return err
+			return fmt.Errorf("base offset: %w", err)
 		}
 		if err := floatToSignedFraction(from.OffsetHDR[i], &to.AltOffsetN[i], &to.AltOffsetD[i]); err != nil {
-			return err
+			return fmt.Errorf("alternate offset: %w", err)
 		}
 	}
 
@@ -348,10 +457,10 @@ func gainmapMetadataFloatToFraction(from *GainMapMetadata, to *gainmapMetadataFr
 	}
 
 	if err := floatToUnsignedFraction(log2f(from.HDRCapacityMin), &to.BaseHdrHeadroomN, &to.BaseHdrHeadroomD); err != nil {
-		return err
+		return fmt.Errorf("base headroom: %w", err)
 	}
 	if err := floatToUnsignedFraction(log2f(from.HDRCapacityMax), &to.AltHdrHeadroomN, &to.AltHdrHeadroomD); err != nil {
-		return err
+		return fmt.Errorf("alternate headroom: %w", err)
 	}
 	return nil
 }
@@ -386,11 +495,20 @@ func (m *gainmapMetadataFrac) allChannelsIdentical() bool {
 		m.AltOffsetD[0] == m.AltOffsetD[1] && m.AltOffsetD[1] == m.AltOffsetD[2]
 }
 
+var (
+	errFractionNotFinite       = errors.New("value is not finite")
+	errFractionOutOfRange      = errors.New("value is out of fraction range")
+	errFractionZeroDenominator = errors.New("zero denominator")
+)
+
 func floatToSignedFraction(v float32, numerator *int32, denominator *uint32) error {
 	const maxInt32 = int32(^uint32(0) >> 1)
+	if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+		return fmt.Errorf("%w: %v", errFractionNotFinite, v)
+	}
 	num, den, ok := floatToUnsignedFractionImpl(math.Abs(float64(v)), uint32(maxInt32))
 	if !ok {
-		return errors.New("failed to encode signed fraction")
+		return fmt.Errorf("%w: %v", errFractionOutOfRange, v)
 	}
 	n := int32(num)
 	if v < 0 {
@@ -403,54 +521,55 @@ func floatToSignedFraction(v float32, numerator *int32, denominator *uint32) err
 
 func floatToUnsignedFraction(v float32, numerator *uint32, denominator *uint32) error {
 	const maxUint32 = ^uint32(0)
+	if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+		return fmt.Errorf("%w: %v", errFractionNotFinite, v)
+	}
 	num, den, ok := floatToUnsignedFractionImpl(float64(v), maxUint32)
 	if !ok {
-		return errors.New("failed to encode unsigned fraction")
+		return fmt.Errorf("%w: %v", errFractionOutOfRange, v)
 	}
 	*numerator = num
 	*denominator = den
 	return nil
 }
 
+// floatToUnsignedFractionImpl finds the closest fraction to v with numerator up to maxNumerator
+// and uint32 denominator. Convergents of continued fraction expansion are tried first, when the
+// next convergent does not fit, the best semiconvergent within bounds is used if it is closer.
 func floatToUnsignedFractionImpl(v float64, maxNumerator uint32) (uint32, uint32, bool) {
 	if math.IsNaN(v) || v < 0 || v > float64(maxNumerator) {
 		return 0, 0, false
 	}
-	var maxD uint64
-	if v <= 1 {
-		maxD = uint64(^uint32(0))
-	} else {
-		maxD = uint64(math.Floor(float64(maxNumerator) / v))
+	// Both numerator and denominator must fit, also for values below 1.
+	maxD := float64(^uint32(0))
+	if v > 0 {
+		maxD = math.Min(maxD, math.Floor(float64(maxNumerator)/v))
 	}
 
-	den := uint32(1)
-	prevD := uint32(0)
+	den := uint64(1)
+	prevD := uint64(0)
 	currentV := v - math.Floor(v)
 	const maxIter = 39
 	for iter := 0; iter < maxIter; iter++ {
-		numeratorDouble := float64(den) * v
-		if numeratorDouble > float64(maxNumerator) {
-			return 0, 0, false
-		}
-		num := uint32(math.Round(numeratorDouble))
-		if math.Abs(numeratorDouble-float64(num)) == 0.0 {
-			return num, den, true
-		}
-		if currentV == 0 {
-			return num, den, true
+		num := math.Round(float64(den) * v)
+		if currentV == 0 || num == float64(den)*v {
+			return uint32(num), uint32(den), true
 		}
 		currentV = 1.0 / currentV
-		newD := float64(prevD) + math.Floor(currentV)*float64(den)
-		if newD > float64(maxD) {
-			return num, den, true
-		}
-		prevD = den
-		if newD > float64(^uint32(0)) {
-			return 0, 0, false
+		a := math.Floor(currentV)
+		if newD := float64(prevD) + a*float64(den); newD > maxD {
+			// Semiconvergent prevD + k*den with largest k that fits.
+			k := math.Floor((maxD - float64(prevD)) / float64(den))
+			semiD := uint64(float64(prevD) + k*float64(den))
+			semiN := math.Round(float64(semiD) * v)
+			if k > 0 && semiN <= float64(maxNumerator) &&
+				math.Abs(semiN/float64(semiD)-v) < math.Abs(num/float64(den)-v) {
+				return uint32(semiN), uint32(semiD), true
+			}
+			return uint32(num), uint32(den), true
 		}
-		den = uint32(newD)
-		currentV -= math.Floor(currentV)
+		prevD, den = den, prevD+uint64(a)*den
+		currentV -= a
 	}
-	num := uint32(math.Round(float64(den) * v))
-	return num, den, true
+	return uint32(math.Round(float64(den) * v)), uint32(den), true
 }
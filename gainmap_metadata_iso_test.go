@@ -0,0 +1,313 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func relErr(got, want float64) float64 {
+	if want == 0 {
+		return math.Abs(got)
+	}
+	return math.Abs(got-want) / math.Abs(want)
+}
+
+func TestFloatToFraction(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	values := []float32{
+		0, 1, 1.0 / 3, 2.0 / 3, 1 / 2.2, 0.1, 15, 14.999999, 15.000001, 32767.9,
+		math.Nextafter32(1, 0), math.Nextafter32(1, 2), 0.9999, 1e-9, 1e-6, 2e9, 4e9,
+	}
+	for range 20000 {
+		// Uniform, wide dynamic range and just below 1.
+		values = append(values,
+			rng.Float32()*16,
+			float32(math.Exp2(rng.Float64()*50-25)),
+			1-float32(math.Exp2(-rng.Float64()*24)),
+		)
+	}
+
+	for _, v := range values {
+		var n, d uint32
+		if err := floatToUnsignedFraction(v, &n, &d); err != nil {
+			t.Fatalf("unsigned %v: %v", v, err)
+		}
+		if d == 0 {
+			t.Fatalf("unsigned %v: zero denominator", v)
+		}
+		// Values below 1/2^32 can only be approximated with zero.
+		if e := relErr(float64(n)/float64(d), float64(v)); e > 1e-6 && v > 1e-9 {
+			t.Fatalf("unsigned %v: %d/%d, relative error %g", v, n, d, e)
+		}
+
+		if v > 2e9 {
+			continue
+		}
+		for _, sv := range []float32{v, -v} {
+			var sn int32
+			if err := floatToSignedFraction(sv, &sn, &d); err != nil {
+				t.Fatalf("signed %v: %v", sv, err)
+			}
+			if e := relErr(float64(sn)/float64(d), float64(sv)); e > 1e-6 && v > 1e-9 {
+				t.Fatalf("signed %v: %d/%d, relative error %g", sv, sn, d, e)
+			}
+		}
+	}
+
+	var n, d uint32
+	var sn int32
+	for _, v := range []float32{float32(math.NaN()), float32(math.Inf(1)), float32(math.Inf(-1))} {
+		if err := floatToUnsignedFraction(v, &n, &d); !errors.Is(err, errFractionNotFinite) {
+			t.Fatalf("unsigned %v: unexpected error %v", v, err)
+		}
+		if err := floatToSignedFraction(v, &sn, &d); !errors.Is(err, errFractionNotFinite) {
+			t.Fatalf("signed %v: unexpected error %v", v, err)
+		}
+	}
+	if err := floatToUnsignedFraction(-1, &n, &d); !errors.Is(err, errFractionOutOfRange) {
+		t.Fatalf("negative unsigned: unexpected error %v", err)
+	}
+	if err := floatToSignedFraction(3e9, &sn, &d); !errors.Is(err, errFractionOutOfRange) {
+		t.Fatalf("signed overflow: unexpected error %v", err)
+	}
+}
+
+func TestGainmapMetadataISORoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for range 2000 {
+		meta := &GainMapMetadata{
+			Version:        "1.0",
+			HDRCapacityMin: 1,
+			HDRCapacityMax: float32(math.Exp2(rng.Float64() * 15)),
+		}
+		for c := range 3 {
+			meta.MinContentBoost[c] = float32(math.Exp2(-rng.Float64() * 4))
+			meta.MaxContentBoost[c] = float32(math.Exp2(rng.Float64() * 15))
+			meta.Gamma[c] = 0.1 + rng.Float32()*3
+			meta.OffsetSDR[c] = rng.Float32() / 64
+			meta.OffsetHDR[c] = rng.Float32() / 64
+		}
+		data, err := encodeGainmapMetadataISO(meta)
+		if err != nil {
+			t.Fatalf("encode %+v: %v", meta, err)
+		}
+		got, err := decodeGainmapMetadataISO(data)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		// Boosts and capacities are stored as log2, compare them in log domain.
+		check := func(name string, got, want float32, log bool) {
+			t.Helper()
+			g, w := float64(got), float64(want)
+			if log {
+				g, w = math.Log2(g), math.Log2(w)
+			}
+			if e := relErr(g, w); e > 1e-6 && math.Abs(g-w) > 1e-6 {
+				t.Fatalf("%s: got %v want %v", name, got, want)
+			}
+		}
+		for c := range 3 {
+			check("min content boost", got.MinContentBoost[c], meta.MinContentBoost[c], true)
+			check("max content boost", got.MaxContentBoost[c], meta.MaxContentBoost[c], true)
+			check("gamma", got.Gamma[c], meta.Gamma[c], false)
+			check("offset sdr", got.OffsetSDR[c], meta.OffsetSDR[c], false)
+			check("offset hdr", got.OffsetHDR[c], meta.OffsetHDR[c], false)
+		}
+		check("hdr capacity max", got.HDRCapacityMax, meta.HDRCapacityMax, true)
+	}
+
+	meta := &GainMapMetadata{Version: "1.0", Gamma: [3]float32{1, 1, 1}, HDRCapacityMin: 1, HDRCapacityMax: float32(math.NaN())}
+	if _, err := encodeGainmapMetadataISO(meta); !errors.Is(err, errFractionNotFinite) {
+		t.Fatalf("expected non-finite error, got %v", err)
+	}
+}
+
+func TestExportedISOGainmapMetadata(t *testing.T) {
+	single := &GainMapMetadata{
+		Version:         "1.0",
+		MaxContentBoost: [3]float32{4, 4, 4},
+		MinContentBoost: [3]float32{1, 1, 1},
+		Gamma:           [3]float32{1, 1, 1},
+		OffsetSDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		OffsetHDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		HDRCapacityMin:  1,
+		HDRCapacityMax:  4,
+		UseBaseCG:       true,
+	}
+	multi := *single
+	multi.MaxContentBoost = [3]float32{4, 2, 8}
+	multi.Gamma = [3]float32{1, 0.5, 2}
+	multi.HDRCapacityMax = 8
+
+	for _, tc := range []struct {
+		name     string
+		meta     *GainMapMetadata
+		channels int
+	}{
+		{name: "single", meta: single, channels: 1},
+		{name: "multi", meta: &multi, channels: 3},
+	} {
+		payload, err := EncodeISOGainmapMetadata(tc.meta)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", tc.name, err)
+		}
+		if multiChannel := payload[4]&isoIsMultiChannelMask != 0; multiChannel != (tc.channels == 3) {
+			t.Fatalf("%s: flags %#x", tc.name, payload[4])
+		}
+		segment, err := BuildISOSegment(tc.meta)
+		if err != nil {
+			t.Fatalf("%s: build segment: %v", tc.name, err)
+		}
+		if !bytes.Equal(segment, append(append([]byte(nil), isoPrefix...), payload...)) {
+			t.Fatalf("%s: segment is not namespace header followed by payload", tc.name)
+		}
+		for _, data := range [][]byte{payload, segment} {
+			got, err := DecodeISOGainmapMetadata(data)
+			if err != nil {
+				t.Fatalf("%s: decode: %v", tc.name, err)
+			}
+			if got.MaxContentBoost != tc.meta.MaxContentBoost || got.MinContentBoost != tc.meta.MinContentBoost ||
+				got.Gamma != tc.meta.Gamma || got.OffsetSDR != tc.meta.OffsetSDR || got.OffsetHDR != tc.meta.OffsetHDR ||
+				got.HDRCapacityMin != tc.meta.HDRCapacityMin || got.HDRCapacityMax != tc.meta.HDRCapacityMax ||
+				got.UseBaseCG != tc.meta.UseBaseCG {
+				t.Fatalf("%s: round trip %+v, want %+v", tc.name, got, tc.meta)
+			}
+		}
+	}
+
+	invalid := *single
+	invalid.Gamma[1] = -1
+	if _, err := EncodeISOGainmapMetadata(&invalid); err == nil {
+		t.Fatalf("expected invalid metadata error")
+	}
+	if _, err := BuildISOSegment(nil); err == nil {
+		t.Fatalf("expected missing metadata error")
+	}
+	if _, err := DecodeISOGainmapMetadata(isoPrefix); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected truncated error, got %v", err)
+	}
+}
+
+func TestDecodeGainmapMetadataISOInvalid(t *testing.T) {
+	meta := &GainMapMetadata{
+		Version:         "1.0",
+		MinContentBoost: [3]float32{1, 0.5, 0.25},
+		MaxContentBoost: [3]float32{4, 8, 16},
+		Gamma:           [3]float32{1, 1, 1},
+		OffsetSDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		OffsetHDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		HDRCapacityMin:  1,
+		HDRCapacityMax:  16,
+	}
+	var valid gainmapMetadataFrac
+	if err := gainmapMetadataFloatToFraction(meta, &valid); err != nil {
+		t.Fatalf("to fraction: %v", err)
+	}
+
+	for _, tc := range []struct {
+		field   string
+		corrupt func(m *gainmapMetadataFrac)
+		zeroDen bool
+	}{
+		{field: "gainmap min (channel 1)", corrupt: func(m *gainmapMetadataFrac) { m.GainMapMinD[1] = 0 }, zeroDen: true},
+		{field: "gainmap max (channel 2)", corrupt: func(m *gainmapMetadataFrac) { m.GainMapMaxD[2] = 0 }, zeroDen: true},
+		{field: "gamma (channel 0)", corrupt: func(m *gainmapMetadataFrac) { m.GainMapGammaD[0] = 0 }, zeroDen: true},
+		{field: "base offset (channel 1)", corrupt: func(m *gainmapMetadataFrac) { m.BaseOffsetD[1] = 0 }, zeroDen: true},
+		{field: "alternate offset (channel 2)", corrupt: func(m *gainmapMetadataFrac) { m.AltOffsetD[2] = 0 }, zeroDen: true},
+		{field: "base headroom", corrupt: func(m *gainmapMetadataFrac) { m.BaseHdrHeadroomD = 0 }, zeroDen: true},
+		{field: "alternate headroom", corrupt: func(m *gainmapMetadataFrac) { m.AltHdrHeadroomD = 0 }, zeroDen: true},
+		{field: "gainmap min (channel 0)", corrupt: func(m *gainmapMetadataFrac) { m.GainMapMinN[0], m.GainMapMinD[0] = -1000, 1 }},
+		{field: "gainmap max (channel 1)", corrupt: func(m *gainmapMetadataFrac) { m.GainMapMaxN[1], m.GainMapMaxD[1] = 1000, 1 }},
+		{field: "gamma (channel 2)", corrupt: func(m *gainmapMetadataFrac) { m.GainMapGammaN[2] = 0 }},
+		{field: "base headroom", corrupt: func(m *gainmapMetadataFrac) { m.BaseHdrHeadroomN, m.BaseHdrHeadroomD = 1000, 1 }},
+		{field: "alternate headroom", corrupt: func(m *gainmapMetadataFrac) { m.BaseHdrHeadroomN, m.BaseHdrHeadroomD = 5, 1 }},
+	} {
+		frac := valid
+		tc.corrupt(&frac)
+		data, err := frac.encode()
+		if err != nil {
+			t.Fatalf("%s: encode: %v", tc.field, err)
+		}
+		_, err = decodeGainmapMetadataISO(data)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.field+":") {
+			t.Fatalf("%s: unexpected error %v", tc.field, err)
+		}
+		if errors.Is(err, errFractionZeroDenominator) != tc.zeroDen {
+			t.Fatalf("%s: unexpected error kind %v", tc.field, err)
+		}
+	}
+
+	// Common denominator form.
+	frac := valid
+	frac.BaseHdrHeadroomD, frac.AltHdrHeadroomD = 0, 0
+	for c := range 3 {
+		frac.GainMapMinD[c], frac.GainMapMaxD[c], frac.GainMapGammaD[c], frac.BaseOffsetD[c], frac.AltOffsetD[c] = 0, 0, 0, 0, 0
+	}
+	data, err := frac.encode()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := decodeGainmapMetadataISO(data); !errors.Is(err, errFractionZeroDenominator) {
+		t.Fatalf("common denominator: unexpected error %v", err)
+	}
+}
+
+func TestDecodeRejectsInvalidISOMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmap, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	var frac gainmapMetadataFrac
+	if err := gainmapMetadataFloatToFraction(sr.Meta, &frac); err != nil {
+		t.Fatalf("to fraction: %v", err)
+	}
+	frac.GainMapMaxD[0] = 0
+	iso, err := frac.encode()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	segs := &MetadataSegments{SecondaryISO: append([]byte(isoNamespace+"\x00"), iso...)}
+	container, err := assembleContainerWithSegments(primary, gainmap, segs)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	if _, _, _, err := Decode(container, nil); !errors.Is(err, errFractionZeroDenominator) {
+		t.Fatalf("expected zero denominator error, got %v", err)
+	}
+}
+
+func FuzzDecodeGainmapMetadataISO(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0})
+	addTestdataSeeds(f, func(data []byte) [][]byte {
+		var seeds [][]byte
+		for _, p := range segmentSeeds(data, func(p []byte) bool { return bytes.HasPrefix(p, isoPrefix) }) {
+			seeds = append(seeds, p[len(isoPrefix):])
+		}
+		return seeds
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var (
+			meta *GainMapMetadata
+			err  error
+		)
+		checkAllocBound(t, len(data), func() { meta, err = decodeGainmapMetadataISO(data) })
+		if err == nil && meta == nil {
+			t.Fatalf("nil metadata without error")
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGainMapMetadataValidate(t *testing.T) {
+	valid := GainMapMetadata{
+		Version:         "1.0",
+		MinContentBoost: [3]float32{1, 1, 1},
+		MaxContentBoost: [3]float32{4, 4, 4},
+		Gamma:           [3]float32{1, 1, 1},
+		OffsetSDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		OffsetHDR:       [3]float32{-1.0 / 64, 1.0 / 64, 1.0 / 64},
+		HDRCapacityMin:  1,
+		HDRCapacityMax:  4,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid metadata: %v", err)
+	}
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(1))
+
+	for _, tc := range []struct {
+		name    string
+		corrupt func(m *GainMapMetadata)
+		want    []string
+	}{
+		{name: "zero min boost", corrupt: func(m *GainMapMetadata) { m.MinContentBoost[1] = 0 }, want: []string{"MinContentBoost[1]"}},
+		{name: "NaN min boost", corrupt: func(m *GainMapMetadata) { m.MinContentBoost[0] = nan }, want: []string{"MinContentBoost[0]"}},
+		{name: "infinite max boost", corrupt: func(m *GainMapMetadata) { m.MaxContentBoost[2] = inf }, want: []string{"MaxContentBoost[2]"}},
+		{name: "max below min", corrupt: func(m *GainMapMetadata) { m.MaxContentBoost[0] = 0.5 }, want: []string{"MaxContentBoost[0]: 0.5 is below MinContentBoost 1"}},
+		{name: "zero gamma", corrupt: func(m *GainMapMetadata) { m.Gamma[2] = 0 }, want: []string{"Gamma[2]"}},
+		{name: "NaN gamma", corrupt: func(m *GainMapMetadata) { m.Gamma[0] = nan }, want: []string{"Gamma[0]"}},
+		{name: "NaN SDR offset", corrupt: func(m *GainMapMetadata) { m.OffsetSDR[1] = nan }, want: []string{"OffsetSDR[1]"}},
+		{name: "infinite HDR offset", corrupt: func(m *GainMapMetadata) { m.OffsetHDR[2] = -inf }, want: []string{"OffsetHDR[2]"}},
+		{name: "capacity min below 1", corrupt: func(m *GainMapMetadata) { m.HDRCapacityMin = 0.5 }, want: []string{"HDRCapacityMin"}},
+		{name: "NaN capacity max", corrupt: func(m *GainMapMetadata) { m.HDRCapacityMax = nan }, want: []string{"HDRCapacityMax"}},
+		{name: "capacity max below min", corrupt: func(m *GainMapMetadata) { m.HDRCapacityMin = 8 }, want: []string{"HDRCapacityMax: 4 is below HDRCapacityMin 8"}},
+		{
+			name: "all violations are reported",
+			corrupt: func(m *GainMapMetadata) {
+				m.MaxContentBoost[1] = 0.25
+				m.Gamma[1] = -1
+				m.HDRCapacityMin = 0
+			},
+			want: []string{"MaxContentBoost[1]", "Gamma[1]", "HDRCapacityMin"},
+		},
+	} {
+		m := valid
+		tc.corrupt(&m)
+		err := m.Validate()
+		if err == nil {
+			t.Fatalf("%s: expected error", tc.name)
+		}
+		if n := strings.Count(err.Error(), "\n") + 1; n != len(tc.want) {
+			t.Fatalf("%s: %d errors, want %d: %v", tc.name, n, len(tc.want), err)
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Fatalf("%s: error %q does not mention %q", tc.name, err, w)
+			}
+		}
+	}
+}
+
+func TestMetadataValidationOnAssembly(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	bad := *sr.Meta
+	bad.Gamma[0] = 0
+
+	if _, err := AssembleWithMetadata(sr.Primary, sr.Gainmap, &bad); err == nil || !strings.Contains(err.Error(), "Gamma[0]") {
+		t.Fatalf("assemble: unexpected error %v", err)
+	}
+	if _, err := RewriteGainmapMetadata(data, &bad); err == nil || !strings.Contains(err.Error(), "Gamma[0]") {
+		t.Fatalf("rewrite: unexpected error %v", err)
+	}
+	bundle, err := sr.BuildMetadataBundle()
+	if err != nil {
+		t.Fatalf("bundle: %v", err)
+	}
+	// XMP is used when there is no ISO metadata.
+	bundle.SecondaryISO = nil
+	bundle.SecondaryXMP = buildGainmapXMP(&bad)
+	if _, err := Join(sr.Primary, sr.Gainmap, bundle, nil); err == nil || !strings.Contains(err.Error(), "Gamma[0]") {
+		t.Fatalf("join: unexpected error %v", err)
+	}
+
+	c, err := JoinWithOptions(sr.Primary, sr.Gainmap, bundle, nil, &JoinOptions{SkipValidation: true})
+	if err != nil {
+		t.Fatalf("join without validation: %v", err)
+	}
+	if !bytes.Contains(c, bundle.SecondaryXMP) {
+		t.Fatalf("expected out of spec XMP in output")
+	}
+
+	// Undecodable ISO falls back to XMP, as by Split, so valid XMP is accepted.
+	bundle.SecondaryISO = append(append([]byte(nil), isoPrefix...), 0, 0, 0, 0, 0xFF)
+	bundle.SecondaryXMP = buildGainmapXMP(sr.Meta)
+	if _, err := Join(sr.Primary, sr.Gainmap, bundle, nil); err != nil {
+		t.Fatalf("join with broken ISO and valid XMP: %v", err)
+	}
+	bundle.SecondaryXMP = buildGainmapXMP(&bad)
+	if _, err := Join(sr.Primary, sr.Gainmap, bundle, nil); err == nil || !strings.Contains(err.Error(), "Gamma[0]") {
+		t.Fatalf("join with broken ISO and invalid XMP: unexpected error %v", err)
+	}
+}
@@ -15,6 +15,7 @@ type GridOptions struct {
 	Quality         int           // JPEG quality for the output (0 uses default).
 	Interpolation   Interpolation // Resize interpolation mode.
 	Background      color.Color   // Background fill color (nil uses black).
+	ExactTransfer   bool          // Compute transfer functions with math.Pow instead of lookup tables.
 	ReceivePosition func(i int, top, left uint, width, height uint)
 }
 
@@ -31,9 +32,11 @@ func Grid(readers []io.Reader, cols int, cellW, cellH int, opts *GridOptions) (*
 		return nil, errors.New("invalid cell size")
 	}
 
-	quality := defaultPrimaryQuality
+	quality := Defaults.PrimaryQuality
 	interp := InterpolationLanczos2
+	exact := false
 	if opts != nil {
+		exact = opts.ExactTransfer
 		if opts.Quality > 0 {
 			quality = opts.Quality
 		}
@@ -52,10 +55,10 @@ func Grid(readers []io.Reader, cols int, cellW, cellH int, opts *GridOptions) (*
 	}
 	draw.Draw(grid, grid.Bounds(), &image.Uniform{C: bg}, image.Point{}, draw.Src)
 
-	gridHDR := &hdrImage{W: gridW, H: gridH, Pix: make([]float32, gridW*gridH*3)}
+	gridHDR := &HDRImage{W: gridW, H: gridH, Pix: make([]float32, gridW*gridH*3)}
 	fillHDRBackground(gridHDR, bg)
 	hasHDR := false
-	sdrProfile := colorProfile{gamut: colorGamutSRGB, transfer: colorTransferSRGB}
+	sdrProfile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
 
 	for idx, r := range readers {
 		if r == nil {
@@ -74,7 +77,7 @@ func Grid(readers []io.Reader, cols int, cellW, cellH int, opts *GridOptions) (*
 		}
 
 		if input.profile != sdrProfile {
-			input.sdr = convertImageProfile(input.sdr, input.profile, sdrProfile)
+			input.sdr = convertImageProfile(input.sdr, input.profile, sdrProfile, exact)
 		}
 
 		resized, w, h := resizeToFit(input.sdr, cellW, cellH, interp)
@@ -94,9 +97,9 @@ func Grid(readers []io.Reader, cols int, cellW, cellH int, opts *GridOptions) (*
 			if input.gainmap.Bounds().Dx() != w || input.gainmap.Bounds().Dy() != h {
 				gainmap = resizeImageInterpolated(input.gainmap, w, h, interp)
 			}
-			writeHDRTile(gridHDR, resized, gainmap, input.meta, x0, y0)
+			writeHDRTile(gridHDR, resized, gainmap, input.gainGamut, input.meta, x0, y0, exact)
 		} else {
-			writeHDRTile(gridHDR, resized, nil, nil, x0, y0)
+			writeHDRTile(gridHDR, resized, nil, ColorGamutSRGB, nil, x0, y0, exact)
 		}
 	}
 
@@ -108,11 +111,11 @@ func Grid(readers []io.Reader, cols int, cellW, cellH int, opts *GridOptions) (*
 		return &Result{Container: out, Primary: out}, nil
 	}
 
-	gainmapImg, meta, err := generateGainmapFromHDR(grid, sdrProfile, gridHDR, nil)
+	gainmapImg, meta, err := generateGainmapFromHDR(grid, sdrProfile, gridHDR, &RebaseOptions{ExactTransfer: exact})
 	if err != nil {
 		return nil, err
 	}
-	gainmapJPEG, err := encodeWithQuality(gainmapImg, defaultGainMapQuality)
+	gainmapJPEG, err := encodeWithQuality(gainmapImg, Defaults.GainmapQuality)
 	if err != nil {
 		return nil, err
 	}
@@ -120,7 +123,7 @@ func Grid(readers []io.Reader, cols int, cellW, cellH int, opts *GridOptions) (*
 	if err != nil {
 		return nil, err
 	}
-	container, err := assembleContainerVipsLike(out, gainmapJPEG, nil, nil, nil, secondaryISO)
+	container, err := assembleContainerVipsLike(containerParts{primary: out, gainmap: gainmapJPEG, secondaryISO: secondaryISO})
 	if err != nil {
 		return nil, err
 	}
@@ -166,17 +169,18 @@ func resizeToFit(img image.Image, cellW, cellH int, interp Interpolation) (image
 }
 
 type gridInput struct {
-	sdr     image.Image
-	gainmap image.Image
-	meta    *GainMapMetadata
-	profile colorProfile
+	sdr       image.Image
+	gainmap   image.Image
+	gainGamut ColorGamut
+	meta      *GainMapMetadata
+	profile   colorProfile
 }
 
 func decodeGridInput(data []byte) (*gridInput, error) {
 	if len(data) == 0 {
 		return nil, errors.New("empty input")
 	}
-	srcProfile := colorProfile{gamut: colorGamutSRGB, transfer: colorTransferSRGB}
+	srcProfile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
 	_, icc, err := extractExifAndIcc(data)
 	if err == nil {
 		srcProfile = detectColorProfileFromICCProfile(collectICCProfile(icc))
@@ -200,14 +204,15 @@ func decodeGridInput(data []byte) (*gridInput, error) {
 		return nil, err
 	}
 	return &gridInput{
-		sdr:     primaryImg,
-		gainmap: gainmapImg,
-		meta:    split.Meta,
-		profile: srcProfile,
+		sdr:       primaryImg,
+		gainmap:   gainmapImg,
+		gainGamut: gainApplicationGamut(split.Meta, srcProfile, split.Gainmap),
+		meta:      split.Meta,
+		profile:   srcProfile,
 	}, nil
 }
 
-func writeHDRTile(dst *hdrImage, sdr image.Image, gainmap image.Image, meta *GainMapMetadata, x0, y0 int) {
+func writeHDRTile(dst *HDRImage, sdr image.Image, gainmap image.Image, gainGamut ColorGamut, meta *GainMapMetadata, x0, y0 int, exact bool) {
 	if dst == nil || sdr == nil {
 		return
 	}
@@ -218,21 +223,25 @@ func writeHDRTile(dst *hdrImage, sdr image.Image, gainmap image.Image, meta *Gai
 	if gainmap != nil {
 		isGray = isGrayImage(gainmap)
 	}
-	srcProfile := colorProfile{gamut: colorGamutSRGB, transfer: colorTransferSRGB}
+	if gainmap == nil || meta == nil || isGray {
+		gainGamut = ColorGamutSRGB
+	}
+	srcProfile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+	dec := newGainDecoder(meta)
 
 	for y := 0; y < h; y++ {
 		for x := 0; x < w; x++ {
-			sdrRGB := sampleSDRInProfile(sdr, b.Min.X+x, b.Min.Y+y, srcProfile, colorGamutSRGB)
+			sdrRGB := sampleSDRInProfile(sdr, b.Min.X+x, b.Min.Y+y, srcProfile, gainGamut, exact)
 			hdrRGB := sdrRGB
-			if gainmap != nil && meta != nil {
-				hdrRGB = applyGainmapToSDR(sdrRGB, gainmap, meta, x, y, isGray)
+			if gainmap != nil && dec != nil {
+				hdrRGB = convertLinearGamut(applyGainmapToSDR(sdrRGB, gainmap, dec, x, y, isGray), gainGamut, ColorGamutSRGB)
 			}
 			dst.set(x0+x, y0+y, hdrRGB)
 		}
 	}
 }
 
-func (h *hdrImage) set(x, y int, v rgb) {
+func (h *HDRImage) set(x, y int, v rgb) {
 	if h == nil || x < 0 || y < 0 || x >= h.W || y >= h.H {
 		return
 	}
@@ -242,47 +251,42 @@ func (h *hdrImage) set(x, y int, v rgb) {
 	h.Pix[i+2] = v.b
 }
 
-func applyGainmapToSDR(sdr rgb, gainmap image.Image, meta *GainMapMetadata, x, y int, isGray bool) rgb {
-	if gainmap == nil || meta == nil {
+func applyGainmapToSDR(sdr rgb, gainmap image.Image, dec *gainDecoder, x, y int, isGray bool) rgb {
+	return applyGainmapWeighted(sdr, gainmap, dec, x, y, isGray, 1)
+}
+
+// applyGainmapWeighted applies gainmap scaled in log space by weight (0 is SDR, 1 is full HDR).
+func applyGainmapWeighted(sdr rgb, gainmap image.Image, dec *gainDecoder, x, y int, isGray bool, weight float32) rgb {
+	if gainmap == nil || dec == nil {
 		return sdr
 	}
+	var gr, gg, gb uint8
 	if isGray {
-		gv := gainmapDecodeValue(grayAt(gainmap, x, y), meta.Gamma[0])
-		logBoost := log2f(meta.MinContentBoost[0])*(1.0-gv) + log2f(meta.MaxContentBoost[0])*gv
-		gainFactor := exp2f(logBoost)
-		return rgb{
-			r: (sdr.r+meta.OffsetSDR[0])*gainFactor - meta.OffsetHDR[0],
-			g: (sdr.g+meta.OffsetSDR[0])*gainFactor - meta.OffsetHDR[0],
-			b: (sdr.b+meta.OffsetSDR[0])*gainFactor - meta.OffsetHDR[0],
-		}
+		// Single channel gainmap still uses per-channel metadata.
+		gr = grayAt(gainmap, x, y)
+		gg, gb = gr, gr
+	} else {
+		gr, gg, gb = rgbAt(gainmap, x, y)
 	}
-
-	gr, gg, gb := rgbAt(gainmap, x, y)
-	gain := rgb{
-		r: gainmapDecodeValue(gr, meta.Gamma[0]),
-		g: gainmapDecodeValue(gg, meta.Gamma[1]),
-		b: gainmapDecodeValue(gb, meta.Gamma[2]),
-	}
-	logBoostR := log2f(meta.MinContentBoost[0])*(1.0-gain.r) + log2f(meta.MaxContentBoost[0])*gain.r
-	logBoostG := log2f(meta.MinContentBoost[1])*(1.0-gain.g) + log2f(meta.MaxContentBoost[1])*gain.g
-	logBoostB := log2f(meta.MinContentBoost[2])*(1.0-gain.b) + log2f(meta.MaxContentBoost[2])*gain.b
-	gainFactorR := exp2f(logBoostR)
-	gainFactorG := exp2f(logBoostG)
-	gainFactorB := exp2f(logBoostB)
+	f := dec.gainmapFactors(gr, gg, gb)
+	if weight != 1 {
+		f = rgb{r: exp2f(log2f(f.r) * weight), g: exp2f(log2f(f.g) * weight), b: exp2f(log2f(f.b) * weight)}
+	}
+	meta := dec.meta
 	return rgb{
-		r: (sdr.r+meta.OffsetSDR[0])*gainFactorR - meta.OffsetHDR[0],
-		g: (sdr.g+meta.OffsetSDR[1])*gainFactorG - meta.OffsetHDR[1],
-		b: (sdr.b+meta.OffsetSDR[2])*gainFactorB - meta.OffsetHDR[2],
+		r: (sdr.r+meta.OffsetSDR[0])*f.r - meta.OffsetHDR[0],
+		g: (sdr.g+meta.OffsetSDR[1])*f.g - meta.OffsetHDR[1],
+		b: (sdr.b+meta.OffsetSDR[2])*f.b - meta.OffsetHDR[2],
 	}
 }
 
-func fillHDRBackground(dst *hdrImage, bg color.NRGBA) {
+func fillHDRBackground(dst *HDRImage, bg color.NRGBA) {
 	if dst == nil {
 		return
 	}
-	r := invOETF(float32(bg.R)/255.0, colorTransferSRGB)
-	g := invOETF(float32(bg.G)/255.0, colorTransferSRGB)
-	b := invOETF(float32(bg.B)/255.0, colorTransferSRGB)
+	r := invOETF(float32(bg.R)/255.0, ColorTransferSRGB)
+	g := invOETF(float32(bg.G)/255.0, ColorTransferSRGB)
+	b := invOETF(float32(bg.B)/255.0, ColorTransferSRGB)
 	for i := 0; i < len(dst.Pix); i += 3 {
 		dst.Pix[i] = r
 		dst.Pix[i+1] = g
@@ -2,8 +2,12 @@ package jpegx
 
 const (
 	sof0Marker = 0xc0 // Start Of Frame (Baseline Sequential).
+	sof2Marker = 0xc2 // Start Of Frame (Progressive DCT).
 	dhtMarker  = 0xc4 // Define Huffman Table.
 	dqtMarker  = 0xdb // Define Quantization Table.
+	sosMarker  = 0xda // Start Of Scan.
+	driMarker  = 0xdd // Define Restart Interval.
+	rst0Marker = 0xd0 // ReSTart (0), RST1-RST7 follow.
 )
 
 const blockSize = 64 // A DCT block is 8x8.
@@ -0,0 +1,523 @@
+package jpegx
+
+import (
+	"image"
+)
+
+// coefBlock is a quantized DCT block in zig-zag order.
+type coefBlock [blockSize]int16
+
+// coefPlane holds quantized blocks of a component, padded to whole MCUs.
+type coefPlane struct {
+	blocks []coefBlock
+	stride int // Blocks per padded row.
+	// w and h are block counts covering component samples, non-interleaved scans visit only them.
+	w, h int
+}
+
+// progressiveScan is a scan of a spectral band, DC scans (ss == 0) interleave all components.
+type progressiveScan struct {
+	comp   int
+	ss, se int
+}
+
+// progressiveScans is a spectral selection script: DC first, then low luma frequencies
+// for a quick preview, chroma and remaining luma frequencies. Successive approximation
+// is not used.
+var progressiveScans = []progressiveScan{
+	{ss: 0, se: 0},
+	{comp: 0, ss: 1, se: 5},
+	{comp: 1, ss: 1, se: 63},
+	{comp: 2, ss: 1, se: 63},
+	{comp: 0, ss: 6, se: 63},
+}
+
+// quantize transforms b and stores quantized coefficients in zig-zag order.
+func (e *encoder) quantize(b *block, q quantIndex, dst *coefBlock) {
+	fdct(b)
+	for zig := 0; zig < blockSize; zig++ {
+		dst[zig] = int16(div(b[unzig[zig]], 8*int32(e.quant[q][zig])))
+	}
+}
+
+// is444 reports whether chroma is stored at full resolution, 4:2:0 is used otherwise.
+func (e *encoder) is444() bool {
+	return e.useSampling && e.sampling[0].H == 1 && e.sampling[0].V == 1
+}
+
+// quantizeImage computes quantized DCT coefficients of all components of m.
+func (e *encoder) quantizeImage(m image.Image) []coefPlane {
+	bounds := m.Bounds()
+	blocksW, blocksH := (bounds.Dx()+7)/8, (bounds.Dy()+7)/8
+	var b block
+	if gray, ok := m.(*image.Gray); ok {
+		p := coefPlane{blocks: e.coefBlocks(blocksW * blocksH), stride: blocksW, w: blocksW, h: blocksH}
+		for by := 0; by < blocksH; by++ {
+			for bx := 0; bx < blocksW; bx++ {
+				grayToY(gray, image.Pt(bounds.Min.X+8*bx, bounds.Min.Y+8*by), &b)
+				e.quantize(&b, 0, &p.blocks[by*blocksW+bx])
+			}
+		}
+		return []coefPlane{p}
+	}
+
+	rgba, _ := m.(*image.RGBA)
+	ycbcr, _ := m.(*image.YCbCr)
+	var cb, cr [4]block
+	extract := func(p image.Point, i int) {
+		switch {
+		case rgba != nil:
+			rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
+		case ycbcr != nil:
+			yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
+		default:
+			toYCbCr(m, p, &b, &cb[i], &cr[i])
+		}
+	}
+
+	if e.is444() {
+		planes := make([]coefPlane, 3)
+		n := blocksW * blocksH
+		blocks := e.coefBlocks(3 * n)
+		for c := range planes {
+			planes[c] = coefPlane{blocks: blocks[c*n : (c+1)*n : (c+1)*n], stride: blocksW, w: blocksW, h: blocksH}
+		}
+		for by := 0; by < blocksH; by++ {
+			for bx := 0; bx < blocksW; bx++ {
+				extract(image.Pt(bounds.Min.X+8*bx, bounds.Min.Y+8*by), 0)
+				i := by*blocksW + bx
+				e.quantize(&b, 0, &planes[0].blocks[i])
+				e.quantize(&cb[0], 1, &planes[1].blocks[i])
+				e.quantize(&cr[0], 1, &planes[2].blocks[i])
+			}
+		}
+		return planes
+	}
+
+	// 4:2:0, MCU is 16x16 with four luma blocks.
+	mcusW, mcusH := (bounds.Dx()+15)/16, (bounds.Dy()+15)/16
+	chromaW, chromaH := (bounds.Dx()+1)/2, (bounds.Dy()+1)/2
+	n := mcusW * mcusH
+	blocks := e.coefBlocks(6 * n)
+	planes := []coefPlane{
+		{blocks: blocks[: 4*n : 4*n], stride: 2 * mcusW, w: blocksW, h: blocksH},
+		{blocks: blocks[4*n : 5*n : 5*n], stride: mcusW, w: (chromaW + 7) / 8, h: (chromaH + 7) / 8},
+		{blocks: blocks[5*n:], stride: mcusW, w: (chromaW + 7) / 8, h: (chromaH + 7) / 8},
+	}
+	for my := 0; my < mcusH; my++ {
+		for mx := 0; mx < mcusW; mx++ {
+			for i := 0; i < 4; i++ {
+				xOff, yOff := i&1, i>>1
+				extract(image.Pt(bounds.Min.X+16*mx+8*xOff, bounds.Min.Y+16*my+8*yOff), i)
+				e.quantize(&b, 0, &planes[0].blocks[(2*my+yOff)*planes[0].stride+2*mx+xOff])
+			}
+			scale(&b, &cb)
+			e.quantize(&b, 1, &planes[1].blocks[my*mcusW+mx])
+			scale(&b, &cr)
+			e.quantize(&b, 1, &planes[2].blocks[my*mcusW+mx])
+		}
+	}
+	return planes
+}
+
+// scanCoder emits Huffman coded symbols of a scan, or counts symbol frequencies when counting.
+type scanCoder struct {
+	e        *encoder
+	counting bool
+	freq     [nHuffIndex][257]int64
+	lut      [nHuffIndex]huffmanLUT
+	eobRun   int32
+	rst      restarter
+}
+
+// restart is called before each MCU of a scan, it reports whether DC predictions must be reset.
+func (s *scanCoder) restart() bool {
+	if !s.rst.due() {
+		return false
+	}
+	s.flushEOBRun()
+	if !s.counting {
+		s.e.writeRST(&s.rst)
+	}
+	return true
+}
+
+func (s *scanCoder) symbol(t int, sym int32) {
+	if s.counting {
+		s.freq[t][sym]++
+		return
+	}
+	x := s.lut[t][sym]
+	s.e.emit(x&(1<<24-1), x>>24)
+}
+
+// value emits a run/size symbol followed by the value bits, as emitHuffRLE does.
+func (s *scanCoder) value(t int, runLength, v int32) {
+	a, b := v, v
+	if a < 0 {
+		a, b = -v, v-1
+	}
+	var nBits uint32
+	if a < 0x100 {
+		nBits = uint32(bitCount[a])
+	} else {
+		nBits = 8 + uint32(bitCount[a>>8])
+	}
+	s.symbol(t, runLength<<4|int32(nBits))
+	if nBits > 0 && !s.counting {
+		s.e.emit(uint32(b)&(1<<nBits-1), nBits)
+	}
+}
+
+// flushEOBRun emits pending run of blocks with no more non-zero coefficients in the band.
+func (s *scanCoder) flushEOBRun() {
+	if s.eobRun == 0 {
+		return
+	}
+	nBits := uint32(0)
+	for s.eobRun>>(nBits+1) != 0 {
+		nBits++
+	}
+	s.symbol(0, int32(nBits)<<4)
+	if nBits > 0 && !s.counting {
+		s.e.emit(uint32(s.eobRun)&(1<<nBits-1), nBits)
+	}
+	s.eobRun = 0
+}
+
+// encodeDC codes DC coefficients of all planes in MCU order, luma uses table 0 and chroma table 1.
+func (s *scanCoder) encodeDC(planes []coefPlane) {
+	var prevDC [3]int32
+	dc := func(c int, i int) {
+		v := int32(planes[c].blocks[i][0])
+		s.value(min(c, 1), 0, v-prevDC[c])
+		prevDC[c] = v
+	}
+	if len(planes) == 1 {
+		// Single component scan is not interleaved.
+		p := planes[0]
+		for by := 0; by < p.h; by++ {
+			for bx := 0; bx < p.w; bx++ {
+				if s.restart() {
+					prevDC = [3]int32{}
+				}
+				dc(0, by*p.stride+bx)
+			}
+		}
+		return
+	}
+	// Luma blocks per MCU along each axis.
+	n := 2
+	if planes[0].stride == planes[1].stride {
+		n = 1
+	}
+	if len(planes[1].blocks) == 0 {
+		return
+	}
+	mcusH := len(planes[1].blocks) / planes[1].stride
+	for my := 0; my < mcusH; my++ {
+		for mx := 0; mx < planes[1].stride; mx++ {
+			if s.restart() {
+				prevDC = [3]int32{}
+			}
+			for v := 0; v < n; v++ {
+				for h := 0; h < n; h++ {
+					dc(0, (n*my+v)*planes[0].stride+n*mx+h)
+				}
+			}
+			dc(1, my*planes[1].stride+mx)
+			dc(2, my*planes[2].stride+mx)
+		}
+	}
+}
+
+// encodeAC codes ss..se band of a single plane with table 0, runs of empty bands are coded with EOBRUN.
+func (s *scanCoder) encodeAC(p coefPlane, ss, se int) {
+	for by := 0; by < p.h; by++ {
+		for bx := 0; bx < p.w; bx++ {
+			s.restart()
+			blk := &p.blocks[by*p.stride+bx]
+			runLength := int32(0)
+			for k := ss; k <= se; k++ {
+				v := int32(blk[k])
+				if v == 0 {
+					runLength++
+					continue
+				}
+				s.flushEOBRun()
+				for runLength > 15 {
+					s.symbol(0, 0xf0)
+					runLength -= 16
+				}
+				s.value(0, runLength, v)
+				runLength = 0
+			}
+			if runLength > 0 {
+				s.eobRun++
+				if s.eobRun == 0x7fff {
+					s.flushEOBRun()
+				}
+			}
+		}
+	}
+	s.flushEOBRun()
+}
+
+// encodeSequential codes all coefficients of interleaved baseline MCUs with tables of
+// huffIndex order: luma DC and AC tables are 0 and 1, chroma tables are 2 and 3.
+func (s *scanCoder) encodeSequential(planes []coefPlane) {
+	var prevDC [3]int32
+	blk := func(c int, i int) {
+		t := 2 * min(c, 1)
+		b := &planes[c].blocks[i]
+		s.value(t, 0, int32(b[0])-prevDC[c])
+		prevDC[c] = int32(b[0])
+		runLength := int32(0)
+		for k := 1; k < blockSize; k++ {
+			v := int32(b[k])
+			if v == 0 {
+				runLength++
+				continue
+			}
+			for runLength > 15 {
+				s.symbol(t+1, 0xf0)
+				runLength -= 16
+			}
+			s.value(t+1, runLength, v)
+			runLength = 0
+		}
+		if runLength > 0 {
+			s.symbol(t+1, 0x00)
+		}
+	}
+	if len(planes) == 1 {
+		p := planes[0]
+		for by := 0; by < p.h; by++ {
+			for bx := 0; bx < p.w; bx++ {
+				if s.restart() {
+					prevDC = [3]int32{}
+				}
+				blk(0, by*p.stride+bx)
+			}
+		}
+		return
+	}
+	n := 2
+	if planes[0].stride == planes[1].stride {
+		n = 1
+	}
+	mcusH := len(planes[1].blocks) / planes[1].stride
+	for my := 0; my < mcusH; my++ {
+		for mx := 0; mx < planes[1].stride; mx++ {
+			if s.restart() {
+				prevDC = [3]int32{}
+			}
+			for v := 0; v < n; v++ {
+				for h := 0; h < n; h++ {
+					blk(0, (n*my+v)*planes[0].stride+n*mx+h)
+				}
+			}
+			blk(1, my*planes[1].stride+mx)
+			blk(2, my*planes[2].stride+mx)
+		}
+	}
+}
+
+// optimizeHuffman replaces Huffman tables with optimal tables for symbol frequencies of
+// a baseline scan of planes.
+func (e *encoder) optimizeHuffman(planes []coefPlane) {
+	s := scanCoder{e: e, counting: true, rst: restarter{interval: e.restartInterval}}
+	s.encodeSequential(planes)
+	tables := int(nHuffIndex)
+	if len(planes) == 1 {
+		tables = 2
+	}
+	for t := 0; t < tables; t++ {
+		spec := optimalHuffmanSpec(&s.freq[t], e.valueBuf[t][:0])
+		e.huffSpec[t] = spec
+		e.huffLUT[t].initInto(&e.lutBuf[t], spec)
+	}
+	e.useCustomHuff = true
+}
+
+// writeSequential writes SOS marker and baseline entropy-coded data of quantized planes.
+func (e *encoder) writeSequential(planes []coefPlane) {
+	if len(planes) == 1 {
+		e.write(sosHeaderY)
+	} else {
+		e.write(sosHeaderYCbCr)
+	}
+	s := scanCoder{e: e, lut: e.huffLUT, rst: restarter{interval: e.restartInterval}}
+	s.encodeSequential(planes)
+	// Pad the last byte with 1's.
+	e.emit(0x7f, 7)
+}
+
+// writeProgressive writes DHT and SOS markers with entropy-coded data of each scan of the script.
+// Huffman tables are optimized for each scan, as standard tables have no EOBRUN symbols.
+func (e *encoder) writeProgressive(m image.Image) {
+	planes := e.quantizeImage(m)
+	dri := 0
+	for _, scan := range progressiveScans {
+		if scan.comp >= len(planes) {
+			continue
+		}
+		// Decoders disagree on MCU of a non-interleaved scan of subsampled luma: one block
+		// by spec (libjpeg), 2x2 blocks in image/jpeg, so such scans have no restarts.
+		interval := e.restartInterval
+		if scan.ss > 0 && scan.comp == 0 && len(planes) > 1 && !e.is444() {
+			interval = 0
+		}
+		if interval != dri {
+			e.writeDRI(interval)
+			dri = interval
+		}
+		s := scanCoder{e: e, counting: true}
+		code := func() {
+			s.rst = restarter{interval: interval}
+			if scan.ss == 0 {
+				s.encodeDC(planes)
+			} else {
+				s.encodeAC(planes[scan.comp], scan.ss, scan.se)
+			}
+		}
+		code()
+
+		tables := 1
+		if scan.ss == 0 && len(planes) > 1 {
+			tables = 2
+		}
+		tableClass := byte(0x00)
+		if scan.ss > 0 {
+			tableClass = 0x10
+		}
+		for t := 0; t < tables; t++ {
+			// Scan tables use scratch past huffLUT storage, which is kept intact.
+			spec := optimalHuffmanSpec(&s.freq[t], e.valueBuf[int(nHuffIndex)+t][:0])
+			s.lut[t].initInto(&e.lutBuf[int(nHuffIndex)+t], spec)
+			e.writeMarkerHeader(dhtMarker, 2+1+16+len(spec.Value))
+			e.writeByte(tableClass | byte(t))
+			e.write(spec.Count[:])
+			e.write(spec.Value)
+		}
+
+		e.writeScanHeader(scan, len(planes))
+		s.counting = false
+		code()
+		// Pad the last byte with 1's.
+		if e.nBits > 0 {
+			e.emit(0x7f, 7)
+		}
+		e.bits, e.nBits = 0, 0
+	}
+}
+
+// writeScanHeader writes SOS marker of a progressive scan.
+func (e *encoder) writeScanHeader(scan progressiveScan, nComponent int) {
+	comps := []int{scan.comp}
+	if scan.ss == 0 {
+		comps = comps[:0]
+		for c := 0; c < nComponent; c++ {
+			comps = append(comps, c)
+		}
+	}
+	e.writeMarkerHeader(sosMarker, 6+2*len(comps))
+	e.writeByte(byte(len(comps)))
+	for _, c := range comps {
+		// DC scans select per component DC table, AC scans always use table 0.
+		tables := byte(0)
+		if scan.ss == 0 {
+			tables = byte(min(c, 1)) << 4
+		}
+		e.writeByte(byte(c + 1))
+		e.writeByte(tables)
+	}
+	e.writeByte(byte(scan.ss))
+	e.writeByte(byte(scan.se))
+	e.writeByte(0) // Ah, Al: no successive approximation.
+}
+
+// optimalHuffmanSpec builds a Huffman table for symbol frequencies with code lengths
+// limited to 16 bits, following section K.2 of the spec. freq is modified, symbols are
+// appended to values.
+func optimalHuffmanSpec(freq *[257]int64, values []byte) HuffmanSpec {
+	var (
+		codeSize [257]int
+		others   [257]int
+		bits     [33]int
+	)
+	for i := range others {
+		others[i] = -1
+	}
+	// Reserved symbol guarantees no code word consists of all 1 bits.
+	freq[256] = 1
+
+	for {
+		c1, c2 := -1, -1
+		var v1, v2 int64
+		for i, f := range freq {
+			if f == 0 {
+				continue
+			}
+			if c1 < 0 || f <= v1 {
+				c2, v2 = c1, v1
+				c1, v1 = i, f
+			} else if c2 < 0 || f <= v2 {
+				c2, v2 = i, f
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	for _, size := range codeSize {
+		if size > 0 {
+			bits[size]++
+		}
+	}
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	// Remove the reserved symbol, it has the longest code.
+	bits[i]--
+
+	spec := HuffmanSpec{Value: values}
+	for i := 1; i <= 16; i++ {
+		spec.Count[i-1] = byte(bits[i])
+	}
+	for size := 1; size <= 32; size++ {
+		for sym := 0; sym < 256; sym++ {
+			if codeSize[sym] == size {
+				spec.Value = append(spec.Value, byte(sym))
+			}
+		}
+	}
+	return spec
+}
@@ -0,0 +1,216 @@
+package jpegx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// scanInfo describes a scan of an encoded JPEG.
+type scanInfo struct {
+	comps          []byte // Component selectors.
+	ss, se, ah, al byte
+	interval       int    // Restart interval in effect for the scan.
+	rst            []byte // RST markers of entropy-coded data in order of appearance.
+}
+
+// parseScans returns frame marker and scans of data.
+func parseScans(t *testing.T, data []byte) (sof byte, scans []scanInfo) {
+	t.Helper()
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		t.Fatalf("missing SOI")
+	}
+	interval := 0
+	i := 2
+	for {
+		if i+2 > len(data) || data[i] != 0xff {
+			t.Fatalf("invalid marker at %d", i)
+		}
+		marker := data[i+1]
+		if marker == 0xd9 {
+			if i+2 != len(data) {
+				t.Fatalf("%d bytes after EOI", len(data)-i-2)
+			}
+			return sof, scans
+		}
+		if i+4 > len(data) {
+			t.Fatalf("truncated marker %X at %d", marker, i)
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			t.Fatalf("invalid length of marker %X at %d", marker, i)
+		}
+		seg := data[i+4 : i+2+n]
+		i += 2 + n
+		switch marker {
+		case sof0Marker, sof2Marker:
+			sof = marker
+		case driMarker:
+			interval = int(binary.BigEndian.Uint16(seg))
+		case sosMarker:
+			nc := int(seg[0])
+			s := scanInfo{interval: interval, ss: seg[1+2*nc], se: seg[2+2*nc], ah: seg[3+2*nc] >> 4, al: seg[3+2*nc] & 0x0f}
+			for c := 0; c < nc; c++ {
+				s.comps = append(s.comps, seg[1+2*c])
+			}
+			// Entropy-coded data ends at a marker other than RST or stuffed zero.
+			for ; i+1 < len(data); i++ {
+				if data[i] != 0xff || data[i+1] == 0x00 {
+					continue
+				}
+				if data[i+1] < rst0Marker || data[i+1] > rst0Marker+7 {
+					break
+				}
+				s.rst = append(s.rst, data[i+1])
+				i++
+			}
+			scans = append(scans, s)
+		}
+	}
+}
+
+// testImage returns RGBA image with gradients and texture, so that all bands have non-zero coefficients.
+func testImage(w, h int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetRGBA(x, y, color.RGBA{
+				R: uint8(x * 255 / w),
+				G: uint8(y * 255 / h),
+				B: uint8((x*y)%7*20 + (x/3+y/5)%2*60),
+				A: 0xff,
+			})
+		}
+	}
+	return m
+}
+
+func testGray(w, h int) *image.Gray {
+	m := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(m, m.Bounds(), testImage(w, h), image.Point{}, draw.Src)
+	return m
+}
+
+var (
+	sampling420 = [3]SamplingFactor{{H: 2, V: 2}, {H: 1, V: 1}, {H: 1, V: 1}}
+	sampling444 = [3]SamplingFactor{{H: 1, V: 1}, {H: 1, V: 1}, {H: 1, V: 1}}
+)
+
+func toRGBA(m image.Image) *image.RGBA {
+	r := image.NewRGBA(image.Rect(0, 0, m.Bounds().Dx(), m.Bounds().Dy()))
+	draw.Draw(r, r.Bounds(), m, m.Bounds().Min, draw.Src)
+	return r
+}
+
+func TestProgressiveDecode(t *testing.T) {
+	// Odd sizes make partial MCUs, non-interleaved scans cover fewer blocks than MCU grid.
+	images := []image.Image{testImage(64, 48), testImage(37, 23), testGray(41, 17)}
+	for _, sampling := range [][3]SamplingFactor{sampling420, sampling444} {
+		for i, img := range images {
+			var baseline, progressive bytes.Buffer
+			opt := EncoderOptions{Quality: 85, UseSampling: true, Sampling: sampling}
+			if err := EncodeWithTables(&baseline, img, opt); err != nil {
+				t.Fatalf("image %d: encode baseline: %v", i, err)
+			}
+			opt.Progressive = true
+			if err := EncodeWithTables(&progressive, img, opt); err != nil {
+				t.Fatalf("image %d: encode progressive: %v", i, err)
+			}
+
+			want, err := jpeg.Decode(&baseline)
+			if err != nil {
+				t.Fatalf("image %d: decode baseline: %v", i, err)
+			}
+			got, err := jpeg.Decode(&progressive)
+			if err != nil {
+				t.Fatalf("image %d: decode progressive: %v", i, err)
+			}
+			if got.Bounds() != img.Bounds() {
+				t.Fatalf("image %d: bounds %v, want %v", i, got.Bounds(), img.Bounds())
+			}
+			switch m := got.(type) {
+			case *image.Gray:
+				if _, ok := img.(*image.Gray); !ok {
+					t.Fatalf("image %d: decoded gray image", i)
+				}
+			case *image.YCbCr:
+				ratio := image.YCbCrSubsampleRatio420
+				if sampling == sampling444 {
+					ratio = image.YCbCrSubsampleRatio444
+				}
+				if m.SubsampleRatio != ratio {
+					t.Fatalf("image %d: subsample ratio %v, want %v", i, m.SubsampleRatio, ratio)
+				}
+			default:
+				t.Fatalf("image %d: unexpected decoded type %T", i, got)
+			}
+
+			// Both carry the same quantized coefficients, rounding of decoder IDCT may differ.
+			wantPix, gotPix := toRGBA(want).Pix, toRGBA(got).Pix
+			for j := range wantPix {
+				if d := int(gotPix[j]) - int(wantPix[j]); d < -1 || d > 1 {
+					t.Fatalf("image %d: sample %d is %d, baseline %d", i, j, gotPix[j], wantPix[j])
+				}
+			}
+		}
+	}
+}
+
+func TestProgressiveScanCoverage(t *testing.T) {
+	for _, sampling := range [][3]SamplingFactor{sampling420, sampling444} {
+		for i, img := range []image.Image{testImage(37, 23), testGray(41, 17)} {
+			var buf bytes.Buffer
+			if err := EncodeWithTables(&buf, img, EncoderOptions{Quality: 85, UseSampling: true, Sampling: sampling, Progressive: true}); err != nil {
+				t.Fatalf("image %d: encode: %v", i, err)
+			}
+			sof, scans := parseScans(t, buf.Bytes())
+			if sof != sof2Marker {
+				t.Fatalf("image %d: frame marker %X, want SOF2", i, sof)
+			}
+			nComponent := 3
+			if _, ok := img.(*image.Gray); ok {
+				nComponent = 1
+			}
+
+			// Each coefficient of each component is sent by exactly one scan, with all its bits.
+			var coverage [3][blockSize]int
+			for j, s := range scans {
+				if s.ss > s.se || s.se >= blockSize {
+					t.Fatalf("image %d, scan %d: spectral selection %d..%d", i, j, s.ss, s.se)
+				}
+				if s.ah != 0 || s.al != 0 {
+					t.Fatalf("image %d, scan %d: successive approximation Ah %d, Al %d", i, j, s.ah, s.al)
+				}
+				if s.ss == 0 {
+					if s.se != 0 || len(s.comps) != nComponent {
+						t.Fatalf("image %d, scan %d: DC scan of %d components up to %d", i, j, len(s.comps), s.se)
+					}
+				} else if len(s.comps) != 1 {
+					t.Fatalf("image %d, scan %d: AC scan of %d components", i, j, len(s.comps))
+				}
+				for _, c := range s.comps {
+					if c < 1 || int(c) > nComponent {
+						t.Fatalf("image %d, scan %d: component %d", i, j, c)
+					}
+					if s.ss > 0 && coverage[c-1][0] == 0 {
+						t.Fatalf("image %d, scan %d: AC scan of component %d precedes its DC scan", i, j, c)
+					}
+					for k := s.ss; k <= s.se; k++ {
+						coverage[c-1][k]++
+					}
+				}
+			}
+			for c := 0; c < nComponent; c++ {
+				for k, n := range coverage[c] {
+					if n != 1 {
+						t.Fatalf("image %d: coefficient %d of component %d sent %d times", i, k, c+1, n)
+					}
+				}
+			}
+		}
+	}
+}
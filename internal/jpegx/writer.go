@@ -180,7 +180,13 @@ type huffmanLUT []uint32
 
 func (h *huffmanLUT) init(s HuffmanSpec) {
 	// Always allocate 256 entries to cover all possible symbols.
-	*h = make([]uint32, 256)
+	h.initInto(new([256]uint32), s)
+}
+
+// initInto compiles s into storage of dst, so that encoders reuse it across images.
+func (h *huffmanLUT) initInto(dst *[256]uint32, s HuffmanSpec) {
+	*dst = [256]uint32{}
+	*h = dst[:]
 	code, k := uint32(0), 0
 	for i := 0; i < len(s.Count); i++ {
 		nBits := uint32(i+1) << 24
@@ -229,6 +235,38 @@ type encoder struct {
 	// sampling factors for Y, Cb, Cr
 	sampling    [3]SamplingFactor
 	useSampling bool
+	// restartInterval is the number of MCUs between RST markers, 0 disables them.
+	restartInterval int
+
+	// Scratch storage kept by reset: compiled custom Huffman tables (huffLUT, then progressive
+	// scan tables), values of optimal Huffman tables and quantized coefficients.
+	lutBuf   [nHuffIndex + 2][256]uint32
+	valueBuf [nHuffIndex + 2][256]byte
+	coefBuf  []coefBlock
+}
+
+// maxScratchBlocks limits coefficient blocks kept by encoder between images (64 MiB).
+const maxScratchBlocks = 64 << 20 / (blockSize * 2)
+
+// reset clears per-image state of e, scratch storage is kept for reuse.
+func (e *encoder) reset() {
+	e.w, e.err = nil, nil
+	e.bits, e.nBits = 0, 0
+	e.useCustomHuff = false
+	e.sampling, e.useSampling = [3]SamplingFactor{}, false
+	e.restartInterval = 0
+}
+
+// coefBlocks returns n blocks of scratch storage, contents are not cleared.
+// Blocks of images larger than maxScratchBlocks are not kept.
+func (e *encoder) coefBlocks(n int) []coefBlock {
+	if n > maxScratchBlocks {
+		return make([]coefBlock, n)
+	}
+	if cap(e.coefBuf) < n {
+		e.coefBuf = make([]coefBlock, n)
+	}
+	return e.coefBuf[:n]
 }
 
 func (e *encoder) flush() {
@@ -295,6 +333,46 @@ func (e *encoder) emitHuffRLE(h huffIndex, runLength, value int32) {
 	}
 }
 
+// restarter counts MCUs of a scan to insert RST markers every interval MCUs.
+type restarter struct {
+	interval int
+	mcus     int
+	count    int
+}
+
+// due is called before each MCU, it reports whether a restart marker precedes it,
+// DC predictions (and EOB runs of progressive scans) are reset then.
+func (r *restarter) due() bool {
+	if r.interval <= 0 {
+		return false
+	}
+	r.mcus++
+	return r.mcus > 1 && (r.mcus-1)%r.interval == 0
+}
+
+// writeRST pads entropy-coded data to a byte boundary and writes the next RST marker.
+func (e *encoder) writeRST(r *restarter) {
+	e.padByte()
+	e.writeByte(0xff)
+	e.writeByte(rst0Marker + uint8(r.count&7))
+	r.count++
+}
+
+// padByte pads pending bits to a byte boundary with 1's.
+func (e *encoder) padByte() {
+	if e.nBits > 0 {
+		e.emit(0x7f, 7)
+	}
+	e.bits, e.nBits = 0, 0
+}
+
+// writeDRI writes the Define Restart Interval marker, interval 0 disables restarts of following scans.
+func (e *encoder) writeDRI(interval int) {
+	e.writeMarkerHeader(driMarker, 4)
+	e.writeByte(uint8(interval >> 8))
+	e.writeByte(uint8(interval))
+}
+
 // writeMarkerHeader writes the header for a marker with the given length.
 func (e *encoder) writeMarkerHeader(marker uint8, markerlen int) {
 	e.buf[0] = 0xff
@@ -304,18 +382,26 @@ func (e *encoder) writeMarkerHeader(marker uint8, markerlen int) {
 	e.write(e.buf[:4])
 }
 
-// writeDQT writes the Define Quantization Table marker.
-func (e *encoder) writeDQT() {
-	const markerlen = 2 + int(nQuantIndex)*(1+blockSize)
-	e.writeMarkerHeader(dqtMarker, markerlen)
-	for i := range e.quant {
+// writeDQT writes the Define Quantization Table marker, grayscale images
+// have no chrominance table.
+func (e *encoder) writeDQT(nComponent int) {
+	tables := e.quant[:]
+	if nComponent == 1 {
+		tables = tables[:1]
+	}
+	e.writeMarkerHeader(dqtMarker, 2+len(tables)*(1+blockSize))
+	for i := range tables {
 		e.writeByte(uint8(i))
-		e.write(e.quant[i][:])
+		e.write(tables[i][:])
 	}
 }
 
-func (e *encoder) writeDQTSeparate() {
-	for i := range e.quant {
+func (e *encoder) writeDQTSeparate(nComponent int) {
+	tables := e.quant[:]
+	if nComponent == 1 {
+		tables = tables[:1]
+	}
+	for i := range tables {
 		const markerlen = 2 + 1 + blockSize
 		e.writeMarkerHeader(dqtMarker, markerlen)
 		e.writeByte(uint8(i))
@@ -325,8 +411,13 @@ func (e *encoder) writeDQTSeparate() {
 
 // writeSOF0 writes the Start Of Frame (Baseline Sequential) marker.
 func (e *encoder) writeSOF0(size image.Point, nComponent int) {
+	e.writeSOF(sof0Marker, size, nComponent)
+}
+
+// writeSOF writes the Start Of Frame marker of the given coding process.
+func (e *encoder) writeSOF(marker uint8, size image.Point, nComponent int) {
 	markerlen := 8 + 3*nComponent
-	e.writeMarkerHeader(sof0Marker, markerlen)
+	e.writeMarkerHeader(marker, markerlen)
 	e.buf[0] = 8 // 8-bit color.
 	e.buf[1] = uint8(size.Y >> 8)
 	e.buf[2] = uint8(size.Y & 0xff)
@@ -557,12 +648,20 @@ func (e *encoder) writeSOS(m image.Image) {
 		cb, cr [4]block
 		// DC components are delta-encoded.
 		prevDCY, prevDCCb, prevDCCr int32
+		rst                         = restarter{interval: e.restartInterval}
 	)
+	restart := func() {
+		if rst.due() {
+			e.writeRST(&rst)
+			prevDCY, prevDCCb, prevDCCr = 0, 0, 0
+		}
+	}
 	bounds := m.Bounds()
 	switch m := m.(type) {
 	case *image.Gray:
 		for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 {
 			for x := bounds.Min.X; x < bounds.Max.X; x += 8 {
+				restart()
 				p := image.Pt(x, y)
 				grayToY(m, p, &b)
 				prevDCY = e.writeBlock(&b, 0, prevDCY)
@@ -575,6 +674,7 @@ func (e *encoder) writeSOS(m image.Image) {
 			// 4:4:4
 			for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 {
 				for x := bounds.Min.X; x < bounds.Max.X; x += 8 {
+					restart()
 					p := image.Pt(x, y)
 					if rgba != nil {
 						rgbaToYCbCr(rgba, p, &b, &cb[0], &cr[0])
@@ -592,6 +692,7 @@ func (e *encoder) writeSOS(m image.Image) {
 			// Default 4:2:0
 			for y := bounds.Min.Y; y < bounds.Max.Y; y += 16 {
 				for x := bounds.Min.X; x < bounds.Max.X; x += 16 {
+					restart()
 					for i := 0; i < 4; i++ {
 						xOff := (i & 1) * 8
 						yOff := (i & 2) * 4
@@ -642,6 +743,16 @@ type EncoderOptions struct {
 	Sampling       [3]SamplingFactor
 	SplitDQT       bool
 	SplitDHT       bool
+	// Progressive writes progressive DCT scans (spectral selection) instead of a baseline scan.
+	// Huffman tables are optimized per scan, so UseHuffman and SplitDHT are ignored.
+	Progressive bool
+	// OptimizeHuffman builds optimal Huffman tables from symbol statistics of the image instead
+	// of writing standard tables, which takes an extra pass and makes baseline output smaller.
+	// UseHuffman tables are ignored, progressive scans are always optimized.
+	OptimizeHuffman bool
+	// RestartInterval writes DRI marker and RST markers every RestartInterval MCUs (up to 65535),
+	// so that a corrupted bit only damages image data up to the next restart. 0 disables restarts.
+	RestartInterval int
 }
 
 // Encode writes the Image m to w in JPEG 4:2:0 baseline format with the given
@@ -670,7 +781,7 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 	e.buf[1] = 0xd8
 	e.write(e.buf[:2])
 	// Write the quantization tables.
-	e.writeDQT()
+	e.writeDQT(nComponent)
 	// Write the image dimensions.
 	e.writeSOF0(b.Size(), nComponent)
 	// Write the Huffman tables.
@@ -687,17 +798,41 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 
 // EncodeWithTables writes JPEG using custom quantization and Huffman tables.
 func EncodeWithTables(w io.Writer, m image.Image, o EncoderOptions) error {
+	var enc Encoder
+	return enc.EncodeWithTables(w, m, o)
+}
+
+// Encoder writes JPEG images reusing its working memory (encoder state and output
+// buffering) across calls. Zero value is ready to use, it is not safe for concurrent use.
+type Encoder struct {
+	e  encoder
+	bw *bufio.Writer
+}
+
+// EncodeWithTables writes JPEG using custom quantization and Huffman tables.
+func (enc *Encoder) EncodeWithTables(w io.Writer, m image.Image, o EncoderOptions) error {
 	b := m.Bounds()
 	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
 		return errors.New("jpeg: image is too large to encode")
 	}
-	var e encoder
+	if o.RestartInterval < 0 || o.RestartInterval >= 1<<16 {
+		return errors.New("jpeg: invalid restart interval")
+	}
+	e := &enc.e
+	e.reset()
 	if ww, ok := w.(writer); ok {
 		e.w = ww
 	} else {
-		e.w = bufio.NewWriter(w)
+		if enc.bw == nil {
+			enc.bw = bufio.NewWriter(w)
+		} else {
+			enc.bw.Reset(w)
+		}
+		e.w = enc.bw
+		// Writer is not retained after encoding.
+		defer enc.bw.Reset(nil)
 	}
-	initEncoderWithOptions(&e, o)
+	initEncoderWithOptions(e, o)
 
 	e.write([]byte{0xff, 0xd8}) // SOI.
 	nComponent := 3
@@ -705,17 +840,35 @@ func EncodeWithTables(w io.Writer, m image.Image, o EncoderOptions) error {
 		nComponent = 1
 	}
 	if o.SplitDQT {
-		e.writeDQTSeparate()
+		e.writeDQTSeparate(nComponent)
 	} else {
-		e.writeDQT()
+		e.writeDQT(nComponent)
 	}
-	e.writeSOF0(b.Size(), nComponent)
-	if o.SplitDHT {
-		e.writeDHTSeparate(nComponent)
-	} else {
-		e.writeDHT(nComponent)
+	switch {
+	case o.Progressive:
+		e.writeSOF(sof2Marker, b.Size(), nComponent)
+		e.writeProgressive(m)
+	default:
+		e.writeSOF0(b.Size(), nComponent)
+		var planes []coefPlane
+		if o.OptimizeHuffman {
+			planes = e.quantizeImage(m)
+			e.optimizeHuffman(planes)
+		}
+		if o.SplitDHT {
+			e.writeDHTSeparate(nComponent)
+		} else {
+			e.writeDHT(nComponent)
+		}
+		if e.restartInterval > 0 {
+			e.writeDRI(e.restartInterval)
+		}
+		if planes != nil {
+			e.writeSequential(planes)
+		} else {
+			e.writeSOS(m)
+		}
 	}
-	e.writeSOS(m)
 	e.write([]byte{0xff, 0xd9}) // EOI.
 	e.flush()
 	return e.err
@@ -778,11 +931,12 @@ func initEncoderWithOptions(e *encoder, o EncoderOptions) {
 				}
 			}
 			e.huffSpec[i] = spec
-			e.huffLUT[i].init(spec)
+			e.huffLUT[i].initInto(&e.lutBuf[i], spec)
 		}
 	}
 	if o.UseSampling {
 		e.useSampling = true
 		e.sampling = o.Sampling
 	}
+	e.restartInterval = o.RestartInterval
 }
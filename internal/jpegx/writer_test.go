@@ -0,0 +1,183 @@
+package jpegx
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// checkRestarts checks RST markers of a scan of units MCUs: one between each interval MCUs,
+// numbered from RST0 and wrapping after RST7.
+func checkRestarts(t *testing.T, s scanInfo, units int) {
+	t.Helper()
+	want := 0
+	if s.interval > 0 {
+		want = (units - 1) / s.interval
+	}
+	if len(s.rst) != want {
+		t.Fatalf("scan %v %d..%d: %d RST markers for %d MCUs and interval %d, want %d", s.comps, s.ss, s.se, len(s.rst), units, s.interval, want)
+	}
+	for k, m := range s.rst {
+		if m != rst0Marker+byte(k%8) {
+			t.Fatalf("scan %v %d..%d: marker %d is %X", s.comps, s.ss, s.se, k, m)
+		}
+	}
+}
+
+// decodeRGBA decodes data with image/jpeg.
+func decodeRGBA(t *testing.T, data []byte) *image.RGBA {
+	t.Helper()
+	m, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return toRGBA(m)
+}
+
+func TestRestartMarkersWrap(t *testing.T) {
+	// 10x2 MCUs of 4:4:4, 19 restarts cycle through RST0-RST7 twice.
+	img := testImage(80, 16)
+	for _, optimize := range []bool{false, true} {
+		var plain, restarted bytes.Buffer
+		opt := EncoderOptions{Quality: 85, UseSampling: true, Sampling: sampling444, OptimizeHuffman: optimize}
+		if err := EncodeWithTables(&plain, img, opt); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		opt.RestartInterval = 1
+		if err := EncodeWithTables(&restarted, img, opt); err != nil {
+			t.Fatalf("encode with restarts: %v", err)
+		}
+		_, scans := parseScans(t, restarted.Bytes())
+		if len(scans) != 1 || scans[0].interval != 1 {
+			t.Fatalf("optimize %v: unexpected scans %v", optimize, scans)
+		}
+		checkRestarts(t, scans[0], 20)
+		if scans[0].rst[8] != rst0Marker || scans[0].rst[18] != rst0Marker+2 {
+			t.Fatalf("optimize %v: markers % X do not wrap", optimize, scans[0].rst)
+		}
+		if !bytes.Equal(decodeRGBA(t, plain.Bytes()).Pix, decodeRGBA(t, restarted.Bytes()).Pix) {
+			t.Fatalf("optimize %v: decoded image differs", optimize)
+		}
+	}
+}
+
+func TestRestartIntervalNotDividing(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		img      image.Image
+		sampling [3]SamplingFactor
+		interval int
+		mcus     int
+	}{
+		{name: "420", img: testImage(100, 70), sampling: sampling420, interval: 4, mcus: 7 * 5},
+		{name: "444", img: testImage(37, 23), sampling: sampling444, interval: 7, mcus: 5 * 3},
+		{name: "gray", img: testGray(41, 17), sampling: sampling420, interval: 5, mcus: 6 * 3},
+	} {
+		if tc.mcus%tc.interval == 0 {
+			t.Fatalf("%s: interval %d divides %d MCUs", tc.name, tc.interval, tc.mcus)
+		}
+		var plain, restarted bytes.Buffer
+		opt := EncoderOptions{Quality: 85, UseSampling: true, Sampling: tc.sampling}
+		if err := EncodeWithTables(&plain, tc.img, opt); err != nil {
+			t.Fatalf("%s: encode: %v", tc.name, err)
+		}
+		opt.RestartInterval = tc.interval
+		if err := EncodeWithTables(&restarted, tc.img, opt); err != nil {
+			t.Fatalf("%s: encode with restarts: %v", tc.name, err)
+		}
+		_, scans := parseScans(t, restarted.Bytes())
+		if len(scans) != 1 || scans[0].interval != tc.interval {
+			t.Fatalf("%s: unexpected scans %v", tc.name, scans)
+		}
+		checkRestarts(t, scans[0], tc.mcus)
+		// Restarts do not change coefficients, so decoded images are identical.
+		if !bytes.Equal(decodeRGBA(t, plain.Bytes()).Pix, decodeRGBA(t, restarted.Bytes()).Pix) {
+			t.Fatalf("%s: decoded image differs", tc.name)
+		}
+	}
+}
+
+func TestProgressiveRestarts(t *testing.T) {
+	const w, h, interval = 37, 23, 3
+	lumaBlocks := ((w + 7) / 8) * ((h + 7) / 8)
+	for _, tc := range []struct {
+		name     string
+		img      image.Image
+		sampling [3]SamplingFactor
+		// MCUs of the interleaved DC scan and blocks of AC scans by component.
+		dcMCUs   int
+		acBlocks [3]int
+		// Restarts of non-interleaved scans of subsampled luma are disabled.
+		acInterval [3]int
+	}{
+		{
+			name: "420", img: testImage(w, h), sampling: sampling420,
+			dcMCUs: 3 * 2, acBlocks: [3]int{lumaBlocks, 3 * 2, 3 * 2}, acInterval: [3]int{0, interval, interval},
+		},
+		{
+			name: "444", img: testImage(w, h), sampling: sampling444,
+			dcMCUs: lumaBlocks, acBlocks: [3]int{lumaBlocks, lumaBlocks, lumaBlocks}, acInterval: [3]int{interval, interval, interval},
+		},
+		{
+			name: "gray", img: testGray(w, h), sampling: sampling420,
+			dcMCUs: lumaBlocks, acBlocks: [3]int{lumaBlocks}, acInterval: [3]int{interval},
+		},
+	} {
+		var plain, restarted bytes.Buffer
+		opt := EncoderOptions{Quality: 85, UseSampling: true, Sampling: tc.sampling, Progressive: true}
+		if err := EncodeWithTables(&plain, tc.img, opt); err != nil {
+			t.Fatalf("%s: encode: %v", tc.name, err)
+		}
+		opt.RestartInterval = interval
+		if err := EncodeWithTables(&restarted, tc.img, opt); err != nil {
+			t.Fatalf("%s: encode with restarts: %v", tc.name, err)
+		}
+		_, scans := parseScans(t, restarted.Bytes())
+		for _, s := range scans {
+			units, want := tc.dcMCUs, interval
+			if s.ss > 0 {
+				c := s.comps[0] - 1
+				units, want = tc.acBlocks[c], tc.acInterval[c]
+			}
+			if s.interval != want {
+				t.Fatalf("%s: scan %v %d..%d has restart interval %d, want %d", tc.name, s.comps, s.ss, s.se, s.interval, want)
+			}
+			// Each scan numbers its restarts from RST0.
+			checkRestarts(t, s, units)
+		}
+		if !bytes.Equal(decodeRGBA(t, plain.Bytes()).Pix, decodeRGBA(t, restarted.Bytes()).Pix) {
+			t.Fatalf("%s: decoded image differs", tc.name)
+		}
+	}
+}
+
+func TestEncoderReuse(t *testing.T) {
+	// Images of different sizes and component counts are encoded in sequence, so that
+	// scratch storage of a larger image is reused for a smaller one and the other way around.
+	images := []image.Image{testImage(96, 64), testGray(41, 17), testImage(37, 23), testGray(130, 70), testImage(8, 8)}
+	options := []EncoderOptions{
+		{Quality: 90, UseSampling: true, Sampling: sampling420, SplitDQT: true, SplitDHT: true},
+		{Quality: 75, UseSampling: true, Sampling: sampling444, OptimizeHuffman: true},
+		{Quality: 85, UseSampling: true, Sampling: sampling420, Progressive: true},
+		{Quality: 85, UseSampling: true, Sampling: sampling444, Progressive: true, RestartInterval: 2},
+	}
+
+	var enc Encoder
+	for i := 0; i < 2; i++ {
+		for o, opt := range options {
+			for j, img := range images {
+				var fresh, reused bytes.Buffer
+				if err := EncodeWithTables(&fresh, img, opt); err != nil {
+					t.Fatalf("options %d, image %d: encode: %v", o, j, err)
+				}
+				if err := enc.EncodeWithTables(&reused, img, opt); err != nil {
+					t.Fatalf("options %d, image %d: encode with reused encoder: %v", o, j, err)
+				}
+				if !bytes.Equal(reused.Bytes(), fresh.Bytes()) {
+					t.Fatalf("iteration %d, options %d, image %d: output of reused encoder differs", i, o, j)
+				}
+			}
+		}
+	}
+}
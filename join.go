@@ -1,43 +1,271 @@
 package ultrahdr
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+)
+
+// JoinOptions controls JoinWithOptions.
+type JoinOptions struct {
+	// GainmapQuality is the JPEG quality used to encode a PNG gainmap (0 uses default).
+	GainmapQuality int
+	// Warn receives non-fatal consistency warnings, e.g. gainmap and primary aspect ratio mismatch.
+	Warn func(msg string)
+	// KeepPrimaryAppSegments preserves APP segments of primary JPEG that container assembly
+	// does not manage (e.g. JFIF, vendor APPn), instead of stripping them.
+	// EXIF, XMP, ICC, MPF and ISO segments are still taken from metadata source, extended XMP
+	// segments of the replaced primary XMP are dropped.
+	KeepPrimaryAppSegments bool
+	// SkipValidation disables GainMapMetadata.Validate checks of gainmap metadata,
+	// e.g. to deliberately produce out of spec files for testing decoders.
+	SkipValidation bool
+}
 
 // Join assembles an UltraHDR container from primary and gainmap JPEGs.
 // If bundle is provided, it is used as the metadata source. If template is provided,
 // it is used to build the bundle. Otherwise gainmap metadata is extracted from the
 // gainmap JPEG and EXIF/ICC are extracted from the primary JPEG.
 func Join(primaryJPEG, gainmapJPEG []byte, bundle *MetadataBundle, template *Result) ([]byte, error) {
+	var out bytes.Buffer
+	if err := WriteJoined(&out, primaryJPEG, gainmapJPEG, bundle, template); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// WriteJoined is like Join, but writes the container to w. Image data is streamed
+// from primaryJPEG and gainmapJPEG without building the container in memory.
+func WriteJoined(w io.Writer, primaryJPEG, gainmapJPEG []byte, bundle *MetadataBundle, template *Result) error {
+	return writeJoined(w, primaryJPEG, gainmapJPEG, bundle, template, nil, false)
+}
+
+// writeJoined implements WriteJoined, leading segments are written right after primary SOI.
+func writeJoined(w io.Writer, primaryJPEG, gainmapJPEG []byte, bundle *MetadataBundle, template *Result, leading []appSegment, skipValidation bool) error {
+	parts, err := joinedParts(primaryJPEG, gainmapJPEG, bundle, template, leading, skipValidation)
+	if err != nil {
+		return err
+	}
+	return writeContainerVipsLike(w, parts)
+}
+
+// joinedParts collects container parts for writeJoined from bundle, template or JPEG segments.
+func joinedParts(primaryJPEG, gainmapJPEG []byte, bundle *MetadataBundle, template *Result, leading []appSegment, skipValidation bool) (containerParts, error) {
+	c := containerParts{primary: primaryJPEG, gainmap: gainmapJPEG, leading: leading}
 	if len(primaryJPEG) == 0 || len(gainmapJPEG) == 0 {
-		return nil, errors.New("missing primary or gainmap JPEG")
+		return c, errors.New("missing primary or gainmap JPEG")
+	}
+	if bundle == nil && template != nil {
+		var err error
+		if bundle, err = template.BuildMetadataBundle(); err != nil {
+			return c, err
+		}
 	}
 	if bundle != nil {
-		return assembleFromBundle(primaryJPEG, gainmapJPEG, bundle)
+		if err := bundle.Validate(); err != nil {
+			return c, err
+		}
+		if !skipValidation {
+			if err := validateSegmentMetadata(bundle.SecondaryXMP, bundle.SecondaryISO); err != nil {
+				return c, err
+			}
+		}
+		c.exif, c.icc, c.comments = bundle.Exif, bundle.ICC, bundle.Comments
+		c.primaryXMP, c.secondaryXMP, c.secondaryISO = completeSegmentMetadata(bundle.SecondaryXMP, bundle.SecondaryISO)
+		return c, nil
 	}
-	if template != nil {
-		bundle, err := template.BuildMetadataBundle()
+
+	var err error
+	c.exif, c.icc, err = extractExifAndIcc(primaryJPEG)
+	if err != nil {
+		return c, err
+	}
+	if len(c.exif) == 0 && len(c.icc) == 0 {
+		c.exif, c.icc, err = extractExifAndIcc(gainmapJPEG)
 		if err != nil {
-			return nil, err
+			return c, err
 		}
-		return assembleFromBundle(primaryJPEG, gainmapJPEG, bundle)
 	}
 
-	exif, icc, err := extractExifAndIcc(primaryJPEG)
+	app1, app2, err := extractAppSegments(gainmapJPEG)
 	if err != nil {
+		return c, err
+	}
+	secondaryXMP := findXMP(app1)
+	secondaryISO := findISO(app2)
+	if !skipValidation {
+		if err := validateSegmentMetadata(secondaryXMP, secondaryISO); err != nil {
+			return c, err
+		}
+	}
+	c.primaryXMP, c.secondaryXMP, c.secondaryISO = completeSegmentMetadata(secondaryXMP, secondaryISO)
+	return c, nil
+}
+
+// AssembleWithMetadata assembles an UltraHDR container from primary and gainmap JPEGs
+// using the provided gainmap metadata. ISO 21496-1 and XMP metadata are generated from meta,
+// the gainmap image is used as is. EXIF/ICC are taken from the primary JPEG (or the gainmap
+// JPEG when the primary has none).
+func AssembleWithMetadata(primaryJPEG, gainmapJPEG []byte, meta *GainMapMetadata) ([]byte, error) {
+	var out bytes.Buffer
+	if err := WriteContainer(&out, primaryJPEG, gainmapJPEG, meta); err != nil {
 		return nil, err
 	}
-	if len(exif) == 0 && len(icc) == 0 {
-		exif, icc, err = extractExifAndIcc(gainmapJPEG)
+	return out.Bytes(), nil
+}
+
+// WriteContainer is like AssembleWithMetadata, but writes the container to w.
+// MPF offsets are computed up front, so that large JPEG payloads are streamed
+// to w instead of being concatenated in memory.
+func WriteContainer(w io.Writer, primaryJPEG, gainmapJPEG []byte, meta *GainMapMetadata) error {
+	parts, err := containerSegments(primaryJPEG, gainmapJPEG, meta)
+	if err != nil {
+		return err
+	}
+	return writeContainerVipsLike(w, parts)
+}
+
+// PredictContainerSize returns the byte size of container that AssembleWithMetadata (or WriteContainer)
+// produces for the same arguments, without assembling it, e.g. to pre-allocate storage or to enforce
+// upload limits.
+func PredictContainerSize(primaryJPEG, gainmapJPEG []byte, meta *GainMapMetadata) (int, error) {
+	parts, err := containerSegments(primaryJPEG, gainmapJPEG, meta)
+	if err != nil {
+		return 0, err
+	}
+	return containerSizeVipsLike(parts)
+}
+
+// containerSegments validates meta and prepares EXIF, ICC and gainmap metadata segments for WriteContainer.
+func containerSegments(primaryJPEG, gainmapJPEG []byte, meta *GainMapMetadata) (containerParts, error) {
+	c := containerParts{primary: primaryJPEG, gainmap: gainmapJPEG}
+	if len(primaryJPEG) == 0 || len(gainmapJPEG) == 0 {
+		return c, errors.New("missing primary or gainmap JPEG")
+	}
+	if err := validateMetadata(meta); err != nil {
+		return c, err
+	}
+
+	var err error
+	c.exif, c.icc, err = extractExifAndIcc(primaryJPEG)
+	if err != nil {
+		return c, err
+	}
+	if len(c.exif) == 0 && len(c.icc) == 0 {
+		c.exif, c.icc, err = extractExifAndIcc(gainmapJPEG)
 		if err != nil {
-			return nil, err
+			return c, err
 		}
 	}
 
-	app1, app2, err := extractAppSegments(gainmapJPEG)
+	c.secondaryISO, err = buildIsoPayload(meta)
 	if err != nil {
+		return c, err
+	}
+	c.secondaryXMP = buildGainmapXMP(meta)
+	c.primaryXMP = buildPrimaryXMP(meta, 0)
+	return c, nil
+}
+
+// JoinWithOptions is like Join, but also accepts a PNG gainmap which is encoded to JPEG
+// (single channel for grayscale PNG) with opt.GainmapQuality before assembly, and can keep
+// custom APP segments of primary JPEG.
+// A PNG gainmap carries no gainmap metadata, so bundle or template is required for it.
+func JoinWithOptions(primaryJPEG, gainmap []byte, bundle *MetadataBundle, template *Result, opt *JoinOptions) ([]byte, error) {
+	var out bytes.Buffer
+	if err := WriteJoinedWithOptions(&out, primaryJPEG, gainmap, bundle, template, opt); err != nil {
 		return nil, err
 	}
-	secondaryXMP := findXMP(app1)
-	secondaryISO := findISO(app2)
+	return out.Bytes(), nil
+}
+
+// WriteJoinedWithOptions is like JoinWithOptions, but writes the container to w.
+// Kept APP segments are accounted in MPF up front, so image data is streamed as by WriteJoined.
+func WriteJoinedWithOptions(w io.Writer, primaryJPEG, gainmap []byte, bundle *MetadataBundle, template *Result, opt *JoinOptions) error {
+	if opt == nil {
+		opt = &JoinOptions{}
+	}
+	if len(primaryJPEG) == 0 || len(gainmap) == 0 {
+		return errors.New("missing primary or gainmap JPEG")
+	}
+	gainmapJPEG := gainmap
+	if bytes.HasPrefix(gainmap, pngSig) {
+		if bundle == nil && template == nil {
+			return errors.New("PNG gainmap requires metadata bundle or template")
+		}
+		img, err := png.Decode(bytes.NewReader(gainmap))
+		if err != nil {
+			return fmt.Errorf("decode PNG gainmap: %w", err)
+		}
+		quality := Defaults.GainmapQuality
+		if opt.GainmapQuality > 0 {
+			quality = opt.GainmapQuality
+		}
+		gainmapJPEG, err = encodeWithQuality(gainmapImageForJPEG(img), quality)
+		if err != nil {
+			return fmt.Errorf("encode gainmap: %w", err)
+		}
+	}
+	if opt.Warn != nil {
+		if msg := checkGainmapScale(primaryJPEG, gainmapJPEG); msg != "" {
+			opt.Warn(msg)
+		}
+	}
+	var leading []appSegment
+	if opt.KeepPrimaryAppSegments {
+		var err error
+		if leading, err = customAppSegments(primaryJPEG); err != nil {
+			return err
+		}
+	}
+	return writeJoined(w, primaryJPEG, gainmapJPEG, bundle, template, leading, opt.SkipValidation)
+}
+
+// gainmapImageForJPEG converts 16-bit grayscale images to 8-bit gray, so that gainmap is encoded
+// as a single channel JPEG.
+func gainmapImageForJPEG(img image.Image) image.Image {
+	if _, ok := img.(*image.Gray16); !ok {
+		return img
+	}
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	return gray
+}
 
-	return assembleContainerVipsLike(primaryJPEG, gainmapJPEG, exif, icc, secondaryXMP, secondaryISO)
+// checkGainmapScale returns a warning when gainmap dimensions do not correspond to a uniform
+// downscale of primary image, or an empty string.
+func checkGainmapScale(primaryJPEG, gainmapJPEG []byte) string {
+	pc, err := ParseJPEGHeader(primaryJPEG)
+	if err != nil {
+		return ""
+	}
+	gc, err := ParseJPEGHeader(gainmapJPEG)
+	if err != nil {
+		return ""
+	}
+	return gainmapScaleMismatch(pc.Width, pc.Height, gc.Width, gc.Height)
+}
+
+// gainmapScaleMismatch describes gainmap dimensions gw x gh that are not a uniform downscale
+// of primary dimensions pw x ph, or returns an empty string.
+func gainmapScaleMismatch(pw, ph, gw, gh int) string {
+	if pw <= 0 || ph <= 0 || gw <= 0 || gh <= 0 {
+		return ""
+	}
+	if gw > pw || gh > ph {
+		return fmt.Sprintf("gainmap %dx%d is larger than primary %dx%d", gw, gh, pw, ph)
+	}
+	// Allow one gainmap pixel of rounding.
+	wantH := float64(gw) * float64(ph) / float64(pw)
+	if math.Abs(wantH-float64(gh)) > 1 {
+		return fmt.Sprintf("gainmap %dx%d aspect ratio does not match primary %dx%d, scale %.3gx%.3g",
+			gw, gh, pw, ph, float64(pw)/float64(gw), float64(ph)/float64(gh))
+	}
+	return ""
 }
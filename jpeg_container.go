@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"image"
 	"sort"
 )
 
@@ -15,6 +17,8 @@ const (
 	markerAPP0  = 0xE0
 	markerAPP1  = 0xE1
 	markerAPP2  = 0xE2
+	markerAPP14 = 0xEE
+	markerCOM   = 0xFE
 )
 
 const (
@@ -24,11 +28,60 @@ const (
 
 var (
 	exifSig = []byte{'E', 'x', 'i', 'f', 0, 0}
+	jfifSig = []byte{'J', 'F', 'I', 'F', 0}
 	iccSig  = []byte{'I', 'C', 'C', '_', 'P', 'R', 'O', 'F', 'I', 'L', 'E', 0}
+
+	// adobeSig starts APP14 segment with DCT color transform flag (YCbCr/YCCK/none for RGB/CMYK).
+	adobeSig = []byte{'A', 'd', 'o', 'b', 'e'}
+
+	// xmpExtensionSig starts APP1 segments of extended XMP, they continue the main XMP packet
+	// (xmpNote:HasExtendedXMP) and are orphaned when it is replaced.
+	xmpExtensionSig = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// Errors returned (possibly wrapped) by Split, Decode, Join and metadata parsers, use errors.Is to check them.
+var (
+	// ErrNotJPEG means input is not a JPEG image (no SOI marker).
+	ErrNotJPEG = errors.New("not a JPEG")
+	// ErrNoGainmap means input is a JPEG without a secondary (gainmap) image, i.e. not an UltraHDR container.
+	ErrNoGainmap = errors.New("gainmap image not found")
+	// ErrNoGainmapMetadata means neither XMP nor ISO 21496-1 gainmap metadata is present.
+	ErrNoGainmapMetadata = errors.New("no gainmap metadata found")
+	// ErrTruncated means data ends prematurely, e.g. inside an image or a metadata block.
+	ErrTruncated = errors.New("truncated")
+	// ErrInvalidMPF means the MPF (multi-picture format) directory is malformed.
+	ErrInvalidMPF = errors.New("invalid MPF")
+	// ErrUnsupportedMetadata means gainmap metadata version or feature is not supported.
+	ErrUnsupportedMetadata = errors.New("unsupported gainmap metadata")
+	// ErrInvalidGainmapDimensions means gainmap is larger than primary image or has a different aspect ratio.
+	ErrInvalidGainmapDimensions = errors.New("invalid gainmap dimensions")
 )
 
+// ErrTruncatedGainmap is returned when container data ends inside the gainmap image,
+// RecoverPrimary salvages the primary image of such a container. It matches ErrTruncated.
+var ErrTruncatedGainmap = fmt.Errorf("container %w: gainmap image incomplete", ErrTruncated)
+
+// maxPixelsPerByte bounds image size declared in JPEG frame header by data length: any decodable
+// JPEG spends at least one bit on DC of each 8x8 luma block, i.e. 512 pixels per byte, twice
+// that is allowed.
+const maxPixelsPerByte = 1024
+
+// decodeJPEG decodes JPEG data, rejecting frame dimensions that data is too short to encode,
+// so that a crafted header does not allocate a huge image.
+func decodeJPEG(data []byte) (image.Image, error) {
+	if cfg, err := ParseJPEGHeader(data); err == nil {
+		if int64(cfg.Width)*int64(cfg.Height) > maxPixelsPerByte*int64(len(data)) {
+			return nil, fmt.Errorf("%w: %dx%d image in %d bytes", ErrTruncated, cfg.Width, cfg.Height, len(data))
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
 func scanJPEGs(data []byte) ([][2]int, error) {
-	if ranges, ok := scanJPEGsByMPF(data); ok {
+	// Stale MPF sizes (e.g. after metadata edits) fall back to the marker walk,
+	// it skips APP payloads, so that EXIF thumbnails are not taken for images.
+	if ranges, ok := scanJPEGsByMPF(data); ok && endsWithEOI(data, ranges[0]) && endsWithEOI(data, ranges[1]) {
 		return ranges, nil
 	}
 	var ranges [][2]int
@@ -38,6 +91,9 @@ func scanJPEGs(data []byte) ([][2]int, error) {
 			start := i
 			end, err := findJPEGEnd(data, i)
 			if err != nil {
+				if len(ranges) > 0 {
+					return nil, ErrTruncatedGainmap
+				}
 				return nil, err
 			}
 			ranges = append(ranges, [2]int{start, end})
@@ -47,38 +103,62 @@ func scanJPEGs(data []byte) ([][2]int, error) {
 		i++
 	}
 	if len(ranges) == 0 {
-		return nil, errors.New("no JPEG images found")
+		return nil, fmt.Errorf("%w: no JPEG images found", ErrNotJPEG)
 	}
 	return ranges, nil
 }
 
+// endsWithEOI checks that JPEG range is terminated with EOI marker.
+func endsWithEOI(data []byte, r [2]int) bool {
+	return r[1]-r[0] >= 4 && r[1] <= len(data) && data[r[1]-2] == markerStart && data[r[1]-1] == markerEOI
+}
+
+// scanJPEGsByMPF returns primary and gainmap ranges as described by MPF of the first image.
+// Ranges are ordered by MPF image type (primary first), not by position in data.
 func scanJPEGsByMPF(data []byte) ([][2]int, bool) {
 	if len(data) < 4 || data[0] != markerStart || data[1] != markerSOI {
 		return nil, false
 	}
-	primaryStart := 0
-	primarySize, secondarySize, secondaryOffset, ok := findMPFInfo(data, primaryStart)
+	info, tiffHeaderAbs, ok := findMPFInfo(data, 0)
 	if !ok {
 		return nil, false
 	}
-	primaryEnd := primaryStart + primarySize
-	secondaryStart := secondaryOffset
-	secondaryEnd := secondaryStart + secondarySize
-	if primarySize <= 0 || secondarySize <= 0 {
+	if info.primarySize <= 0 || info.secondarySize <= 0 {
 		return nil, false
 	}
-	if primaryEnd > len(data) || secondaryEnd > len(data) || secondaryStart < 0 {
+	// Offset of the first image is zero by MPF spec, others are relative to MPF TIFF header.
+	imageStart := func(offset int) int {
+		if offset == 0 {
+			return 0
+		}
+		return tiffHeaderAbs + offset
+	}
+	primaryStart := imageStart(info.primaryOffset)
+	secondaryStart := imageStart(info.secondaryOffset)
+	if primaryStart == secondaryStart {
 		return nil, false
 	}
-	if secondaryStart+1 >= len(data) || data[secondaryStart] != markerStart || data[secondaryStart+1] != markerSOI {
+	ranges := [][2]int{
+		{primaryStart, primaryStart + info.primarySize},
+		{secondaryStart, secondaryStart + info.secondarySize},
+	}
+	for _, r := range ranges {
+		if r[0] < 0 || r[1] > len(data) || r[0]+1 >= len(data) || data[r[0]] != markerStart || data[r[0]+1] != markerSOI {
+			return nil, false
+		}
+	}
+	// Images may come in any order, but must not overlap, otherwise one range could swallow the other.
+	if ranges[0][0] < ranges[1][1] && ranges[1][0] < ranges[0][1] {
 		return nil, false
 	}
-	return [][2]int{{primaryStart, primaryEnd}, {secondaryStart, secondaryEnd}}, true
+	return ranges, true
 }
 
-func findMPFInfo(data []byte, primaryStart int) (primarySize, secondarySize, secondaryOffset int, ok bool) {
+// findMPFInfo parses MPF of the image at primaryStart, it also returns absolute position
+// of MPF TIFF header that image offsets are relative to.
+func findMPFInfo(data []byte, primaryStart int) (mpfInfo, int, bool) {
 	if primaryStart+1 >= len(data) || data[primaryStart] != markerStart || data[primaryStart+1] != markerSOI {
-		return 0, 0, 0, false
+		return mpfInfo{}, 0, false
 	}
 	pos := primaryStart + 2
 	for pos+3 < len(data) {
@@ -98,7 +178,7 @@ func findMPFInfo(data []byte, primaryStart int) (primarySize, secondarySize, sec
 		case markerSOI:
 			continue
 		case markerEOI, markerSOS:
-			return 0, 0, 0, false
+			return mpfInfo{}, 0, false
 		}
 		if marker >= 0xD0 && marker <= 0xD7 {
 			continue
@@ -107,11 +187,11 @@ func findMPFInfo(data []byte, primaryStart int) (primarySize, secondarySize, sec
 			continue
 		}
 		if pos+1 >= len(data) {
-			return 0, 0, 0, false
+			return mpfInfo{}, 0, false
 		}
 		segLen := int(binary.BigEndian.Uint16(data[pos:]))
 		if segLen < 2 || pos+segLen > len(data) {
-			return 0, 0, 0, false
+			return mpfInfo{}, 0, false
 		}
 		segStart := pos + 2
 		segEnd := pos + segLen
@@ -119,30 +199,29 @@ func findMPFInfo(data []byte, primaryStart int) (primarySize, secondarySize, sec
 			payload := data[segStart:segEnd]
 			info, err := parseMPF(payload)
 			if err != nil {
-				return 0, 0, 0, false
+				return mpfInfo{}, 0, false
 			}
-			tiffHeaderAbs := segStart + len(mpfSig)
-			secondaryOffsetAbs := tiffHeaderAbs + info.secondaryOffset
-			return info.primarySize, info.secondarySize, secondaryOffsetAbs, true
+			return info, segStart + len(mpfSig), true
 		}
 		pos = segEnd
 	}
-	return 0, 0, 0, false
+	return mpfInfo{}, 0, false
 }
 
 type mpfInfo struct {
 	primarySize     int
+	primaryOffset   int
 	secondarySize   int
 	secondaryOffset int
 }
 
 func parseMPF(payload []byte) (mpfInfo, error) {
 	if len(payload) < len(mpfSig)+8 || !bytes.HasPrefix(payload, mpfSig) {
-		return mpfInfo{}, errors.New("mpf signature missing")
+		return mpfInfo{}, fmt.Errorf("%w: signature missing", ErrInvalidMPF)
 	}
 	tiff := payload[len(mpfSig):]
 	if len(tiff) < 8 {
-		return mpfInfo{}, errors.New("mpf tiff header too small")
+		return mpfInfo{}, fmt.Errorf("%w: tiff header too small", ErrInvalidMPF)
 	}
 	var order binary.ByteOrder
 	switch {
@@ -151,14 +230,14 @@ func parseMPF(payload []byte) (mpfInfo, error) {
 	case tiff[0] == 0x49 && tiff[1] == 0x49:
 		order = binary.LittleEndian
 	default:
-		return mpfInfo{}, errors.New("mpf endian invalid")
+		return mpfInfo{}, fmt.Errorf("%w: endian invalid", ErrInvalidMPF)
 	}
 	if order.Uint16(tiff[2:4]) != 0x002A {
-		return mpfInfo{}, errors.New("mpf tiff magic invalid")
+		return mpfInfo{}, fmt.Errorf("%w: tiff magic invalid", ErrInvalidMPF)
 	}
 	ifdOffset := int(order.Uint32(tiff[4:8]))
 	if ifdOffset < 0 || ifdOffset+2 > len(tiff) {
-		return mpfInfo{}, errors.New("mpf ifd offset invalid")
+		return mpfInfo{}, fmt.Errorf("%w: ifd offset invalid", ErrInvalidMPF)
 	}
 	ifdPos := ifdOffset
 	tagCount := int(order.Uint16(tiff[ifdPos : ifdPos+2]))
@@ -166,7 +245,7 @@ func parseMPF(payload []byte) (mpfInfo, error) {
 	entryOffset := -1
 	for i := 0; i < tagCount; i++ {
 		if ifdPos+12 > len(tiff) {
-			return mpfInfo{}, errors.New("mpf ifd truncated")
+			return mpfInfo{}, fmt.Errorf("%w: ifd truncated", ErrInvalidMPF)
 		}
 		tag := order.Uint16(tiff[ifdPos : ifdPos+2])
 		typ := order.Uint16(tiff[ifdPos+2 : ifdPos+4])
@@ -179,16 +258,17 @@ func parseMPF(payload []byte) (mpfInfo, error) {
 		ifdPos += 12
 	}
 	if entryOffset < 0 || entryOffset+mpfEntrySize*mpfNumPictures > len(tiff) {
-		return mpfInfo{}, errors.New("mpf entry offset invalid")
+		return mpfInfo{}, fmt.Errorf("%w: entry offset invalid", ErrInvalidMPF)
 	}
 	entryPos := entryOffset
-	var primarySize, secondarySize, secondaryOffset int
+	var primarySize, primaryOffset, secondarySize, secondaryOffset int
 	for i := 0; i < mpfNumPictures; i++ {
 		attr := order.Uint32(tiff[entryPos : entryPos+4])
 		size := int(order.Uint32(tiff[entryPos+4 : entryPos+8]))
 		offset := int(order.Uint32(tiff[entryPos+8 : entryPos+12]))
-		if attr&mpfAttrTypePrimary != 0 {
+		if attr&mpfAttrTypeMask == mpfAttrTypePrimary {
 			primarySize = size
+			primaryOffset = offset
 		} else {
 			secondarySize = size
 			secondaryOffset = offset
@@ -196,14 +276,14 @@ func parseMPF(payload []byte) (mpfInfo, error) {
 		entryPos += mpfEntrySize
 	}
 	if primarySize == 0 || secondarySize == 0 {
-		return mpfInfo{}, errors.New("mpf sizes missing")
+		return mpfInfo{}, fmt.Errorf("%w: sizes missing", ErrInvalidMPF)
 	}
-	return mpfInfo{primarySize: primarySize, secondarySize: secondarySize, secondaryOffset: secondaryOffset}, nil
+	return mpfInfo{primarySize: primarySize, primaryOffset: primaryOffset, secondarySize: secondarySize, secondaryOffset: secondaryOffset}, nil
 }
 
 func findJPEGEnd(data []byte, start int) (int, error) {
 	if start+1 >= len(data) || data[start] != markerStart || data[start+1] != markerSOI {
-		return 0, errors.New("not a JPEG SOI")
+		return 0, fmt.Errorf("%w SOI", ErrNotJPEG)
 	}
 	pos := start + 2
 	inScan := false
@@ -228,7 +308,7 @@ func findJPEGEnd(data []byte, start int) (int, error) {
 				return pos, nil
 			case markerSOS:
 				if pos+1 >= len(data) {
-					return 0, errors.New("truncated SOS")
+					return 0, fmt.Errorf("%w SOS", ErrTruncated)
 				}
 				segLen := int(binary.BigEndian.Uint16(data[pos:]))
 				pos += segLen
@@ -242,7 +322,7 @@ func findJPEGEnd(data []byte, start int) (int, error) {
 				continue
 			}
 			if pos+1 >= len(data) {
-				return 0, errors.New("truncated marker segment")
+				return 0, fmt.Errorf("%w marker segment", ErrTruncated)
 			}
 			segLen := int(binary.BigEndian.Uint16(data[pos:]))
 			if segLen < 2 {
@@ -252,82 +332,74 @@ func findJPEGEnd(data []byte, start int) (int, error) {
 			continue
 		}
 
-		// in scan data
-		if data[pos] == markerStart {
+		// in scan data, jump to the next marker candidate
+		if data[pos] != markerStart {
+			i := bytes.IndexByte(data[pos:], markerStart)
+			if i < 0 {
+				break
+			}
+			pos += i
+			continue
+		}
+		next := data[pos+1]
+		switch {
+		case next == 0x00:
+			pos += 2
+		case next >= 0xD0 && next <= 0xD7:
+			pos += 2
+		case next == markerEOI:
+			return pos + 2, nil
+		default:
+			// Attempt to parse marker within scan data.
+			pos += 2
 			if pos+1 >= len(data) {
-				return 0, errors.New("truncated scan data")
+				return 0, fmt.Errorf("%w marker in scan", ErrTruncated)
 			}
-			next := data[pos+1]
-			switch {
-			case next == 0x00:
-				pos += 2
-				continue
-			case next >= 0xD0 && next <= 0xD7:
-				pos += 2
-				continue
-			case next == markerEOI:
-				return pos + 2, nil
-			default:
-				// Attempt to parse marker within scan data.
-				pos += 2
-				if pos+1 >= len(data) {
-					return 0, errors.New("truncated marker in scan")
-				}
-				segLen := int(binary.BigEndian.Uint16(data[pos:]))
-				if segLen < 2 {
-					return 0, errors.New("invalid marker length in scan")
-				}
-				pos += segLen
-				continue
+			segLen := int(binary.BigEndian.Uint16(data[pos:]))
+			if segLen < 2 {
+				return 0, errors.New("invalid marker length in scan")
 			}
+			pos += segLen
 		}
-		pos++
 	}
-	return 0, errors.New("no EOI found")
+	return 0, fmt.Errorf("%w: no EOI found", ErrTruncated)
 }
 
 func extractAppSegments(jpegData []byte) (app1 [][]byte, app2 [][]byte, err error) {
-	if len(jpegData) < 4 || jpegData[0] != markerStart || jpegData[1] != markerSOI {
-		return nil, nil, errors.New("invalid JPEG")
+	app1, app2, err = appSegmentViews(jpegData)
+	if err != nil {
+		return nil, nil, err
 	}
-	pos := 2
-	for pos+3 < len(jpegData) {
-		if jpegData[pos] != markerStart {
-			pos++
-			continue
-		}
-		for pos < len(jpegData) && jpegData[pos] == markerStart {
-			pos++
-		}
-		if pos >= len(jpegData) {
-			break
-		}
-		marker := jpegData[pos]
-		pos++
-		if marker == markerSOS || marker == markerEOI {
-			break
-		}
-		if marker >= 0xD0 && marker <= 0xD7 {
-			continue
-		}
-		if pos+1 >= len(jpegData) {
-			return nil, nil, errors.New("truncated marker")
+	for i, seg := range app1 {
+		app1[i] = append([]byte(nil), seg...)
+	}
+	for i, seg := range app2 {
+		app2[i] = append([]byte(nil), seg...)
+	}
+	return app1, app2, nil
+}
+
+// appSegmentViews returns APP1 and APP2 payloads as sub-slices of jpegData (not copied).
+func appSegmentViews(jpegData []byte) (app1 [][]byte, app2 [][]byte, err error) {
+	r, err := newSegmentReader(jpegData)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		seg, ok, err := r.next()
+		if err != nil {
+			return nil, nil, err
 		}
-		segLen := int(binary.BigEndian.Uint16(jpegData[pos:]))
-		if segLen < 2 || pos+segLen > len(jpegData) {
-			return nil, nil, errors.New("invalid segment length")
+		if !ok || seg.marker == markerSOS || seg.marker == markerEOI {
+			return app1, app2, nil
 		}
-		segStart := pos + 2
-		segEnd := pos + segLen
-		switch marker {
+		switch seg.marker {
 		case markerAPP1:
-			app1 = append(app1, append([]byte(nil), jpegData[segStart:segEnd]...))
+			app1 = append(app1, seg.payload)
 		case markerAPP2:
-			app2 = append(app2, append([]byte(nil), jpegData[segStart:segEnd]...))
+			app2 = append(app2, seg.payload)
 		}
-		pos = segEnd
 	}
-	return app1, app2, nil
 }
 
 func findXMP(app1 [][]byte) []byte {
@@ -358,18 +430,92 @@ type appSegment struct {
 	payload []byte
 }
 
+// jpegSegment is a marker segment of JPEG data.
+type jpegSegment struct {
+	marker  byte
+	offset  int    // Position of 0xFF marker prefix, including fill bytes.
+	end     int    // Position after payload.
+	payload []byte // Sub-slice of data, nil for standalone markers.
+}
+
+// segmentReader walks marker segments of a JPEG image.
+type segmentReader struct {
+	data []byte
+	pos  int
+}
+
+// newSegmentReader returns a reader positioned after SOI marker of jpegData.
+func newSegmentReader(jpegData []byte) (*segmentReader, error) {
+	if len(jpegData) < 4 || jpegData[0] != markerStart || jpegData[1] != markerSOI {
+		return nil, fmt.Errorf("%w: SOI marker missing", ErrNotJPEG)
+	}
+	return &segmentReader{data: jpegData, pos: 2}, nil
+}
+
+// next returns the next marker segment, or false at the end of data. Bytes that do not start
+// a marker (e.g. entropy-coded data) and fill bytes are skipped. Standalone markers (SOI, EOI, RST,
+// TEM and stuffed zero in entropy-coded data) have no payload. Callers that only read headers
+// stop at SOS.
+func (r *segmentReader) next() (jpegSegment, bool, error) {
+	i := bytes.IndexByte(r.data[r.pos:], markerStart)
+	if i < 0 {
+		r.pos = len(r.data)
+		return jpegSegment{}, false, nil
+	}
+	offset := r.pos + i
+	pos := offset
+	for pos+1 < len(r.data) && r.data[pos+1] == markerStart {
+		pos++
+	}
+	if pos+1 >= len(r.data) {
+		r.pos = len(r.data)
+		return jpegSegment{}, false, nil
+	}
+	seg := jpegSegment{marker: r.data[pos+1], offset: offset, end: pos + 2}
+	if seg.marker == 0x00 || seg.marker == 0x01 || (seg.marker >= 0xD0 && seg.marker <= markerEOI) {
+		r.pos = seg.end
+		return seg, true, nil
+	}
+	if seg.end+2 > len(r.data) {
+		return seg, false, fmt.Errorf("%w marker", ErrTruncated)
+	}
+	segLen := int(binary.BigEndian.Uint16(r.data[seg.end:]))
+	if segLen < 2 || seg.end+segLen > len(r.data) {
+		return seg, false, errors.New("invalid segment length")
+	}
+	seg.payload = r.data[seg.end+2 : seg.end+segLen : seg.end+segLen]
+	seg.end += segLen
+	r.pos = seg.end
+	return seg, true, nil
+}
+
+// isApp reports whether the segment is one of APP0-APP15.
+func (s jpegSegment) isApp() bool {
+	return s.marker >= markerAPP0 && s.marker <= markerAPP0+15
+}
+
 // extractExifAndIcc returns the EXIF APP1 payload (if present) and ICC APP2 payloads.
+// EXIF exceeding segment limit (e.g. with large preview) continues in following full-size
+// EXIF APP1 segments, their data is stitched into a single payload.
 func extractExifAndIcc(jpegData []byte) ([]byte, [][]byte, error) {
 	app1, app2, err := extractAppSegments(jpegData)
 	if err != nil {
 		return nil, nil, err
 	}
 	var exif []byte
+	last := 0
 	for _, seg := range app1 {
-		if bytes.HasPrefix(seg, exifSig) {
+		if !bytes.HasPrefix(seg, exifSig) {
+			continue
+		}
+		if exif == nil {
 			exif = append([]byte(nil), seg...)
+		} else if last == maxAppPayload {
+			exif = append(exif, seg[len(exifSig):]...)
+		} else {
 			break
 		}
+		last = len(seg)
 	}
 	var iccSegs []iccSegment
 	for _, seg := range app2 {
@@ -389,26 +535,143 @@ func extractExifAndIcc(jpegData []byte) ([]byte, [][]byte, error) {
 	return exif, out, nil
 }
 
-func writeAppSegment(out *bytes.Buffer, marker byte, payload []byte) {
+// extractComments returns COM payloads of jpegData in stream order.
+func extractComments(jpegData []byte) ([][]byte, error) {
+	r, err := newSegmentReader(jpegData)
+	if err != nil {
+		return nil, err
+	}
+	var comments [][]byte
+	for {
+		seg, ok, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || seg.marker == markerSOS || seg.marker == markerEOI {
+			return comments, nil
+		}
+		if seg.marker == markerCOM {
+			comments = append(comments, append([]byte(nil), seg.payload...))
+		}
+	}
+}
+
+// jfifDensitySegment returns a JFIF APP0 segment carrying source density (without thumbnail).
+// It returns false if source has no JFIF APP0 or density is the default 1:1 aspect ratio.
+func jfifDensitySegment(jpegData []byte) (appSegment, bool) {
+	if len(jpegData) < 4 || jpegData[0] != markerStart || jpegData[1] != markerSOI {
+		return appSegment{}, false
+	}
+	pos := 2
+	for pos+3 < len(jpegData) {
+		if jpegData[pos] != markerStart {
+			return appSegment{}, false
+		}
+		for pos < len(jpegData) && jpegData[pos] == markerStart {
+			pos++
+		}
+		if pos+2 >= len(jpegData) {
+			break
+		}
+		marker := jpegData[pos]
+		pos++
+		if (marker < markerAPP0 || marker > 0xEF) && marker != markerCOM {
+			// JFIF APP0 precedes other segments, some encoders put COM first.
+			break
+		}
+		segLen := int(binary.BigEndian.Uint16(jpegData[pos:]))
+		if segLen < 2 || pos+segLen > len(jpegData) {
+			break
+		}
+		seg := jpegData[pos+2 : pos+segLen]
+		if marker == markerAPP0 && len(seg) >= len(jfifSig)+7 && bytes.HasPrefix(seg, jfifSig) {
+			// Version (2), units (1), Xdensity (2), Ydensity (2).
+			density := seg[len(jfifSig) : len(jfifSig)+7]
+			units := density[2]
+			xd := binary.BigEndian.Uint16(density[3:])
+			yd := binary.BigEndian.Uint16(density[5:])
+			if xd == 0 || yd == 0 || (units == 0 && xd == yd) {
+				return appSegment{}, false
+			}
+			payload := make([]byte, 0, len(jfifSig)+9)
+			payload = append(payload, jfifSig...)
+			payload = append(payload, density...)
+			payload = append(payload, 0, 0) // No thumbnail.
+			return appSegment{marker: markerAPP0, payload: payload}, true
+		}
+		pos += segLen
+	}
+	return appSegment{}, false
+}
+
+// maxAppPayload is the largest APP segment payload, segment length includes its own two bytes.
+const maxAppPayload = 0xFFFF - 2
+
+var errSegmentTooLarge = errors.New("APP segment too large")
+
+func writeAppSegment(out *bytes.Buffer, marker byte, payload []byte) error {
+	if len(payload) > maxAppPayload {
+		if marker == markerCOM {
+			return fmt.Errorf("COM: %w: %d bytes", errSegmentTooLarge, len(payload))
+		}
+		return fmt.Errorf("APP%d: %w: %d bytes", marker-markerAPP0, errSegmentTooLarge, len(payload))
+	}
 	out.WriteByte(markerStart)
 	out.WriteByte(marker)
 	length := uint16(len(payload) + 2)
 	out.WriteByte(byte(length >> 8))
 	out.WriteByte(byte(length))
 	out.Write(payload)
+	return nil
+}
+
+// writeExifSegments writes EXIF APP1 payload, payload exceeding segment limit is split into
+// full-size APP1 segments each starting with EXIF signature, as stitched by extractExifAndIcc.
+func writeExifSegments(out *bytes.Buffer, exif []byte) error {
+	if len(exif) <= maxAppPayload || !bytes.HasPrefix(exif, exifSig) {
+		return writeAppSegment(out, markerAPP1, exif)
+	}
+	data := exif[len(exifSig):]
+	chunk := maxAppPayload - len(exifSig)
+	for len(data) > 0 {
+		n := min(chunk, len(data))
+		seg := make([]byte, 0, len(exifSig)+n)
+		seg = append(append(seg, exifSig...), data[:n]...)
+		if err := writeAppSegment(out, markerAPP1, seg); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
 }
 
 // insertAppSegments inserts APP segments after SOI.
 func insertAppSegments(jpegData []byte, segs []appSegment) ([]byte, error) {
 	if len(jpegData) < 2 || jpegData[0] != markerStart || jpegData[1] != markerSOI {
-		return nil, errors.New("invalid jpeg")
+		return nil, fmt.Errorf("%w: SOI marker missing", ErrNotJPEG)
 	}
 	var out bytes.Buffer
 	out.WriteByte(markerStart)
 	out.WriteByte(markerSOI)
-	for _, s := range segs {
-		writeAppSegment(&out, s.marker, s.payload)
+	if err := writeAppSegments(&out, segs); err != nil {
+		return nil, err
 	}
 	out.Write(jpegData[2:])
 	return out.Bytes(), nil
 }
+
+// writeAppSegments writes APP segments, oversized EXIF APP1 payloads are split into chunks.
+func writeAppSegments(out *bytes.Buffer, segs []appSegment) error {
+	for _, s := range segs {
+		var err error
+		if s.marker == markerAPP1 {
+			err = writeExifSegments(out, s.payload)
+		} else {
+			err = writeAppSegment(out, s.marker, s.payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,818 @@
+package ultrahdr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// findJPEGEndByteWise is the byte-at-a-time scanner findJPEGEnd is checked against.
+func findJPEGEndByteWise(data []byte, start int) (int, error) {
+	if start+1 >= len(data) || data[start] != markerStart || data[start+1] != markerSOI {
+		return 0, errors.New("not a JPEG SOI")
+	}
+	pos := start + 2
+	inScan := false
+	for pos+1 < len(data) {
+		if !inScan {
+			if data[pos] != markerStart {
+				pos++
+				continue
+			}
+			for pos < len(data) && data[pos] == markerStart {
+				pos++
+			}
+			if pos >= len(data) {
+				break
+			}
+			marker := data[pos]
+			pos++
+			switch marker {
+			case markerSOI:
+				continue
+			case markerEOI:
+				return pos, nil
+			case markerSOS:
+				if pos+1 >= len(data) {
+					return 0, errors.New("truncated SOS")
+				}
+				pos += int(binary.BigEndian.Uint16(data[pos:]))
+				inScan = true
+				continue
+			}
+			if (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+				continue
+			}
+			if pos+1 >= len(data) {
+				return 0, errors.New("truncated marker segment")
+			}
+			segLen := int(binary.BigEndian.Uint16(data[pos:]))
+			if segLen < 2 {
+				return 0, errors.New("invalid marker length")
+			}
+			pos += segLen
+			continue
+		}
+		if data[pos] == markerStart {
+			next := data[pos+1]
+			switch {
+			case next == 0x00, next >= 0xD0 && next <= 0xD7:
+				pos += 2
+				continue
+			case next == markerEOI:
+				return pos + 2, nil
+			default:
+				pos += 2
+				if pos+1 >= len(data) {
+					return 0, errors.New("truncated marker in scan")
+				}
+				segLen := int(binary.BigEndian.Uint16(data[pos:]))
+				if segLen < 2 {
+					return 0, errors.New("invalid marker length in scan")
+				}
+				pos += segLen
+				continue
+			}
+		}
+		pos++
+	}
+	return 0, errors.New("truncated: no EOI found")
+}
+
+// readScanDataByteWise is the byte-at-a-time reader readScanData is checked against.
+func readScanDataByteWise(br *bufio.Reader, buf *bytes.Buffer) error {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(b)
+		if b != markerStart {
+			continue
+		}
+		b2, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(b2)
+		switch {
+		case b2 == 0x00, b2 >= 0xD0 && b2 <= 0xD7:
+			continue
+		case b2 == markerEOI:
+			return nil
+		default:
+			if err := readSegment(br, buf, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// skipScanToEOIByteWise is the byte-at-a-time reader skipScanToEOI is checked against.
+func skipScanToEOIByteWise(br *bufio.Reader) error {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != markerStart {
+			continue
+		}
+		m, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		for m == markerStart {
+			if m, err = br.ReadByte(); err != nil {
+				return err
+			}
+		}
+		switch {
+		case m == 0x00, m >= 0xD0 && m <= 0xD7:
+			continue
+		case m == markerEOI:
+			return nil
+		}
+	}
+}
+
+func TestScanJPEGsByMPFOverlap(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	want, err := scanJPEGs(data)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	mpfStart, payload, err := findMpfPayload(data)
+	if err != nil {
+		t.Fatalf("find mpf: %v", err)
+	}
+
+	// Primary size covering the whole file makes primary range swallow the gainmap.
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(want[0][1]-want[0][0]))
+	i := bytes.Index(payload, size[:])
+	if i < 0 {
+		t.Fatalf("primary size not found in MPF")
+	}
+	crafted := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(crafted[mpfStart+i:], uint32(len(crafted)))
+
+	if ranges, ok := scanJPEGsByMPF(crafted); ok {
+		t.Fatalf("overlapping MPF ranges accepted: %v", ranges)
+	}
+	got, err := scanJPEGs(crafted)
+	if err != nil {
+		t.Fatalf("scan crafted: %v", err)
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("ranges: got %v want %v", got, want)
+	}
+	sr, err := SplitView(crafted)
+	if err != nil {
+		t.Fatalf("split view: %v", err)
+	}
+	if len(sr.Primary) != want[0][1]-want[0][0] || len(sr.Gainmap) != want[1][1]-want[1][0] {
+		t.Fatalf("split sizes: primary %d gainmap %d", len(sr.Primary), len(sr.Gainmap))
+	}
+}
+
+func TestOversizedExif(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	// Large preview appended after IFD makes EXIF span three segments.
+	exif := exifWithOrientation(orientationRotate90)
+	for i := range 150000 {
+		exif = append(exif, byte(i*7))
+	}
+	tagged, err := insertContainerAppSegments(data, []appSegment{{marker: markerAPP1, payload: exif}})
+	if err != nil {
+		t.Fatalf("insert exif: %v", err)
+	}
+	sr := mustSplit(t, tagged)
+	app1, _, err := extractAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("extract segments: %v", err)
+	}
+	var sizes []int
+	for _, seg := range app1 {
+		if bytes.HasPrefix(seg, exifSig) {
+			sizes = append(sizes, len(seg))
+		}
+	}
+	// Original EXIF of the sample follows inserted segments.
+	if len(sizes) != 4 || sizes[0] != maxAppPayload || sizes[1] != maxAppPayload || sizes[2] == maxAppPayload {
+		t.Fatalf("unexpected EXIF segment sizes %v", sizes)
+	}
+	got, _, err := extractExifAndIcc(sr.Primary)
+	if err != nil {
+		t.Fatalf("extract exif: %v", err)
+	}
+	if !bytes.Equal(got, exif) {
+		t.Fatalf("stitched EXIF mismatch: got %d bytes want %d", len(got), len(exif))
+	}
+
+	var res *Result
+	err = ResizeHDR(bytes.NewReader(tagged), ResizeSpec{
+		Width: 40, Height: 30,
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			res = r
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	for _, f := range ValidateContainer(res.Container) {
+		if f.Severity == SeverityFatal {
+			t.Fatalf("invalid resized container: %v", f)
+		}
+	}
+	if got, _, err = extractExifAndIcc(mustSplit(t, res.Container).Primary); err != nil || !bytes.Equal(got, exif) {
+		t.Fatalf("resized EXIF mismatch: got %d bytes, %v", len(got), err)
+	}
+	if o, _ := exifOrientation(got); o != orientationRotate90 {
+		t.Fatalf("orientation lost: %d", o)
+	}
+
+	// Other oversized payloads are rejected instead of overflowing segment length.
+	segs := &MetadataSegments{SecondaryXMP: make([]byte, maxAppPayload+1)}
+	if _, err := assembleContainerWithSegments(sr.Primary, sr.Gainmap, segs); !errors.Is(err, errSegmentTooLarge) {
+		t.Fatalf("expected segment size error, got %v", err)
+	}
+}
+
+func TestICCSegmentsRoundTrip(t *testing.T) {
+	p3, err := os.ReadFile("testdata/sample_display_p3.jpg")
+	if err != nil {
+		t.Fatalf("read p3: %v", err)
+	}
+	_, p3Segs, err := extractExifAndIcc(p3)
+	if err != nil || len(p3Segs) == 0 {
+		t.Fatalf("extract icc: %d segments, %v", len(p3Segs), err)
+	}
+	// Padding past the tag table keeps the header valid and makes the profile span two segments.
+	profile := collectICCProfile(p3Segs)
+	for i := range 72 * 1024 {
+		profile = append(profile, byte(i*13))
+	}
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+
+	segs, err := buildICCSegments(profile)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(segs) != 2 || len(segs[0]) != maxAppPayload || len(segs[0])-len(iccSig)-2 != 65519 {
+		t.Fatalf("unexpected chunking: %d segments", len(segs))
+	}
+	for i, seg := range segs {
+		if !bytes.HasPrefix(seg, iccSig) || seg[len(iccSig)] != byte(i+1) || seg[len(iccSig)+1] != 2 {
+			t.Fatalf("segment %d: bad header % x", i, seg[:len(iccSig)+2])
+		}
+	}
+	if got := collectICCProfile([][]byte{segs[1], segs[0]}); !bytes.Equal(got, profile) {
+		t.Fatalf("round trip mismatch: got %d bytes want %d", len(got), len(profile))
+	}
+	if segs, err := buildICCSegments(nil); segs != nil || err != nil {
+		t.Fatalf("empty profile: %d segments, %v", len(segs), err)
+	}
+	huge := make([]byte, 255*iccChunkSize+1)
+	if _, err := buildICCSegments(huge); err == nil {
+		t.Fatalf("expected error for profile exceeding 255 segments")
+	}
+	// Container assembly fails instead of dropping the profile.
+	sdr := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	hdr := &HDRImage{W: 8, H: 8, Pix: make([]float32, 8*8*3)}
+	if _, err := RebaseFromHDR(sdr, hdr, WithICCProfile(huge)); err == nil || !strings.Contains(err.Error(), "255 APP2 segments") {
+		t.Fatalf("expected ICC profile size error, got %v", err)
+	}
+
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	// A single oversized chunk, as a concatenated profile from a bundle, is re-split on assembly.
+	whole := append(append(append([]byte(nil), iccSig...), 1, 1), profile...)
+	for _, icc := range [][][]byte{segs, {segs[1], segs[0]}, {whole}} {
+		container, err := assembleContainerVipsLike(containerParts{
+			primary: sr.Primary, gainmap: sr.Gainmap, icc: icc,
+			secondaryXMP: sr.Segs.SecondaryXMP, secondaryISO: sr.Segs.SecondaryISO,
+		})
+		if err != nil {
+			t.Fatalf("assemble: %v", err)
+		}
+		for _, f := range ValidateContainer(container) {
+			if f.Severity == SeverityFatal {
+				t.Fatalf("invalid container: %v", f)
+			}
+		}
+		out := mustSplit(t, container)
+		_, gotSegs, err := extractExifAndIcc(out.Primary)
+		if err != nil {
+			t.Fatalf("extract icc: %v", err)
+		}
+		if len(gotSegs) != 2 || !bytes.Equal(gotSegs[0], segs[0]) || !bytes.Equal(gotSegs[1], segs[1]) {
+			t.Fatalf("unexpected ICC segments: %d", len(gotSegs))
+		}
+		if p := jpegColorProfile(out.Primary); p.gamut != ColorGamutDisplayP3 {
+			t.Fatalf("gamut: %v", p.gamut)
+		}
+	}
+}
+
+func TestScanSkipsExifThumbnails(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	want := mustSplit(t, data)
+	thumb, err := stripAppSegments(want.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	// EXIF with JPEG thumbnail data after IFD, as cameras store IFD1 thumbnails.
+	exif := append(exifWithOrientation(orientationNormal), thumb...)
+	tagged, err := insertContainerAppSegments(data, []appSegment{{marker: markerAPP1, payload: exif}})
+	if err != nil {
+		t.Fatalf("insert exif: %v", err)
+	}
+	gainmap, err := insertAppSegments(want.Gainmap, []appSegment{{marker: markerAPP1, payload: exif}})
+	if err != nil {
+		t.Fatalf("insert gainmap exif: %v", err)
+	}
+	ranges, err := scanJPEGs(tagged)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	tagged = append(tagged[:ranges[1][0]:ranges[1][0]], gainmap...)
+	if i := bytes.Index(tagged[2:], []byte{markerStart, markerSOI}); i+2 > ranges[0][1]/2 {
+		t.Fatalf("first embedded SOI at %d is not the primary EXIF thumbnail", i+2)
+	}
+
+	// MPF sizes are stale after gainmap EXIF insertion, broken MPF signature forces the fallback scanner too.
+	noMPF := bytes.Replace(tagged, mpfSig, []byte("MPX\x00"), 1)
+	for name, c := range map[string][]byte{"stale mpf": tagged, "no mpf": noMPF} {
+		ranges, err := scanJPEGs(c)
+		if err != nil || len(ranges) != 2 {
+			t.Fatalf("%s: scan: %v %v", name, ranges, err)
+		}
+		if !bytes.Equal(c[ranges[1][0]:ranges[1][1]], gainmap) {
+			t.Fatalf("%s: second range %v is not the gainmap", name, ranges[1])
+		}
+		for _, split := range []func([]byte) (*Result, error){
+			func(b []byte) (*Result, error) { return Split(bytes.NewReader(b)) },
+			SplitView,
+		} {
+			sr, err := split(c)
+			if err != nil {
+				t.Fatalf("%s: split: %v", name, err)
+			}
+			if !bytes.Equal(sr.Gainmap, gainmap) || sr.Meta == nil {
+				t.Fatalf("%s: gainmap %d bytes, want %d", name, len(sr.Gainmap), len(gainmap))
+			}
+			if exif, _, err := extractExifAndIcc(sr.Primary); err != nil || !bytes.HasSuffix(exif, thumb) {
+				t.Fatalf("%s: primary EXIF with thumbnail missing: %v", name, err)
+			}
+		}
+		if ok, err := IsUltraHDR(bytes.NewReader(c)); err != nil || !ok {
+			t.Fatalf("%s: detect: %v %v", name, ok, err)
+		}
+	}
+}
+
+func TestIsUltraHDRMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	second, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	iso, err := encodeGainmapMetadataISO(sr.Meta)
+	if err != nil {
+		t.Fatalf("encode iso: %v", err)
+	}
+	ratingXMP := append([]byte(xmpNamespace+"\x00"), `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`+
+		`<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="5"/></rdf:RDF></x:xmpmeta>`...)
+	gainmapXMP := buildGainmapXMP(sr.Meta)
+	futureISO := append([]byte(isoNamespace+"\x00"), 0, 1, 0, 1)
+
+	for _, tc := range []struct {
+		name string
+		segs MetadataSegments
+		want bool
+	}{
+		{name: "burst with ordinary XMP", segs: MetadataSegments{SecondaryXMP: ratingXMP}},
+		{name: "burst without metadata"},
+		{name: "unsupported ISO version", segs: MetadataSegments{SecondaryXMP: ratingXMP, SecondaryISO: futureISO}},
+		{name: "gainmap XMP", segs: MetadataSegments{SecondaryXMP: gainmapXMP}, want: true},
+		{name: "gainmap ISO", segs: MetadataSegments{SecondaryXMP: ratingXMP, SecondaryISO: append([]byte(isoNamespace+"\x00"), iso...)}, want: true},
+		{name: "primary ordinary XMP", segs: MetadataSegments{PrimaryXMP: ratingXMP, SecondaryXMP: ratingXMP}},
+		{name: "primary directory", segs: MetadataSegments{PrimaryXMP: buildPrimaryXMP(sr.Meta, 0), SecondaryXMP: ratingXMP}, want: true},
+		{name: "primary ISO version", segs: MetadataSegments{PrimaryISO: append([]byte(isoNamespace+"\x00"), 0, 0, 0, 0)}, want: true},
+	} {
+		c, err := assembleContainerWithSegments(primary, second, &tc.segs)
+		if err != nil {
+			t.Fatalf("%s: assemble: %v", tc.name, err)
+		}
+		if ok, err := IsUltraHDR(bytes.NewReader(c)); err != nil || ok != tc.want {
+			t.Fatalf("%s: detect %v, want %v: %v", tc.name, ok, tc.want, err)
+		}
+		// Primary metadata is enough, the secondary image is not read.
+		if tc.segs.PrimaryXMP != nil || tc.segs.PrimaryISO != nil {
+			ranges, err := scanJPEGs(c)
+			if err != nil {
+				t.Fatalf("%s: scan: %v", tc.name, err)
+			}
+			if ok, err := IsUltraHDR(bytes.NewReader(c[:ranges[0][1]])); ok != tc.want || (tc.want && err != nil) {
+				t.Fatalf("%s: detect primary only %v, want %v: %v", tc.name, ok, tc.want, err)
+			}
+		}
+	}
+}
+
+func TestIsUltraHDRNotJPEG(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	plain, err := stripAppSegments(mustSplit(t, data).Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{name: "empty", err: ErrNotJPEG},
+		{name: "png", data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), err: ErrNotJPEG},
+		{name: "plain JPEG", data: plain},
+	} {
+		ok, err := IsUltraHDR(bytes.NewReader(tc.data))
+		if ok || !errors.Is(err, tc.err) {
+			t.Fatalf("%s: detect %v, %v, want error %v", tc.name, ok, err, tc.err)
+		}
+	}
+}
+
+func TestKeepAdobeSegment(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	// Version 100, flags0, flags1, transform 1 (YCbCr).
+	adobe := append(append([]byte(nil), adobeSig...), 0, 100, 0, 0, 0, 0, 1)
+	withAdobe, err := insertAppSegments(primary, []appSegment{
+		{marker: markerAPP14, payload: adobe},
+		{marker: markerAPP14, payload: []byte("Other")},
+	})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	stripped, err := stripAppSegments(withAdobe)
+	if err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	if want := append(append([]byte(nil), primary[:2]...), withAdobe[2:2+4+len(adobe)]...); !bytes.HasPrefix(stripped, want) ||
+		len(stripped) != len(primary)+4+len(adobe) {
+		t.Fatalf("Adobe segment not kept, markers % X", headerMarkers(stripped))
+	}
+
+	c, err := assembleContainerVipsLike(containerParts{
+		primary: withAdobe, gainmap: sr.Gainmap, secondaryXMP: sr.Segs.SecondaryXMP, secondaryISO: sr.Segs.SecondaryISO,
+	})
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	markers, _, err := DebugContainer(c)
+	if err != nil {
+		t.Fatalf("debug: %v", err)
+	}
+	if strings.Count(markers, "APP14:Adobe;") != 1 || strings.Contains(markers, "APP14;") {
+		t.Fatalf("unexpected markers %s", markers)
+	}
+}
+
+func TestSegmentReader(t *testing.T) {
+	// Fill bytes before APP1, a stray byte before COM, RST in headers, SOS with stuffed byte and RST in scan.
+	data := []byte{
+		0xFF, 0xD8,
+		0xFF, 0xFF, 0xE1, 0x00, 0x04, 'a', 'b',
+		0x00,
+		0xFF, 0xFE, 0x00, 0x02,
+		0xFF, 0xD0,
+		0xFF, 0xDA, 0x00, 0x03, 0x01,
+		0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD1, 0x56,
+		0xFF, 0xD9,
+	}
+	r, err := newSegmentReader(data)
+	if err != nil {
+		t.Fatalf("new reader: %v", err)
+	}
+	var got []jpegSegment
+	for {
+		seg, ok, err := r.next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, seg)
+	}
+	want := []jpegSegment{
+		{marker: markerAPP1, offset: 2, end: 9, payload: []byte("ab")},
+		{marker: markerCOM, offset: 10, end: 14, payload: []byte{}},
+		{marker: 0xD0, offset: 14, end: 16},
+		{marker: markerSOS, offset: 16, end: 21, payload: []byte{0x01}},
+		{marker: 0x00, offset: 22, end: 24},
+		{marker: 0xD1, offset: 25, end: 27},
+		{marker: markerEOI, offset: 28, end: 30},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d: %+v", len(got), len(want), got)
+	}
+	for i, seg := range got {
+		w := want[i]
+		if seg.marker != w.marker || seg.offset != w.offset || seg.end != w.end ||
+			!bytes.Equal(seg.payload, w.payload) || (seg.payload == nil) != (w.payload == nil) {
+			t.Fatalf("segment %d: got %+v, want %+v", i, seg, w)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		data []byte
+		want error
+	}{
+		"not jpeg":       {data: []byte{0xFF, 0xD9, 0xFF, 0xD9}, want: ErrNotJPEG},
+		"truncated":      {data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00}, want: ErrTruncated},
+		"invalid length": {data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x08, 'a'}},
+	} {
+		_, _, err := appSegmentViews(tc.data)
+		if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestReadSegmentPayloadCopy(t *testing.T) {
+	br := bufio.NewReader(bytes.NewReader([]byte{0x00, 0x04, 'a', 'b', 0x00, 0x04, 'c', 'd'}))
+	var buf bytes.Buffer
+	var first, second []byte
+	if err := readSegment(br, &buf, &first); err != nil {
+		t.Fatalf("read first: %v", err)
+	}
+	// Reused buffer does not overwrite payload of a previous segment.
+	buf.Reset()
+	if err := readSegment(br, &buf, &second); err != nil {
+		t.Fatalf("read second: %v", err)
+	}
+	if string(first) != "ab" || string(second) != "cd" || buf.String() != "\x00\x04cd" {
+		t.Fatalf("unexpected payloads %q, %q, buffer %q", first, second, buf.String())
+	}
+}
+
+func errText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func FuzzScanEntropyData(f *testing.F) {
+	f.Add([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD0, 0x56, 0xFF, 0xD9})
+	f.Add([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xFF, 0xD9, 0xFF})
+	f.Add([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0xFF, 0xC4, 0x00, 0x03, 0x00, 0xFF, 0xD9})
+	f.Add([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF})
+	if data, err := os.ReadFile("testdata/small_uhdr.jpg"); err == nil {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		end, err := findJPEGEnd(data, 0)
+		wantEnd, wantErr := findJPEGEndByteWise(data, 0)
+		if end != wantEnd || errText(err) != errText(wantErr) {
+			t.Fatalf("findJPEGEnd: got %d, %v want %d, %v", end, err, wantEnd, wantErr)
+		}
+
+		// Minimal buffer size makes ReadSlice hit bufio.ErrBufferFull on longer runs.
+		var got, want bytes.Buffer
+		err = readScanData(bufio.NewReaderSize(bytes.NewReader(data), 16), &got)
+		wantErr = readScanDataByteWise(bufio.NewReaderSize(bytes.NewReader(data), 16), &want)
+		if errText(err) != errText(wantErr) || !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("readScanData: got %d bytes, %v want %d bytes, %v", got.Len(), err, want.Len(), wantErr)
+		}
+
+		br, wantBR := bufio.NewReaderSize(bytes.NewReader(data), 16), bufio.NewReaderSize(bytes.NewReader(data), 16)
+		err, wantErr = skipScanToEOI(br), skipScanToEOIByteWise(wantBR)
+		rest, _ := io.ReadAll(br)
+		wantRest, _ := io.ReadAll(wantBR)
+		if errText(err) != errText(wantErr) || !bytes.Equal(rest, wantRest) {
+			t.Fatalf("skipScanToEOI: got %v, %d left want %v, %d left", err, len(rest), wantErr, len(wantRest))
+		}
+	})
+}
+
+// addTestdataSeeds adds payloads extracted from testdata JPEGs to fuzz corpus.
+func addTestdataSeeds(f *testing.F, extract func(data []byte) [][]byte) {
+	f.Helper()
+	files, err := filepath.Glob("testdata/*.jpg")
+	if err != nil {
+		f.Fatalf("glob: %v", err)
+	}
+	generated, _ := filepath.Glob("testdata/generated/*.jpg")
+	for _, name := range append(files, generated...) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatalf("read %s: %v", name, err)
+		}
+		for _, seed := range extract(data) {
+			f.Add(seed)
+		}
+	}
+}
+
+// segmentSeeds returns APP1/APP2 payloads of all images in data that satisfy keep.
+func segmentSeeds(data []byte, keep func(payload []byte) bool) [][]byte {
+	ranges, err := scanJPEGs(data)
+	if err != nil {
+		return nil
+	}
+	var seeds [][]byte
+	for _, r := range ranges {
+		app1, app2, err := appSegmentViews(data[r[0]:r[1]])
+		if err != nil {
+			continue
+		}
+		for _, p := range append(app1, app2...) {
+			if keep(p) {
+				seeds = append(seeds, p)
+			}
+		}
+	}
+	return seeds
+}
+
+// checkAllocBound fails when fn allocates more than a linear function of input size n,
+// e.g. because of a declared size or count that was not checked against input.
+func checkAllocBound(t *testing.T, n int, fn func()) {
+	t.Helper()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	if allocated, limit := after.TotalAlloc-before.TotalAlloc, uint64(64*n+1<<20); allocated > limit {
+		t.Fatalf("allocated %d bytes for %d bytes of input, limit %d", allocated, n, limit)
+	}
+}
+
+func FuzzScanJPEGs(f *testing.F) {
+	f.Add([]byte{0xFF, 0xD8, 0xFF, 0xD9, 0xFF, 0xD8, 0xFF, 0xD9})
+	f.Add([]byte{0xFF, 0xD8, 0xFF, 0xE2, 0x00, 0x06, 'M', 'P', 'F', 0x00, 0xFF, 0xD9})
+	addTestdataSeeds(f, func(data []byte) [][]byte { return [][]byte{data} })
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var (
+			ranges [][2]int
+			err    error
+		)
+		checkAllocBound(t, len(data), func() { ranges, err = scanJPEGs(data) })
+		if err != nil {
+			return
+		}
+		// The smallest JPEG is SOI followed by EOI.
+		if len(ranges) > len(data)/4 {
+			t.Fatalf("%d images in %d bytes", len(ranges), len(data))
+		}
+		for _, r := range ranges {
+			if r[0] < 0 || r[1] > len(data) || r[1]-r[0] < 4 || data[r[0]] != markerStart || data[r[0]+1] != markerSOI {
+				t.Fatalf("invalid range %v of %d bytes", r, len(data))
+			}
+		}
+	})
+}
+
+func FuzzParseMPF(f *testing.F) {
+	f.Add(generateMpf(1000, 200, 900))
+	addTestdataSeeds(f, func(data []byte) [][]byte {
+		return segmentSeeds(data, func(p []byte) bool { return bytes.HasPrefix(p, mpfSig) })
+	})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var (
+			info mpfInfo
+			err  error
+		)
+		checkAllocBound(t, len(payload), func() { info, err = parseMPF(payload) })
+		if err != nil {
+			if !errors.Is(err, ErrInvalidMPF) {
+				t.Fatalf("error %q does not match ErrInvalidMPF", err)
+			}
+			return
+		}
+		if info.primarySize <= 0 || info.secondarySize <= 0 {
+			t.Fatalf("unexpected sizes %+v", info)
+		}
+	})
+}
+
+func TestDecodeRejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	data := buf.Bytes()
+	sof := bytes.Index(data, []byte{markerStart, 0xC0})
+	if sof < 0 {
+		t.Fatalf("SOF0 not found")
+	}
+	// Frame header: length, precision, height, width.
+	binary.BigEndian.PutUint16(data[sof+5:], 60000)
+	binary.BigEndian.PutUint16(data[sof+7:], 60000)
+
+	var err error
+	checkAllocBound(t, len(data), func() { _, err = decodeJPEG(data) })
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+
+	uhdr, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, uhdr)
+	container, err := AssembleWithMetadata(data, sr.Gainmap, sr.Meta)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	checkAllocBound(t, len(container), func() { _, _, _, err = Decode(container, nil) })
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("decode: expected ErrTruncated, got %v", err)
+	}
+}
+
+func BenchmarkScanJPEGs(b *testing.B) {
+	data, err := os.ReadFile("testdata/uhdr.jpg")
+	if err != nil {
+		b.Fatalf("read uhdr: %v", err)
+	}
+	// Break MPF signature to force the marker walk over entropy-coded data.
+	data = bytes.Replace(data, mpfSig, []byte("MPX\x00"), 1)
+	if _, ok := scanJPEGsByMPF(data); ok {
+		b.Fatalf("MPF not removed")
+	}
+
+	b.Run("scanJPEGs", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := scanJPEGs(data); err != nil {
+				b.Fatalf("scan: %v", err)
+			}
+		}
+	})
+	b.Run("IsUltraHDR", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := IsUltraHDR(bytes.NewReader(data)); err != nil {
+				b.Fatalf("detect: %v", err)
+			}
+		}
+	})
+	b.Run("Split", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Split(bytes.NewReader(data)); err != nil {
+				b.Fatalf("split: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package ultrahdr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// JPEGInfo is the frame header of a JPEG image.
+type JPEGInfo struct {
+	Width       int
+	Height      int
+	Precision   int             // Sample precision in bits, 8 for baseline images.
+	Progressive bool            // Progressive DCT frame (SOF2, SOF6, SOF10 or SOF14).
+	Components  []JPEGComponent // Frame components in header order.
+}
+
+// JPEGComponent describes a frame component.
+type JPEGComponent struct {
+	ID         uint8
+	H, V       uint8 // Horizontal and vertical sampling factors.
+	QuantTable uint8 // Quantization table selector.
+}
+
+// ParseJPEGHeader reads the frame header (SOF segment) of the JPEG image at the start of data
+// without decoding image data, e.g. to check dimensions of a primary or gainmap image.
+func ParseJPEGHeader(data []byte) (JPEGInfo, error) {
+	if len(data) < 2 || data[0] != markerStart || data[1] != markerSOI {
+		return JPEGInfo{}, fmt.Errorf("%w: SOI marker missing", ErrNotJPEG)
+	}
+	pos := 2
+	for {
+		for pos < len(data) && data[pos] != markerStart {
+			pos++
+		}
+		for pos < len(data) && data[pos] == markerStart {
+			pos++
+		}
+		if pos >= len(data) {
+			return JPEGInfo{}, fmt.Errorf("%w: frame header missing", ErrTruncated)
+		}
+		marker := data[pos]
+		pos++
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// TEM and RST have no length.
+			continue
+		}
+		if marker == markerSOS || marker == markerEOI {
+			return JPEGInfo{}, errors.New("frame header missing")
+		}
+		if pos+2 > len(data) {
+			return JPEGInfo{}, fmt.Errorf("%w marker", ErrTruncated)
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos:]))
+		if segLen < 2 {
+			return JPEGInfo{}, fmt.Errorf("invalid length of marker %02X", marker)
+		}
+		if pos+segLen > len(data) {
+			return JPEGInfo{}, fmt.Errorf("%w marker %02X", ErrTruncated, marker)
+		}
+		if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC {
+			return parseSOF(marker, data[pos+2:pos+segLen])
+		}
+		pos += segLen
+	}
+}
+
+// parseSOF parses frame header payload of SOFn marker.
+func parseSOF(marker byte, payload []byte) (JPEGInfo, error) {
+	if len(payload) < 6 {
+		return JPEGInfo{}, errors.New("invalid frame header length")
+	}
+	n := int(payload[5])
+	if n == 0 || len(payload) < 6+3*n {
+		return JPEGInfo{}, fmt.Errorf("invalid frame header with %d components", n)
+	}
+	info := JPEGInfo{
+		Precision:   int(payload[0]),
+		Height:      int(binary.BigEndian.Uint16(payload[1:])),
+		Width:       int(binary.BigEndian.Uint16(payload[3:])),
+		Progressive: marker == 0xC2 || marker == 0xC6 || marker == 0xCA || marker == 0xCE,
+		Components:  make([]JPEGComponent, n),
+	}
+	for i := range info.Components {
+		c := payload[6+3*i:]
+		info.Components[i] = JPEGComponent{ID: c[0], H: c[1] >> 4, V: c[1] & 0x0f, QuantTable: c[2]}
+	}
+	return info, nil
+}
+
+// decodedBytes estimates memory of the decoded image, a byte per sample: gray, YCbCr with
+// subsampled chroma planes, or CMYK.
+func (info JPEGInfo) decodedBytes() int64 {
+	w, h := int64(info.Width), int64(info.Height)
+	if len(info.Components) != 3 {
+		return w * h * int64(max(len(info.Components), 1))
+	}
+	var hMax, vMax int64 = 1, 1
+	for _, c := range info.Components {
+		hMax, vMax = max(hMax, int64(c.H)), max(vMax, int64(c.V))
+	}
+	var n int64
+	for _, c := range info.Components {
+		ch, cv := max(int64(c.H), 1), max(int64(c.V), 1)
+		n += (w*ch + hMax - 1) / hMax * ((h*cv + vMax - 1) / vMax)
+	}
+	return n
+}
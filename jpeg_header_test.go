@@ -0,0 +1,86 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseJPEGHeader(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.jpg")
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	generated, _ := filepath.Glob("testdata/generated/*.jpg")
+	for _, name := range append(files, generated...) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: decode config: %v", name, err)
+		}
+		info, err := ParseJPEGHeader(data)
+		if err != nil {
+			t.Fatalf("%s: parse header: %v", name, err)
+		}
+		if info.Width != cfg.Width || info.Height != cfg.Height || info.Precision != 8 {
+			t.Fatalf("%s: %dx%d %d-bit, want %dx%d", name, info.Width, info.Height, info.Precision, cfg.Width, cfg.Height)
+		}
+		components := map[color.Model]int{color.GrayModel: 1, color.YCbCrModel: 3, color.CMYKModel: 4}[cfg.ColorModel]
+		if len(info.Components) != components {
+			t.Fatalf("%s: %d components, color model %v", name, len(info.Components), cfg.ColorModel)
+		}
+	}
+
+	data, err := os.ReadFile("testdata/progressive_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := ParseJPEGHeader(sr.Primary)
+	if err != nil {
+		t.Fatalf("parse primary: %v", err)
+	}
+	gainmap, err := ParseJPEGHeader(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("parse gainmap: %v", err)
+	}
+	if !primary.Progressive || gainmap.Progressive {
+		t.Fatalf("progressive primary %v, gainmap %v", primary.Progressive, gainmap.Progressive)
+	}
+	want := []JPEGComponent{{ID: 1, H: 2, V: 2, QuantTable: 0}, {ID: 2, H: 1, V: 1, QuantTable: 1}, {ID: 3, H: 1, V: 1, QuantTable: 1}}
+	for i, c := range primary.Components {
+		if c != want[i] {
+			t.Fatalf("component %d: %+v, want %+v", i, c, want[i])
+		}
+	}
+
+	gray, err := encodeWithQuality(image.NewGray(image.Rect(0, 0, 9, 5)), 85)
+	if err != nil {
+		t.Fatalf("encode gray: %v", err)
+	}
+	sof := bytes.Index(gray, []byte{markerStart, 0xC0})
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{name: "not JPEG", data: []byte("GIF89a"), want: ErrNotJPEG},
+		{name: "truncated before frame", data: gray[:sof+3], want: ErrTruncated},
+		{name: "truncated frame", data: gray[:sof+8], want: ErrTruncated},
+	} {
+		if _, err := ParseJPEGHeader(tc.data); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if _, err := ParseJPEGHeader(append(gray[:sof:sof], markerStart, markerEOI)); err == nil {
+		t.Fatalf("expected missing frame header error")
+	}
+}
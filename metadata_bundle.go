@@ -1,6 +1,9 @@
 package ultrahdr
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 const metadataBundleFormat = "ultrahdr-meta-1"
 
@@ -14,6 +17,7 @@ type MetadataBundle struct {
 	SecondaryISO []byte   `json:"secondary_iso,omitempty"`
 	Exif         []byte   `json:"exif,omitempty"`
 	ICC          [][]byte `json:"icc,omitempty"`
+	Comments     [][]byte `json:"comments,omitempty"` // COM payloads of primary image.
 }
 
 // BuildMetadataBundle builds a metadata bundle from split segments and primary JPEG.
@@ -28,6 +32,10 @@ func (r *Result) BuildMetadataBundle() (*MetadataBundle, error) {
 	if err != nil {
 		return nil, err
 	}
+	comments, err := extractComments(r.Primary)
+	if err != nil {
+		return nil, err
+	}
 	return &MetadataBundle{
 		Format:       metadataBundleFormat,
 		PrimaryXMP:   r.Segs.PrimaryXMP,
@@ -36,6 +44,7 @@ func (r *Result) BuildMetadataBundle() (*MetadataBundle, error) {
 		SecondaryISO: r.Segs.SecondaryISO,
 		Exif:         exif,
 		ICC:          icc,
+		Comments:     comments,
 	}, nil
 }
 
@@ -48,18 +57,10 @@ func (b *MetadataBundle) Validate() error {
 		return errors.New("metadata bundle missing format")
 	}
 	if b.Format != metadataBundleFormat {
-		return errors.New("unsupported metadata bundle format")
+		return fmt.Errorf("%w: metadata bundle format %q", ErrUnsupportedMetadata, b.Format)
 	}
 	if len(b.SecondaryXMP) == 0 && len(b.SecondaryISO) == 0 {
-		return errors.New("metadata bundle missing gainmap metadata")
+		return fmt.Errorf("metadata bundle: %w", ErrNoGainmapMetadata)
 	}
 	return nil
 }
-
-// assembleFromBundle builds a container using metadata from the bundle.
-func assembleFromBundle(primaryJPEG, gainmapJPEG []byte, b *MetadataBundle) ([]byte, error) {
-	if err := b.Validate(); err != nil {
-		return nil, err
-	}
-	return assembleContainerVipsLike(primaryJPEG, gainmapJPEG, b.Exif, b.ICC, b.SecondaryXMP, b.SecondaryISO)
-}
@@ -0,0 +1,143 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// RewriteGainmapMetadata replaces gainmap metadata of an UltraHDR JPEG with meta.
+// ISO 21496-1 and XMP metadata of the gainmap image are regenerated, primary copies
+// (hdrgm attributes in primary XMP, Item:Length and MPF sizes) are updated, compressed
+// image data and other segments are left untouched. Output has primary image first.
+func RewriteGainmapMetadata(data []byte, meta *GainMapMetadata) ([]byte, error) {
+	if err := validateMetadata(meta); err != nil {
+		return nil, err
+	}
+	ranges, err := scanJPEGs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) < 2 {
+		return nil, errors.New("gainmap image not found")
+	}
+	primary := data[ranges[0][0]:ranges[0][1]]
+	gainmap := data[ranges[1][0]:ranges[1][1]]
+
+	iso, err := buildIsoPayload(meta)
+	if err != nil {
+		return nil, fmt.Errorf("encode gainmap iso: %w", err)
+	}
+	xmp := buildGainmapXMP(meta)
+
+	hasISO, hasXMP := false, false
+	gainmap, err = rewriteAppSegments(gainmap, func(marker byte, payload []byte) []byte {
+		switch {
+		case marker == markerAPP2 && bytes.HasPrefix(payload, isoPrefix):
+			hasISO = true
+			return iso
+		case marker == markerAPP1 && bytes.HasPrefix(payload, xmpPrefix):
+			hasXMP = true
+			return xmp
+		}
+		return payload
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gainmap: %w", err)
+	}
+	var missing []appSegment
+	if !hasXMP {
+		missing = append(missing, appSegment{marker: markerAPP1, payload: xmp})
+	}
+	if !hasISO {
+		missing = append(missing, appSegment{marker: markerAPP2, payload: iso})
+	}
+	if len(missing) > 0 {
+		if gainmap, err = insertAppSegments(gainmap, missing); err != nil {
+			return nil, fmt.Errorf("gainmap: %w", err)
+		}
+	}
+
+	primary, err = rewriteAppSegments(primary, func(marker byte, payload []byte) []byte {
+		switch {
+		case marker == markerAPP2 && bytes.HasPrefix(payload, isoPrefix) && len(payload) > len(isoPrefix)+isoVersionSize:
+			// Full metadata copy on primary image.
+			return iso
+		case marker == markerAPP1 && bytes.HasPrefix(payload, xmpPrefix):
+			payload = rewriteXMPAttributes(payload, meta)
+			if updated, err := updatePrimaryXmpLength(payload, len(gainmap)); err == nil {
+				payload = updated
+			}
+		}
+		return payload
+	})
+	if err != nil {
+		return nil, fmt.Errorf("primary: %w", err)
+	}
+
+	out := make([]byte, 0, len(primary)+len(gainmap))
+	out = append(out, primary...)
+	out = append(out, gainmap...)
+	if err := replaceMpfPayload(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// rewriteAppSegments returns a copy of JPEG with APP segment payloads (up to SOS) replaced by rewrite.
+func rewriteAppSegments(jpegData []byte, rewrite func(marker byte, payload []byte) []byte) ([]byte, error) {
+	r, err := newSegmentReader(jpegData)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.Write(jpegData[:2])
+	for {
+		prev := r.pos
+		seg, ok, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || seg.marker == markerSOS || seg.marker == markerEOI {
+			out.Write(jpegData[prev:])
+			return out.Bytes(), nil
+		}
+		if !seg.isApp() {
+			out.Write(jpegData[prev:seg.end])
+			continue
+		}
+		out.Write(jpegData[prev:seg.offset])
+		if err := writeAppSegment(&out, seg.marker, rewrite(seg.marker, seg.payload)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+var reXMPGainmapAttr = regexp.MustCompile(`hdrgm:(GainMapMin|GainMapMax|Gamma|OffsetSDR|OffsetHDR|HDRCapacityMin|HDRCapacityMax)="[^"]*"`)
+
+// rewriteXMPAttributes replaces existing single-value hdrgm attributes with values of meta.
+func rewriteXMPAttributes(payload []byte, meta *GainMapMetadata) []byte {
+	return reXMPGainmapAttr.ReplaceAllFunc(payload, func(attr []byte) []byte {
+		name := string(reXMPGainmapAttr.FindSubmatch(attr)[1])
+		var v float32
+		switch name {
+		case "GainMapMin":
+			v = log2f(meta.MinContentBoost[0])
+		case "GainMapMax":
+			v = log2f(meta.MaxContentBoost[0])
+		case "Gamma":
+			v = meta.Gamma[0]
+		case "OffsetSDR":
+			v = meta.OffsetSDR[0]
+		case "OffsetHDR":
+			v = meta.OffsetHDR[0]
+		case "HDRCapacityMin":
+			v = log2f(meta.HDRCapacityMin)
+		case "HDRCapacityMax":
+			v = log2f(meta.HDRCapacityMax)
+		}
+		return []byte(`hdrgm:` + name + `="` + strconv.FormatFloat(float64(v), 'g', 6, 32) + `"`)
+	})
+}
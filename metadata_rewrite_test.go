@@ -0,0 +1,84 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestRewriteGainmapMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	src := mustSplit(t, data)
+	meta := *src.Meta
+	meta.HDRCapacityMax = 2
+	meta.HDRCapacityMin = 1
+
+	out, err := RewriteGainmapMetadata(data, &meta)
+	if err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	if MaxSeverity(ValidateContainer(out)) >= SeverityWarning {
+		t.Fatalf("rewritten container is invalid: %+v", ValidateContainer(out))
+	}
+	res := mustSplit(t, out)
+	if d := res.Meta.HDRCapacityMax - 2; d > 1e-3 || d < -1e-3 {
+		t.Fatalf("HDRCapacityMax = %v, want 2", res.Meta.HDRCapacityMax)
+	}
+	if res.Meta.MaxContentBoost != src.Meta.MaxContentBoost {
+		t.Fatalf("MaxContentBoost changed: %v -> %v", src.Meta.MaxContentBoost, res.Meta.MaxContentBoost)
+	}
+	xmpMeta, err := parseXMP(res.Segs.SecondaryXMP)
+	if err != nil {
+		t.Fatalf("parse secondary XMP: %v", err)
+	}
+	if d := xmpMeta.HDRCapacityMax - 2; d > 1e-3 || d < -1e-3 {
+		t.Fatalf("XMP HDRCapacityMax = %v, want 2", xmpMeta.HDRCapacityMax)
+	}
+
+	// Compressed image data is kept as is.
+	for name, pair := range map[string][2][]byte{
+		"primary": {src.Primary, res.Primary},
+		"gainmap": {src.Gainmap, res.Gainmap},
+	} {
+		a, err := stripAppSegments(pair[0])
+		if err != nil {
+			t.Fatalf("strip %s: %v", name, err)
+		}
+		b, err := stripAppSegments(pair[1])
+		if err != nil {
+			t.Fatalf("strip %s: %v", name, err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Fatalf("%s image data changed", name)
+		}
+	}
+}
+
+func TestUpdateContainerGainmapLength(t *testing.T) {
+	xmp := buildPrimaryXMP(asymmetricGammaMeta(), 1234)
+	if !bytes.Contains(xmp, []byte(`Item:Length="1234"`)) {
+		t.Fatalf("unexpected primary XMP: %s", xmp)
+	}
+	orig := append([]byte(nil), xmp...)
+
+	out, err := UpdateContainerGainmapLength(xmp, 56789)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if !bytes.Contains(out, []byte(`Item:Length="56789"`)) || bytes.Contains(out, []byte(`Item:Length="1234"`)) {
+		t.Fatalf("length not updated: %s", out)
+	}
+	if !bytes.Equal(xmp, orig) {
+		t.Fatalf("input modified")
+	}
+
+	if _, err := UpdateContainerGainmapLength(xmp, 0); err == nil {
+		t.Fatalf("expected error for invalid size")
+	}
+	if _, err := UpdateContainerGainmapLength([]byte("not xmp"), 10); err == nil {
+		t.Fatalf("expected error for missing XMP namespace")
+	}
+}
@@ -20,6 +20,7 @@ const (
 
 	mpfAttrFormatJpeg  = 0x0000000
 	mpfAttrTypePrimary = 0x030000
+	mpfAttrTypeMask    = 0xFFFFFF
 )
 
 var (
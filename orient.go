@@ -0,0 +1,374 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// EXIF orientation values, see TIFF/EXIF tag 0x0112.
+const (
+	orientationNormal     = 1
+	orientationFlipH      = 2
+	orientationRotate180  = 3
+	orientationFlipV      = 4
+	orientationTranspose  = 5
+	orientationRotate90   = 6
+	orientationTransverse = 7
+	orientationRotate270  = 8
+
+	exifTagOrientation = 0x0112
+)
+
+// Transform is a flip or rotation applied to resize outputs.
+type Transform int
+
+// Supported transforms.
+const (
+	TransformNone      Transform = iota
+	TransformFlipH               // Mirror left to right.
+	TransformFlipV               // Mirror top to bottom.
+	TransformRotate90            // Rotate clockwise by 90 degrees.
+	TransformRotate180           // Rotate by 180 degrees.
+	TransformRotate270           // Rotate clockwise by 270 degrees.
+)
+
+// orientation returns EXIF orientation equivalent of t.
+func (t Transform) orientation() int {
+	switch t {
+	case TransformFlipH:
+		return orientationFlipH
+	case TransformFlipV:
+		return orientationFlipV
+	case TransformRotate90:
+		return orientationRotate90
+	case TransformRotate180:
+		return orientationRotate180
+	case TransformRotate270:
+		return orientationRotate270
+	default:
+		return orientationNormal
+	}
+}
+
+// apply returns img transformed with t, img is returned as is for TransformNone.
+func (t Transform) apply(img image.Image) image.Image {
+	if o := t.orientation(); o != orientationNormal {
+		return orientImage(img, o)
+	}
+	return img
+}
+
+// OrientOptions controls re-encoding for RotateHDR, FlipHDR and AutoOrientHDR.
+type OrientOptions struct {
+	Quality        int // Primary JPEG quality (0 uses default).
+	GainmapQuality int // Gainmap JPEG quality (0 uses default or Quality).
+}
+
+// RotateHDR rotates an UltraHDR JPEG clockwise by a multiple of 90 degrees.
+// Primary and gainmap are rotated together, EXIF orientation is reset to normal.
+func RotateHDR(r io.Reader, degrees int, opt *OrientOptions) (*Result, error) {
+	switch ((degrees % 360) + 360) % 360 {
+	case 0:
+		return orientHDR(r, orientationNormal, opt)
+	case 90:
+		return orientHDR(r, orientationRotate90, opt)
+	case 180:
+		return orientHDR(r, orientationRotate180, opt)
+	case 270:
+		return orientHDR(r, orientationRotate270, opt)
+	default:
+		return nil, fmt.Errorf("rotation must be a multiple of 90 degrees, got %d", degrees)
+	}
+}
+
+// FlipHDR mirrors an UltraHDR JPEG horizontally (left to right) or vertically (top to bottom).
+func FlipHDR(r io.Reader, horizontal bool, opt *OrientOptions) (*Result, error) {
+	if horizontal {
+		return orientHDR(r, orientationFlipH, opt)
+	}
+	return orientHDR(r, orientationFlipV, opt)
+}
+
+// AutoOrientHDR bakes EXIF orientation of the primary image into pixels of primary and gainmap.
+// Input without orientation tag (or with normal orientation) is returned unchanged.
+func AutoOrientHDR(r io.Reader, opt *OrientOptions) (*Result, error) {
+	return orientHDR(r, 0, opt)
+}
+
+// orientHDR applies EXIF-style orientation o to UltraHDR container, zero o reads it from EXIF.
+func orientHDR(r io.Reader, o int, opt *OrientOptions) (*Result, error) {
+	if r == nil {
+		return nil, errors.New("missing input reader")
+	}
+	if opt == nil {
+		opt = &OrientOptions{}
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("split: %w", err)
+	}
+	if sr.Meta == nil {
+		return nil, ErrNoGainmapMetadata
+	}
+	exif, icc, err := extractExifAndIcc(sr.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("extract exif and icc: %w", err)
+	}
+	if o == 0 {
+		o, _ = exifOrientation(exif)
+		if o < orientationNormal || o > orientationRotate270 {
+			o = orientationNormal
+		}
+		if o == orientationNormal {
+			sr.Container = data
+			return sr, nil
+		}
+	}
+
+	primaryImg, err := decodeJPEG(sr.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("decode primary: %w", err)
+	}
+	gainmapImg, err := decodeJPEG(sr.Gainmap)
+	if err != nil {
+		return nil, fmt.Errorf("decode gainmap: %w", err)
+	}
+
+	primaryQuality := Defaults.PrimaryQuality
+	gainmapQuality := Defaults.GainmapQuality
+	if opt.Quality > 0 {
+		primaryQuality = opt.Quality
+	}
+	if opt.GainmapQuality > 0 {
+		gainmapQuality = opt.GainmapQuality
+	} else if opt.Quality > 0 {
+		gainmapQuality = opt.Quality
+	}
+
+	primaryOut, err := encodeWithQuality(orientImage(primaryImg, o), primaryQuality)
+	if err != nil {
+		return nil, fmt.Errorf("encode primary: %w", err)
+	}
+	gainmapOut, err := encodeWithQuality(orientImage(gainmapImg, o), gainmapQuality)
+	if err != nil {
+		return nil, fmt.Errorf("encode gainmap: %w", err)
+	}
+
+	exif = resetExifOrientation(exif)
+	secondaryISO := sr.Segs.SecondaryISO
+	if len(secondaryISO) == 0 {
+		secondaryISO, err = buildIsoPayload(sr.Meta)
+		if err != nil {
+			return nil, fmt.Errorf("encode gainmap iso: %w", err)
+		}
+	}
+	container, err := assembleContainerVipsLike(containerParts{
+		primary: primaryOut, gainmap: gainmapOut, exif: exif, icc: icc,
+		secondaryXMP: sr.Segs.SecondaryXMP, secondaryISO: secondaryISO,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("assemble container: %w", err)
+	}
+	if density, ok := jfifDensitySegment(sr.Primary); ok {
+		if o >= orientationTranspose {
+			density = swapJFIFDensity(density)
+		}
+		container, err = insertContainerAppSegments(container, []appSegment{density})
+		if err != nil {
+			return nil, fmt.Errorf("assemble container: %w", err)
+		}
+	}
+	return &Result{Container: container, Primary: primaryOut, Gainmap: gainmapOut, Meta: sr.Meta, Segs: sr.Segs}, nil
+}
+
+// orientedDims returns dimensions of w x h image after applying EXIF orientation o.
+func orientedDims(w, h, o int) (int, int) {
+	if o >= orientationTranspose {
+		return h, w
+	}
+	return w, h
+}
+
+// orientSource maps destination coordinates of w x h source oriented with o to source coordinates.
+func orientSource(x, y, w, h, o int) (int, int) {
+	switch o {
+	case orientationFlipH:
+		return w - 1 - x, y
+	case orientationRotate180:
+		return w - 1 - x, h - 1 - y
+	case orientationFlipV:
+		return x, h - 1 - y
+	case orientationTranspose:
+		return y, x
+	case orientationRotate90:
+		return y, h - 1 - x
+	case orientationTransverse:
+		return w - 1 - y, h - 1 - x
+	case orientationRotate270:
+		return w - 1 - y, x
+	default:
+		return x, y
+	}
+}
+
+// swapJFIFDensity returns a copy of JFIF density segment with horizontal and vertical densities
+// swapped, for images with swapped axes.
+func swapJFIFDensity(seg appSegment) appSegment {
+	seg.payload = append([]byte(nil), seg.payload...)
+	d := seg.payload[len(jfifSig)+3:]
+	d[0], d[1], d[2], d[3] = d[2], d[3], d[0], d[1]
+	return seg
+}
+
+// orientImage returns a copy of img transformed to EXIF orientation o.
+func orientImage(img image.Image, o int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := orientedDims(w, h, o)
+
+	// Fast paths copy pixels of concrete image types directly.
+	switch src := img.(type) {
+	case *image.Gray:
+		out := image.NewGray(image.Rect(0, 0, dw, dh))
+		for y := 0; y < dh; y++ {
+			for x := 0; x < dw; x++ {
+				sx, sy := orientSource(x, y, w, h, o)
+				out.Pix[y*out.Stride+x] = src.Pix[src.PixOffset(b.Min.X+sx, b.Min.Y+sy)]
+			}
+		}
+		return out
+	case *image.RGBA:
+		out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+		orientPix4(out.Pix, out.Stride, src.Pix, src.Stride, b.Min.X-src.Rect.Min.X, b.Min.Y-src.Rect.Min.Y, w, h, o)
+		return out
+	case *image.NRGBA:
+		out := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+		orientPix4(out.Pix, out.Stride, src.Pix, src.Stride, b.Min.X-src.Rect.Min.X, b.Min.Y-src.Rect.Min.Y, w, h, o)
+		return out
+	case *image.YCbCr:
+		out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+		for y := 0; y < dh; y++ {
+			for x := 0; x < dw; x++ {
+				sx, sy := orientSource(x, y, w, h, o)
+				sx, sy = b.Min.X+sx, b.Min.Y+sy
+				ci := src.COffset(sx, sy)
+				r, g, bl := color.YCbCrToRGB(src.Y[src.YOffset(sx, sy)], src.Cb[ci], src.Cr[ci])
+				i := y*out.Stride + x*4
+				out.Pix[i], out.Pix[i+1], out.Pix[i+2], out.Pix[i+3] = r, g, bl, 0xFF
+			}
+		}
+		return out
+	}
+
+	if isGrayImage(img) {
+		out := image.NewGray(image.Rect(0, 0, dw, dh))
+		for y := 0; y < dh; y++ {
+			for x := 0; x < dw; x++ {
+				sx, sy := orientSource(x, y, w, h, o)
+				out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+			}
+		}
+		return out
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := orientSource(x, y, w, h, o)
+			out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return out
+}
+
+// orientPix4 copies 4-byte pixels of w x h source region at x0, y0 to dst with orientation o.
+func orientPix4(dst []byte, dstStride int, src []byte, srcStride int, x0, y0, w, h, o int) {
+	dw, dh := orientedDims(w, h, o)
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := orientSource(x, y, w, h, o)
+			si := (y0+sy)*srcStride + (x0+sx)*4
+			copy(dst[y*dstStride+x*4:y*dstStride+x*4+4], src[si:si+4])
+		}
+	}
+}
+
+// orientHDRImage returns a copy of hdr transformed to EXIF orientation o.
+func orientHDRImage(hdr *HDRImage, o int) *HDRImage {
+	dw, dh := orientedDims(hdr.W, hdr.H, o)
+	out := &HDRImage{W: dw, H: dh, Pix: make([]float32, len(hdr.Pix)), Gamut: hdr.Gamut}
+	if hdr.Alpha != nil {
+		out.Alpha = make([]float32, len(hdr.Alpha))
+	}
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := orientSource(x, y, hdr.W, hdr.H, o)
+			out.set(x, y, hdr.at(sx, sy))
+			if out.Alpha != nil {
+				out.Alpha[y*dw+x] = hdr.Alpha[sy*hdr.W+sx]
+			}
+		}
+	}
+	return out
+}
+
+// exifOrientation returns orientation value and its offset in EXIF APP1 payload.
+func exifOrientation(exif []byte) (int, int) {
+	if !bytes.HasPrefix(exif, exifSig) {
+		return 0, -1
+	}
+	tiff := exif[len(exifSig):]
+	if len(tiff) < 8 {
+		return 0, -1
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0, -1
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, -1
+	}
+	n := int(bo.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if bo.Uint16(tiff[entry:]) != exifTagOrientation {
+			continue
+		}
+		// SHORT value is stored inline at the start of the value field.
+		pos := entry + 8
+		return int(bo.Uint16(tiff[pos:])), len(exifSig) + pos
+	}
+	return 0, -1
+}
+
+// resetExifOrientation returns a copy of EXIF payload with normal orientation.
+func resetExifOrientation(exif []byte) []byte {
+	o, pos := exifOrientation(exif)
+	if pos < 0 || o == orientationNormal {
+		return exif
+	}
+	out := append([]byte(nil), exif...)
+	if string(out[len(exifSig):len(exifSig)+2]) == "II" {
+		binary.LittleEndian.PutUint16(out[pos:], orientationNormal)
+	} else {
+		binary.BigEndian.PutUint16(out[pos:], orientationNormal)
+	}
+	return out
+}
@@ -0,0 +1,239 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"os"
+	"testing"
+)
+
+// exifWithOrientation builds a minimal little-endian EXIF APP1 payload with orientation tag.
+func exifWithOrientation(o uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	copy(tiff, "II")
+	binary.LittleEndian.PutUint16(tiff[2:], 42)
+	binary.LittleEndian.PutUint32(tiff[4:], 8)
+	binary.LittleEndian.PutUint16(tiff[8:], 1)
+	binary.LittleEndian.PutUint16(tiff[10:], exifTagOrientation)
+	binary.LittleEndian.PutUint16(tiff[12:], 3) // SHORT
+	binary.LittleEndian.PutUint32(tiff[14:], 1)
+	binary.LittleEndian.PutUint16(tiff[18:], o)
+	return append(append([]byte(nil), exifSig...), tiff...)
+}
+
+func TestOrientImage(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	// Source:
+	// 0 1 2
+	// 3 4 5
+	for _, tc := range []struct {
+		o    int
+		w, h int
+		want []uint8
+	}{
+		{o: orientationFlipH, w: 3, h: 2, want: []uint8{2, 1, 0, 5, 4, 3}},
+		{o: orientationRotate180, w: 3, h: 2, want: []uint8{5, 4, 3, 2, 1, 0}},
+		{o: orientationFlipV, w: 3, h: 2, want: []uint8{3, 4, 5, 0, 1, 2}},
+		{o: orientationTranspose, w: 2, h: 3, want: []uint8{0, 3, 1, 4, 2, 5}},
+		{o: orientationRotate90, w: 2, h: 3, want: []uint8{3, 0, 4, 1, 5, 2}},
+		{o: orientationTransverse, w: 2, h: 3, want: []uint8{5, 2, 4, 1, 3, 0}},
+		{o: orientationRotate270, w: 2, h: 3, want: []uint8{2, 5, 1, 4, 0, 3}},
+	} {
+		out, ok := orientImage(src, tc.o).(*image.Gray)
+		if !ok {
+			t.Fatalf("orientation %d: expected gray output", tc.o)
+		}
+		if out.Bounds().Dx() != tc.w || out.Bounds().Dy() != tc.h {
+			t.Fatalf("orientation %d: got %v", tc.o, out.Bounds())
+		}
+		if !bytes.Equal(out.Pix, tc.want) {
+			t.Fatalf("orientation %d: got %v want %v", tc.o, out.Pix, tc.want)
+		}
+	}
+}
+
+func TestOrientImageFastPaths(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 5, 3))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 7)
+	}
+	for i := 3; i < len(rgba.Pix); i += 4 {
+		rgba.Pix[i] = 0xFF
+	}
+	nrgba := image.NewNRGBA(rgba.Rect)
+	copy(nrgba.Pix, rgba.Pix)
+	ycc := image.NewYCbCr(image.Rect(0, 0, 5, 3), image.YCbCrSubsampleRatio420)
+	for i := range ycc.Y {
+		ycc.Y[i] = uint8(i * 13)
+	}
+	for i := range ycc.Cb {
+		ycc.Cb[i], ycc.Cr[i] = uint8(100+i*9), uint8(200-i*11)
+	}
+
+	for _, img := range []image.Image{rgba, nrgba, ycc, rgba.SubImage(image.Rect(1, 1, 4, 3)), ycc.SubImage(image.Rect(1, 0, 5, 3))} {
+		for o := orientationFlipH; o <= orientationRotate270; o++ {
+			got := orientImage(img, o)
+			want := orientImage(opaqueImage{img}, o)
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("%T orientation %d: got %v want %v", img, o, got.Bounds(), want.Bounds())
+			}
+			b := got.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					r1, g1, b1, a1 := got.At(x, y).RGBA()
+					r2, g2, b2, a2 := want.At(x, y).RGBA()
+					if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+						t.Fatalf("%T orientation %d: pixel %d,%d mismatch", img, o, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRotateHDR(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	pCfg, _, err := image.DecodeConfig(bytes.NewReader(sr.Primary))
+	if err != nil {
+		t.Fatalf("decode primary config: %v", err)
+	}
+	gCfg, _, err := image.DecodeConfig(bytes.NewReader(sr.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap config: %v", err)
+	}
+
+	res, err := RotateHDR(bytes.NewReader(data), 90, nil)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	out, err := Split(bytes.NewReader(res.Container))
+	if err != nil {
+		t.Fatalf("split rotated: %v", err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(out.Primary))
+	if err != nil {
+		t.Fatalf("decode primary config: %v", err)
+	}
+	if cfg.Width != pCfg.Height || cfg.Height != pCfg.Width {
+		t.Fatalf("primary dims not swapped: got %dx%d", cfg.Width, cfg.Height)
+	}
+	cfg, _, err = image.DecodeConfig(bytes.NewReader(out.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap config: %v", err)
+	}
+	if cfg.Width != gCfg.Height || cfg.Height != gCfg.Width {
+		t.Fatalf("gainmap dims not swapped: got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if _, err := RotateHDR(bytes.NewReader(data), 45, nil); err == nil {
+		t.Fatalf("expected error for 45 degrees")
+	}
+}
+
+func TestAutoOrientHDR(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	res, err := AutoOrientHDR(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("auto orient: %v", err)
+	}
+	if !bytes.Equal(res.Container, data) {
+		t.Fatalf("expected unchanged container without orientation")
+	}
+
+	tagged, err := insertContainerAppSegments(data, []appSegment{{marker: markerAPP1, payload: exifWithOrientation(orientationRotate90)}})
+	if err != nil {
+		t.Fatalf("insert exif: %v", err)
+	}
+	res, err = AutoOrientHDR(bytes.NewReader(tagged), &OrientOptions{Quality: 85})
+	if err != nil {
+		t.Fatalf("auto orient: %v", err)
+	}
+	exif, _, err := extractExifAndIcc(mustSplit(t, res.Container).Primary)
+	if err != nil {
+		t.Fatalf("extract exif: %v", err)
+	}
+	if o, _ := exifOrientation(exif); o != orientationNormal {
+		t.Fatalf("orientation not reset: %d", o)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(mustSplit(t, data).Primary))
+	if err != nil {
+		t.Fatalf("decode source: %v", err)
+	}
+	dst, _, err := image.Decode(bytes.NewReader(res.Primary))
+	if err != nil {
+		t.Fatalf("decode rotated: %v", err)
+	}
+	sb, db := src.Bounds(), dst.Bounds()
+	if db.Dx() != sb.Dy() || db.Dy() != sb.Dx() {
+		t.Fatalf("dims not swapped: %v -> %v", sb, db)
+	}
+	// Top-right destination corner comes from top-left source corner.
+	want := color.GrayModel.Convert(src.At(sb.Min.X, sb.Min.Y)).(color.Gray).Y
+	got := color.GrayModel.Convert(dst.At(db.Max.X-1, db.Min.Y)).(color.Gray).Y
+	if d := int(got) - int(want); d > 12 || d < -12 {
+		t.Fatalf("corner mismatch: got %d want %d", got, want)
+	}
+}
+
+func TestDecodeOrientation(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	tagged, err := insertContainerAppSegments(data, []appSegment{{marker: markerAPP1, payload: exifWithOrientation(orientationRotate90)}})
+	if err != nil {
+		t.Fatalf("insert exif: %v", err)
+	}
+
+	raw, rawSDR, _, err := Decode(tagged, &DecodeOptions{RawOrientation: true})
+	if err != nil {
+		t.Fatalf("decode raw: %v", err)
+	}
+	hdr, sdr, _, err := Decode(tagged, nil)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if hdr.W != raw.H || hdr.H != raw.W {
+		t.Fatalf("HDR dims not swapped: %dx%d -> %dx%d", raw.W, raw.H, hdr.W, hdr.H)
+	}
+	if sdr.Bounds().Dx() != rawSDR.Bounds().Dy() || sdr.Bounds().Dy() != rawSDR.Bounds().Dx() {
+		t.Fatalf("SDR dims not swapped: %v -> %v", rawSDR.Bounds(), sdr.Bounds())
+	}
+	// Top-right display corner comes from top-left stored corner.
+	if got, want := hdr.at(hdr.W-1, 0), raw.at(0, 0); got != want {
+		t.Fatalf("corner mismatch: got %v want %v", got, want)
+	}
+
+	_, base, _, err := Decode(tagged, &DecodeOptions{SkipReconstruction: true})
+	if err != nil {
+		t.Fatalf("decode base: %v", err)
+	}
+	if base.Bounds() != sdr.Bounds() {
+		t.Fatalf("base not oriented: %v", base.Bounds())
+	}
+}
+
+func mustSplit(t *testing.T, data []byte) *Result {
+	t.Helper()
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	return sr
+}
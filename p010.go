@@ -0,0 +1,84 @@
+package ultrahdr
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// HDRImageFromP010 converts a P010 (semi-planar 4:2:0, 10 bits in the upper bits of
+// little-endian 16-bit samples, limited range) buffer into a linear HDR image.
+//
+// y holds the luma plane, uv holds interleaved Cb/Cr samples at half resolution.
+// stride is the row length of both planes in samples (pixels), zero means w.
+// The YUV->RGB matrix is selected by gamut (BT.2020, BT.709 for sRGB, BT.601 for Display P3),
+// transfer is used to linearize values relative to SDR white (Defaults.SDRWhiteNits for PQ/HLG).
+func HDRImageFromP010(y, uv []byte, w, h, stride int, transfer ColorTransfer, gamut ColorGamut) (*HDRImage, error) {
+	if w <= 0 || h <= 0 {
+		return nil, errors.New("invalid P010 dimensions")
+	}
+	if stride == 0 {
+		stride = w
+	}
+	if stride < w {
+		return nil, errors.New("invalid P010 stride")
+	}
+	if len(y) < 2*(stride*(h-1)+w) {
+		return nil, errors.New("P010 luma plane too short")
+	}
+	cw, ch := (w+1)/2, (h+1)/2
+	if len(uv) < 2*(stride*(ch-1)+2*cw) {
+		return nil, errors.New("P010 chroma plane too short")
+	}
+
+	kr, kb := yuvCoefficients(gamut)
+	kg := 1 - kr - kb
+	crR := 2 * (1 - kr)
+	cbB := 2 * (1 - kb)
+	cbG := cbB * kb / kg
+	crG := crR * kr / kg
+
+	out := &HDRImage{
+		W:     w,
+		H:     h,
+		Pix:   make([]float32, w*h*3),
+		Gamut: gamut,
+	}
+	for py := 0; py < h; py++ {
+		yRow := py * stride * 2
+		uvRow := (py / 2) * stride * 2
+		for px := 0; px < w; px++ {
+			yy := (float32(p010Sample(y, yRow+px*2)) - 64) / 876
+			ci := uvRow + (px/2)*4
+			cb := (float32(p010Sample(uv, ci)) - 512) / 896
+			cr := (float32(p010Sample(uv, ci+2)) - 512) / 896
+
+			v := rgb{
+				r: clamp01(yy + crR*cr),
+				g: clamp01(yy - cbG*cb - crG*cr),
+				b: clamp01(yy + cbB*cb),
+			}
+			v = hdrLinearize(v, transfer, Defaults.SDRWhiteNits)
+			i := (py*w + px) * 3
+			out.Pix[i] = v.r
+			out.Pix[i+1] = v.g
+			out.Pix[i+2] = v.b
+		}
+	}
+	return out, nil
+}
+
+func p010Sample(b []byte, off int) uint16 {
+	return binary.LittleEndian.Uint16(b[off:]) >> 6
+}
+
+// yuvCoefficients returns Kr, Kb luma coefficients for the YUV matrix of gamut.
+func yuvCoefficients(gamut ColorGamut) (float32, float32) {
+	switch gamut {
+	case ColorGamutBT2020:
+		return 0.2627, 0.0593
+	case ColorGamutDisplayP3, ColorGamutAdobeRGB:
+		return 0.299, 0.114
+	default:
+		return 0.2126, 0.0722
+	}
+}
@@ -0,0 +1,110 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestHDRImageFromP010(t *testing.T) {
+	// 2x2 image, one chroma sample per plane.
+	p010 := func(w, h int, ys []uint16, u, v uint16) ([]byte, []byte) {
+		y := make([]byte, 0, w*h*2)
+		for _, s := range ys {
+			y = binary.LittleEndian.AppendUint16(y, s<<6)
+		}
+		uv := make([]byte, 0, w*2)
+		for i := 0; i < (h+1)/2; i++ {
+			for j := 0; j < (w+1)/2; j++ {
+				uv = binary.LittleEndian.AppendUint16(uv, u<<6)
+				uv = binary.LittleEndian.AppendUint16(uv, v<<6)
+			}
+		}
+		return y, uv
+	}
+
+	t.Run("pq neutral", func(t *testing.T) {
+		y, uv := p010(2, 2, []uint16{64, 940, 573, 502}, 512, 512)
+		hdr, err := HDRImageFromP010(y, uv, 2, 2, 0, ColorTransferPQ, ColorGamutBT2020)
+		if err != nil {
+			t.Fatalf("convert: %v", err)
+		}
+		for i, want := range []float32{0, 10000.0 / 203, 1.0034628} {
+			got := hdr.at(i%2, i/2)
+			assertRelClose(t, got.r, want, 1e-3)
+			assertRelClose(t, got.g, want, 1e-3)
+			assertRelClose(t, got.b, want, 1e-3)
+		}
+	})
+
+	t.Run("linear bt2020 chroma", func(t *testing.T) {
+		y, uv := p010(2, 2, []uint16{502, 502, 502, 502}, 512, 736)
+		hdr, err := HDRImageFromP010(y, uv, 2, 2, 0, ColorTransferLinear, ColorGamutBT2020)
+		if err != nil {
+			t.Fatalf("convert: %v", err)
+		}
+		got := hdr.at(1, 1)
+		assertRelClose(t, got.r, 0.86865, 1e-4)
+		assertRelClose(t, got.g, 0.35716, 1e-4)
+		assertRelClose(t, got.b, 0.5, 1e-4)
+	})
+
+	t.Run("stride", func(t *testing.T) {
+		// Stride of 4 samples for a 2x2 image, padding must be skipped.
+		y := make([]byte, 4*2*2)
+		uv := make([]byte, 4*2)
+		for row := 0; row < 2; row++ {
+			binary.LittleEndian.PutUint16(y[row*8:], 940<<6)
+			binary.LittleEndian.PutUint16(y[row*8+2:], 940<<6)
+			binary.LittleEndian.PutUint16(y[row*8+4:], 64<<6)
+		}
+		binary.LittleEndian.PutUint16(uv, 512<<6)
+		binary.LittleEndian.PutUint16(uv[2:], 512<<6)
+		hdr, err := HDRImageFromP010(y, uv, 2, 2, 4, ColorTransferLinear, ColorGamutBT2020)
+		if err != nil {
+			t.Fatalf("convert: %v", err)
+		}
+		assertRelClose(t, hdr.at(1, 1).g, 1, 1e-4)
+	})
+
+	if _, err := HDRImageFromP010(make([]byte, 4), make([]byte, 4), 2, 2, 0, ColorTransferPQ, ColorGamutBT2020); err == nil {
+		t.Fatalf("expected error for short luma plane")
+	}
+}
+
+func TestRebaseFromHDRWithP010(t *testing.T) {
+	const w, h = 16, 8
+	y := make([]byte, w*h*2)
+	uv := make([]byte, w*(h/2)*2)
+	sdr := image.NewRGBA(image.Rect(0, 0, w, h))
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px++ {
+			// Horizontal PQ ramp from black to 1000 nits.
+			code := 64 + uint16(px*(769-64)/(w-1))
+			binary.LittleEndian.PutUint16(y[(py*w+px)*2:], code<<6)
+			v := uint8(px * 255 / (w - 1))
+			sdr.Set(px, py, color.RGBA{R: v, G: v, B: v, A: 0xff})
+		}
+	}
+	for i := 0; i < len(uv); i += 2 {
+		binary.LittleEndian.PutUint16(uv[i:], 512<<6)
+	}
+
+	hdr, err := HDRImageFromP010(y, uv, w, h, 0, ColorTransferPQ, ColorGamutBT2020)
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	res, err := RebaseFromHDR(sdr, hdr)
+	if err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	got, err := Split(bytes.NewReader(res.Container))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if got.Meta.MaxContentBoost[0] <= 1 {
+		t.Fatalf("expected HDR headroom, got max boost %v", got.Meta.MaxContentBoost[0])
+	}
+}
@@ -0,0 +1,30 @@
+package ultrahdr
+
+import (
+	"runtime"
+	"sync"
+)
+
+// parallelChunks returns number of ranges parallelFor splits n items into.
+func parallelChunks(n int) int {
+	return max(1, min(n, runtime.GOMAXPROCS(0)))
+}
+
+// parallelFor splits [0, n) into parallelChunks(n) consecutive ranges and calls fn for each
+// range concurrently, chunk is the index of range (for per-worker partial results).
+func parallelFor(n int, fn func(chunk, start, end int)) {
+	chunks := parallelChunks(n)
+	if chunks == 1 {
+		fn(0, 0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	for c := 0; c < chunks; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(c, c*n/chunks, (c+1)*n/chunks)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,324 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+var pngSig = []byte("\x89PNG\r\n\x1a\n")
+
+// cICP code points (ITU-T H.273).
+const (
+	cicpPrimariesBT709  = 1
+	cicpPrimariesBT2020 = 9
+	cicpPrimariesP3D65  = 12
+
+	cicpTransferLinear = 8
+	cicpTransferSRGB   = 13
+	cicpTransferPQ     = 16
+	cicpTransferHLG    = 18
+)
+
+// PNGHDROptions controls EncodePNGHDR output.
+type PNGHDROptions struct {
+	// Transfer is one of ColorTransferPQ (default), ColorTransferHLG or ColorTransferLinear.
+	Transfer ColorTransfer
+	// WhiteNits is the luminance of SDR white (1.0), Defaults.SDRWhiteNits (203) when zero.
+	WhiteNits float32
+	// PeakNits is the luminance of encoded 1.0 for linear transfer, default 10000.
+	PeakNits float32
+}
+
+// EncodePNGHDR writes a linear HDR image as a 16-bit RGB PNG with BT.2020 primaries,
+// the transfer and primaries are declared in a cICP chunk.
+// nil opts means PQ with SDR white at 203 nits.
+func EncodePNGHDR(hdr *HDRImage, w io.Writer, opts *PNGHDROptions) error {
+	if hdr == nil || w == nil {
+		return errors.New("missing HDR image or writer")
+	}
+	if hdr.W <= 0 || hdr.H <= 0 || len(hdr.Pix) < hdr.W*hdr.H*3 {
+		return errors.New("invalid HDR image dimensions")
+	}
+	o := PNGHDROptions{Transfer: ColorTransferPQ}
+	if opts != nil {
+		o = *opts
+	}
+	if o.WhiteNits <= 0 {
+		o.WhiteNits = Defaults.SDRWhiteNits
+	}
+	if o.PeakNits <= 0 {
+		o.PeakNits = pqMaxNits
+	}
+	var transferCode byte
+	switch o.Transfer {
+	case ColorTransferPQ:
+		transferCode = cicpTransferPQ
+	case ColorTransferHLG:
+		transferCode = cicpTransferHLG
+	case ColorTransferLinear:
+		transferCode = cicpTransferLinear
+	default:
+		return fmt.Errorf("unsupported PNG HDR transfer: %d", o.Transfer)
+	}
+
+	img := image.NewRGBA64(image.Rect(0, 0, hdr.W, hdr.H))
+	for y := 0; y < hdr.H; y++ {
+		for x := 0; x < hdr.W; x++ {
+			v := convertLinearGamut(hdr.at(x, y), hdr.Gamut, ColorGamutBT2020)
+			v = hdrEncode(v, o)
+			img.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(clamp01(v.r)*65535 + 0.5),
+				G: uint16(clamp01(v.g)*65535 + 0.5),
+				B: uint16(clamp01(v.b)*65535 + 0.5),
+				A: 0xffff,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	out, err := insertPNGChunk(buf.Bytes(), "cICP", []byte{cicpPrimariesBT2020, transferCode, 0, 1})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// hdrEncode converts linear light relative to SDR white to encoded values, inverse of hdrLinearize.
+func hdrEncode(v rgb, o PNGHDROptions) rgb {
+	v = rgb{r: max(v.r, 0), g: max(v.g, 0), b: max(v.b, 0)}
+	switch o.Transfer {
+	case ColorTransferPQ:
+		scale := o.WhiteNits / pqMaxNits
+		return rgb{r: pqInvEOTF(v.r * scale), g: pqInvEOTF(v.g * scale), b: pqInvEOTF(v.b * scale)}
+	case ColorTransferHLG:
+		// Inverse HLG OOTF with nominal peak display luminance.
+		scale := o.WhiteNits / hlgPeakNits
+		d := rgb{r: v.r * scale, g: v.g * scale, b: v.b * scale}
+		yd := 0.2627*d.r + 0.6780*d.g + 0.0593*d.b
+		if yd > 0 {
+			s := float32(math.Pow(float64(yd), (1-hlgGamma)/hlgGamma))
+			d = rgb{r: d.r * s, g: d.g * s, b: d.b * s}
+		}
+		return rgb{r: hlgOETF(d.r), g: hlgOETF(d.g), b: hlgOETF(d.b)}
+	default:
+		scale := o.WhiteNits / o.PeakNits
+		return rgb{r: v.r * scale, g: v.g * scale, b: v.b * scale}
+	}
+}
+
+// DecodePNGHDR decodes a (typically 16-bit) PNG into a linear HDR image relative to SDR white.
+//
+// Encoded values are linearized with transfer. For PQ and HLG, whiteNits defines the luminance
+// of SDR white (Defaults.SDRWhiteNits, 203 nits, when zero), for sRGB and linear transfers 1.0 is SDR white.
+// PQ and HLG images are assumed to have BT.2020 primaries, other transfers sRGB primaries.
+// If the PNG carries a cICP chunk, transfer and primaries are taken from it instead.
+func DecodePNGHDR(data []byte, transfer ColorTransfer, whiteNits float32) (*HDRImage, error) {
+	gamut := ColorGamutSRGB
+	if transfer == ColorTransferPQ || transfer == ColorTransferHLG {
+		gamut = ColorGamutBT2020
+	}
+	cicp, ok, err := findPNGCICP(data)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if gamut, transfer, err = cicpColorSpace(cicp); err != nil {
+			return nil, err
+		}
+	}
+	if whiteNits <= 0 {
+		whiteNits = Defaults.SDRWhiteNits
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= 0 || h <= 0 {
+		return nil, errors.New("invalid PNG dimensions")
+	}
+	out := &HDRImage{
+		W:     w,
+		H:     h,
+		Pix:   make([]float32, w*h*3),
+		Gamut: gamut,
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+			v := rgb{
+				r: float32(c.R) / 65535.0,
+				g: float32(c.G) / 65535.0,
+				b: float32(c.B) / 65535.0,
+			}
+			v = hdrLinearize(v, transfer, whiteNits)
+			i := (y*w + x) * 3
+			out.Pix[i] = v.r
+			out.Pix[i+1] = v.g
+			out.Pix[i+2] = v.b
+		}
+	}
+	return out, nil
+}
+
+// DecodePNG16HDR decodes a 16-bit PNG into a linear HDR image, see DecodePNGHDR.
+// PQ and HLG values are normalized with SDR white at 203 nits.
+func DecodePNG16HDR(data []byte, transfer ColorTransfer) (*HDRImage, error) {
+	// IHDR: width (4), height (4), bit depth (1).
+	const bitDepthOffset = 8 + 8 + 8
+	if !bytes.HasPrefix(data, pngSig) || len(data) <= bitDepthOffset || string(data[len(pngSig)+4:len(pngSig)+8]) != "IHDR" {
+		return nil, errors.New("not a PNG file")
+	}
+	if depth := data[bitDepthOffset]; depth != 16 {
+		return nil, fmt.Errorf("unsupported PNG bit depth %d, 16 expected", depth)
+	}
+	return DecodePNGHDR(data, transfer, 0)
+}
+
+// hdrLinearize converts encoded values to linear light relative to SDR white.
+func hdrLinearize(v rgb, transfer ColorTransfer, whiteNits float32) rgb {
+	switch transfer {
+	case ColorTransferPQ:
+		scale := float32(pqMaxNits) / whiteNits
+		return rgb{r: pqEOTF(v.r) * scale, g: pqEOTF(v.g) * scale, b: pqEOTF(v.b) * scale}
+	case ColorTransferHLG:
+		s := rgb{r: hlgInvOETF(v.r), g: hlgInvOETF(v.g), b: hlgInvOETF(v.b)}
+		// HLG OOTF with nominal peak display luminance, BT.2020 luma weights.
+		ys := 0.2627*s.r + 0.6780*s.g + 0.0593*s.b
+		scale := float32(hlgPeakNits) / whiteNits
+		if ys > 0 {
+			scale *= float32(math.Pow(float64(ys), hlgGamma-1))
+		}
+		return rgb{r: s.r * scale, g: s.g * scale, b: s.b * scale}
+	default:
+		return rgb{r: invOETF(v.r, transfer), g: invOETF(v.g, transfer), b: invOETF(v.b, transfer)}
+	}
+}
+
+// findPNGCICP looks up cICP chunk payload in PNG data.
+func findPNGCICP(data []byte) ([4]byte, bool, error) {
+	var cicp [4]byte
+	payload, ok, err := findPNGChunk(data, "cICP")
+	if err != nil || !ok {
+		return cicp, false, err
+	}
+	if len(payload) != 4 {
+		return cicp, false, errors.New("invalid cICP chunk")
+	}
+	copy(cicp[:], payload)
+	return cicp, true, nil
+}
+
+// pngICCProfile returns decompressed ICC profile of iCCP chunk in PNG data, or nil.
+func pngICCProfile(data []byte) ([]byte, error) {
+	payload, ok, err := findPNGChunk(data, "iCCP")
+	if err != nil || !ok {
+		return nil, err
+	}
+	// Profile name (1-79 bytes), null separator, compression method (0 is zlib).
+	sep := bytes.IndexByte(payload, 0)
+	if sep < 1 || sep+2 > len(payload) || payload[sep+1] != 0 {
+		return nil, errors.New("invalid iCCP chunk")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(payload[sep+2:]))
+	if err != nil {
+		return nil, fmt.Errorf("iCCP chunk: %w", err)
+	}
+	defer zr.Close()
+	profile, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("iCCP chunk: %w", err)
+	}
+	return profile, nil
+}
+
+// findPNGChunk looks up payload of the first chunk of typ preceding image data.
+func findPNGChunk(data []byte, typ string) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, pngSig) {
+		return nil, false, errors.New("not a PNG file")
+	}
+	pos := len(pngSig)
+	for pos+8 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		t := string(data[pos+4 : pos+8])
+		start := pos + 8
+		if n < 0 || start+n+4 > len(data) {
+			return nil, false, errors.New("invalid PNG chunk length")
+		}
+		switch t {
+		case typ:
+			return data[start : start+n], true, nil
+		case "IDAT", "IEND":
+			// Color chunks must precede image data.
+			return nil, false, nil
+		}
+		pos = start + n + 4
+	}
+	return nil, false, nil
+}
+
+func cicpColorSpace(cicp [4]byte) (ColorGamut, ColorTransfer, error) {
+	var (
+		gamut    ColorGamut
+		transfer ColorTransfer
+	)
+	switch cicp[0] {
+	case cicpPrimariesBT709:
+		gamut = ColorGamutSRGB
+	case cicpPrimariesBT2020:
+		gamut = ColorGamutBT2020
+	case cicpPrimariesP3D65:
+		gamut = ColorGamutDisplayP3
+	default:
+		return 0, 0, fmt.Errorf("unsupported cICP color primaries: %d", cicp[0])
+	}
+	switch cicp[1] {
+	case cicpTransferLinear:
+		transfer = ColorTransferLinear
+	case cicpTransferSRGB:
+		transfer = ColorTransferSRGB
+	case cicpTransferPQ:
+		transfer = ColorTransferPQ
+	case cicpTransferHLG:
+		transfer = ColorTransferHLG
+	default:
+		return 0, 0, fmt.Errorf("unsupported cICP transfer characteristics: %d", cicp[1])
+	}
+	return gamut, transfer, nil
+}
+
+// insertPNGChunk inserts an ancillary chunk right after IHDR.
+func insertPNGChunk(data []byte, typ string, payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSig) || len(data) < len(pngSig)+8 || string(data[len(pngSig)+4:len(pngSig)+8]) != "IHDR" {
+		return nil, errors.New("invalid PNG data")
+	}
+	ihdrEnd := len(pngSig) + 8 + int(binary.BigEndian.Uint32(data[len(pngSig):])) + 4
+	if ihdrEnd > len(data) {
+		return nil, errors.New("invalid PNG chunk length")
+	}
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := make([]byte, 0, len(data)+len(chunk))
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...), nil
+}
@@ -0,0 +1,185 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+func TestDecodePNGHDRPQRamp(t *testing.T) {
+	nits := []float64{0, 1, 100, 203, 1000, 4000, 10000}
+	data := encodePNG16Ramp(t, nits, pqInverseEOTF)
+
+	hdr, err := DecodePNGHDR(data, ColorTransferPQ, 0)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if hdr.Gamut != ColorGamutBT2020 {
+		t.Fatalf("unexpected gamut: %v", hdr.Gamut)
+	}
+	for i, n := range nits {
+		want := float32(n / kSdrWhiteNits)
+		got := hdr.at(i, 0)
+		assertRelClose(t, got.r, want, 2e-3)
+		assertRelClose(t, got.g, want, 2e-3)
+		assertRelClose(t, got.b, want, 2e-3)
+	}
+
+	hdr, err = DecodePNGHDR(data, ColorTransferPQ, 100)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	assertRelClose(t, hdr.at(2, 0).g, 1, 2e-3)
+}
+
+func TestDecodePNGHDRCICP(t *testing.T) {
+	linear := []float64{0, 0.25, 0.5, 1}
+	data := encodePNG16Ramp(t, linear, func(v float64) float64 { return v })
+	// Linear transfer with BT.2020 primaries, explicit PQ parameter must be ignored.
+	data, err := insertPNGChunk(data, "cICP", []byte{cicpPrimariesBT2020, cicpTransferLinear, 0, 1})
+	if err != nil {
+		t.Fatalf("insert cICP: %v", err)
+	}
+
+	hdr, err := DecodePNGHDR(data, ColorTransferPQ, 1000)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if hdr.Gamut != ColorGamutBT2020 {
+		t.Fatalf("unexpected gamut: %v", hdr.Gamut)
+	}
+	for i, v := range linear {
+		assertRelClose(t, hdr.at(i, 0).r, float32(v), 1e-4)
+	}
+
+	bad, err := insertPNGChunk(encodePNG16Ramp(t, linear, func(v float64) float64 { return v }),
+		"cICP", []byte{cicpPrimariesBT2020, 2, 0, 1})
+	if err != nil {
+		t.Fatalf("insert cICP: %v", err)
+	}
+	if _, err := DecodePNGHDR(bad, ColorTransferPQ, 0); err == nil {
+		t.Fatalf("expected error for unsupported cICP transfer")
+	}
+}
+
+func TestDecodePNGHDRHLG(t *testing.T) {
+	// HLG signal 0.75 is reference white at 203 nits for 1000 nits peak.
+	data := encodePNG16Ramp(t, []float64{0.75}, func(v float64) float64 { return v })
+	hdr, err := DecodePNGHDR(data, ColorTransferHLG, 0)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	assertRelClose(t, hdr.at(0, 0).g, 1, 2e-2)
+}
+
+func TestDecodePNG16HDR(t *testing.T) {
+	data := encodePNG16Ramp(t, []float64{0, 100, 203}, pqInverseEOTF)
+	hdr, err := DecodePNG16HDR(data, ColorTransferPQ)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	assertRelClose(t, hdr.at(2, 0).r, 1, 2e-3)
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	if _, err := DecodePNG16HDR(buf.Bytes(), ColorTransferLinear); err == nil {
+		t.Fatalf("expected error for 8-bit PNG")
+	}
+}
+
+func TestEncodePNGHDR(t *testing.T) {
+	hdr := &HDRImage{W: 4, H: 1, Pix: []float32{
+		0, 0, 0,
+		1, 1, 1,
+		10000.0 / 203, 10000.0 / 203, 10000.0 / 203,
+		2, 0.5, 0.25,
+	}}
+
+	var buf bytes.Buffer
+	if err := EncodePNGHDR(hdr, &buf, nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	cicp, ok, err := findPNGCICP(buf.Bytes())
+	if err != nil || !ok {
+		t.Fatalf("cICP chunk missing: %v", err)
+	}
+	if cicp != [4]byte{9, 16, 0, 1} {
+		t.Fatalf("unexpected cICP: %v", cicp)
+	}
+
+	img, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decode png: %v", err)
+	}
+	for x, want := range []uint16{0, 38055, 65535} {
+		c := img.At(x, 0).(color.RGBA64)
+		if d := int(c.G) - int(want); d > 2 || d < -2 {
+			t.Fatalf("pixel %d: got %d want %d", x, c.G, want)
+		}
+	}
+
+	for _, transfer := range []ColorTransfer{ColorTransferPQ, ColorTransferHLG, ColorTransferLinear} {
+		buf.Reset()
+		if err := EncodePNGHDR(hdr, &buf, &PNGHDROptions{Transfer: transfer}); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		got, err := DecodePNGHDR(buf.Bytes(), 0, 0)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if transfer == ColorTransferLinear {
+			// Linear PNG is normalized to peak nits.
+			assertRelClose(t, got.at(1, 0).g, 203.0/10000, 1e-4)
+			continue
+		}
+		want := convertLinearGamut(hdr.at(3, 0), ColorGamutSRGB, ColorGamutBT2020)
+		px := got.at(3, 0)
+		assertRelClose(t, px.r, want.r, 2e-3)
+		assertRelClose(t, px.g, want.g, 2e-3)
+		assertRelClose(t, px.b, want.b, 2e-3)
+	}
+
+	if err := EncodePNGHDR(hdr, &buf, &PNGHDROptions{Transfer: ColorTransferSRGB}); err == nil {
+		t.Fatalf("expected error for SDR transfer")
+	}
+}
+
+func encodePNG16Ramp(t *testing.T, values []float64, encode func(float64) float64) []byte {
+	t.Helper()
+	img := image.NewNRGBA64(image.Rect(0, 0, len(values), 1))
+	for i, v := range values {
+		c := uint16(math.Round(encode(v) * 65535))
+		img.SetNRGBA64(i, 0, color.NRGBA64{R: c, G: c, B: c, A: 0xffff})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func pqInverseEOTF(nits float64) float64 {
+	y := math.Pow(nits/pqMaxNits, pqM1)
+	return math.Pow((pqC1+pqC2*y)/(1+pqC3*y), pqM2)
+}
+
+func assertRelClose(t *testing.T, got, want, tol float32) {
+	t.Helper()
+	diff := got - want
+	if diff < 0 {
+		diff = -diff
+	}
+	limit := tol
+	if want > 1 {
+		limit = tol * want
+	}
+	if diff > limit {
+		t.Fatalf("value mismatch: got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,249 @@
+package ultrahdr
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	rgbeMinRLEWidth = 8
+	rgbeMaxRLEWidth = 0x7fff
+	rgbeMinRun      = 4
+)
+
+// EncodeRadianceHDR writes a linear HDR image as Radiance RGBE (.hdr) with RLE scanlines.
+// Pixel values are written as is, 1.0 is SDR white.
+func EncodeRadianceHDR(hdr *HDRImage, w io.Writer) error {
+	if hdr == nil || w == nil {
+		return errors.New("missing HDR image or writer")
+	}
+	if hdr.W <= 0 || hdr.H <= 0 || len(hdr.Pix) < hdr.W*hdr.H*3 {
+		return errors.New("invalid HDR image dimensions")
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", hdr.H, hdr.W); err != nil {
+		return err
+	}
+
+	line := make([]byte, hdr.W*4)
+	for y := 0; y < hdr.H; y++ {
+		for x := 0; x < hdr.W; x++ {
+			i := (y*hdr.W + x) * 3
+			floatToRGBE(line[x*4:x*4+4], hdr.Pix[i], hdr.Pix[i+1], hdr.Pix[i+2])
+		}
+		if err := writeRGBELine(bw, line, hdr.W); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// floatToRGBE converts linear RGB to shared exponent representation.
+func floatToRGBE(dst []byte, r, g, b float32) {
+	r, g, b = max(r, 0), max(g, 0), max(b, 0)
+	v := float64(max3(r, g, b))
+	if v < 1e-32 || math.IsNaN(v) {
+		dst[0], dst[1], dst[2], dst[3] = 0, 0, 0, 0
+		return
+	}
+	if math.IsInf(v, 0) {
+		v = math.MaxFloat32
+	}
+	m, e := math.Frexp(v)
+	scale := m * 256 / v
+	dst[0] = byte(min(float64(r)*scale, 255))
+	dst[1] = byte(min(float64(g)*scale, 255))
+	dst[2] = byte(min(float64(b)*scale, 255))
+	dst[3] = byte(e + 128)
+}
+
+// rgbeToFloat converts shared exponent representation to linear RGB.
+func rgbeToFloat(p []byte) rgb {
+	if p[3] == 0 {
+		return rgb{}
+	}
+	f := float32(math.Ldexp(1, int(p[3])-(128+8)))
+	return rgb{
+		r: (float32(p[0]) + 0.5) * f,
+		g: (float32(p[1]) + 0.5) * f,
+		b: (float32(p[2]) + 0.5) * f,
+	}
+}
+
+func writeRGBELine(w *bufio.Writer, line []byte, width int) error {
+	if width < rgbeMinRLEWidth || width > rgbeMaxRLEWidth {
+		_, err := w.Write(line)
+		return err
+	}
+	if _, err := w.Write([]byte{2, 2, byte(width >> 8), byte(width)}); err != nil {
+		return err
+	}
+	comp := make([]byte, width)
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; x++ {
+			comp[x] = line[x*4+c]
+		}
+		if err := writeRGBERLE(w, comp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRGBERLE writes one component of a scanline with adaptive run-length encoding.
+func writeRGBERLE(w *bufio.Writer, data []byte) error {
+	pos := 0
+	for pos < len(data) {
+		// Find next run long enough to be encoded.
+		runStart := pos
+		runLen := 0
+		for runStart < len(data) {
+			runLen = 1
+			for runStart+runLen < len(data) && runLen < 127 && data[runStart+runLen] == data[runStart] {
+				runLen++
+			}
+			if runLen >= rgbeMinRun {
+				break
+			}
+			runStart += runLen
+		}
+		// Write literals preceding the run.
+		for pos < runStart {
+			n := min(runStart-pos, 128)
+			if err := w.WriteByte(byte(n)); err != nil {
+				return err
+			}
+			if _, err := w.Write(data[pos : pos+n]); err != nil {
+				return err
+			}
+			pos += n
+		}
+		if runStart < len(data) && runLen >= rgbeMinRun {
+			if _, err := w.Write([]byte{byte(128 + runLen), data[runStart]}); err != nil {
+				return err
+			}
+			pos = runStart + runLen
+		}
+	}
+	return nil
+}
+
+// DecodeRadianceHDR decodes a Radiance RGBE (.hdr) image with -Y H +X W orientation into linear HDRImage,
+// flat and RLE scanlines are supported. Pixel values are taken as is, 1.0 is SDR white.
+func DecodeRadianceHDR(data []byte) (*HDRImage, error) {
+	br := bufio.NewReader(bytes.NewReader(data))
+	first, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(first, "#?") {
+		return nil, errors.New("not a Radiance HDR file")
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("unsupported Radiance format: %s", line)
+		}
+	}
+	res, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	var w, h int
+	if _, err := fmt.Sscanf(res, "-Y %d +X %d", &h, &w); err != nil {
+		return nil, fmt.Errorf("unsupported Radiance resolution: %q", strings.TrimSpace(res))
+	}
+	if w <= 0 || h <= 0 || w > rgbeMaxRLEWidth || h > rgbeMaxRLEWidth {
+		return nil, errors.New("invalid Radiance HDR dimensions")
+	}
+	// Shortest scanline is RLE with 4 bytes header and 2 bytes per run of 128 values of each component.
+	minLine := int64(w) * 4
+	if w >= rgbeMinRLEWidth {
+		minLine = 4 + 4*2*int64((w+127)/128)
+	}
+	if int64(h)*minLine > int64(len(data)) {
+		return nil, fmt.Errorf("Radiance HDR dimensions %dx%d exceed data size %d", w, h, len(data))
+	}
+
+	out := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+	line := make([]byte, w*4)
+	for y := 0; y < h; y++ {
+		if err := readRGBELine(br, line, w); err != nil {
+			return nil, err
+		}
+		for x := 0; x < w; x++ {
+			v := rgbeToFloat(line[x*4 : x*4+4])
+			i := (y*w + x) * 3
+			out.Pix[i] = v.r
+			out.Pix[i+1] = v.g
+			out.Pix[i+2] = v.b
+		}
+	}
+	return out, nil
+}
+
+func readRGBELine(br *bufio.Reader, line []byte, width int) error {
+	head, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	if width < rgbeMinRLEWidth || width > rgbeMaxRLEWidth || head[0] != 2 || head[1] != 2 || head[2]&0x80 != 0 {
+		_, err := io.ReadFull(br, line)
+		return err
+	}
+	if int(head[2])<<8|int(head[3]) != width {
+		return errors.New("invalid Radiance scanline width")
+	}
+	if _, err := br.Discard(4); err != nil {
+		return err
+	}
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			n, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if n > 128 {
+				count := int(n) - 128
+				v, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+count > width {
+					return errors.New("invalid Radiance run length")
+				}
+				for ; count > 0; count-- {
+					line[x*4+c] = v
+					x++
+				}
+				continue
+			}
+			count := int(n)
+			if count == 0 || x+count > width {
+				return errors.New("invalid Radiance run length")
+			}
+			for ; count > 0; count-- {
+				v, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				line[x*4+c] = v
+				x++
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRadianceHDRRoundTrip(t *testing.T) {
+	for _, w := range []int{5, 37} {
+		const h = 3
+		hdr := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+		for i := range hdr.Pix {
+			switch {
+			case i < 9:
+				// Zeros, denormal-like and negative values.
+				hdr.Pix[i] = []float32{0, 1e-40, -1, 1e-30, 1e-30, 0, 0.5, 0.25, 0.125}[i]
+			case i < 3*w:
+				// Flat region to exercise runs.
+				hdr.Pix[i] = 0.75
+			default:
+				hdr.Pix[i] = float32(i%17) * 37.5
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := EncodeRadianceHDR(hdr, &buf); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), []byte("#?RADIANCE\n")) {
+			t.Fatalf("missing Radiance header")
+		}
+		got, err := DecodeRadianceHDR(buf.Bytes())
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if got.W != w || got.H != h {
+			t.Fatalf("unexpected dimensions: %dx%d", got.W, got.H)
+		}
+		for i := 0; i < w*h; i++ {
+			want := rgb{r: max(hdr.Pix[i*3], 0), g: max(hdr.Pix[i*3+1], 0), b: max(hdr.Pix[i*3+2], 0)}
+			gotPx := got.at(i%w, i/w)
+			// RGBE keeps 8 bits of mantissa relative to the largest component.
+			tol := max3(want.r, want.g, want.b)/128 + 1e-38
+			for c, pair := range [][2]float32{{gotPx.r, want.r}, {gotPx.g, want.g}, {gotPx.b, want.b}} {
+				if d := pair[0] - pair[1]; d > tol || d < -tol {
+					t.Fatalf("w=%d pixel %d channel %d: got %v want %v", w, i, c, pair[0], pair[1])
+				}
+			}
+		}
+
+		// Re-encoding decoded data must be stable.
+		var buf2 bytes.Buffer
+		if err := EncodeRadianceHDR(got, &buf2); err != nil {
+			t.Fatalf("re-encode: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+			t.Fatalf("w=%d: re-encoded data differs", w)
+		}
+	}
+}
+
+func TestEncodeRadianceHDRFromEXR(t *testing.T) {
+	data, err := os.ReadFile("testdata/BrightRings.exr")
+	if err != nil {
+		t.Fatalf("read exr: %v", err)
+	}
+	hdr, err := decodeEXR(data)
+	if err != nil {
+		t.Fatalf("decode exr: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeRadianceHDR(hdr, &buf); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if buf.Len() >= hdr.W*hdr.H*4 {
+		t.Fatalf("expected RLE to compress, got %d bytes", buf.Len())
+	}
+	got, err := DecodeRadianceHDR(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.W != hdr.W || got.H != hdr.H {
+		t.Fatalf("unexpected dimensions: %dx%d", got.W, got.H)
+	}
+}
+
+func TestRebaseFromRadianceHDR(t *testing.T) {
+	exr, err := os.ReadFile("testdata/BrightRings.exr")
+	if err != nil {
+		t.Fatalf("read exr: %v", err)
+	}
+	sdr, err := os.ReadFile("testdata/BrightRings.jpg")
+	if err != nil {
+		t.Fatalf("read sdr: %v", err)
+	}
+	hdr, err := decodeEXR(exr)
+	if err != nil {
+		t.Fatalf("decode exr: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeRadianceHDR(hdr, &buf); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	res, err := RebaseFromRadianceHDR(sdr, buf.Bytes())
+	if err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	if res.Meta == nil || res.Meta.HDRCapacityMax <= 0 {
+		t.Fatalf("expected gainmap metadata with HDR capacity, got %+v", res.Meta)
+	}
+}
+
+func TestDecodeRadianceHDRSizeLimit(t *testing.T) {
+	data := []byte("#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y 30000 +X 30000\n\x02\x02")
+	if _, err := DecodeRadianceHDR(data); err == nil || !strings.Contains(err.Error(), "exceed data size") {
+		t.Fatalf("expected data size error, got %v", err)
+	}
+}
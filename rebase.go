@@ -3,23 +3,40 @@ package ultrahdr
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"math"
 	"os"
 )
 
 // RebaseOptions controls gainmap rebase behavior.
 type RebaseOptions struct {
-	BaseQuality     int     // JPEG quality for the primary SDR output (0 uses default).
-	GainmapQuality  int     // JPEG quality for the gainmap output (0 uses default).
-	GainmapScale    int     // Downscale factor for gainmap generation (higher is smaller/faster).
-	GainmapGamma    float32 // Gamma to apply to gainmap encoding (0 uses default).
-	UseMultiChannel bool    // Encode gainmap as RGB instead of single-channel.
-	HDRCapacityMax  float32 // Clamp maximum HDR capacity when generating gainmaps.
-	ICCProfile      []byte  // ICC profile bytes for new SDR when not embedded in input.
-	PrimaryOut      string  // Optional output path for the rebased primary JPEG.
-	GainmapOut      string  // Optional output path for the rebased gainmap JPEG.
+	BaseQuality        int            // JPEG quality for the primary SDR output (0 uses default).
+	GainmapQuality     int            // JPEG quality for the gainmap output (0 uses default).
+	GainmapScale       int            // Downscale factor for gainmap generation (higher is smaller/faster).
+	GainmapDownscale   *Interpolation // Filter of per-pixel gains when GainmapScale > 1 (nil uses Defaults.GainmapDownscale).
+	GainmapGamma       float32        // Gamma to apply to gainmap encoding (0 uses default).
+	AutoGainmapGamma   bool           // Pick gainmap gamma from the distribution of gains, overrides GainmapGamma.
+	DitherGainmap      bool           // Apply ordered dithering when quantizing gainmap to 8-bit.
+	UseMultiChannel    bool           // Encode gainmap as RGB instead of single-channel.
+	HDRCapacityMax     float32        // Clamp maximum HDR capacity when generating gainmaps.
+	ICCProfile         []byte         // ICC profile bytes for new SDR when not embedded in input.
+	Interpolation      Interpolation  // Resampling of original SDR and gainmap when new SDR dimensions differ.
+	PrimaryOut         string         // Optional output path for the rebased primary JPEG.
+	GainmapOut         string         // Optional output path for the rebased gainmap JPEG.
+	Background         color.Color    // Background for flattening transparent SDR and HDR inputs (nil uses black).
+	KeepComments       bool           // Preserve COM segments of source primary, they are stripped by default.
+	Progressive        bool           // Encode the primary SDR output as progressive JPEG.
+	Subsampling        Subsampling    // Chroma subsampling of the primary SDR output.
+	GainmapSubsampling Subsampling    // Chroma subsampling of the gainmap output.
+	RestartInterval    int            // Write RST markers every RestartInterval MCUs of primary and gainmap outputs (0 disables).
+	OptimizeHuffman    bool           // Build optimal Huffman tables for primary and gainmap outputs.
+	ExactTransfer      bool           // Compute transfer functions with math.Pow instead of lookup tables.
+
+	// EXR sets decoding limits of OpenEXR input.
+	EXR EXRDecodeOptions
 }
 
 // RebaseOption configures rebase behavior.
@@ -46,6 +63,13 @@ func WithGainmapScale(scale int) RebaseOption {
 	}
 }
 
+// WithGainmapDownscale sets the filter that downscales per-pixel gains when gainmap scale is above 1.
+func WithGainmapDownscale(interp Interpolation) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.GainmapDownscale = &interp
+	}
+}
+
 // WithGainmapGamma sets the gamma to apply to gainmap encoding.
 func WithGainmapGamma(gamma float32) RebaseOption {
 	return func(opt *RebaseOptions) {
@@ -53,6 +77,22 @@ func WithGainmapGamma(gamma float32) RebaseOption {
 	}
 }
 
+// WithAutoGainmapGamma toggles gainmap gamma selection from the gain histogram of generated
+// gainmaps, gamma is chosen to map the median gain to the middle of the 8-bit range.
+func WithAutoGainmapGamma(enabled bool) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.AutoGainmapGamma = enabled
+	}
+}
+
+// WithGainmapDither toggles ordered dithering of gainmap 8-bit quantization,
+// it reduces banding of smooth gain gradients at the cost of slight noise.
+func WithGainmapDither(enabled bool) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.DitherGainmap = enabled
+	}
+}
+
 // WithMultiChannelGainmap toggles RGB gainmap encoding.
 func WithMultiChannelGainmap(enabled bool) RebaseOption {
 	return func(opt *RebaseOptions) {
@@ -74,6 +114,77 @@ func WithICCProfile(profile []byte) RebaseOption {
 	}
 }
 
+// WithInterpolation sets resampling mode for new SDR images with different dimensions.
+func WithInterpolation(interp Interpolation) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.Interpolation = interp
+	}
+}
+
+// WithBackground sets the color transparent SDR and HDR (e.g. EXR with alpha) inputs are
+// flattened over before gainmap generation, so that SDR base and gainmap match.
+func WithBackground(c color.Color) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.Background = c
+	}
+}
+
+// WithKeepComments toggles copying COM segments (e.g. asset IDs) of the source primary JPEG
+// into the output container, they are stripped by default.
+func WithKeepComments(enabled bool) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.KeepComments = enabled
+	}
+}
+
+// WithProgressive toggles progressive encoding of the primary SDR output,
+// gainmap is always encoded as baseline JPEG.
+func WithProgressive(enabled bool) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.Progressive = enabled
+	}
+}
+
+// WithSubsampling sets chroma subsampling of the primary SDR and gainmap outputs,
+// e.g. Subsampling444 for primary and SubsamplingGray for gainmap.
+func WithSubsampling(primary, gainmap Subsampling) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.Subsampling = primary
+		opt.GainmapSubsampling = gainmap
+	}
+}
+
+// WithRestartInterval writes restart markers every n MCUs of the primary SDR and gainmap outputs,
+// so that a corrupted bit damages only a stripe of the image instead of the rest of it.
+func WithRestartInterval(n int) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.RestartInterval = n
+	}
+}
+
+// WithOptimizeHuffman toggles optimal Huffman tables of the primary SDR and gainmap outputs,
+// it makes files a few percent smaller at the cost of an extra encoding pass.
+func WithOptimizeHuffman(enabled bool) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.OptimizeHuffman = enabled
+	}
+}
+
+// WithExactTransfer computes transfer functions with math.Pow instead of lookup tables,
+// which stay within 1 LSB of exact 8-bit results.
+func WithExactTransfer(enabled bool) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.ExactTransfer = enabled
+	}
+}
+
+// WithEXRDecodeOptions sets decoding limits of OpenEXR input.
+func WithEXRDecodeOptions(exr EXRDecodeOptions) RebaseOption {
+	return func(opt *RebaseOptions) {
+		opt.EXR = exr
+	}
+}
+
 // WithPrimaryOut sets an optional output path for the rebased primary JPEG.
 func WithPrimaryOut(path string) RebaseOption {
 	return func(opt *RebaseOptions) {
@@ -112,12 +223,13 @@ func rebaseWithOptions(data []byte, newSDR image.Image, opt *RebaseOptions) (*Re
 	if newSDR == nil {
 		return nil, errors.New("new SDR image is nil")
 	}
+	newSDR = quantizeSDR8(newSDR)
 	split, err := Split(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 	if split.Meta == nil {
-		return nil, errors.New("gainmap metadata missing")
+		return nil, ErrNoGainmapMetadata
 	}
 	oldSDR, _, err := image.Decode(bytes.NewReader(split.Primary))
 	if err != nil {
@@ -127,8 +239,9 @@ func rebaseWithOptions(data []byte, newSDR image.Image, opt *RebaseOptions) (*Re
 	if err != nil {
 		return nil, err
 	}
-	if oldSDR.Bounds().Dx() != newSDR.Bounds().Dx() || oldSDR.Bounds().Dy() != newSDR.Bounds().Dy() {
-		return nil, errors.New("new SDR dimensions must match original")
+	oldSDR, gainmapImg, err = resampleForRebase(oldSDR, gainmapImg, newSDR.Bounds(), opt)
+	if err != nil {
+		return nil, err
 	}
 
 	_, oldICCSegs, err := extractExifAndIcc(split.Primary)
@@ -143,27 +256,18 @@ func rebaseWithOptions(data []byte, newSDR image.Image, opt *RebaseOptions) (*Re
 		newProfile = detectColorProfileFromICCProfile(opt.ICCProfile)
 	}
 
-	gainmapOut, err := rebaseGainmap(oldSDR, newSDR, gainmapImg, split.Meta, oldProfile, newProfile, workGamut)
+	gainmapOut, err := rebaseGainmap(oldSDR, newSDR, gainmapImg, split.Meta, oldProfile, newProfile, workGamut, opt)
 	if err != nil {
 		return nil, err
 	}
 
-	gainQ := defaultGainMapQuality
-	baseQ := defaultPrimaryQuality
-	if opt != nil {
-		if opt.GainmapQuality > 0 {
-			gainQ = opt.GainmapQuality
-		}
-		if opt.BaseQuality > 0 {
-			baseQ = opt.BaseQuality
-		}
-	}
-	gainmapJpeg, err := encodeWithQuality(gainmapOut, gainQ)
+	primaryParams, gainmapParams := opt.jpegParams()
+	gainmapJpeg, err := encodeJPEG(gainmapOut, gainmapParams)
 	if err != nil {
 		return nil, err
 	}
 
-	primaryOut, err := encodeWithQuality(newSDR, baseQ)
+	primaryOut, err := encodeJPEG(newSDR, primaryParams)
 	if err != nil {
 		return nil, err
 	}
@@ -177,6 +281,12 @@ func rebaseWithOptions(data []byte, newSDR image.Image, opt *RebaseOptions) (*Re
 		if err != nil {
 			return nil, err
 		}
+		// New SDR is declared in its own profile, gainmap is rebased accordingly.
+		if opt != nil && len(opt.ICCProfile) > 0 {
+			if icc, err = buildICCSegments(opt.ICCProfile); err != nil {
+				return nil, err
+			}
+		}
 	}
 	secondaryISO := split.Segs.SecondaryISO
 	if len(secondaryISO) == 0 && split.Meta != nil {
@@ -185,7 +295,16 @@ func rebaseWithOptions(data []byte, newSDR image.Image, opt *RebaseOptions) (*Re
 			return nil, err
 		}
 	}
-	container, err := assembleContainerVipsLike(primaryOut, gainmapJpeg, exif, icc, split.Segs.SecondaryXMP, secondaryISO)
+	var comments [][]byte
+	if opt != nil && opt.KeepComments {
+		if comments, err = extractComments(split.Primary); err != nil {
+			return nil, err
+		}
+	}
+	container, err := assembleContainerVipsLike(containerParts{
+		primary: primaryOut, gainmap: gainmapJpeg, exif: exif, icc: icc, comments: comments,
+		secondaryXMP: split.Segs.SecondaryXMP, secondaryISO: secondaryISO,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -197,35 +316,58 @@ func rebaseWithOptions(data []byte, newSDR image.Image, opt *RebaseOptions) (*Re
 	}, nil
 }
 
-func rebaseUltraHDRFromHDR(newSDR image.Image, hdr *hdrImage, opt *RebaseOptions) (*Result, error) {
+// resampleForRebase scales original SDR and gainmap to match new SDR dimensions.
+func resampleForRebase(oldSDR, gainmap image.Image, newBounds image.Rectangle, opt *RebaseOptions) (image.Image, image.Image, error) {
+	oldW, oldH := oldSDR.Bounds().Dx(), oldSDR.Bounds().Dy()
+	newW, newH := newBounds.Dx(), newBounds.Dy()
+	if oldW == newW && oldH == newH {
+		return oldSDR, gainmap, nil
+	}
+	if newW <= 0 || newH <= 0 {
+		return nil, nil, errors.New("invalid new SDR dimensions")
+	}
+	// Allow rounding differences, but not a different framing.
+	if math.Abs(float64(oldW)*float64(newH)-float64(newW)*float64(oldH)) > float64(max(oldW, newW)*max(oldH, newH))/100 {
+		return nil, nil, fmt.Errorf("new SDR aspect ratio must match original: %dx%d vs %dx%d", newW, newH, oldW, oldH)
+	}
+	interp := InterpolationNearest
+	if opt != nil {
+		interp = opt.Interpolation
+	}
+	gmW := max(int(math.Round(float64(gainmap.Bounds().Dx())*float64(newW)/float64(oldW))), 1)
+	gmH := max(int(math.Round(float64(gainmap.Bounds().Dy())*float64(newH)/float64(oldH))), 1)
+	return resizeImageInterpolated(oldSDR, newW, newH, interp), resizeImageInterpolated(gainmap, gmW, gmH, interp), nil
+}
+
+func rebaseUltraHDRFromHDR(newSDR image.Image, hdr *HDRImage, opt *RebaseOptions) (*Result, error) {
 	if newSDR == nil || hdr == nil {
 		return nil, errors.New("missing SDR or HDR input")
 	}
+	newSDR = quantizeSDR8(newSDR)
 	var iccProfile []byte
 	if opt != nil {
 		iccProfile = opt.ICCProfile
 	}
 	newProfile := detectColorProfileFromICCProfile(iccProfile)
+	var background color.Color
+	if opt != nil {
+		background = opt.Background
+	}
+	if hdr.Alpha != nil || background != nil {
+		hdr = hdr.Flatten(background)
+		newSDR = flattenImage(newSDR, background)
+	}
 	gainmapOut, meta, err := generateGainmapFromHDR(newSDR, newProfile, hdr, opt)
 	if err != nil {
 		return nil, err
 	}
 
-	gainQ := defaultGainMapQuality
-	baseQ := defaultPrimaryQuality
-	if opt != nil {
-		if opt.GainmapQuality > 0 {
-			gainQ = opt.GainmapQuality
-		}
-		if opt.BaseQuality > 0 {
-			baseQ = opt.BaseQuality
-		}
-	}
-	gainmapJpeg, err := encodeWithQuality(gainmapOut, gainQ)
+	primaryParams, gainmapParams := opt.jpegParams()
+	gainmapJpeg, err := encodeJPEG(gainmapOut, gainmapParams)
 	if err != nil {
 		return nil, err
 	}
-	primaryOut, err := encodeWithQuality(newSDR, baseQ)
+	primaryOut, err := encodeJPEG(newSDR, primaryParams)
 	if err != nil {
 		return nil, err
 	}
@@ -236,40 +378,79 @@ func rebaseUltraHDRFromHDR(newSDR image.Image, hdr *hdrImage, opt *RebaseOptions
 	}, nil
 }
 
-// RebaseFile reads an UltraHDR JPEG, rebases it on newSDRPath, and writes the output.
+// RebaseFile reads an UltraHDR JPEG, rebases it on newSDRPath (JPEG, PNG or TIFF), and writes the output.
 func RebaseFile(inPath, newSDRPath, outPath string, opts ...RebaseOption) error {
 	data, err := os.ReadFile(inPath)
 	if err != nil {
 		return err
 	}
-	newSDR, newICCProfile, _, err := loadImageWithICC(newSDRPath)
+	newSDRData, err := os.ReadFile(newSDRPath)
 	if err != nil {
 		return err
 	}
-	opt := applyRebaseOptions(opts)
-	opt = withICCProfile(opt, newICCProfile)
-	res, err := rebaseWithOptions(data, newSDR, opt)
+	res, err := RebaseJPEG(data, newSDRData, opts...)
 	if err != nil {
 		return err
 	}
-	primaryOut, gainmapOut := outputsFromOptions(opt)
+	primaryOut, gainmapOut := outputsFromOptions(applyRebaseOptions(opts))
 	return writeRebaseOutputs(outPath, res.Container, primaryOut, res.Primary, gainmapOut, res.Gainmap)
 }
 
+// RebaseJPEG is like RebaseFile, but works with in-memory UltraHDR and new SDR image.
+// The new SDR can be JPEG, PNG or TIFF, 16-bit PNG/TIFF samples are rounded to 8-bit,
+// its JPEG or PNG (iCCP) ICC profile is used unless WithICCProfile is provided.
+func RebaseJPEG(data, newSDRJPEG []byte, opts ...RebaseOption) (*Result, error) {
+	newSDR, newICCProfile, err := decodeImageWithICC(newSDRJPEG)
+	if err != nil {
+		return nil, err
+	}
+	opt := applyRebaseOptions(opts)
+	opt = withICCProfile(opt, newICCProfile)
+	return rebaseWithOptions(data, newSDR, opt)
+}
+
 // RebaseFromEXRFile generates an UltraHDR JPEG from an SDR primary and HDR EXR input.
 func RebaseFromEXRFile(primaryPath, exrPath, outPath string, opts ...RebaseOption) error {
-	return rebaseUltraHDRFromHDRFile(primaryPath, exrPath, outPath, decodeEXR, opts...)
+	opt := applyRebaseOptions(opts)
+	return rebaseUltraHDRFromHDRFile(primaryPath, exrPath, outPath, opt.decodeEXR, opt)
 }
 
 // RebaseFromTIFFFile generates an UltraHDR JPEG from an SDR primary and HDR TIFF input.
 func RebaseFromTIFFFile(primaryPath, hdrPath, outPath string, opts ...RebaseOption) error {
-	return rebaseUltraHDRFromHDRFile(primaryPath, hdrPath, outPath, decodeTIFFHDR, opts...)
+	return rebaseUltraHDRFromHDRFile(primaryPath, hdrPath, outPath, decodeTIFFHDR, applyRebaseOptions(opts))
+}
+
+// RebaseFromRadianceHDRFile generates an UltraHDR JPEG from an SDR primary and HDR Radiance RGBE (.hdr) input.
+func RebaseFromRadianceHDRFile(primaryPath, hdrPath, outPath string, opts ...RebaseOption) error {
+	return rebaseUltraHDRFromHDRFile(primaryPath, hdrPath, outPath, DecodeRadianceHDR, applyRebaseOptions(opts))
+}
+
+// RebaseFromEXR is like RebaseFromEXRFile, but works with in-memory SDR JPEG and EXR.
+func RebaseFromEXR(primaryJPEG, exrData []byte, opts ...RebaseOption) (*Result, error) {
+	opt := applyRebaseOptions(opts)
+	return rebaseUltraHDRFromHDRBytes(primaryJPEG, exrData, opt.decodeEXR, opt)
 }
 
-func rebaseGainmap(oldSDR, newSDR, gainmap image.Image, meta *GainMapMetadata, oldProfile, newProfile colorProfile, workGamut colorGamut) (image.Image, error) {
+// RebaseFromTIFF is like RebaseFromTIFFFile, but works with in-memory SDR JPEG and TIFF.
+func RebaseFromTIFF(primaryJPEG, tiffData []byte, opts ...RebaseOption) (*Result, error) {
+	return rebaseUltraHDRFromHDRBytes(primaryJPEG, tiffData, decodeTIFFHDR, applyRebaseOptions(opts))
+}
+
+// RebaseFromRadianceHDR is like RebaseFromRadianceHDRFile, but works with in-memory SDR JPEG and Radiance HDR.
+func RebaseFromRadianceHDR(primaryJPEG, hdrData []byte, opts ...RebaseOption) (*Result, error) {
+	return rebaseUltraHDRFromHDRBytes(primaryJPEG, hdrData, DecodeRadianceHDR, applyRebaseOptions(opts))
+}
+
+func rebaseGainmap(oldSDR, newSDR, gainmap image.Image, meta *GainMapMetadata, oldProfile, newProfile colorProfile, workGamut ColorGamut, opt *RebaseOptions) (image.Image, error) {
 	if meta == nil {
 		return nil, errors.New("gainmap metadata missing")
 	}
+	if err := checkGainmapDimensions(newSDR.Bounds(), gainmap.Bounds()); err != nil {
+		return nil, err
+	}
+	dither := opt != nil && opt.DitherGainmap
+	exact := opt != nil && opt.ExactTransfer
+	dec := newGainDecoder(meta)
 	b := newSDR.Bounds()
 	w, h := b.Dx(), b.Dy()
 	gmBounds := gainmap.Bounds()
@@ -280,10 +461,47 @@ func rebaseGainmap(oldSDR, newSDR, gainmap image.Image, meta *GainMapMetadata, o
 	isGray := isGrayImage(gainmap)
 	if isGray {
 		out := image.NewGray(image.Rect(0, 0, w, h))
-		for y := 0; y < h; y++ {
+		parallelFor(h, func(_, startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := 0; x < w; x++ {
+					oldRGB := sampleSDRInProfile(oldSDR, b.Min.X+x, b.Min.Y+y, oldProfile, workGamut, exact)
+					newRGB := sampleSDRInProfile(newSDR, b.Min.X+x, b.Min.Y+y, newProfile, workGamut, exact)
+					gx := int(float32(x)/mapScaleX + 0.5)
+					gy := int(float32(y)/mapScaleY + 0.5)
+					if gx < 0 {
+						gx = 0
+					}
+					if gy < 0 {
+						gy = 0
+					}
+					if gx >= gmW {
+						gx = gmW - 1
+					}
+					if gy >= gmH {
+						gy = gmH - 1
+					}
+					hdr := applyGainmapToSDR(oldRGB, gainmap, dec, gx, gy, true)
+					hdrY := max3(hdr.r, hdr.g, hdr.b)
+					newY := max3(newRGB.r, newRGB.g, newRGB.b)
+					denom := newY + meta.OffsetSDR[0]
+					if denom <= 0 {
+						denom = 1e-6
+					}
+					newGain := (hdrY + meta.OffsetHDR[0]) / denom
+					newGV := gainFromFactor(newGain, meta.MinContentBoost[0], meta.MaxContentBoost[0], meta.Gamma[0], quantizeBias(x, y, dither))
+					out.SetGray(x, y, color.Gray{Y: newGV})
+				}
+			}
+		})
+		return out, nil
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	parallelFor(h, func(_, startY, endY int) {
+		for y := startY; y < endY; y++ {
 			for x := 0; x < w; x++ {
-				oldRGB := sampleSDRInProfile(oldSDR, b.Min.X+x, b.Min.Y+y, oldProfile, workGamut)
-				newRGB := sampleSDRInProfile(newSDR, b.Min.X+x, b.Min.Y+y, newProfile, workGamut)
+				oldRGB := sampleSDRInProfile(oldSDR, b.Min.X+x, b.Min.Y+y, oldProfile, workGamut, exact)
+				newRGB := sampleSDRInProfile(newSDR, b.Min.X+x, b.Min.Y+y, newProfile, workGamut, exact)
 				gx := int(float32(x)/mapScaleX + 0.5)
 				gy := int(float32(y)/mapScaleY + 0.5)
 				if gx < 0 {
@@ -298,105 +516,66 @@ func rebaseGainmap(oldSDR, newSDR, gainmap image.Image, meta *GainMapMetadata, o
 				if gy >= gmH {
 					gy = gmH - 1
 				}
-				gv := gainmapDecodeValue(grayAt(gainmap, gx, gy), meta.Gamma[0])
-				logBoost := log2f(meta.MinContentBoost[0])*(1.0-gv) + log2f(meta.MaxContentBoost[0])*gv
-				gainFactor := exp2f(logBoost)
-				hdr := rgb{
-					r: (oldRGB.r+meta.OffsetSDR[0])*gainFactor - meta.OffsetHDR[0],
-					g: (oldRGB.g+meta.OffsetSDR[0])*gainFactor - meta.OffsetHDR[0],
-					b: (oldRGB.b+meta.OffsetSDR[0])*gainFactor - meta.OffsetHDR[0],
+				hdr := applyGainmapToSDR(oldRGB, gainmap, dec, gx, gy, false)
+				denomR := newRGB.r + meta.OffsetSDR[0]
+				denomG := newRGB.g + meta.OffsetSDR[1]
+				denomB := newRGB.b + meta.OffsetSDR[2]
+				if denomR <= 0 {
+					denomR = 1e-6
 				}
-				hdrY := max3(hdr.r, hdr.g, hdr.b)
-				newY := max3(newRGB.r, newRGB.g, newRGB.b)
-				denom := newY + meta.OffsetSDR[0]
-				if denom <= 0 {
-					denom = 1e-6
+				if denomG <= 0 {
+					denomG = 1e-6
 				}
-				newGain := (hdrY + meta.OffsetHDR[0]) / denom
-				newGV := gainFromFactor(newGain, meta.MinContentBoost[0], meta.MaxContentBoost[0], meta.Gamma[0])
-				out.SetGray(x, y, color.Gray{Y: newGV})
-			}
-		}
-		return out, nil
-	}
-
-	out := image.NewRGBA(image.Rect(0, 0, w, h))
-	for y := 0; y < h; y++ {
-		for x := 0; x < w; x++ {
-			oldRGB := sampleSDRInProfile(oldSDR, b.Min.X+x, b.Min.Y+y, oldProfile, workGamut)
-			newRGB := sampleSDRInProfile(newSDR, b.Min.X+x, b.Min.Y+y, newProfile, workGamut)
-			gx := int(float32(x)/mapScaleX + 0.5)
-			gy := int(float32(y)/mapScaleY + 0.5)
-			if gx < 0 {
-				gx = 0
-			}
-			if gy < 0 {
-				gy = 0
-			}
-			if gx >= gmW {
-				gx = gmW - 1
-			}
-			if gy >= gmH {
-				gy = gmH - 1
-			}
-			gr, gg, gb := rgbAt(gainmap, gx, gy)
-			gain := rgb{
-				r: gainmapDecodeValue(gr, meta.Gamma[0]),
-				g: gainmapDecodeValue(gg, meta.Gamma[1]),
-				b: gainmapDecodeValue(gb, meta.Gamma[2]),
-			}
-			logBoostR := log2f(meta.MinContentBoost[0])*(1.0-gain.r) + log2f(meta.MaxContentBoost[0])*gain.r
-			logBoostG := log2f(meta.MinContentBoost[1])*(1.0-gain.g) + log2f(meta.MaxContentBoost[1])*gain.g
-			logBoostB := log2f(meta.MinContentBoost[2])*(1.0-gain.b) + log2f(meta.MaxContentBoost[2])*gain.b
-			gainFactorR := exp2f(logBoostR)
-			gainFactorG := exp2f(logBoostG)
-			gainFactorB := exp2f(logBoostB)
-			hdr := rgb{
-				r: (oldRGB.r+meta.OffsetSDR[0])*gainFactorR - meta.OffsetHDR[0],
-				g: (oldRGB.g+meta.OffsetSDR[1])*gainFactorG - meta.OffsetHDR[1],
-				b: (oldRGB.b+meta.OffsetSDR[2])*gainFactorB - meta.OffsetHDR[2],
-			}
-			denomR := newRGB.r + meta.OffsetSDR[0]
-			denomG := newRGB.g + meta.OffsetSDR[1]
-			denomB := newRGB.b + meta.OffsetSDR[2]
-			if denomR <= 0 {
-				denomR = 1e-6
-			}
-			if denomG <= 0 {
-				denomG = 1e-6
-			}
-			if denomB <= 0 {
-				denomB = 1e-6
+				if denomB <= 0 {
+					denomB = 1e-6
+				}
+				newGainR := (hdr.r + meta.OffsetHDR[0]) / denomR
+				newGainG := (hdr.g + meta.OffsetHDR[1]) / denomG
+				newGainB := (hdr.b + meta.OffsetHDR[2]) / denomB
+				bias := quantizeBias(x, y, dither)
+				out.SetRGBA(x, y, color.RGBA{
+					R: gainFromFactor(newGainR, meta.MinContentBoost[0], meta.MaxContentBoost[0], meta.Gamma[0], bias),
+					G: gainFromFactor(newGainG, meta.MinContentBoost[1], meta.MaxContentBoost[1], meta.Gamma[1], bias),
+					B: gainFromFactor(newGainB, meta.MinContentBoost[2], meta.MaxContentBoost[2], meta.Gamma[2], bias),
+					A: 0xFF,
+				})
 			}
-			newGainR := (hdr.r + meta.OffsetHDR[0]) / denomR
-			newGainG := (hdr.g + meta.OffsetHDR[1]) / denomG
-			newGainB := (hdr.b + meta.OffsetHDR[2]) / denomB
-			out.SetRGBA(x, y, color.RGBA{
-				R: gainFromFactor(newGainR, meta.MinContentBoost[0], meta.MaxContentBoost[0], meta.Gamma[0]),
-				G: gainFromFactor(newGainG, meta.MinContentBoost[1], meta.MaxContentBoost[1], meta.Gamma[1]),
-				B: gainFromFactor(newGainB, meta.MinContentBoost[2], meta.MaxContentBoost[2], meta.Gamma[2]),
-				A: 0xFF,
-			})
 		}
-	}
+	})
 	return out, nil
 }
 
-func gainFromFactor(gainFactor, minBoost, maxBoost, gamma float32) uint8 {
+// flattenImage composites img over opaque background (nil is black), opaque images are returned as is.
+func flattenImage(img image.Image, background color.Color) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	bg := color.NRGBA{A: 0xFF}
+	if background != nil {
+		bg = color.NRGBAModel.Convert(background).(color.NRGBA)
+		bg.A = 0xFF
+	}
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, &image.Uniform{C: bg}, image.Point{}, draw.Src)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
+
+func gainFromFactor(gainFactor, minBoost, maxBoost, gamma, bias float32) uint8 {
 	if gainFactor < minBoost {
 		gainFactor = minBoost
 	}
 	if gainFactor > maxBoost {
 		gainFactor = maxBoost
 	}
-	logBoost := log2f(gainFactor)
-	logMin := log2f(minBoost)
-	logMax := log2f(maxBoost)
-	g := float32(0)
-	if logMax != logMin {
-		g = (logBoost - logMin) / (logMax - logMin)
+	logMin := boostLog2(minBoost)
+	logMax := boostLog2(maxBoost)
+	if logMax == logMin {
+		// Zero range decodes any value to the same boost, encode it as 0.
+		return 0
 	}
-	g = clamp01(g)
+	g := clamp01((log2f(gainFactor) - logMin) / (logMax - logMin))
 	if gamma != 1 {
 		g = float32(math.Pow(float64(g), float64(gamma)))
 	}
@@ -407,7 +586,7 @@ func gainFromFactor(gainFactor, minBoost, maxBoost, gamma float32) uint8 {
 	if val > 255 {
 		val = 255
 	}
-	return uint8(val + 0.5)
+	return uint8(min(val+bias, 255))
 }
 
 func withICCProfile(opt *RebaseOptions, iccProfile []byte) *RebaseOptions {
@@ -425,11 +604,40 @@ func withICCProfile(opt *RebaseOptions, iccProfile []byte) *RebaseOptions {
 	return &local
 }
 
-func rebaseUltraHDRFromHDRFile(primaryPath, hdrPath, outPath string, decodeHDR func([]byte) (*hdrImage, error), opts ...RebaseOption) error {
+// jpegParams returns encoding parameters of primary SDR and gainmap outputs with defaults applied,
+// opt may be nil.
+func (opt *RebaseOptions) jpegParams() (primary, gainmap jpegParams) {
+	primary.quality = Defaults.PrimaryQuality
+	gainmap.quality = Defaults.GainmapQuality
+	if opt == nil {
+		return primary, gainmap
+	}
+	if opt.BaseQuality > 0 {
+		primary.quality = opt.BaseQuality
+	}
+	if opt.GainmapQuality > 0 {
+		gainmap.quality = opt.GainmapQuality
+	}
+	primary.progressive = opt.Progressive
+	primary.subsampling, gainmap.subsampling = opt.Subsampling, opt.GainmapSubsampling
+	primary.restartInterval, gainmap.restartInterval = opt.RestartInterval, opt.RestartInterval
+	primary.optimizeHuffman, gainmap.optimizeHuffman = opt.OptimizeHuffman, opt.OptimizeHuffman
+	return primary, gainmap
+}
+
+// decodeEXR decodes OpenEXR input with EXR options of opt, nil opt uses defaults.
+func (opt *RebaseOptions) decodeEXR(data []byte) (*HDRImage, error) {
+	if opt == nil {
+		return decodeEXRImage(data, nil, nil)
+	}
+	return decodeEXRImage(data, nil, &opt.EXR)
+}
+
+func rebaseUltraHDRFromHDRFile(primaryPath, hdrPath, outPath string, decodeHDR func([]byte) (*HDRImage, error), opt *RebaseOptions) error {
 	if primaryPath == "" || hdrPath == "" || outPath == "" {
 		return errors.New("missing required arguments")
 	}
-	newSDR, newICCProfile, primaryBytes, err := loadImageWithICC(primaryPath)
+	primaryBytes, err := os.ReadFile(primaryPath)
 	if err != nil {
 		return err
 	}
@@ -437,55 +645,151 @@ func rebaseUltraHDRFromHDRFile(primaryPath, hdrPath, outPath string, decodeHDR f
 	if err != nil {
 		return err
 	}
-	hdr, err := decodeHDR(hdrBytes)
+	res, err := rebaseUltraHDRFromHDRBytes(primaryBytes, hdrBytes, decodeHDR, opt)
 	if err != nil {
 		return err
 	}
+	primaryOut, gainmapOut := outputsFromOptions(opt)
+	return writeRebaseOutputs(outPath, res.Container, primaryOut, res.Primary, gainmapOut, res.Gainmap)
+}
+
+func rebaseUltraHDRFromHDRBytes(primaryBytes, hdrBytes []byte, decodeHDR func([]byte) (*HDRImage, error), opt *RebaseOptions) (*Result, error) {
+	newSDR, newICCProfile, err := decodeImageWithICC(primaryBytes)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := decodeHDR(hdrBytes)
+	if err != nil {
+		return nil, err
+	}
 
-	opt := applyRebaseOptions(opts)
 	opt = withICCProfile(opt, newICCProfile)
 	res, err := rebaseUltraHDRFromHDR(newSDR, hdr, opt)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	res.Container, err = assembleRebasedContainer(res, primaryBytes, opt)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RebaseFromHDR generates an UltraHDR JPEG from an SDR primary and an in-memory HDR image,
+// e.g. one made with DecodePNGHDR or HDRImageFromP010.
+func RebaseFromHDR(newSDR image.Image, hdr *HDRImage, opts ...RebaseOption) (*Result, error) {
+	opt := applyRebaseOptions(opts)
+	res, err := rebaseUltraHDRFromHDR(newSDR, hdr, opt)
+	if err != nil {
+		return nil, err
+	}
+	res.Container, err = assembleRebasedContainer(res, nil, opt)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// assembleRebasedContainer wraps generated primary and gainmap into a container,
+// EXIF/ICC are taken from the original primary JPEG bytes if encoded primary has none,
+// ICC profile of options is used for other (e.g. PNG) primary bytes.
+// COM segments of primary JPEG bytes are copied with keepComments.
+func assembleRebasedContainer(res *Result, primaryBytes []byte, opt *RebaseOptions) ([]byte, error) {
+	if !isJPEG(primaryBytes) {
+		primaryBytes = nil
 	}
 	exif, icc, err := extractExifAndIcc(res.Primary)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(exif) == 0 && len(icc) == 0 {
+	if len(exif) == 0 && len(icc) == 0 && len(primaryBytes) > 0 {
 		exif, icc, err = extractExifAndIcc(primaryBytes)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	if len(icc) == 0 && opt != nil && len(opt.ICCProfile) > 0 {
+		if icc, err = buildICCSegments(opt.ICCProfile); err != nil {
+			return nil, err
 		}
 	}
 	secondaryISO, err := buildIsoPayload(res.Meta)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	secondaryXMP := buildGainmapXMP(res.Meta)
 	primaryXMP := buildPrimaryXMP(res.Meta, 0)
-	container, err := assembleContainerVipsLikeWithPrimaryXMP(res.Primary, res.Gainmap, exif, icc, primaryXMP, secondaryXMP, secondaryISO)
-	if err != nil {
-		return err
+	var comments [][]byte
+	if opt != nil && opt.KeepComments && len(primaryBytes) > 0 {
+		if comments, err = extractComments(primaryBytes); err != nil {
+			return nil, err
+		}
 	}
-	primaryOut, gainmapOut := outputsFromOptions(opt)
-	return writeRebaseOutputs(outPath, container, primaryOut, res.Primary, gainmapOut, res.Gainmap)
+	return assembleContainerVipsLike(containerParts{
+		primary: res.Primary, gainmap: res.Gainmap, exif: exif, icc: icc, comments: comments,
+		primaryXMP: primaryXMP, secondaryXMP: secondaryXMP, secondaryISO: secondaryISO,
+	})
 }
 
-func loadImageWithICC(path string) (image.Image, []byte, []byte, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, nil, nil, err
-	}
+// decodeImageWithICC decodes a JPEG, PNG or TIFF image (16-bit samples are rounded to 8-bit)
+// with its ICC profile, JPEG APP2 and PNG iCCP profiles are supported.
+func decodeImageWithICC(data []byte) (image.Image, []byte, error) {
 	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
-	_, icc, err := extractExifAndIcc(data)
-	if err != nil {
-		return nil, nil, nil, err
+	img = quantizeSDR8(img)
+	switch {
+	case isJPEG(data):
+		_, icc, err := extractExifAndIcc(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return img, collectICCProfile(icc), nil
+	case bytes.HasPrefix(data, pngSig):
+		icc, err := pngICCProfile(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return img, icc, nil
+	default:
+		return img, nil, nil
+	}
+}
+
+func isJPEG(data []byte) bool {
+	return len(data) >= 2 && data[0] == markerStart && data[1] == markerSOI
+}
+
+// quantizeSDR8 rounds 16-bit SDR images (e.g. 16-bit PNG or TIFF) to 8-bit, which is the precision
+// of the encoded primary and of gainmap rebase math, other images are returned as is.
+// Rounding avoids the darkening bias of truncating conversions.
+func quantizeSDR8(img image.Image) image.Image {
+	q := func(v uint32) uint8 { return uint8((v*255 + 32767) / 65535) }
+	b := img.Bounds()
+	switch img.(type) {
+	case *image.Gray16:
+		out := image.NewGray(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				v, _, _, _ := img.At(x, y).RGBA()
+				out.Pix[out.PixOffset(x, y)] = q(v)
+			}
+		}
+		return out
+	case *image.RGBA64, *image.NRGBA64:
+		out := image.NewRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, a := img.At(x, y).RGBA()
+				i := out.PixOffset(x, y)
+				out.Pix[i], out.Pix[i+1], out.Pix[i+2], out.Pix[i+3] = q(r), q(g), q(bl), q(a)
+			}
+		}
+		return out
+	default:
+		return img
 	}
-	return img, collectICCProfile(icc), data, nil
 }
 
 func writeRebaseOutputs(outPath string, container []byte, primaryOut string, primary []byte, gainmapOut string, gainmap []byte) error {
@@ -0,0 +1,176 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestRebaseDifferentDimensions(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	primary, err := sr.DecodePrimaryImage()
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	b := primary.Bounds()
+	newW, newH := b.Dx()*2, b.Dy()*2
+	newSDR := resizeImageInterpolated(primary, newW, newH, InterpolationBilinear)
+
+	res, err := Rebase(data, newSDR, WithInterpolation(InterpolationBilinear))
+	if err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(res.Primary))
+	if err != nil {
+		t.Fatalf("decode primary config: %v", err)
+	}
+	if cfg.Width != newW || cfg.Height != newH {
+		t.Fatalf("primary dims mismatch: got %dx%d want %dx%d", cfg.Width, cfg.Height, newW, newH)
+	}
+	if _, err := Split(bytes.NewReader(res.Container)); err != nil {
+		t.Fatalf("split rebased: %v", err)
+	}
+
+	squashed := resizeImageInterpolated(primary, b.Dx()*2, b.Dy(), InterpolationNearest)
+	if _, err := Rebase(data, squashed); err == nil {
+		t.Fatalf("expected error for different aspect ratio")
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	saved := Defaults
+	defer func() { Defaults = saved }()
+
+	const w, h = 64, 32
+	sdr := image.NewRGBA(image.Rect(0, 0, w, h))
+	hdr := &HDRImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x + y) * 255 / (w + h))
+			sdr.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 0xff})
+			lin := srgbInvOetf(float32(v) / 255)
+			for c := range 3 {
+				hdr.Pix[(y*w+x)*3+c] = lin * (1 + float32(x)/8)
+			}
+		}
+	}
+
+	Defaults.GainmapScale = 4
+	Defaults.PrimaryQuality = 20
+	res, err := RebaseFromHDR(sdr, hdr)
+	if err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(res.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap config: %v", err)
+	}
+	if cfg.Width != w/4 || cfg.Height != h/4 {
+		t.Fatalf("gainmap %dx%d, want %dx%d", cfg.Width, cfg.Height, w/4, h/4)
+	}
+
+	// Options take precedence over defaults.
+	hq, err := RebaseFromHDR(sdr, hdr, WithBaseQuality(95), WithGainmapScale(2))
+	if err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	if cfg, _, err = image.DecodeConfig(bytes.NewReader(hq.Gainmap)); err != nil || cfg.Width != w/2 {
+		t.Fatalf("gainmap width %d, want %d: %v", cfg.Width, w/2, err)
+	}
+	if len(res.Primary) >= len(hq.Primary) {
+		t.Fatalf("default quality primary %d bytes, quality 95 primary %d bytes", len(res.Primary), len(hq.Primary))
+	}
+}
+
+func TestRebasePNGAndTIFFBase(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := sr.DecodePrimaryImage()
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	b := primary.Bounds()
+	// 16-bit samples halfway between 8-bit levels must round up, not truncate.
+	sdr16 := image.NewNRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := primary.At(x, y).RGBA()
+			half := func(v uint32) uint16 { return uint16(min(v+150, 0xffff)) }
+			sdr16.SetNRGBA64(x, y, color.NRGBA64{R: half(r), G: half(g), B: half(bl), A: 0xffff})
+		}
+	}
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, sdr16); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	p3, err := os.ReadFile("testdata/sample_display_p3.jpg")
+	if err != nil {
+		t.Fatalf("read p3: %v", err)
+	}
+	_, p3Segs, err := extractExifAndIcc(p3)
+	if err != nil {
+		t.Fatalf("extract icc: %v", err)
+	}
+	profile := collectICCProfile(p3Segs)
+	var iccp bytes.Buffer
+	iccp.WriteString("Display P3\x00\x00")
+	zw := zlib.NewWriter(&iccp)
+	_, _ = zw.Write(profile)
+	_ = zw.Close()
+	pngBase, err := insertPNGChunk(pngData.Bytes(), "iCCP", iccp.Bytes())
+	if err != nil {
+		t.Fatalf("insert iCCP: %v", err)
+	}
+
+	img, icc, err := decodeImageWithICC(pngBase)
+	if err != nil {
+		t.Fatalf("decode png base: %v", err)
+	}
+	if !bytes.Equal(icc, profile) {
+		t.Fatalf("iCCP profile %d bytes, want %d", len(icc), len(profile))
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		t.Fatalf("expected 8-bit image, got %T", img)
+	}
+	r, _, _, _ := primary.At(b.Min.X, b.Min.Y).RGBA()
+	if got, want := rgba.Pix[0], uint8((min(r+150, 0xffff)*255+32767)/65535); got != want {
+		t.Fatalf("quantized red %d, want %d", got, want)
+	}
+
+	res, err := RebaseJPEG(data, pngBase)
+	if err != nil {
+		t.Fatalf("rebase png base: %v", err)
+	}
+	out := mustSplit(t, res.Container)
+	if _, outICC, err := extractExifAndIcc(out.Primary); err != nil || !bytes.Equal(collectICCProfile(outICC), profile) {
+		t.Fatalf("expected Display P3 profile of PNG base in output: %v", err)
+	}
+
+	var tiffBase bytes.Buffer
+	if err := tiff.Encode(&tiffBase, primary, nil); err != nil {
+		t.Fatalf("encode tiff: %v", err)
+	}
+	if res, err = RebaseJPEG(data, tiffBase.Bytes()); err != nil {
+		t.Fatalf("rebase tiff base: %v", err)
+	}
+	if _, err := Split(bytes.NewReader(res.Container)); err != nil {
+		t.Fatalf("split tiff rebase: %v", err)
+	}
+}
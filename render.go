@@ -0,0 +1,102 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+// RenderOptions controls RenderSDR.
+type RenderOptions struct {
+	// MaxDisplayBoost is the simulated display headroom (linear ratio to SDR white),
+	// values up to 1 reproduce the SDR base image.
+	MaxDisplayBoost float32
+	Quality         int  // JPEG quality (0 uses default).
+	ExactTransfer   bool // Compute transfer functions with math.Pow instead of lookup tables.
+}
+
+// RenderSDR renders an UltraHDR JPEG into a plain SDR JPEG preview of how it looks on a display
+// with MaxDisplayBoost headroom. HDR is reconstructed with display-boost weighting and tone-mapped
+// so that the boost level maps to SDR white, EXIF and ICC of the primary image are carried over.
+func RenderSDR(data []byte, opt *RenderOptions) ([]byte, error) {
+	if opt == nil {
+		opt = &RenderOptions{}
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("split: %w", err)
+	}
+	if sr.Meta == nil {
+		return nil, ErrNoGainmapMetadata
+	}
+	sdr, err := decodeJPEG(sr.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("decode primary: %w", err)
+	}
+	gainmap, err := decodeJPEG(sr.Gainmap)
+	if err != nil {
+		return nil, fmt.Errorf("decode gainmap: %w", err)
+	}
+	if err := checkGainmapDimensions(sdr.Bounds(), gainmap.Bounds()); err != nil {
+		return nil, err
+	}
+
+	boost := max(opt.MaxDisplayBoost, 1)
+	sdrProfile := jpegColorProfile(sr.Primary)
+	gainGamut := gainApplicationGamut(sr.Meta, sdrProfile, sr.Gainmap)
+	hdr, err := reconstructHDR(sdr, sdrProfile, gainmap, gainGamut, sr.Meta, displayBoostWeight(sr.Meta, boost), opt.ExactTransfer)
+	if err != nil {
+		return nil, err
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, hdr.W, hdr.H))
+	for y := 0; y < hdr.H; y++ {
+		for x := 0; x < hdr.W; x++ {
+			v := toneMapRGB(hdr.at(x, y), boost)
+			i := out.PixOffset(x, y)
+			out.Pix[i] = clampToByte(srgbOetf(clamp01(v.r))*255 + 0.5)
+			out.Pix[i+1] = clampToByte(srgbOetf(clamp01(v.g))*255 + 0.5)
+			out.Pix[i+2] = clampToByte(srgbOetf(clamp01(v.b))*255 + 0.5)
+			out.Pix[i+3] = 0xFF
+		}
+	}
+
+	quality := opt.Quality
+	if quality <= 0 {
+		quality = Defaults.PrimaryQuality
+	}
+	encoded, err := encodeWithQuality(out, quality)
+	if err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+
+	exif, icc, err := extractExifAndIcc(sr.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("extract exif and icc: %w", err)
+	}
+	var segs []appSegment
+	if density, ok := jfifDensitySegment(sr.Primary); ok {
+		segs = append(segs, density)
+	}
+	if exif != nil {
+		segs = append(segs, appSegment{marker: markerAPP1, payload: exif})
+	}
+	for _, seg := range icc {
+		segs = append(segs, appSegment{marker: markerAPP2, payload: seg})
+	}
+	if len(segs) == 0 {
+		return encoded, nil
+	}
+	return insertAppSegments(encoded, segs)
+}
+
+// toneMapRGB compresses linear HDR with extended Reinhard curve on max channel, so that white
+// level maps to 1 while hue is kept, white of 1 leaves SDR range unchanged.
+func toneMapRGB(v rgb, white float32) rgb {
+	m := max3(v.r, v.g, v.b)
+	if m <= 0 {
+		return rgb{}
+	}
+	s := (1 + m/(white*white)) / (1 + m)
+	return rgb{r: v.r * s, g: v.g * s, b: v.b * s}
+}
@@ -0,0 +1,70 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"testing"
+)
+
+func TestRenderSDR(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	base, _, err := image.Decode(bytes.NewReader(sr.Primary))
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+
+	meanDiff := func(boost float32) float64 {
+		out, err := RenderSDR(data, &RenderOptions{MaxDisplayBoost: boost, Quality: 95})
+		if err != nil {
+			t.Fatalf("render %v: %v", boost, err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("decode render %v: %v", boost, err)
+		}
+		if img.Bounds().Size() != base.Bounds().Size() {
+			t.Fatalf("render %v size %v, want %v", boost, img.Bounds().Size(), base.Bounds().Size())
+		}
+		var sum, n float64
+		b := base.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r1, g1, b1, _ := base.At(x, y).RGBA()
+				r2, g2, b2, _ := img.At(x-b.Min.X, y-b.Min.Y).RGBA()
+				for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+					sum += float64(max(d, -d))
+					n++
+				}
+			}
+		}
+		return sum / n
+	}
+
+	if d := meanDiff(1); d > 2 {
+		t.Fatalf("boost 1 differs from base image by %.2f on average", d)
+	}
+	if d := meanDiff(4); d < 2 {
+		t.Fatalf("boost 4 is too close to base image: %.2f", d)
+	}
+
+	out, err := RenderSDR(data, nil)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	exif, _, err := extractExifAndIcc(out)
+	if err != nil {
+		t.Fatalf("extract exif: %v", err)
+	}
+	baseExif, _, _ := extractExifAndIcc(sr.Primary)
+	if !bytes.Equal(exif, baseExif) {
+		t.Fatalf("EXIF is not carried over")
+	}
+}
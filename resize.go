@@ -9,24 +9,50 @@ import (
 	"image/draw"
 	"io"
 	"math"
+	"sync"
 
 	"github.com/vearutop/ultrahdr/internal/jpegx"
 )
 
 // ResizeSpec describes one output variant for ResizeSDR/ResizeHDR.
 type ResizeSpec struct {
-	Width          uint                         // Target width in pixels.
-	Height         uint                         // Target height in pixels.
-	Crop           *image.Rectangle             // Optional crop rectangle in source pixels.
-	Quality        int                          // SDR/primary JPEG quality (0 uses default).
-	GainmapQuality int                          // Gainmap JPEG quality for HDR resize (0 uses default or Quality).
-	Interpolation  Interpolation                // Resize interpolation mode for SDR and HDR paths.
-	KeepMeta       bool                         // SDR: preserve EXIF/ICC and skip sRGB conversion when true.
-	ReceiveResult  func(res *Result, err error) // Callback for each output.
-	ReceiveSplit   func(sr *Result)             // HDR: callback with split result before resizing.
+	Width              uint                                        // Target width in pixels.
+	Height             uint                                        // Target height in pixels.
+	Crop               *image.Rectangle                            // Optional crop rectangle in source pixels.
+	Quality            int                                         // SDR/primary JPEG quality (0 uses default).
+	GainmapQuality     int                                         // Gainmap JPEG quality for HDR resize (0 uses default or Quality).
+	GainmapMaxDim      uint                                        // HDR: optional cap for the gainmap long edge, aspect is preserved.
+	Interpolation      Interpolation                               // Resize interpolation mode for SDR and HDR paths.
+	Resample           func(src image.Image, w, h int) image.Image // Optional custom resampler for primary and gainmap, Interpolation is used when nil.
+	Transform          Transform                                   // Optional flip or rotation applied after resampling, rotation by 90/270 swaps output dimensions.
+	KeepMeta           bool                                        // SDR: preserve EXIF/ICC and skip sRGB conversion when true.
+	KeepComments       bool                                        // Preserve COM segments of source primary, they are stripped by default.
+	Progressive        bool                                        // Encode primary (SDR output) as progressive JPEG, HDR gainmap stays baseline.
+	Subsampling        Subsampling                                 // Chroma subsampling of primary (SDR output).
+	GainmapSubsampling Subsampling                                 // HDR: chroma subsampling of gainmap.
+	RestartInterval    int                                         // Write RST markers every RestartInterval MCUs of primary and gainmap (0 disables).
+	OptimizeHuffman    bool                                        // Build optimal Huffman tables for primary and gainmap (smaller files, slower encoding).
+	MaxMemoryBytes     int64                                       // Optional limit of estimated decoded source and output image memory, checked before decoding (0 disables).
+	ExactTransfer      bool                                        // SDR: compute color conversion with math.Pow instead of lookup tables.
+	ReceiveResult      func(res *Result, err error)                // Callback for each output.
+	ReceiveSplit       func(sr *Result)                            // HDR: callback with split result before resizing.
+}
+
+// ErrMemoryLimit is returned for a ResizeHDR or ResizeSDR spec when estimated memory of decoded
+// source and output images exceeds its MaxMemoryBytes.
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+// ResizeInfo describes a resize output.
+type ResizeInfo struct {
+	Width           int        // Output primary width, after Transform.
+	Height          int        // Output primary height, after Transform.
+	SourceGamut     ColorGamut // Gamut of the source primary image, as declared by its ICC profile (sRGB without ICC).
+	ConvertedToSRGB bool       // Pixels were converted from SourceGamut to sRGB (ResizeSDR without KeepMeta).
 }
 
 // ResizeHDR resizes an UltraHDR JPEG container to the requested dimensions.
+// Primary and gainmap are decoded once and shared by all specs, so multiple thumbnail
+// sizes should be requested in a single call.
 // Results are delivered via ReceiveResult on each spec; ReceiveSplit runs before resizing.
 func ResizeHDR(r io.Reader, specs ...ResizeSpec) error {
 	if len(specs) == 0 {
@@ -42,16 +68,21 @@ func ResizeHDR(r io.Reader, specs ...ResizeSpec) error {
 	if sr.Segs == nil {
 		return errors.New("metadata segments missing")
 	}
-	primaryImg, _, err := image.Decode(bytes.NewReader(sr.Primary))
+	rejected, all := checkMemoryLimits(specs, sr.Primary, sr.Gainmap)
+	if all {
+		// Sources are not decoded when no spec fits its memory limit.
+		return resizeSpecs(specs, func(i int, _ ResizeSpec) (*Result, error) { return nil, rejected[i] })
+	}
+	primaryImg, err := decodeJPEG(sr.Primary)
 	if err != nil {
 		return fmt.Errorf("decode primary: %w", err)
 	}
-	gainmapImg, _, err := image.Decode(bytes.NewReader(sr.Gainmap))
+	gainmapImg, err := decodeJPEG(sr.Gainmap)
 	if err != nil {
 		return fmt.Errorf("decode gainmap: %w", err)
 	}
 	if sr.Meta == nil {
-		return errors.New("gainmap metadata missing")
+		return ErrNoGainmapMetadata
 	}
 	primaryBounds := primaryImg.Bounds()
 	srcW := primaryBounds.Dx()
@@ -73,6 +104,12 @@ func ResizeHDR(r io.Reader, specs ...ResizeSpec) error {
 	if err != nil {
 		return fmt.Errorf("extract exif and icc: %w", err)
 	}
+	srcGamut := detectColorProfileFromICCProfile(collectICCProfile(icc)).gamut
+	srcComments, err := extractComments(sr.Primary)
+	if err != nil {
+		return fmt.Errorf("extract comments: %w", err)
+	}
+	density, hasDensity := jfifDensitySegment(sr.Primary)
 	secondaryISO := sr.Segs.SecondaryISO
 	if len(secondaryISO) == 0 && sr.Meta != nil {
 		secondaryISO, err = buildIsoPayload(sr.Meta)
@@ -81,101 +118,96 @@ func ResizeHDR(r io.Reader, specs ...ResizeSpec) error {
 		}
 	}
 
-	for _, spec := range specs {
+	return resizeSpecs(specs, func(i int, spec ResizeSpec) (*Result, error) {
+		if rejected[i] != nil {
+			return nil, rejected[i]
+		}
 		cropRect := primaryBounds
 		if spec.Crop != nil {
 			cropRect = *spec.Crop
 			if err := validateCropRect(cropRect, primaryBounds); err != nil {
-				if spec.ReceiveResult != nil {
-					spec.ReceiveResult(nil, err)
-				}
-				return err
+				return nil, err
 			}
 		}
 		primaryCropRect, gainmapCropRect, err := resolveCropRects(cropRect, primaryBounds, gainmapBounds)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return err
+			return nil, err
 		}
 
 		primaryCropped, err := cropImage(primaryImg, primaryCropRect)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return fmt.Errorf("crop primary: %w", err)
+			return nil, fmt.Errorf("crop primary: %w", err)
 		}
 		gainmapCropped, err := cropImage(gainmapImg, gainmapCropRect)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return fmt.Errorf("crop gainmap: %w", err)
+			return nil, fmt.Errorf("crop gainmap: %w", err)
 		}
 
 		width, height, err := resolveResizeDims(spec, primaryCropRect.Dx(), primaryCropRect.Dy())
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return err
+			return nil, err
 		}
 
-		primaryQuality := defaultPrimaryQuality
-		gainmapQuality := defaultGainMapQuality
+		primaryParams, gainmapParams := spec.jpegParams()
 		interp := InterpolationNearest
-		if spec.Quality > 0 {
-			primaryQuality = spec.Quality
-		}
-		if spec.GainmapQuality > 0 {
-			gainmapQuality = spec.GainmapQuality
-		} else if spec.Quality > 0 {
-			gainmapQuality = spec.Quality
-		}
 		if spec.Interpolation != 0 {
 			interp = spec.Interpolation
 		}
 
 		primaryThumbImg := primaryCropped
 		if primaryCropRect.Dx() != int(width) || primaryCropRect.Dy() != int(height) {
-			primaryThumbImg = resizeImageInterpolated(primaryCropped, int(width), int(height), interp)
+			primaryThumbImg, err = spec.resample(primaryCropped, int(width), int(height), interp)
+			if err != nil {
+				return nil, fmt.Errorf("resize primary: %w", err)
+			}
 		}
-		primaryThumb, err := encodeWithQuality(primaryThumbImg, primaryQuality)
+		primaryThumbImg = spec.Transform.apply(primaryThumbImg)
+		primaryThumb, err := encodeJPEG(primaryThumbImg, primaryParams)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return fmt.Errorf("resize primary: %w", err)
+			return nil, fmt.Errorf("resize primary: %w", err)
 		}
+		gainmapW, gainmapH := gainmapTargetDims(width, height, spec.GainmapMaxDim)
 		gainmapThumbImg := gainmapCropped
-		if gainmapCropRect.Dx() != int(width) || gainmapCropRect.Dy() != int(height) {
-			gainmapThumbImg = resizeImageInterpolated(gainmapCropped, int(width), int(height), interp)
+		if gainmapCropRect.Dx() != int(gainmapW) || gainmapCropRect.Dy() != int(gainmapH) {
+			gainmapThumbImg, err = spec.resample(gainmapCropped, int(gainmapW), int(gainmapH), interp)
+			if err != nil {
+				return nil, fmt.Errorf("resize gainmap: %w", err)
+			}
 		}
-		gainmapThumb, err := encodeWithQuality(gainmapThumbImg, gainmapQuality)
+		gainmapThumb, err := encodeJPEG(spec.Transform.apply(gainmapThumbImg), gainmapParams)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
+			return nil, fmt.Errorf("resize gainmap: %w", err)
+		}
+		var comments [][]byte
+		if spec.KeepComments {
+			comments = srcComments
+		}
+		container, err := assembleContainerVipsLike(containerParts{
+			primary: primaryThumb, gainmap: gainmapThumb, exif: exif, icc: icc, comments: comments,
+			secondaryXMP: sr.Segs.SecondaryXMP, secondaryISO: secondaryISO,
+		})
+		if err == nil && hasDensity {
+			d := density
+			if spec.Transform.orientation() >= orientationTranspose {
+				d = swapJFIFDensity(d)
 			}
-			return fmt.Errorf("resize gainmap: %w", err)
+			container, err = insertContainerAppSegments(container, []appSegment{d})
 		}
-		container, err := assembleContainerVipsLike(primaryThumb, gainmapThumb, exif, icc, sr.Segs.SecondaryXMP, secondaryISO)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return fmt.Errorf("assemble container: %w", err)
+			return nil, fmt.Errorf("assemble container: %w", err)
 		}
-		if spec.ReceiveResult != nil {
-			spec.ReceiveResult(&Result{Container: container, Primary: primaryThumb, Gainmap: gainmapThumb}, nil)
+		info := &ResizeInfo{
+			Width:       primaryThumbImg.Bounds().Dx(),
+			Height:      primaryThumbImg.Bounds().Dy(),
+			SourceGamut: srcGamut,
 		}
-	}
-	return nil
+		return &Result{Container: container, Primary: primaryThumb, Gainmap: gainmapThumb, Resize: info}, nil
+	})
 }
 
 // ResizeSDR resizes one JPEG into multiple outputs with a single source decode.
 // For each spec: when KeepMeta is true EXIF/ICC are preserved; otherwise output is metadata-free.
+// JFIF density (DPI) of the source is preserved in both cases.
 // Metadata-free outputs are converted to sRGB when source profile is recognized as wide gamut.
 func ResizeSDR(r io.Reader, specs ...ResizeSpec) error {
 	if len(specs) == 0 {
@@ -196,20 +228,35 @@ func ResizeSDR(r io.Reader, specs ...ResizeSpec) error {
 		return err
 	}
 
-	srcProfile := colorProfile{gamut: colorGamutSRGB, transfer: colorTransferSRGB}
+	srcProfile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
 	exif, icc, err := extractExifAndIcc(data)
 	if err == nil {
 		srcProfile = detectColorProfileFromICCProfile(collectICCProfile(icc))
 	}
 
-	keepMetaSegs := make([]appSegment, 0, 1+len(icc))
+	keepMetaSegs := make([]appSegment, 0, 2+len(icc))
+	var densitySegs []appSegment
+	if jfif, ok := jfifDensitySegment(data); ok {
+		densitySegs = append(densitySegs, jfif)
+		keepMetaSegs = append(keepMetaSegs, jfif)
+	}
 	if exif != nil {
 		keepMetaSegs = append(keepMetaSegs, appSegment{marker: markerAPP1, payload: exif})
 	}
 	for _, seg := range icc {
 		keepMetaSegs = append(keepMetaSegs, appSegment{marker: markerAPP2, payload: seg})
 	}
+	var commentSegs []appSegment
+	if comments, err := extractComments(data); err == nil {
+		for _, c := range comments {
+			commentSegs = append(commentSegs, appSegment{marker: markerCOM, payload: c})
+		}
+	}
 
+	rejected, all := checkMemoryLimits(specs, data)
+	if all {
+		return resizeSpecs(specs, func(i int, _ ResizeSpec) (*Result, error) { return nil, rejected[i] })
+	}
 	srcImg, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return err
@@ -221,75 +268,173 @@ func ResizeSDR(r io.Reader, specs ...ResizeSpec) error {
 		return errors.New("invalid source dimensions")
 	}
 
-	for _, spec := range specs {
+	return resizeSpecs(specs, func(i int, spec ResizeSpec) (*Result, error) {
+		if rejected[i] != nil {
+			return nil, rejected[i]
+		}
 		cropRect := srcBounds
 		if spec.Crop != nil {
 			cropRect = *spec.Crop
 			if err := validateCropRect(cropRect, srcBounds); err != nil {
-				if spec.ReceiveResult != nil {
-					spec.ReceiveResult(nil, err)
-				}
-				return err
+				return nil, err
 			}
 		}
 		cropped, err := cropImage(srcImg, cropRect)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return err
+			return nil, err
 		}
 
 		width, height, err := resolveResizeDims(spec, cropRect.Dx(), cropRect.Dy())
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
-			return err
-		}
-		if spec.Quality <= 0 {
-			spec.Quality = defaultPrimaryQuality
+			return nil, err
 		}
-
 		resized := cropped
 		if cropRect.Dx() != int(width) || cropRect.Dy() != int(height) {
-			resized = resizeImageInterpolated(cropped, int(width), int(height), spec.Interpolation)
+			resized, err = spec.resample(cropped, int(width), int(height), spec.Interpolation)
+			if err != nil {
+				return nil, err
+			}
 		}
 
+		resized = spec.Transform.apply(resized)
+
 		dstProfile := srcProfile
-		var segs []appSegment
+		segs := densitySegs
 		if spec.KeepMeta {
 			segs = keepMetaSegs
 		} else {
-			dstProfile = colorProfile{gamut: colorGamutSRGB, transfer: colorTransferSRGB}
+			dstProfile = colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+		}
+		if len(densitySegs) > 0 && spec.Transform.orientation() >= orientationTranspose {
+			// Density is the first segment in both sets.
+			segs = append([]appSegment{swapJFIFDensity(segs[0])}, segs[1:]...)
+		}
+		if spec.KeepComments && len(commentSegs) > 0 {
+			segs = append(segs[:len(segs):len(segs)], commentSegs...)
 		}
 
 		converted := resized
 		if dstProfile != srcProfile {
-			converted = convertImageProfile(converted, srcProfile, dstProfile)
+			converted = convertImageProfile(converted, srcProfile, dstProfile, spec.ExactTransfer)
 		}
 
-		out, err := encodeWithQuality(converted, spec.Quality)
+		params, _ := spec.jpegParams()
+		out, err := encodeJPEG(converted, params)
 		if err != nil {
-			if spec.ReceiveResult != nil {
-				spec.ReceiveResult(nil, err)
-			}
+			return nil, fmt.Errorf("encode: %w", err)
 		}
 		if len(segs) > 0 {
-			out, err = insertAppSegments(out, segs)
-			if err != nil {
-				if spec.ReceiveResult != nil {
-					spec.ReceiveResult(nil, err)
-				}
+			if out, err = insertAppSegments(out, segs); err != nil {
+				return nil, fmt.Errorf("insert metadata: %w", err)
 			}
 		}
+		info := &ResizeInfo{
+			Width:           converted.Bounds().Dx(),
+			Height:          converted.Bounds().Dy(),
+			SourceGamut:     srcProfile.gamut,
+			ConvertedToSRGB: dstProfile != srcProfile,
+		}
+		return &Result{Container: out, Primary: out, Resize: info}, nil
+	})
+}
 
+// resizeSpecs calls resize for each spec and delivers its outcome to ReceiveResult exactly once.
+// A failed spec does not stop the others, per-spec errors are joined with spec indices.
+func resizeSpecs(specs []ResizeSpec, resize func(i int, spec ResizeSpec) (*Result, error)) error {
+	var errs []error
+	for i, spec := range specs {
+		res, err := resize(i, spec)
+		if err != nil {
+			res = nil
+			errs = append(errs, fmt.Errorf("spec %d: %w", i, err))
+		}
 		if spec.ReceiveResult != nil {
-			spec.ReceiveResult(&Result{Container: out, Primary: out}, err)
+			spec.ReceiveResult(res, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resample resizes img with custom Resample of spec, or with built-in interp when it is nil.
+func (spec ResizeSpec) resample(img image.Image, w, h int, interp Interpolation) (image.Image, error) {
+	if spec.Resample == nil {
+		return resizeImageInterpolated(img, w, h, interp), nil
+	}
+	out := spec.Resample(img, w, h)
+	if out == nil {
+		return nil, errors.New("custom resample returned nil image")
+	}
+	if b := out.Bounds(); b.Dx() != w || b.Dy() != h {
+		return nil, fmt.Errorf("custom resample returned %dx%d image, expected %dx%d", b.Dx(), b.Dy(), w, h)
+	}
+	return out, nil
+}
+
+// gainmapTargetDims fits gainmap dimensions within maxDim, keeping primary aspect ratio.
+func gainmapTargetDims(width, height, maxDim uint) (uint, uint) {
+	if maxDim == 0 || (width <= maxDim && height <= maxDim) {
+		return width, height
+	}
+	if width >= height {
+		h := uint(math.Round(float64(height) * float64(maxDim) / float64(width)))
+		return maxDim, max(h, 1)
+	}
+	w := uint(math.Round(float64(width) * float64(maxDim) / float64(height)))
+	return max(w, 1), maxDim
+}
+
+// checkMemoryLimits estimates memory of each spec with MaxMemoryBytes from JPEG frame headers of
+// sources (primary first), so that oversized jobs are rejected before decoding. It returns
+// ErrMemoryLimit errors by spec index and whether all specs are rejected.
+func checkMemoryLimits(specs []ResizeSpec, sources ...[]byte) ([]error, bool) {
+	rejected := make([]error, len(specs))
+	var infos []JPEGInfo
+	n := 0
+	for i, spec := range specs {
+		if spec.MaxMemoryBytes <= 0 {
+			continue
+		}
+		if infos == nil {
+			for _, data := range sources {
+				info, err := ParseJPEGHeader(data)
+				if err != nil || info.Width <= 0 || info.Height <= 0 {
+					// Decoding reports malformed sources.
+					return rejected, false
+				}
+				infos = append(infos, info)
+			}
+		}
+		if need := spec.estimateMemory(infos); need > spec.MaxMemoryBytes {
+			rejected[i] = fmt.Errorf("%w: estimated %d bytes, limit %d", ErrMemoryLimit, need, spec.MaxMemoryBytes)
+			n++
 		}
 	}
+	return rejected, n == len(specs)
+}
 
-	return nil
+// estimateMemory returns bytes of decoded sources and their resized outputs, output images
+// keep bytes per pixel of sources and gainmap follows GainmapMaxDim.
+func (spec ResizeSpec) estimateMemory(sources []JPEGInfo) int64 {
+	primary := image.Rect(0, 0, sources[0].Width, sources[0].Height)
+	crop := primary
+	if spec.Crop != nil {
+		crop = spec.Crop.Intersect(primary)
+	}
+	width, height, err := resolveResizeDims(spec, crop.Dx(), crop.Dy())
+	if err != nil {
+		// Resize reports invalid dimensions.
+		width, height = 0, 0
+	}
+	var total int64
+	for i, info := range sources {
+		w, h := width, height
+		if i > 0 {
+			w, h = gainmapTargetDims(width, height, spec.GainmapMaxDim)
+		}
+		src := info.decodedBytes()
+		total += src + src*int64(w)*int64(h)/(int64(info.Width)*int64(info.Height))
+	}
+	return total
 }
 
 func resolveResizeDims(spec ResizeSpec, srcW, srcH int) (uint, uint, error) {
@@ -332,6 +477,13 @@ const (
 	InterpolationLanczos2
 	// InterpolationLanczos3 is Lanczos sampling with a=3.
 	InterpolationLanczos3
+	// InterpolationHermite is cubic Hermite (smoothstep) sampling, smoother than bilinear
+	// without Lanczos ringing, which makes it a good fit for gainmaps.
+	InterpolationHermite
+	// InterpolationLanczos4 is Lanczos sampling with a=4, sharpest for high quality downscales.
+	InterpolationLanczos4
+	// InterpolationBox is area averaging, downscaled pixels are means of source pixels they cover.
+	InterpolationBox
 )
 
 func resizeImageInterpolated(img image.Image, w, h int, interp Interpolation) image.Image {
@@ -357,7 +509,7 @@ func resizeImageInterpolated(img image.Image, w, h int, interp Interpolation) im
 	}
 }
 
-func convertImageProfile(img image.Image, from, to colorProfile) image.Image {
+func convertImageProfile(img image.Image, from, to colorProfile, exact bool) image.Image {
 	if from == to {
 		return img
 	}
@@ -365,12 +517,12 @@ func convertImageProfile(img image.Image, from, to colorProfile) image.Image {
 	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
 	for y := b.Min.Y; y < b.Max.Y; y++ {
 		for x := b.Min.X; x < b.Max.X; x++ {
-			v := sampleSDRInProfile(img, x, y, from, to.gamut)
+			v := sampleSDRInProfile(img, x, y, from, to.gamut, exact)
 			_, _, _, a := img.At(x, y).RGBA()
 			out.SetNRGBA(x-b.Min.X, y-b.Min.Y, color.NRGBA{
-				R: uint8(clamp01(oETF(v.r, to.transfer))*255.0 + 0.5),
-				G: uint8(clamp01(oETF(v.g, to.transfer))*255.0 + 0.5),
-				B: uint8(clamp01(oETF(v.b, to.transfer))*255.0 + 0.5),
+				R: oETF8(v.r, to.transfer, exact),
+				G: oETF8(v.g, to.transfer, exact),
+				B: oETF8(v.b, to.transfer, exact),
 				A: uint8(a >> 8),
 			})
 		}
@@ -435,21 +587,157 @@ func nearestScale(dst draw.Image, src image.Image) {
 	}
 }
 
+// Subsampling selects chroma subsampling of encoded JPEG images.
+type Subsampling int
+
+const (
+	// Subsampling420 stores chroma at half resolution in both directions (default),
+	// grayscale images stay single-channel.
+	Subsampling420 Subsampling = iota
+	// Subsampling444 stores chroma at full resolution.
+	Subsampling444
+	// SubsamplingGray stores luma only, as a single-channel JPEG.
+	// Multi-channel gainmaps are collapsed to a single channel.
+	SubsamplingGray
+)
+
+// jpegParams controls JPEG encoding of an output image.
+type jpegParams struct {
+	quality         int
+	progressive     bool
+	subsampling     Subsampling
+	restartInterval int  // Write RST markers every restartInterval MCUs (0 disables).
+	optimizeHuffman bool // Build optimal Huffman tables instead of standard ones.
+}
+
+// jpegParams returns encoding parameters of primary and gainmap outputs with defaults applied.
+// Gainmap quality falls back to Quality, only the primary output can be progressive.
+func (spec ResizeSpec) jpegParams() (primary, gainmap jpegParams) {
+	primary = jpegParams{
+		quality:         Defaults.PrimaryQuality,
+		progressive:     spec.Progressive,
+		subsampling:     spec.Subsampling,
+		restartInterval: spec.RestartInterval,
+		optimizeHuffman: spec.OptimizeHuffman,
+	}
+	gainmap = jpegParams{
+		quality:         Defaults.GainmapQuality,
+		subsampling:     spec.GainmapSubsampling,
+		restartInterval: spec.RestartInterval,
+		optimizeHuffman: spec.OptimizeHuffman,
+	}
+	if spec.Quality > 0 {
+		primary.quality = spec.Quality
+		gainmap.quality = spec.Quality
+	}
+	if spec.GainmapQuality > 0 {
+		gainmap.quality = spec.GainmapQuality
+	}
+	return primary, gainmap
+}
+
 func encodeWithQuality(img image.Image, quality int) ([]byte, error) {
-	var buf bytes.Buffer
+	return encodeJPEG(img, jpegParams{quality: quality})
+}
+
+// encodeJPEG is like encodeWithQuality, but optionally writes progressive scans
+// with the given chroma subsampling, restart markers and optimized Huffman tables.
+func encodeJPEG(img image.Image, p jpegParams) ([]byte, error) {
 	opt := jpegx.EncoderOptions{
-		Quality:        quality,
-		UseQuantTables: false,
-		UseHuffman:     false,
-		UseSampling:    true,
-		Sampling:       [3]jpegx.SamplingFactor{{H: 2, V: 2}, {H: 1, V: 1}, {H: 1, V: 1}},
-		SplitDQT:       true,
-		SplitDHT:       true,
-	}
-	if err := jpegx.EncodeWithTables(&buf, img, opt); err != nil {
+		Quality:         p.quality,
+		UseQuantTables:  false,
+		UseHuffman:      false,
+		UseSampling:     true,
+		Sampling:        [3]jpegx.SamplingFactor{{H: 2, V: 2}, {H: 1, V: 1}, {H: 1, V: 1}},
+		SplitDQT:        true,
+		SplitDHT:        true,
+		Progressive:     p.progressive,
+		RestartInterval: p.restartInterval,
+		OptimizeHuffman: p.optimizeHuffman,
+	}
+	switch p.subsampling {
+	case Subsampling420:
+	case Subsampling444:
+		opt.Sampling[0] = jpegx.SamplingFactor{H: 1, V: 1}
+	case SubsamplingGray:
+		img = grayImage(img)
+	default:
+		return nil, fmt.Errorf("unsupported subsampling %d", p.subsampling)
+	}
+
+	enc := jpegEncoders.Get().(*jpegx.Encoder)
+	defer jpegEncoders.Put(enc)
+	buf := jpegBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledJPEGBuffer {
+			buf.Reset()
+			jpegBuffers.Put(buf)
+		}
+	}()
+
+	// Entropy-coded data rarely exceeds 3/4 byte per pixel even at quality 100,
+	// reserving it up front avoids repeated growth of a fresh buffer.
+	pixels := img.Bounds().Dx() * img.Bounds().Dy()
+	buf.Grow(pixels/4 + pixels*max(p.quality, 1)/200 + 1024)
+	if err := enc.EncodeWithTables(buf, img, opt); err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// grayImage returns luma of img as 8-bit gray image, YCbCr luma plane is copied as is.
+func grayImage(img image.Image) image.Image {
+	if _, ok := img.(*image.Gray); ok {
+		return img
+	}
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if m, ok := img.(*image.YCbCr); ok {
+		for y := 0; y < b.Dy(); y++ {
+			off := m.YOffset(b.Min.X, b.Min.Y+y)
+			copy(gray.Pix[y*gray.Stride:y*gray.Stride+b.Dx()], m.Y[off:off+b.Dx()])
+		}
+		return gray
+	}
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	return gray
+}
+
+// maxPooledJPEGBuffer limits capacity of output buffers kept for reuse by encodeJPEG.
+const maxPooledJPEGBuffer = 64 << 20
+
+var (
+	jpegEncoders = sync.Pool{New: func() any { return new(jpegx.Encoder) }}
+	jpegBuffers  = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+// gainDecoder maps 8-bit gainmap samples to gain factors of metadata, tables are built once
+// per image, so that gamma and exp2 are not computed per pixel.
+type gainDecoder struct {
+	meta    *GainMapMetadata
+	factors [3][256]float32
+}
+
+// newGainDecoder builds gain tables for meta, each channel uses its own gamma and content boost range.
+// It returns nil for nil meta.
+func newGainDecoder(meta *GainMapMetadata) *gainDecoder {
+	if meta == nil {
+		return nil
+	}
+	d := &gainDecoder{meta: meta}
+	for i := range d.factors {
+		logMin, logMax := boostLog2(meta.MinContentBoost[i]), boostLog2(meta.MaxContentBoost[i])
+		for v := range d.factors[i] {
+			gv := gainmapDecodeValue(uint8(v), meta.Gamma[i])
+			d.factors[i][v] = exp2f(logMin*(1.0-gv) + logMax*gv)
+		}
+	}
+	return d
+}
+
+// gainmapFactors decodes gainmap samples into per-channel gain factors.
+func (d *gainDecoder) gainmapFactors(gr, gg, gb uint8) rgb {
+	return rgb{r: d.factors[0][gr], g: d.factors[1][gg], b: d.factors[2][gb]}
 }
 
 func gainmapDecodeValue(v uint8, gamma float32) float32 {
@@ -460,8 +748,18 @@ func gainmapDecodeValue(v uint8, gamma float32) float32 {
 	return clamp01(g)
 }
 
+// boostLog2 returns log2 of content boost or HDR capacity. Invalid values (not positive
+// or not finite) are treated as no boost, so degenerate metadata never yields NaN gains.
+func boostLog2(v float32) float32 {
+	if v <= 0 || math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+		return 0
+	}
+	return log2f(v)
+}
+
+// clamp01 limits v to [0, 1], NaN is mapped to 0.
 func clamp01(v float32) float32 {
-	if v < 0 {
+	if !(v > 0) {
 		return 0
 	}
 	if v > 1 {
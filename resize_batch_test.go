@@ -2,9 +2,14 @@ package ultrahdr
 
 import (
 	"bytes"
+	"errors"
 	"image"
+	"image/jpeg"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -107,3 +112,320 @@ func TestResizeSDRCrop(t *testing.T) {
 		t.Fatalf("write output: %v", err)
 	}
 }
+
+func TestResizeHDRBatch(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+
+	sizes := [][2]uint{{300, 200}, {150, 100}, {60, 40}}
+	results := make([]*Result, len(sizes))
+	specs := make([]ResizeSpec, 0, len(sizes))
+	for i, sz := range sizes {
+		specs = append(specs, ResizeSpec{
+			Width:         sz[0],
+			Height:        sz[1],
+			Quality:       85,
+			Interpolation: InterpolationBilinear,
+			ReceiveResult: func(res *Result, err error) {
+				if err != nil {
+					t.Fatalf("resize %dx%d: %v", sz[0], sz[1], err)
+				}
+				results[i] = res
+			},
+		})
+	}
+
+	if err := ResizeHDR(bytes.NewReader(data), specs...); err != nil {
+		t.Fatalf("batch resize: %v", err)
+	}
+
+	for i, res := range results {
+		if res == nil {
+			t.Fatalf("missing result for %dx%d", sizes[i][0], sizes[i][1])
+		}
+		sr, err := Split(bytes.NewReader(res.Container))
+		if err != nil {
+			t.Fatalf("split %dx%d: %v", sizes[i][0], sizes[i][1], err)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(sr.Primary))
+		if err != nil {
+			t.Fatalf("decode primary config: %v", err)
+		}
+		if cfg.Width != int(sizes[i][0]) || cfg.Height != int(sizes[i][1]) {
+			t.Fatalf("primary dims mismatch: got %dx%d want %dx%d", cfg.Width, cfg.Height, sizes[i][0], sizes[i][1])
+		}
+	}
+}
+
+func TestResizeCustomResample(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+
+	calls := 0
+	var res *Result
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width:  120,
+		Height: 80,
+		Resample: func(src image.Image, w, h int) image.Image {
+			calls++
+			return resizeImageInterpolated(src, w, h, InterpolationBilinear)
+		},
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			res = r
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	if calls != 2 || res == nil {
+		t.Fatalf("expected custom resample for primary and gainmap, got %d calls", calls)
+	}
+
+	err = ResizeSDR(bytes.NewReader(data), ResizeSpec{
+		Width:  120,
+		Height: 80,
+		Resample: func(src image.Image, w, h int) image.Image {
+			return image.NewRGBA(image.Rect(0, 0, w+1, h))
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error for wrong custom resample size")
+	}
+}
+
+func TestResizeTransform(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+
+	for _, tc := range []struct {
+		transform Transform
+		w, h      int
+	}{
+		{transform: TransformNone, w: 120, h: 80},
+		{transform: TransformFlipH, w: 120, h: 80},
+		{transform: TransformFlipV, w: 120, h: 80},
+		{transform: TransformRotate90, w: 80, h: 120},
+		{transform: TransformRotate180, w: 120, h: 80},
+		{transform: TransformRotate270, w: 80, h: 120},
+	} {
+		var hdr, sdr *Result
+		spec := ResizeSpec{
+			Width:         120,
+			Height:        80,
+			Interpolation: InterpolationBilinear,
+			Transform:     tc.transform,
+			ReceiveResult: func(r *Result, err error) {
+				if err != nil {
+					t.Fatalf("transform %d: resize: %v", tc.transform, err)
+				}
+				hdr = r
+			},
+		}
+		if err := ResizeHDR(bytes.NewReader(data), spec); err != nil {
+			t.Fatalf("transform %d: resize hdr: %v", tc.transform, err)
+		}
+		spec.ReceiveResult = func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("transform %d: resize sdr: %v", tc.transform, err)
+			}
+			sdr = r
+		}
+		if err := ResizeSDR(bytes.NewReader(data), spec); err != nil {
+			t.Fatalf("transform %d: resize sdr: %v", tc.transform, err)
+		}
+
+		for _, r := range []*Result{hdr, sdr} {
+			if r.Resize == nil || r.Resize.Width != tc.w || r.Resize.Height != tc.h {
+				t.Fatalf("transform %d: resize info %+v, want %dx%d", tc.transform, r.Resize, tc.w, tc.h)
+			}
+		}
+		for name, jpegData := range map[string][]byte{"primary": hdr.Primary, "gainmap": hdr.Gainmap, "sdr": sdr.Primary} {
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(jpegData))
+			if err != nil {
+				t.Fatalf("transform %d: %s config: %v", tc.transform, name, err)
+			}
+			// Gainmap keeps primary orientation, its size depends on source gainmap scale.
+			if name != "gainmap" && (cfg.Width != tc.w || cfg.Height != tc.h) {
+				t.Fatalf("transform %d: %s is %dx%d, want %dx%d", tc.transform, name, cfg.Width, cfg.Height, tc.w, tc.h)
+			}
+			if name == "gainmap" && (cfg.Width > cfg.Height) != (tc.w > tc.h) {
+				t.Fatalf("transform %d: gainmap is %dx%d, not oriented as primary", tc.transform, cfg.Width, cfg.Height)
+			}
+		}
+	}
+
+	// Flip is applied to pixels: left column of flipped output matches right column of plain one.
+	var plain, flipped image.Image
+	for _, tr := range []Transform{TransformNone, TransformFlipH} {
+		err := ResizeSDR(bytes.NewReader(data), ResizeSpec{
+			Width: 120, Height: 80, Quality: 100, Transform: tr,
+			ReceiveResult: func(r *Result, err error) {
+				if err != nil {
+					t.Fatalf("resize: %v", err)
+				}
+				img, err := jpeg.Decode(bytes.NewReader(r.Primary))
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if tr == TransformNone {
+					plain = img
+				} else {
+					flipped = img
+				}
+			},
+		})
+		if err != nil {
+			t.Fatalf("resize: %v", err)
+		}
+	}
+	var diff float64
+	for y := 0; y < 80; y++ {
+		r1, _, _, _ := plain.At(119, y).RGBA()
+		r2, _, _, _ := flipped.At(0, y).RGBA()
+		diff += math.Abs(float64(r1>>8) - float64(r2>>8))
+	}
+	if diff/80 > 8 {
+		t.Fatalf("flipped output does not mirror plain one, mean diff %v", diff/80)
+	}
+}
+
+func TestResizeInfo(t *testing.T) {
+	p3, err := os.ReadFile("testdata/sample_display_p3.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	receive := func(info **ResizeInfo) func(r *Result, err error) {
+		return func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			*info = r.Resize
+		}
+	}
+
+	for _, keepMeta := range []bool{false, true} {
+		var info *ResizeInfo
+		if err := ResizeSDR(bytes.NewReader(p3), ResizeSpec{Width: 300, Height: 200, KeepMeta: keepMeta, ReceiveResult: receive(&info)}); err != nil {
+			t.Fatalf("resize: %v", err)
+		}
+		want := ResizeInfo{Width: 300, Height: 200, SourceGamut: ColorGamutDisplayP3, ConvertedToSRGB: !keepMeta}
+		if info == nil || *info != want {
+			t.Fatalf("keep meta %v: got %+v want %+v", keepMeta, info, want)
+		}
+	}
+
+	// Height is computed from aspect ratio when omitted.
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(mustSplit(t, data).Primary))
+	if err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	var info *ResizeInfo
+	if err := ResizeHDR(bytes.NewReader(data), ResizeSpec{Width: 60, ReceiveResult: receive(&info)}); err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	want := ResizeInfo{Width: 60, Height: int(math.Round(60 * float64(cfg.Height) / float64(cfg.Width))), SourceGamut: ColorGamutSRGB}
+	if info == nil || *info != want {
+		t.Fatalf("hdr: got %+v want %+v", info, want)
+	}
+}
+
+func TestResizeBatchErrors(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	// JPEG dimensions are limited to 65535, so encoding the resampled image fails.
+	tooWide := func(_ image.Image, w, h int) image.Image {
+		return image.NewGray(image.Rect(0, 0, w, h))
+	}
+
+	for name, resize := range map[string]func(r io.Reader, specs ...ResizeSpec) error{
+		"sdr": ResizeSDR,
+		"hdr": ResizeHDR,
+	} {
+		calls := make([]int, 3)
+		receive := func(i int) func(res *Result, err error) {
+			return func(res *Result, err error) {
+				calls[i]++
+				if (err == nil) != (i != 1) || (res == nil) != (i == 1) {
+					t.Fatalf("%s spec %d: unexpected result %v, %v", name, i, res != nil, err)
+				}
+			}
+		}
+		err := resize(bytes.NewReader(data),
+			ResizeSpec{Width: 64, Height: 48, ReceiveResult: receive(0)},
+			ResizeSpec{Width: 70000, Height: 1, Resample: tooWide, ReceiveResult: receive(1)},
+			ResizeSpec{Width: 32, Height: 24, ReceiveResult: receive(2)},
+		)
+		if err == nil || !strings.Contains(err.Error(), "spec 1: ") || strings.Contains(err.Error(), "spec 0") {
+			t.Fatalf("%s: expected spec 1 error, got %v", name, err)
+		}
+		for i, n := range calls {
+			if n != 1 {
+				t.Fatalf("%s spec %d: ReceiveResult called %d times", name, i, n)
+			}
+		}
+	}
+}
+
+func TestResizeMaxMemoryBytes(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := ParseJPEGHeader(sr.Primary)
+	if err != nil {
+		t.Fatalf("parse primary header: %v", err)
+	}
+	gainmap, err := ParseJPEGHeader(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("parse gainmap header: %v", err)
+	}
+	// Decoded 4:2:0 primary takes 1.5 bytes per pixel.
+	if got, want := primary.decodedBytes(), int64(primary.Width*primary.Height*3/2); math.Abs(float64(got-want)) > float64(primary.Width+primary.Height) {
+		t.Fatalf("decoded primary bytes %d, want about %d", got, want)
+	}
+	sources := primary.decodedBytes() + gainmap.decodedBytes()
+
+	for name, resize := range map[string]func(r io.Reader, specs ...ResizeSpec) error{
+		"sdr": ResizeSDR,
+		"hdr": ResizeHDR,
+	} {
+		// Limit below decoded sources rejects a spec, others are resized.
+		var rejected, resized bool
+		err := resize(bytes.NewReader(data),
+			ResizeSpec{Width: 64, Height: 48, MaxMemoryBytes: sources / 2, ReceiveResult: func(res *Result, err error) {
+				rejected = res == nil && errors.Is(err, ErrMemoryLimit)
+			}},
+			ResizeSpec{Width: 64, Height: 48, MaxMemoryBytes: 2 * sources, ReceiveResult: func(res *Result, err error) {
+				resized = err == nil && res != nil
+			}},
+		)
+		if !errors.Is(err, ErrMemoryLimit) || !strings.Contains(err.Error(), "spec 0: ") || !rejected || !resized {
+			t.Fatalf("%s: unexpected outcome %v, rejected %v, resized %v", name, err, rejected, resized)
+		}
+
+		// Destination counts too, upscaling 4x takes 16x source memory.
+		err = resize(bytes.NewReader(data), ResizeSpec{
+			Width: uint(4 * primary.Width), Height: uint(4 * primary.Height), MaxMemoryBytes: 2 * sources,
+			ReceiveSplit: func(*Result) { t.Fatalf("%s: sources decoded for rejected spec", name) },
+		})
+		if !errors.Is(err, ErrMemoryLimit) {
+			t.Fatalf("%s: expected memory limit error, got %v", name, err)
+		}
+	}
+}
@@ -91,3 +91,56 @@ func TestResizeHDRCrop(t *testing.T) {
 		t.Fatalf("write gainmap: %v", err)
 	}
 }
+
+func TestResizeHDRGainmapMaxDim(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+
+	var out *Result
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width:         120,
+		Height:        80,
+		GainmapMaxDim: 30,
+		Interpolation: InterpolationBilinear,
+		ReceiveResult: func(res *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			out = res
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(out.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap config: %v", err)
+	}
+	if cfg.Width != 30 || cfg.Height != 20 {
+		t.Fatalf("gainmap dims mismatch: got %dx%d want 30x20", cfg.Width, cfg.Height)
+	}
+	split, err := Split(bytes.NewReader(out.Container))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if !bytes.Equal(split.Gainmap[len(split.Gainmap)-2:], []byte{markerStart, markerEOI}) {
+		t.Fatalf("gainmap not terminated")
+	}
+	cfg, _, err = image.DecodeConfig(bytes.NewReader(split.Primary))
+	if err != nil {
+		t.Fatalf("decode primary config: %v", err)
+	}
+	if cfg.Width != 120 || cfg.Height != 80 {
+		t.Fatalf("primary dims mismatch: got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if w, h := gainmapTargetDims(100, 4000, 512); w != 13 || h != 512 {
+		t.Fatalf("unexpected portrait dims: %dx%d", w, h)
+	}
+	if w, h := gainmapTargetDims(400, 300, 512); w != 400 || h != 300 {
+		t.Fatalf("unexpected dims within bound: %dx%d", w, h)
+	}
+}
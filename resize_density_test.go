@@ -0,0 +1,111 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func jfifDensityPayload(units byte, xd, yd uint16) []byte {
+	p := append([]byte(nil), jfifSig...)
+	p = append(p, 1, 2, units)
+	p = binary.BigEndian.AppendUint16(p, xd)
+	p = binary.BigEndian.AppendUint16(p, yd)
+	return append(p, 0, 0)
+}
+
+func assertDensity(t *testing.T, data []byte, want []byte) {
+	t.Helper()
+	seg, ok := jfifDensitySegment(data)
+	if !ok {
+		t.Fatalf("JFIF density missing")
+	}
+	if !bytes.Equal(seg.payload, want) {
+		t.Fatalf("JFIF density mismatch: got %x want %x", seg.payload, want)
+	}
+}
+
+func TestResizeSDRPreservesDensity(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample_srgb.jpg")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	data, err = stripAppSegments(data)
+	if err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	density := jfifDensityPayload(1, 300, 300)
+	data, err = insertAppSegments(data, []appSegment{{marker: markerAPP0, payload: density}})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	for _, keepMeta := range []bool{true, false} {
+		var out []byte
+		err = ResizeSDR(bytes.NewReader(data), ResizeSpec{
+			Width: 120, Height: 80, KeepMeta: keepMeta,
+			ReceiveResult: func(res *Result, err error) {
+				if err != nil {
+					t.Fatalf("resize: %v", err)
+				}
+				out = res.Primary
+			},
+		})
+		if err != nil {
+			t.Fatalf("resize: %v", err)
+		}
+		assertDensity(t, out, density)
+	}
+
+	// Default aspect-only JFIF is not carried over.
+	if _, ok := jfifDensitySegment(mustInsertAPP0(t, data, jfifDensityPayload(0, 1, 1))); ok {
+		t.Fatalf("unexpected density for default JFIF")
+	}
+}
+
+func TestResizeHDRPreservesDensity(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	density := jfifDensityPayload(2, 118, 118)
+	data, err = insertContainerAppSegments(data, []appSegment{{marker: markerAPP0, payload: density}})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	var out *Result
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width: 100, Height: 60,
+		ReceiveResult: func(res *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			out = res
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	assertDensity(t, out.Container, density)
+	if _, _, err := DebugContainer(out.Container); err != nil {
+		t.Fatalf("mpf invalid: %v", err)
+	}
+	if _, err := Split(bytes.NewReader(out.Container)); err != nil {
+		t.Fatalf("split: %v", err)
+	}
+}
+
+func mustInsertAPP0(t *testing.T, data, payload []byte) []byte {
+	t.Helper()
+	stripped, err := stripAppSegments(data)
+	if err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	out, err := insertAppSegments(stripped, []appSegment{{marker: markerAPP0, payload: payload}})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	return out
+}
@@ -42,9 +42,16 @@ func kernelForInterpolation(interp Interpolation) kernelDef {
 	case InterpolationMitchellNetravali:
 		return kernelDef{interp: InterpolationMitchellNetravali, taps: 4, kernel: mitchellNetravaliKernel}
 	case InterpolationLanczos2:
-		return kernelDef{interp: InterpolationLanczos2, taps: 4, kernel: lanczos2Kernel}
+		return lanczosKernelDef(InterpolationLanczos2, 2)
 	case InterpolationLanczos3:
-		return kernelDef{interp: InterpolationLanczos3, taps: 6, kernel: lanczos3Kernel}
+		return lanczosKernelDef(InterpolationLanczos3, 3)
+	case InterpolationLanczos4:
+		return lanczosKernelDef(InterpolationLanczos4, 4)
+	case InterpolationHermite:
+		return kernelDef{interp: InterpolationHermite, taps: 2, kernel: hermiteKernel}
+	case InterpolationBox:
+		// Box kernel stretched by downscale factor covers whole source area of output pixel.
+		return kernelDef{interp: InterpolationBox, taps: 2, kernel: nearestKernel}
 	default:
 		return kernelDef{interp: InterpolationNearest, taps: 2, kernel: nearestKernel}
 	}
@@ -161,10 +168,9 @@ func resamplePlane8(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def kern
 	wx := getWeights(srcW, dstW, def, scaleX)
 	wy := getWeights(srcH, dstH, def, scaleY)
 
-	temp := getFloat32(dstW * srcH)
-	for y := 0; y < srcH; y++ {
+	out := make([]uint8, dstW*dstH)
+	resampleStrips(srcH, dstH, dstW, wy, func(y int, outRow []float32) {
 		row := src[y*srcStride:]
-		outRow := temp[y*dstW:]
 		for x := 0; x < dstW; x++ {
 			s := wx.start[x]
 			base := x * wx.filterLength
@@ -180,29 +186,57 @@ func resamplePlane8(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def kern
 			}
 			outRow[x] = sum
 		}
-	}
-
-	out := make([]uint8, dstW*dstH)
-	for y := 0; y < dstH; y++ {
-		s := wy.start[y]
+	}, func(y int, rows [][]float32) {
 		base := y * wy.filterLength
 		row := out[y*dstW:]
 		for x := 0; x < dstW; x++ {
 			var sum float32
-			for i := 0; i < wy.filterLength; i++ {
-				yi := s + i
-				if yi < 0 {
-					yi = 0
-				} else if yi >= srcH {
-					yi = srcH - 1
-				}
-				sum += temp[yi*dstW+x] * wy.coeffs[base+i]
+			for i, r := range rows {
+				sum += r[x] * wy.coeffs[base+i]
 			}
 			row[x] = clampToByte(sum)
 		}
-	}
+	})
+	return out
+}
 
-	putFloat32(temp)
+// resampleRowsF32 resamples float32 rows of channels interleaved samples, source rows are produced
+// on demand by srcRow, so that full resolution source is never held in memory.
+func resampleRowsF32(srcW, srcH, channels, dstW, dstH int, def kernelDef, srcRow func(y int, row []float32)) []float32 {
+	scaleX := float64(srcW) / float64(dstW)
+	scaleY := float64(srcH) / float64(dstH)
+	wx := getWeights(srcW, dstW, def, scaleX)
+	wy := getWeights(srcH, dstH, def, scaleY)
+
+	rowLen := dstW * channels
+	out := make([]float32, dstH*rowLen)
+	resampleStrips(srcH, dstH, rowLen, wy, func(y int, outRow []float32) {
+		src := getFloat32(srcW * channels)
+		defer putFloat32(src)
+		srcRow(y, src)
+		for x := 0; x < dstW; x++ {
+			s := wx.start[x]
+			base := x * wx.filterLength
+			for c := 0; c < channels; c++ {
+				var sum float32
+				for i := 0; i < wx.filterLength; i++ {
+					xi := min(max(s+i, 0), srcW-1)
+					sum += src[xi*channels+c] * wx.coeffs[base+i]
+				}
+				outRow[x*channels+c] = sum
+			}
+		}
+	}, func(y int, rows [][]float32) {
+		base := y * wy.filterLength
+		row := out[y*rowLen : (y+1)*rowLen]
+		for x := range row {
+			var sum float32
+			for i, r := range rows {
+				sum += r[x] * wy.coeffs[base+i]
+			}
+			row[x] = sum
+		}
+	})
 	return out
 }
 
@@ -212,10 +246,9 @@ func resamplePlane16(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def ker
 	wx := getWeights(srcW, dstW, def, scaleX)
 	wy := getWeights(srcH, dstH, def, scaleY)
 
-	temp := getFloat32(dstW * srcH)
-	for y := 0; y < srcH; y++ {
+	out := make([]uint16, dstW*dstH)
+	resampleStrips(srcH, dstH, dstW, wy, func(y int, outRow []float32) {
 		row := src[y*srcStride:]
-		outRow := temp[y*dstW:]
 		for x := 0; x < dstW; x++ {
 			s := wx.start[x]
 			base := x * wx.filterLength
@@ -233,29 +266,17 @@ func resamplePlane16(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def ker
 			}
 			outRow[x] = sum
 		}
-	}
-
-	out := make([]uint16, dstW*dstH)
-	for y := 0; y < dstH; y++ {
-		s := wy.start[y]
+	}, func(y int, rows [][]float32) {
 		base := y * wy.filterLength
 		row := out[y*dstW:]
 		for x := 0; x < dstW; x++ {
 			var sum float32
-			for i := 0; i < wy.filterLength; i++ {
-				yi := s + i
-				if yi < 0 {
-					yi = 0
-				} else if yi >= srcH {
-					yi = srcH - 1
-				}
-				sum += temp[yi*dstW+x] * wy.coeffs[base+i]
+			for i, r := range rows {
+				sum += r[x] * wy.coeffs[base+i]
 			}
 			row[x] = clampToUint16(sum)
 		}
-	}
-
-	putFloat32(temp)
+	})
 	return out
 }
 
@@ -265,10 +286,9 @@ func resampleRGBA8(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def kerne
 	wx := getWeights(srcW, dstW, def, scaleX)
 	wy := getWeights(srcH, dstH, def, scaleY)
 
-	temp := getFloat32(dstW * srcH * 4)
-	for y := 0; y < srcH; y++ {
+	out := make([]uint8, dstW*dstH*4)
+	resampleStrips(srcH, dstH, dstW*4, wy, func(y int, outRow []float32) {
 		row := src[y*srcStride:]
-		outRow := temp[y*dstW*4:]
 		for x := 0; x < dstW; x++ {
 			s := wx.start[x]
 			base := x * wx.filterLength
@@ -293,38 +313,25 @@ func resampleRGBA8(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def kerne
 			outRow[outOff+2] = b
 			outRow[outOff+3] = a
 		}
-	}
-
-	out := make([]uint8, dstW*dstH*4)
-	for y := 0; y < dstH; y++ {
-		s := wy.start[y]
+	}, func(y int, rows [][]float32) {
 		base := y * wy.filterLength
 		row := out[y*dstW*4:]
 		for x := 0; x < dstW; x++ {
+			off := x * 4
 			var r, g, b, a float32
-			for i := 0; i < wy.filterLength; i++ {
-				yi := s + i
-				if yi < 0 {
-					yi = 0
-				} else if yi >= srcH {
-					yi = srcH - 1
-				}
-				off := (yi*dstW + x) * 4
+			for i, t := range rows {
 				w := wy.coeffs[base+i]
-				r += temp[off+0] * w
-				g += temp[off+1] * w
-				b += temp[off+2] * w
-				a += temp[off+3] * w
+				r += t[off+0] * w
+				g += t[off+1] * w
+				b += t[off+2] * w
+				a += t[off+3] * w
 			}
-			outOff := x * 4
-			row[outOff+0] = clampToByte(r)
-			row[outOff+1] = clampToByte(g)
-			row[outOff+2] = clampToByte(b)
-			row[outOff+3] = clampToByte(a)
+			row[off+0] = clampToByte(r)
+			row[off+1] = clampToByte(g)
+			row[off+2] = clampToByte(b)
+			row[off+3] = clampToByte(a)
 		}
-	}
-
-	putFloat32(temp)
+	})
 	return out
 }
 
@@ -334,10 +341,9 @@ func resampleRGBA16(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def kern
 	wx := getWeights(srcW, dstW, def, scaleX)
 	wy := getWeights(srcH, dstH, def, scaleY)
 
-	temp := getFloat32(dstW * srcH * 4)
-	for y := 0; y < srcH; y++ {
+	out := make([]uint16, dstW*dstH*4)
+	resampleStrips(srcH, dstH, dstW*4, wy, func(y int, outRow []float32) {
 		row := src[y*srcStride:]
-		outRow := temp[y*dstW*4:]
 		for x := 0; x < dstW; x++ {
 			s := wx.start[x]
 			base := x * wx.filterLength
@@ -362,41 +368,61 @@ func resampleRGBA16(src []uint8, srcW, srcH, srcStride, dstW, dstH int, def kern
 			outRow[outOff+2] = b
 			outRow[outOff+3] = a
 		}
-	}
-
-	out := make([]uint16, dstW*dstH*4)
-	for y := 0; y < dstH; y++ {
-		s := wy.start[y]
+	}, func(y int, rows [][]float32) {
 		base := y * wy.filterLength
 		row := out[y*dstW*4:]
 		for x := 0; x < dstW; x++ {
+			off := x * 4
 			var r, g, b, a float32
-			for i := 0; i < wy.filterLength; i++ {
-				yi := s + i
-				if yi < 0 {
-					yi = 0
-				} else if yi >= srcH {
-					yi = srcH - 1
-				}
-				off := (yi*dstW + x) * 4
+			for i, t := range rows {
 				w := wy.coeffs[base+i]
-				r += temp[off+0] * w
-				g += temp[off+1] * w
-				b += temp[off+2] * w
-				a += temp[off+3] * w
+				r += t[off+0] * w
+				g += t[off+1] * w
+				b += t[off+2] * w
+				a += t[off+3] * w
 			}
-			outOff := x * 4
-			row[outOff+0] = clampToUint16(r)
-			row[outOff+1] = clampToUint16(g)
-			row[outOff+2] = clampToUint16(b)
-			row[outOff+3] = clampToUint16(a)
+			row[off+0] = clampToUint16(r)
+			row[off+1] = clampToUint16(g)
+			row[off+2] = clampToUint16(b)
+			row[off+3] = clampToUint16(a)
 		}
-	}
-
-	putFloat32(temp)
+	})
 	return out
 }
 
+// resampleStrips runs separable filter passes for destination rows in parallel strips.
+// Horizontal pass results (rowLen floats per source row) are kept in a per-worker ring
+// of wy.filterLength rows, which covers the vertical filter footprint of one destination
+// row, so temporary memory does not depend on source height. Source rows are visited in
+// increasing order and each one is resampled horizontally once per worker.
+func resampleStrips(srcH, dstH, rowLen int, wy resampleWeights, horizontal func(y int, out []float32), vertical func(y int, rows [][]float32)) {
+	fl := wy.filterLength
+	parallelFor(dstH, func(_, start, end int) {
+		ring := getFloat32(fl * rowLen)
+		defer putFloat32(ring)
+		loaded := make([]int, fl)
+		for i := range loaded {
+			loaded[i] = -1
+		}
+		rows := make([][]float32, fl)
+		for y := start; y < end; y++ {
+			s := wy.start[y]
+			for i := 0; i < fl; i++ {
+				// Rows of the footprint are distinct modulo fl, so they never evict each other.
+				yi := min(max(s+i, 0), srcH-1)
+				slot := yi % fl
+				row := ring[slot*rowLen : (slot+1)*rowLen]
+				if loaded[slot] != yi {
+					horizontal(yi, row)
+					loaded[slot] = yi
+				}
+				rows[i] = row
+			}
+			vertical(y, rows)
+		}
+	})
+}
+
 func getWeights(src, dst int, def kernelDef, scale float64) resampleWeights {
 	if src <= 0 || dst <= 0 {
 		return resampleWeights{}
@@ -468,6 +494,14 @@ func linearKernel(in float64) float64 {
 	return 0
 }
 
+func hermiteKernel(in float64) float64 {
+	in = math.Abs(in)
+	if in <= 1 {
+		return (2*in-3)*in*in + 1
+	}
+	return 0
+}
+
 func cubicKernel(in float64) float64 {
 	in = math.Abs(in)
 	if in <= 1 {
@@ -498,18 +532,19 @@ func sinc(x float64) float64 {
 	return 1
 }
 
-func lanczos2Kernel(in float64) float64 {
-	if in > -2 && in < 2 {
-		return sinc(in) * sinc(in*0.5)
-	}
-	return 0
+// lanczosKernelDef returns Lanczos kernel with support a (2a taps).
+func lanczosKernelDef(interp Interpolation, a int) kernelDef {
+	return kernelDef{interp: interp, taps: 2 * a, kernel: lanczosKernel(float64(a))}
 }
 
-func lanczos3Kernel(in float64) float64 {
-	if in > -3 && in < 3 {
-		return sinc(in) * sinc(in*0.3333333333333333)
+func lanczosKernel(a float64) func(float64) float64 {
+	invA := 1 / a
+	return func(in float64) float64 {
+		if in > -a && in < a {
+			return sinc(in) * sinc(in*invA)
+		}
+		return 0
 	}
-	return 0
 }
 
 func clampToByte(v float32) uint8 {
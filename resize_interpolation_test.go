@@ -0,0 +1,98 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"runtime"
+	"testing"
+)
+
+func TestHermiteInterpolation(t *testing.T) {
+	for _, f := range []float64{0, 0.25, 0.5, 0.75} {
+		if sum := hermiteKernel(f) + hermiteKernel(f-1); math.Abs(sum-1) > 1e-9 {
+			t.Fatalf("weights at %v sum to %v", f, sum)
+		}
+	}
+
+	// Upscaled ramp must stay monotonic and within source range (no ringing).
+	src := image.NewGray(image.Rect(0, 0, 8, 1))
+	for x := range src.Pix {
+		src.Pix[x] = uint8(x * 30)
+	}
+	dst := resizeGrayInterpolated(src, 32, 1, InterpolationHermite)
+	for x := 1; x < 32; x++ {
+		if dst.Pix[x] < dst.Pix[x-1] {
+			t.Fatalf("not monotonic at %d: %v", x, dst.Pix)
+		}
+	}
+	if dst.Pix[0] < src.Pix[0] || dst.Pix[31] > src.Pix[7] {
+		t.Fatalf("out of source range: %v", dst.Pix)
+	}
+}
+
+func TestLanczosKernel(t *testing.T) {
+	// Generic kernel matches former hard-coded a=2 and a=3 kernels bit for bit.
+	for in := -4.0; in <= 4; in += 0.0625 {
+		want2, want3 := 0.0, 0.0
+		if in > -2 && in < 2 {
+			want2 = sinc(in) * sinc(in*0.5)
+		}
+		if in > -3 && in < 3 {
+			want3 = sinc(in) * sinc(in*0.3333333333333333)
+		}
+		if got := kernelForInterpolation(InterpolationLanczos2).kernel(in); got != want2 {
+			t.Fatalf("lanczos2(%v): got %v want %v", in, got, want2)
+		}
+		if got := kernelForInterpolation(InterpolationLanczos3).kernel(in); got != want3 {
+			t.Fatalf("lanczos3(%v): got %v want %v", in, got, want3)
+		}
+	}
+
+	def := kernelForInterpolation(InterpolationLanczos4)
+	if def.interp != InterpolationLanczos4 || def.taps != 8 {
+		t.Fatalf("unexpected lanczos4 definition: %v taps", def.taps)
+	}
+	if def.kernel(0) != 1 || def.kernel(4) != 0 || def.kernel(-4.5) != 0 || def.kernel(3.5) == 0 {
+		t.Fatalf("unexpected lanczos4 support")
+	}
+
+	// Flat image stays flat.
+	src := image.NewGray(image.Rect(0, 0, 40, 30))
+	for i := range src.Pix {
+		src.Pix[i] = 117
+	}
+	dst := resizeGrayInterpolated(src, 13, 7, InterpolationLanczos4)
+	for i, v := range dst.Pix {
+		if v != 117 {
+			t.Fatalf("pixel %d: got %d", i, v)
+		}
+	}
+}
+
+func TestResampleTallImageMemory(t *testing.T) {
+	// Full height horizontal pass would need 256*12000*4 floats (~49MB).
+	src := image.NewRGBA(image.Rect(0, 0, 128, 12000))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i ^ i>>9)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	dst := resizeRGBAInterpolated(src, 256, 300, InterpolationBicubic)
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+		t.Fatalf("resize allocated %d bytes", alloc)
+	}
+
+	// Strips split among workers must not change results.
+	procs := runtime.GOMAXPROCS(max(runtime.GOMAXPROCS(0), 4))
+	multi := resizeRGBAInterpolated(src, 256, 300, InterpolationBicubic)
+	runtime.GOMAXPROCS(1)
+	single := resizeRGBAInterpolated(src, 256, 300, InterpolationBicubic)
+	runtime.GOMAXPROCS(procs)
+	if !bytes.Equal(dst.Pix, multi.Pix) || !bytes.Equal(dst.Pix, single.Pix) {
+		t.Fatalf("results depend on number of workers")
+	}
+}
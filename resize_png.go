@@ -0,0 +1,166 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+// ResizePNG resizes one image (PNG, JPEG or TIFF) into PNG outputs with a single source decode,
+// alpha channel is preserved. Pixels are resampled with premultiplied alpha, so that colors
+// of transparent pixels do not bleed into edges, 16-bit sources produce 16-bit PNGs.
+// Source ICC profile (PNG iCCP or JPEG APP2) is embedded as iCCP chunk when KeepMeta is true,
+// otherwise wide gamut colors are converted to sRGB and output is metadata-free.
+// JPEG encoding fields of spec (Quality, Progressive, Subsampling, etc.) are ignored.
+func ResizePNG(r io.Reader, specs ...ResizeSpec) error {
+	if len(specs) == 0 {
+		return errors.New("no resize specs provided")
+	}
+	if r == nil {
+		return errors.New("missing input reader")
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var icc []byte
+	switch {
+	case bytes.HasPrefix(data, pngSig):
+		icc, err = pngICCProfile(data)
+	case isJPEG(data):
+		var segs [][]byte
+		_, segs, err = extractExifAndIcc(data)
+		icc = collectICCProfile(segs)
+	}
+	if err != nil {
+		return err
+	}
+	srcProfile := detectColorProfileFromICCProfile(icc)
+
+	srcImg, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	srcBounds := srcImg.Bounds()
+
+	return resizeSpecs(specs, func(_ int, spec ResizeSpec) (*Result, error) {
+		cropRect := srcBounds
+		if spec.Crop != nil {
+			cropRect = *spec.Crop
+		}
+		cropped, err := cropImage(srcImg, cropRect)
+		if err != nil {
+			return nil, err
+		}
+		width, height, err := resolveResizeDims(spec, cropRect.Dx(), cropRect.Dy())
+		if err != nil {
+			return nil, err
+		}
+		resized := cropped
+		if cropRect.Dx() != int(width) || cropRect.Dy() != int(height) {
+			if resized, err = spec.resample(premultipliedImage(cropped), int(width), int(height), spec.Interpolation); err != nil {
+				return nil, err
+			}
+		}
+		resized = spec.Transform.apply(resized)
+
+		dstProfile := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+		if spec.KeepMeta {
+			dstProfile = srcProfile
+		}
+		converted := resized
+		if dstProfile != srcProfile {
+			converted = convertImageProfileAlpha(converted, srcProfile, dstProfile, spec.ExactTransfer)
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, converted); err != nil {
+			return nil, fmt.Errorf("encode: %w", err)
+		}
+		out := buf.Bytes()
+		if spec.KeepMeta && len(icc) > 0 {
+			if out, err = insertPNGChunk(out, "iCCP", pngICCPPayload(icc)); err != nil {
+				return nil, fmt.Errorf("insert metadata: %w", err)
+			}
+		}
+		info := &ResizeInfo{
+			Width:           converted.Bounds().Dx(),
+			Height:          converted.Bounds().Dy(),
+			SourceGamut:     srcProfile.gamut,
+			ConvertedToSRGB: dstProfile != srcProfile,
+		}
+		return &Result{Container: out, Primary: out, Resize: info}, nil
+	})
+}
+
+// premultipliedImage converts images with straight alpha to premultiplied RGBA or RGBA64 for resampling,
+// so that built-in resamplers weight colors by coverage. Other images are returned as is.
+func premultipliedImage(img image.Image) image.Image {
+	var dst draw.Image
+	switch src := img.(type) {
+	case *image.NRGBA, *image.Paletted:
+		dst = image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	case *image.NRGBA64:
+		dst = image.NewRGBA64(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	default:
+		return img
+	}
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+// convertImageProfileAlpha is like convertImageProfile, but converts straight (not premultiplied)
+// colors and keeps alpha, so that translucent pixels keep their color. 16-bit images produce NRGBA64.
+func convertImageProfileAlpha(img image.Image, from, to colorProfile, exact bool) image.Image {
+	b := img.Bounds()
+	deep := false
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		deep = true
+	}
+	var out draw.Image = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if deep {
+		out = image.NewNRGBA64(out.Bounds())
+	}
+	parallelFor(b.Dy(), func(_, startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := color.NRGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+				v := convertLinearGamut(rgb{
+					r: invOETF16(uint32(c.R), from.transfer, exact),
+					g: invOETF16(uint32(c.G), from.transfer, exact),
+					b: invOETF16(uint32(c.B), from.transfer, exact),
+				}, from.gamut, to.gamut)
+				if deep {
+					out.Set(x, y, color.NRGBA64{R: oETF16(v.r, to.transfer), G: oETF16(v.g, to.transfer), B: oETF16(v.b, to.transfer), A: c.A})
+				} else {
+					out.Set(x, y, color.NRGBA{R: oETF8(v.r, to.transfer, exact), G: oETF8(v.g, to.transfer, exact), B: oETF8(v.b, to.transfer, exact), A: uint8(c.A >> 8)})
+				}
+			}
+		}
+	})
+	return out
+}
+
+// oETF16 encodes linear value to 16-bit with transfer.
+func oETF16(v float32, transfer ColorTransfer) uint16 {
+	return uint16(clamp01(oETF(v, transfer))*0xFFFF + 0.5)
+}
+
+// pngICCPPayload builds iCCP chunk payload: profile name, null separator, zlib compression method and
+// compressed profile.
+func pngICCPPayload(icc []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("ICC Profile\x00\x00")
+	zw := zlib.NewWriter(&buf)
+	_, _ = zw.Write(icc)
+	_ = zw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,115 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestResizePNG(t *testing.T) {
+	// Opaque red on the left, fully transparent green on the right.
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if x < 4 {
+				src.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+			} else {
+				src.SetNRGBA(x, y, color.NRGBA{G: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	resize := func(data []byte, spec ResizeSpec) (*Result, image.Image) {
+		t.Helper()
+		var res *Result
+		spec.ReceiveResult = func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			res = r
+		}
+		if err := ResizePNG(bytes.NewReader(data), spec); err != nil {
+			t.Fatalf("resize: %v", err)
+		}
+		img, err := png.Decode(bytes.NewReader(res.Container))
+		if err != nil {
+			t.Fatalf("decode output: %v", err)
+		}
+		return res, img
+	}
+
+	_, img := resize(buf.Bytes(), ResizeSpec{Width: 5, Height: 4, Interpolation: InterpolationBilinear})
+	out, ok := img.(*image.NRGBA)
+	if !ok || out.Bounds().Dx() != 5 || out.Bounds().Dy() != 4 {
+		t.Fatalf("unexpected output %T %v", img, img.Bounds())
+	}
+	if c := out.NRGBAAt(0, 0); c != (color.NRGBA{R: 255, A: 255}) {
+		t.Fatalf("opaque pixel %v", c)
+	}
+	if c := out.NRGBAAt(4, 0); c.A != 0 {
+		t.Fatalf("transparent pixel %v", c)
+	}
+	// Edge pixels mix coverage, but transparent green must not bleed into color.
+	c := out.NRGBAAt(2, 0)
+	if c.A == 0 || c.A == 255 || c.R < 250 || c.G > 5 {
+		t.Fatalf("edge pixel %v", c)
+	}
+
+	// Display P3 source is converted to sRGB with alpha intact, or kept with iCCP chunk.
+	p3 := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	p3.SetNRGBA(0, 0, color.NRGBA{R: 200, G: 100, B: 50, A: 255})
+	p3.SetNRGBA(1, 0, color.NRGBA{R: 200, G: 100, B: 50, A: 128})
+	buf.Reset()
+	if err := png.Encode(&buf, p3); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	icc := []byte("fake profile: Display P3")
+	data, err := insertPNGChunk(buf.Bytes(), "iCCP", pngICCPPayload(icc))
+	if err != nil {
+		t.Fatalf("insert iCCP: %v", err)
+	}
+
+	res, img := resize(data, ResizeSpec{Width: 2, Height: 1})
+	if !res.Resize.ConvertedToSRGB || res.Resize.SourceGamut != ColorGamutDisplayP3 {
+		t.Fatalf("unexpected info %+v", res.Resize)
+	}
+	if profile, err := pngICCProfile(res.Container); err != nil || profile != nil {
+		t.Fatalf("converted output has ICC profile: %v", err)
+	}
+	opaque, translucent := img.(*image.NRGBA).NRGBAAt(0, 0), img.(*image.NRGBA).NRGBAAt(1, 0)
+	if opaque.R == 200 && opaque.G == 100 {
+		t.Fatalf("colors were not converted: %v", opaque)
+	}
+	if translucent.A != 128 || translucent.R != opaque.R || translucent.G != opaque.G || translucent.B != opaque.B {
+		t.Fatalf("translucent pixel %v, opaque %v", translucent, opaque)
+	}
+
+	res, img = resize(data, ResizeSpec{Width: 2, Height: 1, KeepMeta: true})
+	if res.Resize.ConvertedToSRGB {
+		t.Fatalf("unexpected conversion with KeepMeta")
+	}
+	if profile, err := pngICCProfile(res.Container); err != nil || !bytes.Equal(profile, icc) {
+		t.Fatalf("ICC profile %q not kept: %v", profile, err)
+	}
+	if c := img.(*image.NRGBA).NRGBAAt(1, 0); c != (color.NRGBA{R: 200, G: 100, B: 50, A: 128}) {
+		t.Fatalf("kept pixel %v", c)
+	}
+
+	// 16-bit sources produce 16-bit output.
+	deep := image.NewNRGBA64(image.Rect(0, 0, 4, 4))
+	for i := range deep.Pix {
+		deep.Pix[i] = 0x80
+	}
+	buf.Reset()
+	if err := png.Encode(&buf, deep); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, img := resize(buf.Bytes(), ResizeSpec{Width: 2, Height: 2, Interpolation: InterpolationLanczos2}); img.ColorModel() != color.NRGBA64Model {
+		t.Fatalf("unexpected 16-bit output model %T", img)
+	}
+}
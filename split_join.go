@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"image"
 	"io"
 )
 
@@ -15,13 +17,37 @@ type Result struct {
 	Gainmap   []byte
 	Meta      *GainMapMetadata
 	Segs      *MetadataSegments
+	// Warnings lists recoverable metadata problems, e.g. invalid ISO metadata with valid XMP fallback.
+	Warnings []string
+	// Resize describes output of ResizeHDR and ResizeSDR, it is nil for other operations.
+	Resize *ResizeInfo
+}
+
+var errTruncatedPrimary = fmt.Errorf("container %w: primary image incomplete", ErrTruncated)
+
+// SplitOptions controls SplitWithOptions.
+type SplitOptions struct {
+	// DisplayWithoutMetadata takes the image without gainmap metadata segments as primary (display)
+	// image regardless of MPF attributes, for producers that mark the gainmap as MPF primary.
+	// MPF order is kept when both or neither image carry gainmap metadata.
+	DisplayWithoutMetadata bool
 }
 
 // Split extracts primary/gainmap JPEGs, metadata, and raw XMP/ISO segments.
+// Errors match ErrNotJPEG, ErrNoGainmap, ErrNoGainmapMetadata or ErrTruncated for the
+// corresponding problems of input.
 func Split(r io.Reader) (*Result, error) {
+	return SplitWithOptions(r, nil)
+}
+
+// SplitWithOptions is like Split, but can assign image roles by gainmap metadata.
+func SplitWithOptions(r io.Reader, opt *SplitOptions) (*Result, error) {
 	if r == nil {
 		return nil, errors.New("missing reader")
 	}
+	if opt == nil {
+		opt = &SplitOptions{}
+	}
 
 	br := bufio.NewReader(r)
 	res := Result{Segs: &MetadataSegments{}}
@@ -34,49 +60,321 @@ func Split(r io.Reader) (*Result, error) {
 	)
 
 	if err := scanToSOI(br, &res.Primary); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: SOI marker not found", ErrNotJPEG)
+		}
 		return nil, err
 	}
 	if err := readJPEGFromSOI(br, &res.Primary, &primaryApp1, &primaryApp2, true); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTruncatedPrimary
+		}
 		return nil, err
 	}
 	if err := scanToSOI(br, &res.Gainmap); err != nil {
-		return nil, errors.New("gainmap image not found")
+		return nil, ErrNoGainmap
 	}
 	if err := readJPEGFromSOI(br, &res.Gainmap, &gainmapApp1, &gainmapApp2, false); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrTruncatedGainmap
+		}
 		return nil, err
 	}
 
-	res.Segs.PrimaryXMP = findXMP(primaryApp1)
-	res.Segs.PrimaryISO = findISO(primaryApp2)
-	res.Segs.SecondaryXMP = findXMP(gainmapApp1)
-	res.Segs.SecondaryISO = findISO(gainmapApp2)
+	swap := !firstImageIsPrimary(primaryApp2)
+	if swap || opt.DisplayWithoutMetadata {
+		// Re-read APP segments as capture stops at MPF of the first image.
+		var err error
+		if primaryApp1, primaryApp2, err = extractAppSegments(res.Primary); err != nil {
+			return nil, err
+		}
+		if gainmapApp1, gainmapApp2, err = extractAppSegments(res.Gainmap); err != nil {
+			return nil, err
+		}
+	}
+	if opt.DisplayWithoutMetadata {
+		first := hasGainmapMetadata(primaryApp1, primaryApp2)
+		if first != hasGainmapMetadata(gainmapApp1, gainmapApp2) {
+			swap = first
+		}
+	}
+	if swap {
+		res.Primary, res.Gainmap = res.Gainmap, res.Primary
+		primaryApp1, gainmapApp1 = gainmapApp1, primaryApp1
+		primaryApp2, gainmapApp2 = gainmapApp2, primaryApp2
+	}
+
+	if err := parseSplitMetadata(&res, primaryApp1, primaryApp2, gainmapApp1, gainmapApp2); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
 
-	var err error
-	if iso := res.Segs.SecondaryISO; iso != nil {
-		payload := iso[len(isoNamespace)+1:]
-		res.Meta, err = decodeGainmapMetadataISO(payload)
-		if err != nil {
+// SplitView is like Split, but takes complete container data and does not copy it.
+// Primary, Gainmap and metadata segments of the result are sub-slices that alias data,
+// so data must be kept alive and must not be modified while the result is in use.
+// It is intended for read-only pipelines (detection, analysis) on large inputs.
+func SplitView(data []byte) (*Result, error) {
+	ranges, err := scanJPEGs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) < 2 {
+		return nil, ErrNoGainmap
+	}
+	// Capacity is capped, so that appending to a view does not overwrite data.
+	res := Result{
+		Primary: data[ranges[0][0]:ranges[0][1]:ranges[0][1]],
+		Gainmap: data[ranges[1][0]:ranges[1][1]:ranges[1][1]],
+		Segs:    &MetadataSegments{},
+	}
+	primaryApp1, primaryApp2, err := appSegmentViews(res.Primary)
+	if err != nil {
+		return nil, err
+	}
+	gainmapApp1, gainmapApp2, err := appSegmentViews(res.Gainmap)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseSplitMetadata(&res, primaryApp1, primaryApp2, gainmapApp1, gainmapApp2); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RecoverPrimary is like Split, but tolerates a container truncated inside (or before) the gainmap
+// image, e.g. by an interrupted upload. In that case it returns a result with the intact primary
+// image and its metadata segments (Gainmap is empty, Meta is set only if primary carries gainmap
+// metadata) together with ErrTruncatedGainmap. Other errors, including a truncated primary image,
+// are returned as by Split.
+func RecoverPrimary(data []byte) (*Result, error) {
+	sr, err := Split(bytes.NewReader(data))
+	if err == nil {
+		return sr, nil
+	}
+	start := bytes.Index(data, []byte{markerStart, markerSOI})
+	if start < 0 {
+		return nil, err
+	}
+	end, endErr := findJPEGEnd(data, start)
+	if endErr != nil {
+		return nil, err
+	}
+	res := Result{Primary: append([]byte(nil), data[start:end]...), Segs: &MetadataSegments{}}
+	app1, app2, appErr := extractAppSegments(res.Primary)
+	if appErr != nil {
+		return nil, err
+	}
+	if !errors.Is(err, ErrTruncatedGainmap) {
+		// Data may also end before gainmap SOI, MPF of primary tells if a gainmap was expected.
+		declared := false
+		for _, seg := range app2 {
+			if bytes.HasPrefix(seg, mpfSig) {
+				info, mpfErr := parseMPF(seg)
+				declared = mpfErr == nil && info.secondarySize > 0
+				break
+			}
+		}
+		if !declared || bytes.Contains(data[end:], []byte{markerStart, markerSOI}) {
 			return nil, err
 		}
-		return &res, nil
 	}
-	if xmp := res.Segs.SecondaryXMP; xmp != nil {
-		res.Meta, err = parseXMP(xmp)
+	if !firstImageIsPrimary(app2) {
+		return nil, errTruncatedPrimary
+	}
+	res.Segs.PrimaryXMP = findXMP(app1)
+	res.Segs.PrimaryISO = findISO(app2)
+	res.Meta = primaryGainmapMetadata(res.Segs)
+	return &res, ErrTruncatedGainmap
+}
+
+// parseSplitMetadata finds raw XMP/ISO segments and decodes gainmap metadata,
+// gainmap image segments take precedence over primary ones. Invalid ISO metadata
+// falls back to valid XMP (or primary) metadata with a warning.
+func parseSplitMetadata(sr *Result, primaryApp1, primaryApp2, gainmapApp1, gainmapApp2 [][]byte) error {
+	sr.Segs.PrimaryXMP = findXMP(primaryApp1)
+	sr.Segs.PrimaryISO = findISO(primaryApp2)
+	sr.Segs.SecondaryXMP = findXMP(gainmapApp1)
+	sr.Segs.SecondaryISO = findISO(gainmapApp2)
+
+	var firstErr error
+	if iso := sr.Segs.SecondaryISO; iso != nil {
+		payload := iso[len(isoNamespace)+1:]
+		meta, err := decodeGainmapMetadataISO(payload)
+		if err == nil {
+			sr.Meta = meta
+			return nil
+		}
+		firstErr = fmt.Errorf("gainmap ISO metadata: %w", err)
+	}
+	if xmp := sr.Segs.SecondaryXMP; xmp != nil {
+		meta, err := parseXMP(xmp)
+		if err == nil {
+			sr.Meta = meta
+			if firstErr != nil {
+				sr.Warnings = append(sr.Warnings, firstErr.Error()+", using XMP metadata")
+			}
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if meta := primaryGainmapMetadata(sr.Segs); meta != nil {
+		sr.Meta = meta
+		if firstErr != nil {
+			sr.Warnings = append(sr.Warnings, firstErr.Error()+", using primary image metadata")
+		}
+		return nil
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return ErrNoGainmapMetadata
+}
+
+// firstImageIsPrimary checks MPF of the first image for the primary image type.
+// By MPF spec the first image has zero offset, so gainmap comes first when the
+// primary entry points elsewhere. Missing or invalid MPF keeps positional order.
+func firstImageIsPrimary(app2 [][]byte) bool {
+	for _, seg := range app2 {
+		if !bytes.HasPrefix(seg, mpfSig) {
+			continue
+		}
+		info, err := parseMPF(seg)
 		if err != nil {
-			return nil, err
+			return true
+		}
+		return info.primaryOffset == 0 || info.secondaryOffset != 0
+	}
+	return true
+}
+
+// hasGainmapMetadata checks if APP segments of an image carry decodable gainmap metadata,
+// version-only ISO blocks and container-only XMP packets of primary images do not count.
+func hasGainmapMetadata(app1, app2 [][]byte) bool {
+	return primaryGainmapMetadata(&MetadataSegments{PrimaryXMP: findXMP(app1), PrimaryISO: findISO(app2)}) != nil
+}
+
+// primaryGainmapMetadata parses gainmap metadata stored on the primary image.
+// Some producers put the full ISO/XMP metadata on the primary instead of the gainmap.
+// A version-only ISO block or a container-only XMP packet yields nil.
+func primaryGainmapMetadata(segs *MetadataSegments) *GainMapMetadata {
+	if segs == nil {
+		return nil
+	}
+	if iso := segs.PrimaryISO; len(iso) > len(isoPrefix)+4 {
+		if meta, err := decodeGainmapMetadataISO(iso[len(isoPrefix):]); err == nil {
+			return meta
+		}
+	}
+	if xmp := segs.PrimaryXMP; xmp != nil {
+		if meta, err := parseXMP(xmp); err == nil {
+			return meta
 		}
-		return &res, nil
 	}
-	return nil, errors.New("no gainmap metadata found")
+	return nil
 }
 
 // Join assembles a JPEG/R container using raw metadata segments.
-// PrimaryXMP is updated to reflect the new gainmap length.
+// PrimaryXMP is updated to reflect the new gainmap length. When segments have only one of
+// gainmap XMP and ISO metadata, the other one is synthesized from it.
 func (sr Result) Join() ([]byte, error) {
+	var out bytes.Buffer
+	if err := sr.WriteJoined(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// WriteJoined is like Join, but writes the container to w. MPF is computed up front,
+// so that image data is written to w as is.
+func (sr Result) WriteJoined(w io.Writer) error {
 	if sr.Segs == nil {
-		return nil, errors.New("segments required")
+		return errors.New("segments required")
+	}
+	segs := *sr.Segs
+	var primaryXMP []byte
+	primaryXMP, segs.SecondaryXMP, segs.SecondaryISO = completeSegmentMetadata(segs.SecondaryXMP, segs.SecondaryISO)
+	if len(segs.PrimaryXMP) == 0 {
+		segs.PrimaryXMP = primaryXMP
+	}
+	if len(segs.PrimaryISO) == 0 && len(segs.SecondaryISO) > 0 {
+		segs.PrimaryISO = primaryIsoVersion(segs.SecondaryISO)
 	}
-	return assembleContainerWithSegments(sr.Primary, sr.Gainmap, sr.Segs)
+	return writeContainerWithSegments(w, sr.Primary, sr.Gainmap, &segs)
+}
+
+// ReplaceGainmap assembles a container of the split primary with a new gainmap JPEG.
+// EXIF, ICC and COM segments are taken from the primary, gainmap metadata is regenerated
+// from meta, or kept from the split segments when meta is nil.
+// The container is checked with ValidateContainer, fatal findings are returned as error.
+func (sr Result) ReplaceGainmap(gainmapJPEG []byte, meta *GainMapMetadata) ([]byte, error) {
+	bundle, err := sr.BuildMetadataBundle()
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		if err := validateMetadata(meta); err != nil {
+			return nil, err
+		}
+		if bundle.SecondaryISO, err = buildIsoPayload(meta); err != nil {
+			return nil, err
+		}
+		bundle.SecondaryXMP = buildGainmapXMP(meta)
+	}
+	return joinValidated(sr.Primary, gainmapJPEG, bundle)
+}
+
+// ReplacePrimary assembles a container of a new primary JPEG (e.g. re-encoded SDR) with the split
+// gainmap and metadata. EXIF and ICC of the new primary are used when it has any, otherwise they
+// are carried over from the split primary together with COM segments.
+// The container is checked with ValidateContainer, fatal findings are returned as error.
+func (sr Result) ReplacePrimary(primaryJPEG []byte) ([]byte, error) {
+	bundle, err := sr.BuildMetadataBundle()
+	if err != nil {
+		return nil, err
+	}
+	exif, icc, err := extractExifAndIcc(primaryJPEG)
+	if err != nil {
+		return nil, err
+	}
+	if len(exif) > 0 || len(icc) > 0 {
+		bundle.Exif, bundle.ICC = exif, icc
+	}
+	return joinValidated(primaryJPEG, sr.Gainmap, bundle)
+}
+
+// joinValidated joins images with bundle metadata and rejects containers with fatal validation findings.
+func joinValidated(primaryJPEG, gainmapJPEG []byte, bundle *MetadataBundle) ([]byte, error) {
+	container, err := Join(primaryJPEG, gainmapJPEG, bundle, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range ValidateContainer(container) {
+		if f.Severity == SeverityFatal {
+			return nil, fmt.Errorf("invalid container: %s", f.Message)
+		}
+	}
+	return container, nil
+}
+
+// DecodePrimaryImage decodes the primary JPEG.
+func (sr Result) DecodePrimaryImage() (image.Image, error) {
+	if len(sr.Primary) == 0 {
+		return nil, errors.New("primary image missing")
+	}
+	img, err := decodeJPEG(sr.Primary)
+	return img, err
+}
+
+// DecodeGainmap decodes the gainmap JPEG.
+func (sr Result) DecodeGainmap() (image.Image, error) {
+	if len(sr.Gainmap) == 0 {
+		return nil, errors.New("gainmap image missing")
+	}
+	img, err := decodeJPEG(sr.Gainmap)
+	return img, err
 }
 
 func scanToSOI(br *bufio.Reader, dst *[]byte) error {
@@ -137,9 +435,9 @@ func readJPEGFromSOI(br *bufio.Reader, dst *[]byte, app1, app2 *[][]byte, stopOn
 			}
 			switch marker {
 			case markerAPP1:
-				*app1 = append(*app1, append([]byte(nil), payload...))
+				*app1 = append(*app1, payload)
 			case markerAPP2:
-				*app2 = append(*app2, append([]byte(nil), payload...))
+				*app2 = append(*app2, payload)
 				if stopOnMPF && bytes.HasPrefix(payload, mpfSig) {
 					stopCapture = true
 				}
@@ -172,6 +470,8 @@ func readMarkerWithCopy(br *bufio.Reader, buf *bytes.Buffer) (byte, error) {
 	}
 }
 
+// readSegment copies length and payload of a marker segment from br to buf, payload receives
+// a copy that stays valid as buf grows.
 func readSegment(br *bufio.Reader, buf *bytes.Buffer, payload *[]byte) error {
 	var lenBytes [2]byte
 	if _, err := io.ReadFull(br, lenBytes[:]); err != nil {
@@ -189,27 +489,32 @@ func readSegment(br *bufio.Reader, buf *bytes.Buffer, payload *[]byte) error {
 		}
 		return nil
 	}
-	segment := make([]byte, payloadLen)
-	if _, err := io.ReadFull(br, segment); err != nil {
+	// Payload is copied as it is read, so that a crafted segment length does not allocate
+	// beyond actual input.
+	start := buf.Len()
+	if n, err := io.CopyN(buf, br, int64(payloadLen)); err != nil {
+		if errors.Is(err, io.EOF) && n > 0 {
+			return io.ErrUnexpectedEOF
+		}
 		return err
 	}
-	buf.Write(segment)
 	if payload != nil {
-		*payload = segment
+		*payload = bytes.Clone(buf.Bytes()[start:])
 	}
 	return nil
 }
 
 func readScanData(br *bufio.Reader, buf *bytes.Buffer) error {
 	for {
-		b, err := br.ReadByte()
+		// Copy entropy-coded data up to and including the next 0xFF.
+		chunk, err := br.ReadSlice(markerStart)
+		buf.Write(chunk)
 		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				continue
+			}
 			return err
 		}
-		buf.WriteByte(b)
-		if b != markerStart {
-			continue
-		}
 		b2, err := br.ReadByte()
 		if err != nil {
 			return err
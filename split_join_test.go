@@ -3,10 +3,21 @@ package ultrahdr
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/vearutop/ultrahdr/internal/jpegx"
 )
 
 func BenchmarkResizeSDR(b *testing.B) {
@@ -25,6 +36,8 @@ func BenchmarkResizeSDR(b *testing.B) {
 		{name: "mitchell", interp: InterpolationMitchellNetravali},
 		{name: "lanczos2", interp: InterpolationLanczos2},
 		{name: "lanczos3", interp: InterpolationLanczos3},
+		{name: "lanczos4", interp: InterpolationLanczos4},
+		{name: "hermite", interp: InterpolationHermite},
 	}
 	for _, bench := range benches {
 		bench := bench
@@ -44,6 +57,34 @@ func BenchmarkResizeSDR(b *testing.B) {
 	}
 }
 
+// BenchmarkResizeEncode reports allocations of resize with pooled JPEG encoders for each encoding mode.
+func BenchmarkResizeEncode(b *testing.B) {
+	j, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name string
+		spec ResizeSpec
+	}{
+		{name: "baseline", spec: ResizeSpec{}},
+		{name: "optimize", spec: ResizeSpec{OptimizeHuffman: true}},
+		{name: "progressive", spec: ResizeSpec{Progressive: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			spec := bench.spec
+			spec.Width, spec.Height = 300, 200
+			spec.Interpolation = InterpolationNearest
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := ResizeHDR(bytes.NewReader(j), spec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestSplitJoinRoundTripWithSampleJPEG(t *testing.T) {
 	var (
 		result *Result
@@ -300,6 +341,130 @@ func TestResizeSDRKeepMeta(t *testing.T) {
 	}
 }
 
+func TestKeepComments(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	comment := []byte("asset-id:7f3c2a91")
+	tagged, err := insertContainerAppSegments(data, []appSegment{{marker: markerCOM, payload: comment}})
+	if err != nil {
+		t.Fatalf("insert comment: %v", err)
+	}
+	sr := mustSplit(t, tagged)
+
+	check := func(name string, jpegData []byte, want bool) {
+		t.Helper()
+		comments, err := extractComments(jpegData)
+		if err != nil {
+			t.Fatalf("%s: extract comments: %v", name, err)
+		}
+		if !want {
+			if len(comments) != 0 {
+				t.Fatalf("%s: unexpected comments %q", name, comments)
+			}
+			return
+		}
+		if len(comments) != 1 || !bytes.Equal(comments[0], comment) {
+			t.Fatalf("%s: comments %q, want %q", name, comments, comment)
+		}
+		// COM follows APP segments and precedes tables.
+		markers := headerMarkers(jpegData)
+		com := bytes.IndexByte(markers, markerCOM)
+		for i, m := range markers {
+			if (m >= markerAPP0 && m <= 0xEF && i > com) || (m == 0xDB && i < com) {
+				t.Fatalf("%s: unexpected marker order % X", name, markers)
+			}
+		}
+	}
+	checkContainer := func(name string, container []byte, want bool) {
+		t.Helper()
+		for _, f := range ValidateContainer(container) {
+			if f.Severity == SeverityFatal {
+				t.Fatalf("%s: invalid container: %v", name, f)
+			}
+		}
+		check(name, mustSplit(t, container).Primary, want)
+	}
+
+	for _, keep := range []bool{false, true} {
+		err = ResizeHDR(bytes.NewReader(tagged), ResizeSpec{
+			Width: 40, Height: 30, KeepComments: keep,
+			ReceiveResult: func(res *Result, err error) {
+				if err != nil {
+					t.Fatalf("resize hdr: %v", err)
+				}
+				checkContainer("resize hdr", res.Container, keep)
+			},
+		})
+		if err != nil {
+			t.Fatalf("resize hdr: %v", err)
+		}
+		err = ResizeSDR(bytes.NewReader(sr.Primary), ResizeSpec{
+			Width: 40, Height: 30, KeepMeta: true, KeepComments: keep,
+			ReceiveResult: func(res *Result, err error) {
+				if err != nil {
+					t.Fatalf("resize sdr: %v", err)
+				}
+				check("resize sdr", res.Primary, keep)
+			},
+		})
+		if err != nil {
+			t.Fatalf("resize sdr: %v", err)
+		}
+	}
+
+	sdr, err := sr.DecodePrimaryImage()
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	res, err := Rebase(tagged, sdr, WithKeepComments(true))
+	if err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	checkContainer("rebase", res.Container, true)
+	if res, err = Rebase(tagged, sdr); err != nil {
+		t.Fatalf("rebase: %v", err)
+	}
+	checkContainer("rebase default", res.Container, false)
+
+	bundle, err := sr.BuildMetadataBundle()
+	if err != nil {
+		t.Fatalf("build bundle: %v", err)
+	}
+	encoded, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatalf("marshal bundle: %v", err)
+	}
+	var decoded MetadataBundle
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unmarshal bundle: %v", err)
+	}
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	joined, err := Join(primary, sr.Gainmap, &decoded, nil)
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	checkContainer("bundle join", joined, true)
+}
+
+// headerMarkers lists markers of jpegData up to SOS.
+func headerMarkers(jpegData []byte) []byte {
+	var markers []byte
+	for pos := 2; pos+3 < len(jpegData) && jpegData[pos] == markerStart; {
+		marker := jpegData[pos+1]
+		if marker == markerSOS {
+			break
+		}
+		markers = append(markers, marker)
+		pos += 2 + int(binary.BigEndian.Uint16(jpegData[pos+2:]))
+	}
+	return markers
+}
+
 func TestResizeParallelNoRace(t *testing.T) {
 	data, err := os.ReadFile("testdata/small_uhdr.jpg")
 	if err != nil {
@@ -458,6 +623,8 @@ func markerLabel(marker byte, payload []byte) []byte {
 		return []byte("DHT")
 	case 0xC0:
 		return []byte("SOF0")
+	case 0xC2:
+		return []byte("SOF2")
 	default:
 		return []byte("M")
 	}
@@ -597,3 +764,1486 @@ func findMpfPayload(data []byte) (int, []byte, error) {
 	}
 	return 0, nil, errors.New("mpf segment not found")
 }
+
+func TestSplitFallsBackToPrimaryMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmap, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	iso, err := buildIsoPayload(sr.Meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+
+	// Full ISO metadata on the primary, nothing on the gainmap.
+	container, err := assembleContainerWithSegments(primary, gainmap, &MetadataSegments{PrimaryISO: iso})
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	got, err := Split(bytes.NewReader(container))
+	if err != nil {
+		t.Fatalf("split primary-only metadata: %v", err)
+	}
+	if got.Meta == nil {
+		t.Fatalf("metadata missing")
+	}
+	if diff := got.Meta.MaxContentBoost[0] - sr.Meta.MaxContentBoost[0]; diff > 1e-3 || diff < -1e-3 {
+		t.Fatalf("max content boost mismatch: got %v want %v", got.Meta.MaxContentBoost[0], sr.Meta.MaxContentBoost[0])
+	}
+	if diff := got.Meta.HDRCapacityMax - sr.Meta.HDRCapacityMax; diff > 1e-3 || diff < -1e-3 {
+		t.Fatalf("hdr capacity max mismatch: got %v want %v", got.Meta.HDRCapacityMax, sr.Meta.HDRCapacityMax)
+	}
+
+	// Version-only ISO on the primary is not gainmap metadata.
+	container, err = assembleContainerWithSegments(primary, gainmap, &MetadataSegments{PrimaryISO: buildIsoVersionOnly()})
+	if err != nil {
+		t.Fatalf("assemble version-only: %v", err)
+	}
+	if _, err := Split(bytes.NewReader(container)); err == nil {
+		t.Fatalf("expected error for container without gainmap metadata")
+	}
+}
+
+func TestSplitFallsBackToXMPOnInvalidISO(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmap, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	iso, err := buildIsoPayload(sr.Meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+	// Truncated ISO block next to valid XMP on the gainmap.
+	segs := &MetadataSegments{
+		SecondaryXMP: buildGainmapXMP(sr.Meta),
+		SecondaryISO: iso[:len(isoPrefix)+isoVersionSize+3],
+	}
+	container, err := assembleContainerWithSegments(primary, gainmap, segs)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	got, err := Split(bytes.NewReader(container))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if len(got.Warnings) != 1 {
+		t.Fatalf("expected ISO fallback warning, got %v", got.Warnings)
+	}
+	if diff := got.Meta.MaxContentBoost[0] - sr.Meta.MaxContentBoost[0]; diff > 1e-3 || diff < -1e-3 {
+		t.Fatalf("max content boost mismatch: got %v want %v", got.Meta.MaxContentBoost[0], sr.Meta.MaxContentBoost[0])
+	}
+
+	var warnings []string
+	if _, _, _, err := Decode(container, &DecodeOptions{
+		SkipReconstruction: true,
+		Warn:               func(msg string) { warnings = append(warnings, msg) },
+	}); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected decode warning, got %v", warnings)
+	}
+
+	// Without XMP the ISO error is returned.
+	segs.SecondaryXMP = nil
+	if container, err = assembleContainerWithSegments(primary, gainmap, segs); err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	if _, err := Split(bytes.NewReader(container)); err == nil {
+		t.Fatalf("expected error for invalid ISO metadata without fallback")
+	}
+}
+
+func TestAssembleWithMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+
+	if _, err := AssembleWithMetadata(sr.Primary, sr.Gainmap, nil); err == nil {
+		t.Fatalf("expected error for missing metadata")
+	}
+
+	container, err := AssembleWithMetadata(sr.Primary, sr.Gainmap, sr.Meta)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	got, err := Split(bytes.NewReader(container))
+	if err != nil {
+		t.Fatalf("split assembled: %v", err)
+	}
+	if got.Segs.SecondaryISO == nil || got.Segs.SecondaryXMP == nil || got.Segs.PrimaryXMP == nil {
+		t.Fatalf("expected primary XMP and secondary ISO/XMP")
+	}
+	if diff := got.Meta.MaxContentBoost[0] - sr.Meta.MaxContentBoost[0]; diff > 1e-3 || diff < -1e-3 {
+		t.Fatalf("max content boost mismatch: got %v want %v", got.Meta.MaxContentBoost[0], sr.Meta.MaxContentBoost[0])
+	}
+	if _, _, err := DebugContainer(container); err != nil {
+		t.Fatalf("mpf invalid: %v", err)
+	}
+	xmpMeta, err := parseXMP(got.Segs.SecondaryXMP)
+	if err != nil {
+		t.Fatalf("parse secondary xmp: %v", err)
+	}
+	if diff := xmpMeta.HDRCapacityMax - sr.Meta.HDRCapacityMax; diff > 1e-3 || diff < -1e-3 {
+		t.Fatalf("xmp hdr capacity mismatch: got %v want %v", xmpMeta.HDRCapacityMax, sr.Meta.HDRCapacityMax)
+	}
+}
+
+// countingWriter records sizes of writes.
+type countingWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestWriteContainer(t *testing.T) {
+	data, err := os.ReadFile("testdata/uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	_, icc, err := extractExifAndIcc(sr.Primary)
+	if err != nil {
+		t.Fatalf("extract icc: %v", err)
+	}
+	if len(icc) == 0 {
+		t.Fatalf("expected ICC in primary")
+	}
+
+	for name, write := range map[string]func(w *countingWriter) error{
+		"container": func(w *countingWriter) error { return WriteContainer(w, sr.Primary, sr.Gainmap, sr.Meta) },
+		"joined":    func(w *countingWriter) error { return WriteJoined(w, sr.Primary, sr.Gainmap, nil, nil) },
+		"options": func(w *countingWriter) error {
+			return WriteJoinedWithOptions(w, sr.Primary, sr.Gainmap, nil, sr, &JoinOptions{KeepPrimaryAppSegments: true})
+		},
+		"segments": func(w *countingWriter) error { return sr.WriteJoined(w) },
+	} {
+		w := &countingWriter{}
+		if err := write(w); err != nil {
+			t.Fatalf("%s: write: %v", name, err)
+		}
+		for _, n := range w.writes {
+			if n > max(len(sr.Primary), len(sr.Gainmap)) {
+				t.Fatalf("%s: container was buffered in a single write of %d bytes", name, n)
+			}
+		}
+		container := w.Bytes()
+		if _, _, err := DebugContainer(container); err != nil {
+			t.Fatalf("%s: mpf invalid: %v", name, err)
+		}
+		// MPF computed up front matches the one derived from actual image positions.
+		fixed := append([]byte(nil), container...)
+		if err := replaceMpfPayload(fixed); err != nil {
+			t.Fatalf("%s: replace mpf: %v", name, err)
+		}
+		if !bytes.Equal(fixed, container) {
+			t.Fatalf("%s: up front MPF differs from actual image layout", name)
+		}
+		got, err := Split(bytes.NewReader(container))
+		if err != nil {
+			t.Fatalf("%s: split: %v", name, err)
+		}
+		if !bytes.Equal(got.Gainmap[len(got.Gainmap)-100:], sr.Gainmap[len(sr.Gainmap)-100:]) {
+			t.Fatalf("%s: gainmap data mismatch", name)
+		}
+	}
+}
+
+func TestPredictContainerSize(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	stripped, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+
+	for name, primary := range map[string][]byte{"primary": sr.Primary, "stripped primary": stripped} {
+		want, err := AssembleWithMetadata(primary, sr.Gainmap, sr.Meta)
+		if err != nil {
+			t.Fatalf("%s: assemble: %v", name, err)
+		}
+		got, err := PredictContainerSize(primary, sr.Gainmap, sr.Meta)
+		if err != nil {
+			t.Fatalf("%s: predict: %v", name, err)
+		}
+		if got != len(want) {
+			t.Fatalf("%s: predicted %d bytes, assembled %d", name, got, len(want))
+		}
+	}
+
+	// EXIF split into several segments and comments.
+	exif := append(append([]byte{}, exifSig...), bytes.Repeat([]byte{1}, 3*maxAppPayload)...)
+	comments := [][]byte{[]byte("first"), nil, []byte("second")}
+	iso, err := buildIsoPayload(sr.Meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+	parts := containerParts{
+		primary: sr.Primary, gainmap: sr.Gainmap, exif: exif, comments: comments,
+		primaryXMP: buildPrimaryXMP(sr.Meta, 0), secondaryXMP: buildGainmapXMP(sr.Meta), secondaryISO: iso,
+	}
+	want, err := assembleContainerVipsLike(parts)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	got, err := containerSizeVipsLike(parts)
+	if err != nil {
+		t.Fatalf("predict: %v", err)
+	}
+	if got != len(want) {
+		t.Fatalf("predicted %d bytes, assembled %d", got, len(want))
+	}
+
+	// Join inputs: segments of JPEGs, template, bundle with comments and leading custom segments.
+	bundle, err := sr.BuildMetadataBundle()
+	if err != nil {
+		t.Fatalf("build bundle: %v", err)
+	}
+	bundle.Exif = exif
+	bundle.Comments = comments
+	custom := []appSegment{{marker: markerAPP0 + 3, payload: []byte("vendor data")}}
+	primary, err := insertAppSegments(sr.Primary, custom)
+	if err != nil {
+		t.Fatalf("insert segments: %v", err)
+	}
+	for name, tc := range map[string]struct {
+		primary  []byte
+		bundle   *MetadataBundle
+		template *Result
+		opt      *JoinOptions
+	}{
+		"segments": {primary: sr.Primary},
+		"template": {primary: sr.Primary, template: sr},
+		"bundle":   {primary: sr.Primary, bundle: bundle},
+		"leading":  {primary: primary, bundle: bundle, opt: &JoinOptions{KeepPrimaryAppSegments: true}},
+	} {
+		want, err := JoinWithOptions(tc.primary, sr.Gainmap, tc.bundle, tc.template, tc.opt)
+		if err != nil {
+			t.Fatalf("%s: join: %v", name, err)
+		}
+		var leading []appSegment
+		if tc.opt != nil {
+			leading = custom
+		}
+		parts, err := joinedParts(tc.primary, sr.Gainmap, tc.bundle, tc.template, leading, false)
+		if err != nil {
+			t.Fatalf("%s: joined parts: %v", name, err)
+		}
+		got, err := containerSizeVipsLike(parts)
+		if err != nil {
+			t.Fatalf("%s: predict: %v", name, err)
+		}
+		if got != len(want) {
+			t.Fatalf("%s: predicted %d bytes, joined %d", name, got, len(want))
+		}
+	}
+
+	if _, err := PredictContainerSize(sr.Primary, nil, sr.Meta); err == nil {
+		t.Fatalf("expected error for missing gainmap")
+	}
+	if _, err := containerSizeVipsLike(containerParts{
+		primary: sr.Primary, gainmap: sr.Gainmap, comments: [][]byte{make([]byte, maxAppPayload+1)}, secondaryISO: iso,
+	}); !errors.Is(err, errSegmentTooLarge) {
+		t.Fatalf("expected segment too large error, got %v", err)
+	}
+}
+
+func TestTruncatedGainmap(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	ranges, err := scanJPEGs(data)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(ranges) < 2 {
+		t.Fatalf("expected gainmap range")
+	}
+	for _, r := range ranges {
+		if !endsWithEOI(data, r) {
+			t.Fatalf("range %v does not end with EOI", r)
+		}
+	}
+
+	truncated := data[:ranges[1][0]+(ranges[1][1]-ranges[1][0])/2]
+	if _, err := Split(bytes.NewReader(truncated)); !errors.Is(err, ErrTruncatedGainmap) {
+		t.Fatalf("split: expected truncated gainmap error, got %v", err)
+	}
+	if _, err := scanJPEGs(truncated); !errors.Is(err, ErrTruncatedGainmap) {
+		t.Fatalf("scan: expected truncated gainmap error, got %v", err)
+	}
+
+	want := mustSplit(t, data)
+	for _, cut := range []int{len(truncated), ranges[1][0] + 10, ranges[0][1]} {
+		res, err := RecoverPrimary(data[:cut])
+		if !errors.Is(err, ErrTruncatedGainmap) {
+			t.Fatalf("recover %d: expected truncated gainmap error, got %v", cut, err)
+		}
+		if !bytes.Equal(res.Primary, want.Primary) || len(res.Gainmap) != 0 {
+			t.Fatalf("recover %d: primary %d bytes, gainmap %d bytes", cut, len(res.Primary), len(res.Gainmap))
+		}
+		if !bytes.Equal(res.Segs.PrimaryXMP, want.Segs.PrimaryXMP) {
+			t.Fatalf("recover %d: primary XMP mismatch", cut)
+		}
+		if _, err := res.DecodePrimaryImage(); err != nil {
+			t.Fatalf("recover %d: decode primary: %v", cut, err)
+		}
+	}
+
+	// Truncated primary can not be salvaged.
+	res, err := RecoverPrimary(data[:ranges[0][1]/2])
+	if err == nil || errors.Is(err, ErrTruncatedGainmap) || res != nil {
+		t.Fatalf("truncated primary: unexpected result %v", err)
+	}
+
+	// Complete containers and plain JPEGs behave as with Split.
+	if res, err = RecoverPrimary(data); err != nil || len(res.Gainmap) == 0 {
+		t.Fatalf("complete container: %v", err)
+	}
+	plain, err := stripAppSegments(want.Primary)
+	if err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	if _, err := RecoverPrimary(plain); err == nil || errors.Is(err, ErrTruncatedGainmap) {
+		t.Fatalf("plain JPEG: unexpected error %v", err)
+	}
+}
+
+func TestResultDecodeImages(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	primary, err := sr.DecodePrimaryImage()
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	gainmap, err := sr.DecodeGainmap()
+	if err != nil {
+		t.Fatalf("decode gainmap: %v", err)
+	}
+	if primary.Bounds().Empty() || gainmap.Bounds().Empty() {
+		t.Fatalf("empty decoded image")
+	}
+	if _, err := (Result{}).DecodeGainmap(); err == nil {
+		t.Fatalf("expected error for missing gainmap")
+	}
+}
+
+func TestPrimaryIsoVersionSegment(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	iso, err := buildIsoPayload(sr.Meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+	// Full ISO metadata starts with minimum_version and writer_version, both zero.
+	if !bytes.Equal(iso[len(isoPrefix):len(isoPrefix)+isoVersionSize], []byte{0, 0, 0, 0}) {
+		t.Fatalf("unexpected iso version header: %x", iso[len(isoPrefix):len(isoPrefix)+isoVersionSize])
+	}
+
+	for name, secondaryISO := range map[string][]byte{"full": iso, "none": nil} {
+		container, err := assembleContainerVipsLike(containerParts{
+			primary: sr.Primary, gainmap: sr.Gainmap, secondaryXMP: sr.Segs.SecondaryXMP, secondaryISO: secondaryISO,
+		})
+		if err != nil {
+			t.Fatalf("%s: assemble: %v", name, err)
+		}
+		got, err := Split(bytes.NewReader(container))
+		if err != nil {
+			t.Fatalf("%s: split: %v", name, err)
+		}
+		if !bytes.Equal(got.Segs.PrimaryISO, buildIsoVersionOnly()) {
+			t.Fatalf("%s: primary iso is not version-only: %x", name, got.Segs.PrimaryISO)
+		}
+		if primaryGainmapMetadata(&MetadataSegments{PrimaryISO: got.Segs.PrimaryISO}) != nil {
+			t.Fatalf("%s: version-only primary iso parsed as metadata", name)
+		}
+		if diff := got.Meta.HDRCapacityMax - sr.Meta.HDRCapacityMax; diff > 1e-3 || diff < -1e-3 {
+			t.Fatalf("%s: hdr capacity mismatch: got %v want %v", name, got.Meta.HDRCapacityMax, sr.Meta.HDRCapacityMax)
+		}
+		if _, _, _, err := Decode(container, nil); err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+	}
+}
+
+func TestJoinWithPNGGainmap(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	gainmap, err := sr.DecodeGainmap()
+	if err != nil {
+		t.Fatalf("decode gainmap: %v", err)
+	}
+	b := gainmap.Bounds()
+	gray := image.NewGray16(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), gainmap, b.Min, draw.Src)
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, gray); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	if _, err := JoinWithOptions(sr.Primary, pngData.Bytes(), nil, nil, nil); err == nil {
+		t.Fatalf("expected error for PNG gainmap without metadata")
+	}
+
+	var warnings []string
+	container, err := JoinWithOptions(sr.Primary, pngData.Bytes(), nil, sr, &JoinOptions{
+		GainmapQuality: 90,
+		Warn:           func(msg string) { warnings = append(warnings, msg) },
+	})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+	got, err := Split(bytes.NewReader(container))
+	if err != nil {
+		t.Fatalf("split joined: %v", err)
+	}
+	gm, _, err := image.Decode(bytes.NewReader(got.Gainmap))
+	if err != nil {
+		t.Fatalf("decode joined gainmap: %v", err)
+	}
+	if _, ok := gm.(*image.Gray); !ok {
+		t.Fatalf("expected grayscale gainmap JPEG, got %T", gm)
+	}
+	if gm.Bounds().Dx() != b.Dx() || gm.Bounds().Dy() != b.Dy() {
+		t.Fatalf("gainmap dims mismatch: got %v want %v", gm.Bounds(), b)
+	}
+
+	// Squashed gainmap produces a warning but still joins.
+	var squashed bytes.Buffer
+	if err := png.Encode(&squashed, image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()/2))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	warnings = nil
+	if _, err := JoinWithOptions(sr.Primary, squashed.Bytes(), nil, sr, &JoinOptions{
+		Warn: func(msg string) { warnings = append(warnings, msg) },
+	}); err != nil {
+		t.Fatalf("join squashed: %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected aspect ratio warning, got %v", warnings)
+	}
+}
+
+func TestJoinKeepPrimaryAppSegments(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	custom := []appSegment{
+		{marker: markerAPP0 + 3, payload: []byte("vendor data")},
+		{marker: markerAPP2, payload: []byte("FPXR\x00flashpix")},
+	}
+	// Extended XMP continues the primary XMP packet that is replaced, so it is dropped.
+	orphan := appSegment{marker: markerAPP1, payload: []byte("http://ns.adobe.com/xmp/extension/\x00extended")}
+	primary, err := insertAppSegments(sr.Primary, append([]appSegment{orphan}, custom...))
+	if err != nil {
+		t.Fatalf("insert segments: %v", err)
+	}
+
+	segs, err := customAppSegments(primary)
+	if err != nil {
+		t.Fatalf("custom segments: %v", err)
+	}
+	if len(segs) != len(custom) {
+		t.Fatalf("expected %d custom segments, got %d", len(custom), len(segs))
+	}
+
+	stripped, err := JoinWithOptions(primary, sr.Gainmap, nil, sr, nil)
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	kept, err := JoinWithOptions(primary, sr.Gainmap, nil, sr, &JoinOptions{KeepPrimaryAppSegments: true})
+	if err != nil {
+		t.Fatalf("join keeping segments: %v", err)
+	}
+	if bytes.Contains(kept, orphan.payload) {
+		t.Fatalf("extended XMP segment is kept")
+	}
+	for _, seg := range custom {
+		if bytes.Contains(stripped, seg.payload) {
+			t.Fatalf("segment %q is not stripped by default", seg.payload)
+		}
+		if !bytes.Contains(kept, seg.payload) {
+			t.Fatalf("segment %q is not kept", seg.payload)
+		}
+	}
+	// Streamed segments match insertion into assembled container with MPF rewrite.
+	inserted, err := insertContainerAppSegments(stripped, segs)
+	if err != nil {
+		t.Fatalf("insert container segments: %v", err)
+	}
+	if !bytes.Equal(kept, inserted) {
+		t.Fatalf("kept segments differ from inserted ones")
+	}
+	var streamed bytes.Buffer
+	if err := WriteJoinedWithOptions(&streamed, primary, sr.Gainmap, nil, sr, &JoinOptions{KeepPrimaryAppSegments: true}); err != nil {
+		t.Fatalf("write joined: %v", err)
+	}
+	if !bytes.Equal(streamed.Bytes(), kept) {
+		t.Fatalf("streamed container differs")
+	}
+	if len(kept)-len(stripped) != appSize(custom[0].payload)+appSize(custom[1].payload) {
+		t.Fatalf("unexpected size difference %d, managed segments duplicated", len(kept)-len(stripped))
+	}
+	if _, _, err := DebugContainer(kept); err != nil {
+		t.Fatalf("mpf invalid: %v", err)
+	}
+	got := mustSplit(t, kept)
+	if !bytes.Equal(got.Gainmap, sr.Gainmap) {
+		t.Fatalf("gainmap mismatch")
+	}
+}
+
+func TestSplitGainmapFirst(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmap, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	iso, err := buildIsoPayload(sr.Meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+
+	// Gainmap goes first and carries MPF, primary entry points to the second image.
+	mpf := generateMpf(0, 0, 0)
+	firstSize := 2 + appSize(mpf) + appSize(iso) + len(gainmap) - 2
+	tiffHeader := 2 + 4 + len(mpfSig)
+	entries := mpf[len(mpfSig)+8+2+mpfTagCount*mpfTagSize+4:]
+	binary.BigEndian.PutUint32(entries[0:], mpfAttrFormatJpeg)
+	binary.BigEndian.PutUint32(entries[4:], uint32(firstSize))
+	binary.BigEndian.PutUint32(entries[8:], 0)
+	binary.BigEndian.PutUint32(entries[16:], mpfAttrFormatJpeg|mpfAttrTypePrimary)
+	binary.BigEndian.PutUint32(entries[20:], uint32(len(primary)))
+	binary.BigEndian.PutUint32(entries[24:], uint32(firstSize-tiffHeader))
+
+	var out bytes.Buffer
+	out.Write([]byte{markerStart, markerSOI})
+	writeAppSegment(&out, markerAPP2, mpf)
+	writeAppSegment(&out, markerAPP2, iso)
+	out.Write(gainmap[2:])
+	out.Write(primary)
+	container := out.Bytes()
+
+	ranges, err := scanJPEGs(container)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if ranges[0][0] != firstSize || ranges[1][0] != 0 {
+		t.Fatalf("unexpected ranges: %v", ranges)
+	}
+
+	got, err := Split(bytes.NewReader(container))
+	if err != nil {
+		t.Fatalf("split reordered: %v", err)
+	}
+	if !bytes.Equal(got.Primary, primary) {
+		t.Fatalf("primary mismatch")
+	}
+	if got.Segs.SecondaryISO == nil {
+		t.Fatalf("gainmap ISO metadata missing")
+	}
+	if diff := got.Meta.HDRCapacityMax - sr.Meta.HDRCapacityMax; diff > 1e-3 || diff < -1e-3 {
+		t.Fatalf("hdr capacity mismatch: got %v want %v", got.Meta.HDRCapacityMax, sr.Meta.HDRCapacityMax)
+	}
+}
+
+func TestSplitDisplayWithoutMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmap, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	iso, err := buildIsoPayload(sr.Meta)
+	if err != nil {
+		t.Fatalf("build iso: %v", err)
+	}
+
+	// Gainmap with its metadata is the MPF primary, display image follows without metadata.
+	container, err := assembleContainerWithSegments(gainmap, primary, &MetadataSegments{PrimaryISO: iso})
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	got, err := Split(bytes.NewReader(container))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if !bytes.Equal(got.Gainmap, primary) {
+		t.Fatalf("expected MPF order without option")
+	}
+
+	got, err = SplitWithOptions(bytes.NewReader(container), &SplitOptions{DisplayWithoutMetadata: true})
+	if err != nil {
+		t.Fatalf("split with options: %v", err)
+	}
+	if !bytes.Equal(got.Primary, primary) {
+		t.Fatalf("primary mismatch")
+	}
+	if got.Segs.SecondaryISO == nil || got.Segs.PrimaryISO != nil {
+		t.Fatalf("unexpected segments: primary ISO %d bytes, secondary ISO %d bytes", len(got.Segs.PrimaryISO), len(got.Segs.SecondaryISO))
+	}
+	if diff := got.Meta.HDRCapacityMax - sr.Meta.HDRCapacityMax; diff > 1e-3 || diff < -1e-3 {
+		t.Fatalf("hdr capacity mismatch: got %v want %v", got.Meta.HDRCapacityMax, sr.Meta.HDRCapacityMax)
+	}
+
+	// Regular containers keep their roles.
+	got, err = SplitWithOptions(bytes.NewReader(data), &SplitOptions{DisplayWithoutMetadata: true})
+	if err != nil {
+		t.Fatalf("split regular: %v", err)
+	}
+	if !bytes.Equal(got.Primary, sr.Primary) || !bytes.Equal(got.Gainmap, sr.Gainmap) {
+		t.Fatalf("regular container roles changed")
+	}
+}
+
+func TestSplitView(t *testing.T) {
+	for _, name := range []string{"testdata/small_uhdr.jpg", "testdata/uhdr.jpg", "testdata/old_acr.orig.jpg"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		want, err := Split(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("split %s: %v", name, err)
+		}
+		got, err := SplitView(data)
+		if err != nil {
+			t.Fatalf("split view %s: %v", name, err)
+		}
+		if !bytes.Equal(got.Primary, want.Primary) || !bytes.Equal(got.Gainmap, want.Gainmap) {
+			t.Fatalf("%s: images differ from Split", name)
+		}
+		// Split stops capturing primary segments at MPF, so only segments preceding it are compared.
+		if !bytes.Equal(got.Segs.SecondaryISO, want.Segs.SecondaryISO) || !bytes.Equal(got.Segs.SecondaryXMP, want.Segs.SecondaryXMP) ||
+			!bytes.Equal(got.Segs.PrimaryXMP, want.Segs.PrimaryXMP) {
+			t.Fatalf("%s: metadata segments differ from Split", name)
+		}
+		if *got.Meta != *want.Meta {
+			t.Fatalf("%s: metadata differs: %+v vs %+v", name, got.Meta, want.Meta)
+		}
+
+		// Views alias input, but appending to them does not overwrite it.
+		if &got.Primary[0] != &data[0] && &got.Gainmap[0] != &data[0] {
+			t.Fatalf("%s: result does not alias input", name)
+		}
+		if cap(got.Primary) != len(got.Primary) || cap(got.Gainmap) != len(got.Gainmap) {
+			t.Fatalf("%s: view capacity exceeds image", name)
+		}
+	}
+
+	if _, err := SplitView([]byte{markerStart, markerSOI}); err == nil {
+		t.Fatalf("expected error for invalid data")
+	}
+}
+
+func TestHeaderScannersWithoutJFIF(t *testing.T) {
+	uhdr, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, uhdr)
+
+	for _, tc := range []struct {
+		name    string
+		density bool
+	}{
+		{name: "testdata/nojfif_dqt_first.jpg"},         // SOI is followed by DQT.
+		{name: "testdata/com_first.jpg", density: true}, // COM precedes JFIF APP0.
+	} {
+		data, err := os.ReadFile(tc.name)
+		if err != nil {
+			t.Fatalf("read %s: %v", tc.name, err)
+		}
+
+		stripped, err := stripAppSegments(data)
+		if err != nil {
+			t.Fatalf("%s: strip: %v", tc.name, err)
+		}
+		if !bytes.HasPrefix(stripped, []byte{markerStart, markerSOI, markerStart, 0xDB}) {
+			t.Fatalf("%s: stripped JPEG should start with DQT: % x", tc.name, stripped[:4])
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Fatalf("%s: decode stripped: %v", tc.name, err)
+		}
+
+		app1, app2, err := extractAppSegments(data)
+		if err != nil || len(app1) != 0 || len(app2) != 0 {
+			t.Fatalf("%s: unexpected APP segments %d/%d: %v", tc.name, len(app1), len(app2), err)
+		}
+		if _, ok := jfifDensitySegment(data); ok != tc.density {
+			t.Fatalf("%s: density found %v, want %v", tc.name, ok, tc.density)
+		}
+		same, err := rewriteAppSegments(data, func(_ byte, payload []byte) []byte { return payload })
+		if err != nil || !bytes.Equal(same, data) {
+			t.Fatalf("%s: rewrite changed data: %v", tc.name, err)
+		}
+
+		container, err := AssembleWithMetadata(data, sr.Gainmap, sr.Meta)
+		if err != nil {
+			t.Fatalf("%s: assemble: %v", tc.name, err)
+		}
+		if _, _, err := DebugContainer(container); err != nil {
+			t.Fatalf("%s: mpf invalid: %v", tc.name, err)
+		}
+		got, err := Split(bytes.NewReader(container))
+		if err != nil {
+			t.Fatalf("%s: split: %v", tc.name, err)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(got.Primary)); err != nil {
+			t.Fatalf("%s: decode primary: %v", tc.name, err)
+		}
+	}
+}
+
+func BenchmarkEncodeWithQuality(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 1024, 768))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 31)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodeWithQuality(img, 85); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOptimizeHuffman(b *testing.B) {
+	files, err := filepath.Glob("testdata/*.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var images []image.Image
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if img, err := jpeg.Decode(bytes.NewReader(data)); err == nil {
+			images = append(images, img)
+		}
+	}
+	for _, optimize := range []bool{false, true} {
+		b.Run(fmt.Sprintf("optimize=%v", optimize), func(b *testing.B) {
+			b.ReportAllocs()
+			size := 0
+			for i := 0; i < b.N; i++ {
+				size = 0
+				for _, img := range images {
+					out, err := encodeJPEG(img, jpegParams{quality: 85, optimizeHuffman: optimize})
+					if err != nil {
+						b.Fatal(err)
+					}
+					size += len(out)
+				}
+			}
+			b.ReportMetric(float64(size), "bytes/corpus")
+		})
+	}
+}
+
+func TestOptimizeHuffman(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := jpeg.Decode(bytes.NewReader(sr.Primary))
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	for _, sub := range []Subsampling{Subsampling420, Subsampling444, SubsamplingGray} {
+		for _, restart := range []int{0, 5} {
+			plain, err := encodeJPEG(primary, jpegParams{quality: 85, subsampling: sub, restartInterval: restart})
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			optimized, err := encodeJPEG(primary, jpegParams{quality: 85, subsampling: sub, restartInterval: restart, optimizeHuffman: true})
+			if err != nil {
+				t.Fatalf("encode optimized: %v", err)
+			}
+			if len(optimized) >= len(plain) {
+				t.Fatalf("subsampling %d, restart %d: optimized size %d, standard tables %d", sub, restart, len(optimized), len(plain))
+			}
+			// Split DQT/DHT layout is kept.
+			if got, want := headerMarkers(optimized), headerMarkers(plain); !bytes.Equal(got, want) {
+				t.Fatalf("subsampling %d, restart %d: markers % x, want % x", sub, restart, got, want)
+			}
+			// Only entropy coding differs, so decoded images are identical.
+			want, err := jpeg.Decode(bytes.NewReader(plain))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			got, err := jpeg.Decode(bytes.NewReader(optimized))
+			if err != nil {
+				t.Fatalf("subsampling %d, restart %d: decode optimized: %v", sub, restart, err)
+			}
+			wantRGBA, gotRGBA := image.NewRGBA(want.Bounds()), image.NewRGBA(got.Bounds())
+			draw.Draw(wantRGBA, wantRGBA.Bounds(), want, want.Bounds().Min, draw.Src)
+			draw.Draw(gotRGBA, gotRGBA.Bounds(), got, got.Bounds().Min, draw.Src)
+			if !bytes.Equal(wantRGBA.Pix, gotRGBA.Pix) {
+				t.Fatalf("subsampling %d, restart %d: decoded image differs", sub, restart)
+			}
+		}
+	}
+
+	// Primary and gainmap of resized UltraHDR are both optimized.
+	var results []*Result
+	receive := func(res *Result, err error) {
+		if err != nil {
+			t.Fatalf("resize: %v", err)
+		}
+		results = append(results, res)
+	}
+	err = ResizeHDR(bytes.NewReader(data),
+		ResizeSpec{Width: 300, Height: 200, ReceiveResult: receive},
+		ResizeSpec{Width: 300, Height: 200, OptimizeHuffman: true, ReceiveResult: receive},
+	)
+	if err != nil {
+		t.Fatalf("resize uhdr: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("unexpected results: %d", len(results))
+	}
+	if len(results[1].Primary) >= len(results[0].Primary) || len(results[1].Gainmap) >= len(results[0].Gainmap) {
+		t.Fatalf("optimized primary %d, gainmap %d bytes, standard tables %d, %d", len(results[1].Primary),
+			len(results[1].Gainmap), len(results[0].Primary), len(results[0].Gainmap))
+	}
+	if _, err := Split(bytes.NewReader(results[1].Container)); err != nil {
+		t.Fatalf("split optimized: %v", err)
+	}
+}
+
+func TestGrayGainmapEncoding(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	gm, err := jpeg.Decode(bytes.NewReader(sr.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap: %v", err)
+	}
+	gray := image.NewGray(gm.Bounds())
+	draw.Draw(gray, gray.Bounds(), gm, gm.Bounds().Min, draw.Src)
+	rgba := image.NewRGBA(gm.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), gray, gray.Bounds().Min, draw.Src)
+
+	single, err := encodeWithQuality(gray, 85)
+	if err != nil {
+		t.Fatalf("encode gray: %v", err)
+	}
+	triple, err := encodeWithQuality(rgba, 85)
+	if err != nil {
+		t.Fatalf("encode rgba: %v", err)
+	}
+	if len(single) >= len(triple) {
+		t.Fatalf("gray gainmap %d bytes, 3-component %d bytes", len(single), len(triple))
+	}
+	// Luma quantization and Huffman tables only.
+	if got, want := headerMarkers(single), []byte{0xDB, 0xC0, 0xC4, 0xC4}; !bytes.Equal(got, want) {
+		t.Fatalf("gray markers % x, want % x", got, want)
+	}
+	singleImg, err := jpeg.Decode(bytes.NewReader(single))
+	if err != nil {
+		t.Fatalf("decode gray: %v", err)
+	}
+	tripleImg, err := jpeg.Decode(bytes.NewReader(triple))
+	if err != nil {
+		t.Fatalf("decode rgba: %v", err)
+	}
+	singleGray, ok := singleImg.(*image.Gray)
+	if !ok {
+		t.Fatalf("expected single-component JPEG, got %T", singleImg)
+	}
+	ycc := tripleImg.(*image.YCbCr)
+	for y := 0; y < gray.Rect.Dy(); y++ {
+		if !bytes.Equal(singleGray.Pix[y*singleGray.Stride:y*singleGray.Stride+gray.Rect.Dx()], ycc.Y[y*ycc.YStride:y*ycc.YStride+gray.Rect.Dx()]) {
+			t.Fatalf("row %d: gray gainmap differs from luma of 3-component encoding", y)
+		}
+	}
+
+	// Both gainmaps reconstruct the same HDR image.
+	decode := func(gainmap []byte) *HDRImage {
+		t.Helper()
+		c, err := AssembleWithMetadata(sr.Primary, gainmap, sr.Meta)
+		if err != nil {
+			t.Fatalf("assemble: %v", err)
+		}
+		hdr, _, _, err := Decode(c, nil)
+		if err != nil {
+			t.Fatalf("decode container: %v", err)
+		}
+		return hdr
+	}
+	want, got := decode(triple), decode(single)
+	for i := range want.Pix {
+		if math.Abs(float64(want.Pix[i]-got.Pix[i])) > 1e-6*math.Max(1, float64(want.Pix[i])) {
+			t.Fatalf("sample %d: %v, want %v", i, got.Pix[i], want.Pix[i])
+		}
+	}
+}
+
+func TestEncodeWithQualityReuse(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 67, 45))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 31)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 33, 20))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	modes := []struct{ progressive, optimize bool }{{}, {optimize: true}, {progressive: true}}
+
+	want := make(map[[2]int][]byte)
+	for m, mode := range modes {
+		for j, img := range []image.Image{rgba, gray} {
+			var buf bytes.Buffer
+			err := jpegx.EncodeWithTables(&buf, img, jpegx.EncoderOptions{
+				Quality:         90,
+				UseSampling:     true,
+				Sampling:        [3]jpegx.SamplingFactor{{H: 2, V: 2}, {H: 1, V: 1}, {H: 1, V: 1}},
+				SplitDQT:        true,
+				SplitDHT:        true,
+				Progressive:     mode.progressive,
+				OptimizeHuffman: mode.optimize,
+			})
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			want[[2]int{m, j}] = buf.Bytes()
+		}
+	}
+
+	// Pooled encoders and their scratch storage are reused between images of different types and modes.
+	for i := 0; i < 3; i++ {
+		for m, mode := range modes {
+			for j, img := range []image.Image{rgba, gray} {
+				got, err := encodeJPEG(img, jpegParams{quality: 90, progressive: mode.progressive, optimizeHuffman: mode.optimize})
+				if err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+				if !bytes.Equal(got, want[[2]int{m, j}]) {
+					t.Fatalf("iteration %d, mode %d, image %d: output differs from fresh encoder", i, m, j)
+				}
+			}
+		}
+	}
+}
+
+func TestResizeProgressive(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	var res *Result
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width: 120, Height: 90, Progressive: true,
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			res = r
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	for _, f := range ValidateContainer(res.Container) {
+		if f.Severity == SeverityFatal {
+			t.Fatalf("invalid container: %v", f)
+		}
+	}
+	out := mustSplit(t, res.Container)
+	if bytes.IndexByte(headerMarkers(out.Primary), 0xC2) < 0 || bytes.IndexByte(headerMarkers(out.Gainmap), 0xC0) < 0 {
+		t.Fatalf("expected progressive primary and baseline gainmap")
+	}
+	if _, _, _, err := Decode(res.Container, nil); err != nil {
+		t.Fatalf("decode container: %v", err)
+	}
+}
+
+func TestProgressivePrimaryFixture(t *testing.T) {
+	// Progressive primary (SOF2, multiple scans) and baseline gainmap.
+	data, err := os.ReadFile("testdata/progressive_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	markers, _, err := DebugContainer(data)
+	if err != nil {
+		t.Fatalf("debug: %v", err)
+	}
+	primaryMarkers, gainmapMarkers, _ := strings.Cut(markers, "EOI;")
+	if !strings.Contains(primaryMarkers, ";SOF2;") || strings.Count(primaryMarkers, ";SOS;") < 2 || !strings.Contains(gainmapMarkers, ";SOF0;") {
+		t.Fatalf("unexpected fixture markers: %s", markers)
+	}
+	if ok, err := IsUltraHDR(bytes.NewReader(data)); err != nil || !ok {
+		t.Fatalf("detect: %v %v", ok, err)
+	}
+	sr := mustSplit(t, data)
+	if sr.Meta == nil {
+		t.Fatalf("gainmap metadata missing")
+	}
+	if _, err := sr.BuildMetadataBundle(); err != nil {
+		t.Fatalf("bundle: %v", err)
+	}
+
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width: 120, Height: 90,
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize hdr: %v", err)
+			}
+			for _, f := range ValidateContainer(r.Container) {
+				if f.Severity == SeverityFatal {
+					t.Fatalf("invalid container: %v", f)
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize hdr: %v", err)
+	}
+	err = ResizeSDR(bytes.NewReader(sr.Primary), ResizeSpec{
+		Width: 120, Height: 90,
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize sdr: %v", err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize sdr: %v", err)
+	}
+}
+
+func TestSubsampling(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	var res *Result
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width: 120, Height: 90, Subsampling: Subsampling444, GainmapSubsampling: SubsamplingGray,
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			res = r
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	out := mustSplit(t, res.Container)
+	primary, err := out.DecodePrimaryImage()
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	if p, ok := primary.(*image.YCbCr); !ok || p.SubsampleRatio != image.YCbCrSubsampleRatio444 {
+		t.Fatalf("expected 4:4:4 primary, got %T", primary)
+	}
+	gainmap, err := jpeg.Decode(bytes.NewReader(out.Gainmap))
+	if err != nil {
+		t.Fatalf("decode gainmap: %v", err)
+	}
+	if _, ok := gainmap.(*image.Gray); !ok {
+		t.Fatalf("expected gray gainmap, got %T", gainmap)
+	}
+
+	err = ResizeSDR(bytes.NewReader(data), ResizeSpec{
+		Width: 60, Height: 45, Subsampling: SubsamplingGray,
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize sdr: %v", err)
+			}
+			if img, err := jpeg.Decode(bytes.NewReader(r.Primary)); err != nil {
+				t.Fatalf("decode sdr: %v", err)
+			} else if _, ok := img.(*image.Gray); !ok {
+				t.Fatalf("expected gray SDR, got %T", img)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize sdr: %v", err)
+	}
+
+	if _, err := encodeJPEG(primary, jpegParams{quality: 80, subsampling: Subsampling(42)}); err == nil {
+		t.Fatalf("expected unsupported subsampling error")
+	}
+}
+
+func TestRestartInterval(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 100, 70))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i*7 + i/400)
+	}
+	countRST := func(data []byte) int {
+		n := 0
+		for i := 0; i+1 < len(data); i++ {
+			if data[i] == markerStart && data[i+1] >= 0xD0 && data[i+1] <= 0xD7 {
+				n++
+			}
+		}
+		return n
+	}
+	// RST markers inside entropy-coded data do not end the image for the scanner.
+	for _, progressive := range []bool{false, true} {
+		for _, sub := range []Subsampling{Subsampling420, Subsampling444, SubsamplingGray} {
+			restarted, err := encodeJPEG(src, jpegParams{quality: 85, progressive: progressive, subsampling: sub, restartInterval: 3})
+			if err != nil {
+				t.Fatalf("encode with restarts: %v", err)
+			}
+			if countRST(restarted) == 0 {
+				t.Fatalf("progressive %v, subsampling %d: RST markers missing", progressive, sub)
+			}
+			if end, err := findJPEGEnd(restarted, 0); err != nil || end != len(restarted) {
+				t.Fatalf("progressive %v, subsampling %d: EOI at %d of %d: %v", progressive, sub, end, len(restarted), err)
+			}
+		}
+	}
+
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	var res *Result
+	err = ResizeHDR(bytes.NewReader(data), ResizeSpec{
+		Width: 120, Height: 90, RestartInterval: 4,
+		ReceiveResult: func(r *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			res = r
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	out := mustSplit(t, res.Container)
+	if countRST(out.Primary) == 0 || countRST(out.Gainmap) == 0 {
+		t.Fatalf("expected RST markers in primary and gainmap")
+	}
+	if _, _, _, err := Decode(res.Container, nil); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmap, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	bundle, err := sr.BuildMetadataBundle()
+	if err != nil {
+		t.Fatalf("bundle: %v", err)
+	}
+	badBundle := *bundle
+	badBundle.Format = "x"
+
+	iso, err := encodeGainmapMetadataISO(sr.Meta)
+	if err != nil {
+		t.Fatalf("encode iso: %v", err)
+	}
+	isoMinVer := append([]byte{}, iso...)
+	binary.BigEndian.PutUint16(isoMinVer, 1)
+	hdrBaseXMP := bytes.Replace(buildGainmapXMP(sr.Meta), []byte(`BaseRenditionIsHDR="False"`), []byte(`BaseRenditionIsHDR="True"`), 1)
+
+	split := func(b []byte) error {
+		_, err := Split(bytes.NewReader(b))
+		return err
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want []error
+	}{
+		{name: "split non JPEG", err: split([]byte("not an image")), want: []error{ErrNotJPEG}},
+		{name: "split primary only", err: split(sr.Primary), want: []error{ErrNoGainmap}},
+		{name: "split no metadata", err: split(append(append([]byte{}, primary...), gainmap...)), want: []error{ErrNoGainmapMetadata}},
+		{name: "split truncated primary", err: split(data[:len(sr.Primary)/2]), want: []error{ErrTruncated}},
+		{name: "split truncated gainmap", err: split(data[:len(data)-10]), want: []error{ErrTruncated, ErrTruncatedGainmap}},
+		{name: "split view primary only", err: func() error { _, err := SplitView(sr.Primary); return err }(), want: []error{ErrNoGainmap}},
+		{name: "decode non JPEG", err: func() error { _, _, _, err := Decode([]byte("not an image"), nil); return err }(), want: []error{ErrNotJPEG}},
+		{name: "decode primary only", err: func() error { _, _, _, err := Decode(sr.Primary, nil); return err }(), want: []error{ErrNoGainmap}},
+		{name: "join non JPEG", err: func() error { _, err := Join([]byte("not an image"), sr.Gainmap, bundle, nil); return err }(), want: []error{ErrNotJPEG}},
+		{name: "join unknown bundle", err: func() error { _, err := Join(sr.Primary, sr.Gainmap, &badBundle, nil); return err }(), want: []error{ErrUnsupportedMetadata}},
+		{name: "scan garbage", err: func() error { _, err := scanJPEGs([]byte("garbage")); return err }(), want: []error{ErrNotJPEG}},
+		{name: "invalid MPF", err: func() error { _, err := parseMPF([]byte("MPF\x00xx")); return err }(), want: []error{ErrInvalidMPF}},
+		{name: "iso min version", err: func() error { _, err := decodeGainmapMetadataISO(isoMinVer); return err }(), want: []error{ErrUnsupportedMetadata}},
+		{name: "iso truncated", err: func() error { _, err := decodeGainmapMetadataISO(iso[:len(iso)/2]); return err }(), want: []error{ErrTruncated}},
+		{name: "xmp base rendition HDR", err: func() error { _, err := parseXMP(hdrBaseXMP); return err }(), want: []error{ErrUnsupportedMetadata}},
+		{name: "debug primary only", err: func() error { _, _, err := DebugContainer(sr.Primary); return err }(), want: []error{ErrNoGainmap}},
+		{name: "debug truncated", err: func() error { _, _, err := DebugContainer(data[:len(data)-10]); return err }(), want: []error{ErrTruncated}},
+		{name: "MPF update without MPF", err: replaceMpfPayload(append(append([]byte{}, primary...), gainmap...)), want: []error{ErrInvalidMPF}},
+	} {
+		if tc.err == nil {
+			t.Fatalf("%s: expected error", tc.name)
+		}
+		for _, w := range tc.want {
+			if !errors.Is(tc.err, w) {
+				t.Fatalf("%s: error %q does not match %q", tc.name, tc.err, w)
+			}
+		}
+	}
+}
+
+func TestReplaceGainmapAndPrimary(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	sr := mustSplit(t, data)
+	images := func(container []byte) (primary, gainmap []byte, meta *GainMapMetadata) {
+		t.Helper()
+		r := mustSplit(t, container)
+		if primary, err = stripAppSegments(r.Primary); err != nil {
+			t.Fatalf("strip primary: %v", err)
+		}
+		if gainmap, err = stripAppSegments(r.Gainmap); err != nil {
+			t.Fatalf("strip gainmap: %v", err)
+		}
+		return primary, gainmap, r.Meta
+	}
+
+	joined, err := sr.Join()
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	wantPrimary, wantGainmap, wantMeta := images(joined)
+
+	for _, meta := range []*GainMapMetadata{nil, sr.Meta} {
+		replaced, err := sr.ReplaceGainmap(sr.Gainmap, meta)
+		if err != nil {
+			t.Fatalf("replace gainmap: %v", err)
+		}
+		primary, gainmap, got := images(replaced)
+		if !bytes.Equal(primary, wantPrimary) || !bytes.Equal(gainmap, wantGainmap) {
+			t.Fatalf("replaced images differ from Join")
+		}
+		if got.MaxContentBoost != wantMeta.MaxContentBoost || got.HDRCapacityMax != wantMeta.HDRCapacityMax {
+			t.Fatalf("replaced metadata %+v, want %+v", got, wantMeta)
+		}
+	}
+
+	meta := *sr.Meta
+	meta.HDRCapacityMax = 2
+	replaced, err := sr.ReplaceGainmap(sr.Gainmap, &meta)
+	if err != nil {
+		t.Fatalf("replace gainmap with metadata: %v", err)
+	}
+	if _, _, got := images(replaced); got.HDRCapacityMax != 2 {
+		t.Fatalf("HDR capacity %v, want 2", got.HDRCapacityMax)
+	}
+	meta.Gamma[0] = 0
+	if _, err := sr.ReplaceGainmap(sr.Gainmap, &meta); err == nil {
+		t.Fatalf("expected invalid metadata error")
+	}
+
+	// Re-encoded primary has no EXIF/ICC, they are carried over from the split primary.
+	img, err := sr.DecodePrimaryImage()
+	if err != nil {
+		t.Fatalf("decode primary: %v", err)
+	}
+	reencoded, err := encodeWithQuality(img, 80)
+	if err != nil {
+		t.Fatalf("encode primary: %v", err)
+	}
+	replaced, err = sr.ReplacePrimary(reencoded)
+	if err != nil {
+		t.Fatalf("replace primary: %v", err)
+	}
+	primary, gainmap, _ := images(replaced)
+	if want, _ := stripAppSegments(reencoded); !bytes.Equal(primary, want) || !bytes.Equal(gainmap, wantGainmap) {
+		t.Fatalf("replaced primary images mismatch")
+	}
+	r := mustSplit(t, replaced)
+	exif, icc, err := extractExifAndIcc(r.Primary)
+	if err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	wantExif, wantICC, _ := extractExifAndIcc(sr.Primary)
+	if !bytes.Equal(exif, wantExif) || len(icc) != len(wantICC) {
+		t.Fatalf("EXIF/ICC not carried over")
+	}
+	if MaxSeverity(ValidateContainer(replaced)) == SeverityFatal {
+		t.Fatalf("replaced container is invalid")
+	}
+
+	if _, err := sr.ReplacePrimary([]byte("not a jpeg")); err == nil {
+		t.Fatalf("expected error for invalid primary")
+	}
+}
+
+func TestJoinSynthesizesMissingMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	sr := mustSplit(t, data)
+	primary, err := stripAppSegments(sr.Primary)
+	if err != nil {
+		t.Fatalf("strip primary: %v", err)
+	}
+	gainmap, err := stripAppSegments(sr.Gainmap)
+	if err != nil {
+		t.Fatalf("strip gainmap: %v", err)
+	}
+	iso, err := buildIsoPayload(sr.Meta)
+	if err != nil {
+		t.Fatalf("build ISO: %v", err)
+	}
+	xmp := buildGainmapXMP(sr.Meta)
+
+	check := func(name string, container []byte) {
+		t.Helper()
+		r := mustSplit(t, container)
+		if len(r.Segs.SecondaryXMP) == 0 || len(r.Segs.SecondaryISO) == 0 {
+			t.Fatalf("%s: gainmap XMP %d bytes, ISO %d bytes", name, len(r.Segs.SecondaryXMP), len(r.Segs.SecondaryISO))
+		}
+		fromXMP, err := parseXMP(r.Segs.SecondaryXMP)
+		if err != nil {
+			t.Fatalf("%s: parse XMP: %v", name, err)
+		}
+		fromISO, err := decodeGainmapMetadataISO(r.Segs.SecondaryISO[len(isoPrefix):])
+		if err != nil {
+			t.Fatalf("%s: decode ISO: %v", name, err)
+		}
+		for _, m := range []*GainMapMetadata{fromXMP, fromISO} {
+			if math.Abs(float64(m.MaxContentBoost[0]-sr.Meta.MaxContentBoost[0])) > 1e-3 ||
+				math.Abs(float64(m.HDRCapacityMax-sr.Meta.HDRCapacityMax)) > 1e-3 {
+				t.Fatalf("%s: metadata %+v, want %+v", name, m, sr.Meta)
+			}
+		}
+		if len(r.Segs.PrimaryXMP) == 0 || !bytes.Contains(r.Segs.PrimaryXMP, []byte(`Item:Semantic="GainMap"`)) {
+			t.Fatalf("%s: primary XMP directory missing", name)
+		}
+		if findings := ValidateContainer(container); MaxSeverity(findings) == SeverityFatal {
+			t.Fatalf("%s: invalid container: %+v", name, findings)
+		}
+	}
+
+	isoOnly, err := insertAppSegments(gainmap, []appSegment{{marker: markerAPP2, payload: iso}})
+	if err != nil {
+		t.Fatalf("insert ISO: %v", err)
+	}
+	container, err := Join(primary, isoOnly, nil, nil)
+	if err != nil {
+		t.Fatalf("join ISO-only gainmap: %v", err)
+	}
+	check("ISO-only gainmap", container)
+
+	xmpOnly, err := insertAppSegments(gainmap, []appSegment{{marker: markerAPP1, payload: xmp}})
+	if err != nil {
+		t.Fatalf("insert XMP: %v", err)
+	}
+	container, err = Join(primary, xmpOnly, nil, nil)
+	if err != nil {
+		t.Fatalf("join XMP-only gainmap: %v", err)
+	}
+	r := mustSplit(t, container)
+	if len(r.Segs.SecondaryXMP) == 0 || len(r.Segs.SecondaryISO) == 0 {
+		t.Fatalf("XMP-only gainmap: ISO was not synthesized")
+	}
+
+	bundle := &MetadataBundle{Format: metadataBundleFormat, SecondaryISO: iso}
+	container, err = Join(primary, gainmap, bundle, nil)
+	if err != nil {
+		t.Fatalf("join ISO-only bundle: %v", err)
+	}
+	check("ISO-only bundle", container)
+
+	segsOnlyISO := Result{Primary: primary, Gainmap: gainmap, Segs: &MetadataSegments{SecondaryISO: iso}}
+	container, err = segsOnlyISO.Join()
+	if err != nil {
+		t.Fatalf("join ISO-only segments: %v", err)
+	}
+	check("ISO-only segments", container)
+}
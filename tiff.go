@@ -11,7 +11,7 @@ import (
 
 // decodeTIFFHDR decodes a TIFF image into a linear HDR image. It supports
 // 8/16-bit integer TIFFs via the standard Go decoder.
-func decodeTIFFHDR(data []byte) (*hdrImage, error) {
+func decodeTIFFHDR(data []byte) (*HDRImage, error) {
 	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
@@ -21,7 +21,7 @@ func decodeTIFFHDR(data []byte) (*hdrImage, error) {
 	if w <= 0 || h <= 0 {
 		return nil, errors.New("invalid TIFF dimensions")
 	}
-	out := &hdrImage{
+	out := &HDRImage{
 		W:   w,
 		H:   h,
 		Pix: make([]float32, w*h*3),
@@ -0,0 +1,79 @@
+package ultrahdr
+
+// Transfer functions use lookup tables, 8-bit inputs are linearized exactly, 16-bit inputs and
+// 8-bit outputs stay within 1 LSB of exact results. Functions with exact argument compute
+// values with math.Pow per pixel instead, options expose it as ExactTransfer.
+
+// transferLUTSize is the number of intervals of interpolated 16-bit inverse OETF tables.
+const transferLUTSize = 4096
+
+const numTransfers = int(ColorTransferHLG) + 1
+
+var (
+	// invOETF8Tables linearize 8-bit values.
+	invOETF8Tables [numTransfers][256]float32
+	// invOETF16Tables linearize 16-bit values with linear interpolation between entries.
+	invOETF16Tables [numTransfers][transferLUTSize + 1]float32
+	// oETF8Thresholds are linear values at which 8-bit encoded value is rounded up to the next code.
+	oETF8Thresholds [numTransfers][255]float32
+)
+
+func init() {
+	for t := range numTransfers {
+		transfer := ColorTransfer(t)
+		for i := range invOETF8Tables[t] {
+			invOETF8Tables[t][i] = invOETF(float32(i)/255, transfer)
+		}
+		for i := range invOETF16Tables[t] {
+			invOETF16Tables[t][i] = invOETF(float32(i)/transferLUTSize, transfer)
+		}
+		for i := range oETF8Thresholds[t] {
+			oETF8Thresholds[t][i] = invOETF((float32(i)+0.5)/255, transfer)
+		}
+	}
+}
+
+func knownTransfer(transfer ColorTransfer) bool {
+	return transfer >= 0 && int(transfer) < numTransfers
+}
+
+// invOETF8 linearizes an 8-bit value.
+func invOETF8(v uint8, transfer ColorTransfer) float32 {
+	if !knownTransfer(transfer) {
+		return invOETF(float32(v)/255, transfer)
+	}
+	return invOETF8Tables[transfer][v]
+}
+
+// invOETF16 linearizes a 16-bit value (as returned by color.Color.RGBA).
+func invOETF16(v uint32, transfer ColorTransfer, exact bool) float32 {
+	if exact || !knownTransfer(transfer) {
+		return invOETF(float32(v)/65535, transfer)
+	}
+	pos := float32(v) * transferLUTSize / 65535
+	i := int(pos)
+	if i >= transferLUTSize {
+		return invOETF16Tables[transfer][transferLUTSize]
+	}
+	t := &invOETF16Tables[transfer]
+	return t[i] + (t[i+1]-t[i])*(pos-float32(i))
+}
+
+// oETF8 encodes a linear value to 8-bit with rounding, same as uint8(clamp01(oETF(v))*255+0.5).
+func oETF8(v float32, transfer ColorTransfer, exact bool) uint8 {
+	if exact || !knownTransfer(transfer) {
+		return uint8(clamp01(oETF(v, transfer))*255.0 + 0.5)
+	}
+	// Binary search for the number of rounding thresholds not exceeding v.
+	t := &oETF8Thresholds[transfer]
+	lo, hi := 0, len(t)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if t[mid] <= v {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return uint8(lo)
+}
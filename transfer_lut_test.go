@@ -0,0 +1,82 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"image/jpeg"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestTransferLUT(t *testing.T) {
+	for _, transfer := range []ColorTransfer{ColorTransferSRGB, ColorTransferGamma22, ColorTransferLinear} {
+		for v := 0; v < 256; v++ {
+			if got, want := invOETF8(uint8(v), transfer), invOETF(float32(v)/255, transfer); got != want {
+				t.Fatalf("transfer %d: invOETF8(%d) = %v, want %v", transfer, v, got, want)
+			}
+		}
+		for v := 0; v <= 65535; v += 7 {
+			exact := invOETF(float32(v)/65535, transfer)
+			want := int(clamp01(oETF(exact, transfer))*255 + 0.5)
+			if got := int(oETF8(invOETF16(uint32(v), transfer, false), transfer, false)); got-want > 1 || want-got > 1 {
+				t.Fatalf("transfer %d: 16-bit %d encodes to %d, want %d", transfer, v, got, want)
+			}
+		}
+		for i := 0; i <= 100000; i++ {
+			v := float32(i) / 90000 // Includes out of range values.
+			want := int(clamp01(oETF(v, transfer))*255 + 0.5)
+			if got := int(oETF8(v, transfer, false)); got-want > 1 || want-got > 1 {
+				t.Fatalf("transfer %d: oETF8(%v) = %d, want %d", transfer, v, got, want)
+			}
+		}
+	}
+
+	for _, gamma := range []float32{0.5, 2, 2.2} {
+		meta := &GainMapMetadata{
+			MinContentBoost: [3]float32{0.5, 1, 1},
+			MaxContentBoost: [3]float32{4, 8, 2},
+			Gamma:           [3]float32{gamma, 1, gamma},
+		}
+		d := newGainDecoder(meta)
+		for i := range d.factors {
+			for v := 0; v < 256; v++ {
+				gv := float64(v) / 255
+				if meta.Gamma[i] != 1 {
+					gv = math.Pow(gv, 1/float64(meta.Gamma[i]))
+				}
+				logMin, logMax := math.Log2(float64(meta.MinContentBoost[i])), math.Log2(float64(meta.MaxContentBoost[i]))
+				want := math.Exp2(logMin*(1-gv) + logMax*gv)
+				if got := float64(d.factors[i][v]); math.Abs(got-want) > want*1e-5 {
+					t.Fatalf("gamma %v channel %d: decoded %d to %v, want %v", gamma, i, v, got, want)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkConvertImageProfile(b *testing.B) {
+	data, err := os.ReadFile("testdata/sample_adobe_rgb.jpg")
+	if err != nil {
+		b.Fatalf("read sample: %v", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		b.Fatalf("decode: %v", err)
+	}
+	// Resize to keep benchmark iterations short, conversion cost is per pixel.
+	img = resizeImageInterpolated(img, 512, img.Bounds().Dy()*512/img.Bounds().Dx(), InterpolationBilinear)
+	from := colorProfile{gamut: ColorGamutAdobeRGB, transfer: ColorTransferGamma22}
+	to := colorProfile{gamut: ColorGamutSRGB, transfer: ColorTransferSRGB}
+
+	for _, exact := range []bool{false, true} {
+		name := "lut"
+		if exact {
+			name = "exact"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				convertImageProfile(img, from, to, exact)
+			}
+		})
+	}
+}
@@ -19,20 +19,87 @@ func srgbOetf(v float32) float32 {
 	return 1.055*float32(math.Pow(float64(v), 1.0/2.4)) - 0.055
 }
 
-func invOETF(v float32, transfer colorTransfer) float32 {
+func invOETF(v float32, transfer ColorTransfer) float32 {
 	switch transfer {
-	case colorTransferGamma22:
+	case ColorTransferGamma22:
 		return float32(math.Pow(float64(v), 2.2))
+	case ColorTransferLinear:
+		return v
 	default:
 		return srgbInvOetf(v)
 	}
 }
 
-func oETF(v float32, transfer colorTransfer) float32 {
+func oETF(v float32, transfer ColorTransfer) float32 {
 	switch transfer {
-	case colorTransferGamma22:
+	case ColorTransferGamma22:
 		return float32(math.Pow(float64(v), 1.0/2.2))
+	case ColorTransferLinear:
+		return v
 	default:
 		return srgbOetf(v)
 	}
 }
+
+// PQ (SMPTE ST 2084) constants.
+const (
+	pqM1 = 2610.0 / 16384.0
+	pqM2 = 2523.0 / 4096.0 * 128.0
+	pqC1 = 3424.0 / 4096.0
+	pqC2 = 2413.0 / 4096.0 * 32.0
+	pqC3 = 2392.0 / 4096.0 * 32.0
+
+	pqMaxNits = 10000
+)
+
+// pqEOTF maps PQ encoded value to linear light normalized to 10000 nits.
+func pqEOTF(v float32) float32 {
+	if v <= 0 {
+		return 0
+	}
+	p := math.Pow(float64(v), 1/pqM2)
+	num := math.Max(p-pqC1, 0)
+	den := pqC2 - pqC3*p
+	return float32(math.Pow(num/den, 1/pqM1))
+}
+
+// pqInvEOTF maps linear light normalized to 10000 nits to PQ encoded value.
+func pqInvEOTF(v float32) float32 {
+	if v <= 0 {
+		return 0
+	}
+	y := math.Pow(float64(v), pqM1)
+	return float32(math.Pow((pqC1+pqC2*y)/(1+pqC3*y), pqM2))
+}
+
+// HLG (ARIB STD-B67) constants.
+const (
+	hlgA = 0.17883277
+	hlgB = 0.28466892
+	hlgC = 0.55991073
+
+	hlgPeakNits = 1000
+	hlgGamma    = 1.2
+)
+
+// hlgInvOETF maps HLG encoded value to normalized scene linear light.
+func hlgInvOETF(v float32) float32 {
+	if v <= 0 {
+		return 0
+	}
+	if v <= 0.5 {
+		return v * v / 3
+	}
+	return float32((math.Exp((float64(v)-hlgC)/hlgA) + hlgB) / 12)
+}
+
+// hlgOETF maps normalized scene linear light to HLG encoded value.
+func hlgOETF(v float32) float32 {
+	if v <= 0 {
+		return 0
+	}
+	if v <= 1.0/12 {
+		return float32(math.Sqrt(3 * float64(v)))
+	}
+	return float32(hlgA*math.Log(12*float64(v)-hlgB) + hlgC)
+}
@@ -0,0 +1,455 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Severity is the severity of a container validation finding.
+type Severity int
+
+// Validation severities.
+const (
+	SeverityInfo    Severity = iota // Notable, but valid.
+	SeverityWarning                 // Some readers may misbehave.
+	SeverityFatal                   // Container is malformed.
+)
+
+// String returns severity name.
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityFatal:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding is a single container validation result.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Offset   int      `json:"offset"` // Byte offset in container, -1 if not applicable.
+	Message  string   `json:"message"`
+}
+
+var itemLengthValueRe = regexp.MustCompile(`Item:Length="(\d+)"`)
+
+// ValidateContainer checks UltraHDR JPEG/R container structure: JPEG marker framing,
+// MPF sizes and offsets against actual image ranges, primary XMP Item:Length, and
+// parseability and sanity of ISO 21496-1 and XMP gainmap metadata.
+// Findings are ordered by check, the container is valid if none of them is SeverityFatal.
+func ValidateContainer(data []byte) []Finding {
+	v := &validator{data: data}
+	v.validate()
+	return v.findings
+}
+
+// MaxSeverity returns the highest severity of findings, or -1 if there are none.
+func MaxSeverity(findings []Finding) Severity {
+	s := Severity(-1)
+	for _, f := range findings {
+		s = max(s, f.Severity)
+	}
+	return s
+}
+
+type validator struct {
+	data     []byte
+	findings []Finding
+}
+
+func (v *validator) add(s Severity, offset int, format string, args ...any) {
+	v.findings = append(v.findings, Finding{Severity: s, Offset: offset, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) validate() {
+	data := v.data
+	if len(data) < 4 || data[0] != markerStart || data[1] != markerSOI {
+		v.add(SeverityFatal, 0, "missing JPEG SOI marker")
+		return
+	}
+
+	firstSegs := v.headerSegments(0, "primary")
+	firstEnd, err := findJPEGEnd(data, 0)
+	if err != nil {
+		v.add(SeverityFatal, 0, "primary image: %v", err)
+		return
+	}
+	idx := bytes.Index(data[firstEnd:], []byte{markerStart, markerSOI})
+	if idx < 0 {
+		v.add(SeverityFatal, firstEnd, "gainmap image not found")
+		return
+	}
+	secondStart := firstEnd + idx
+	if idx > 0 {
+		v.add(SeverityWarning, firstEnd, "%d bytes between primary and gainmap images", idx)
+	}
+	secondSegs := v.headerSegments(secondStart, "gainmap")
+	secondEnd, err := findJPEGEnd(data, secondStart)
+	if err != nil {
+		v.add(SeverityFatal, secondStart, "%v: %v", ErrTruncatedGainmap, err)
+		secondEnd = len(data)
+	} else if secondEnd < len(data) {
+		v.add(SeverityInfo, secondEnd, "%d trailing bytes after gainmap image", len(data)-secondEnd)
+	}
+
+	images := [2][2]int{{0, firstEnd}, {secondStart, secondEnd}}
+	primarySegs, gainmapSegs := firstSegs, secondSegs
+	if v.checkMPF(firstSegs, &images) {
+		primarySegs, gainmapSegs = secondSegs, firstSegs
+	}
+	v.checkXMPLength(primarySegs, images[1][1]-images[1][0])
+	v.checkMetadata(primarySegs, gainmapSegs)
+}
+
+// headerSegments walks marker segments of JPEG at start up to SOS and reports framing problems.
+func (v *validator) headerSegments(start int, name string) []jpegSegment {
+	data := v.data
+	var segs []jpegSegment
+	pos := start + 2
+	for pos < len(data) {
+		if data[pos] != markerStart {
+			skip := pos
+			for pos < len(data) && data[pos] != markerStart {
+				pos++
+			}
+			v.add(SeverityWarning, skip, "%s: %d unexpected bytes between segments", name, pos-skip)
+			continue
+		}
+		offset := pos
+		for pos < len(data) && data[pos] == markerStart {
+			pos++
+		}
+		if pos >= len(data) {
+			break
+		}
+		marker := data[pos]
+		pos++
+		if marker == markerEOI {
+			v.add(SeverityFatal, offset, "%s: EOI before image data", name)
+			return segs
+		}
+		if marker == markerSOI || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			v.add(SeverityWarning, offset, "%s: unexpected standalone marker 0x%02X in header", name, marker)
+			continue
+		}
+		if pos+2 > len(data) {
+			v.add(SeverityFatal, offset, "%s: truncated marker 0x%02X", name, marker)
+			return segs
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos:]))
+		if segLen < 2 || pos+segLen > len(data) {
+			v.add(SeverityFatal, offset, "%s: marker 0x%02X length %d exceeds data", name, marker, segLen)
+			return segs
+		}
+		segs = append(segs, jpegSegment{marker: marker, offset: offset, payload: data[pos+2 : pos+segLen]})
+		pos += segLen
+		if marker == markerSOS {
+			return segs
+		}
+	}
+	v.add(SeverityFatal, start, "%s: SOS marker not found", name)
+	return segs
+}
+
+// checkMPF compares MPF entries with actual image ranges, it reports whether gainmap precedes primary.
+func (v *validator) checkMPF(segs []jpegSegment, images *[2][2]int) bool {
+	var mpf *jpegSegment
+	for i, s := range segs {
+		if s.marker == markerAPP2 && bytes.HasPrefix(s.payload, mpfSig) {
+			mpf = &segs[i]
+			break
+		}
+	}
+	if mpf == nil {
+		v.add(SeverityFatal, 0, "MPF segment missing in first image")
+		return false
+	}
+	info, err := parseMPF(mpf.payload)
+	if err != nil {
+		v.add(SeverityFatal, mpf.offset, "MPF: %v", err)
+		return false
+	}
+
+	swapped := info.primaryOffset != 0 && info.secondaryOffset == 0
+	if swapped {
+		v.add(SeverityInfo, mpf.offset, "MPF: gainmap image precedes primary image")
+		images[0], images[1] = images[1], images[0]
+	}
+	tiffHeader := mpf.offset + 4 + len(mpfSig)
+	for i, e := range []struct {
+		name         string
+		size, offset int
+	}{
+		{name: "primary", size: info.primarySize, offset: info.primaryOffset},
+		{name: "gainmap", size: info.secondarySize, offset: info.secondaryOffset},
+	} {
+		start := 0
+		if e.offset != 0 {
+			start = tiffHeader + e.offset
+		}
+		actual := images[i]
+		if start != actual[0] {
+			v.add(SeverityFatal, mpf.offset, "MPF: %s image offset points to %d, actual image starts at %d", e.name, start, actual[0])
+		}
+		if e.size != actual[1]-actual[0] {
+			// Readers locate images by offset, but gainmap is usually read by size.
+			s := SeverityWarning
+			if i == 1 {
+				s = SeverityFatal
+			}
+			v.add(s, mpf.offset, "MPF: %s image size %d, actual size %d", e.name, e.size, actual[1]-actual[0])
+		}
+	}
+	return swapped
+}
+
+// checkXMPLength compares GContainer Item:Length of primary XMP with gainmap image size.
+func (v *validator) checkXMPLength(primarySegs []jpegSegment, gainmapSize int) {
+	for _, s := range primarySegs {
+		if s.marker != markerAPP1 || !bytes.HasPrefix(s.payload, []byte(xmpNamespace+"\x00")) {
+			continue
+		}
+		m := itemLengthValueRe.FindAllSubmatchIndex(s.payload, -1)
+		if len(m) == 0 {
+			return
+		}
+		// Gainmap is the last container item.
+		last := m[len(m)-1]
+		n, err := strconv.Atoi(string(s.payload[last[2]:last[3]]))
+		if err != nil || n != gainmapSize {
+			v.add(SeverityWarning, s.offset+4+last[0], "XMP: Item:Length %s does not match gainmap image size %d", s.payload[last[2]:last[3]], gainmapSize)
+		}
+		return
+	}
+}
+
+// checkMetadata checks parseability and sanity of gainmap metadata.
+func (v *validator) checkMetadata(primarySegs, gainmapSegs []jpegSegment) {
+	find := func(segs []jpegSegment, marker byte, prefix []byte) *jpegSegment {
+		for i, s := range segs {
+			if s.marker == marker && bytes.HasPrefix(s.payload, prefix) {
+				return &segs[i]
+			}
+		}
+		return nil
+	}
+	xmpPrefix := []byte(xmpNamespace + "\x00")
+
+	if iso := find(primarySegs, markerAPP2, isoPrefix); iso != nil {
+		if version := iso.payload[len(isoPrefix):]; len(version) < isoVersionSize {
+			v.add(SeverityWarning, iso.offset, "ISO: primary version segment truncated")
+		} else if binary.BigEndian.Uint16(version) != 0 {
+			v.add(SeverityWarning, iso.offset, "ISO: unsupported minimum_version %d", binary.BigEndian.Uint16(version))
+		}
+	}
+
+	found := false
+	if iso := find(gainmapSegs, markerAPP2, isoPrefix); iso != nil {
+		meta, err := decodeGainmapMetadataISO(iso.payload[len(isoPrefix):])
+		if err != nil {
+			v.add(SeverityFatal, iso.offset, "ISO: %v", err)
+		} else {
+			found = true
+			v.checkMetaSanity("ISO", iso.offset, meta)
+		}
+	} else {
+		v.add(SeverityInfo, -1, "ISO 21496-1 gainmap metadata missing")
+	}
+
+	if xmp := find(gainmapSegs, markerAPP1, xmpPrefix); xmp != nil {
+		meta, err := parseXMP(xmp.payload)
+		switch {
+		case err != nil && found:
+			v.add(SeverityWarning, xmp.offset, "XMP: %v", err)
+		case err != nil:
+			v.add(SeverityFatal, xmp.offset, "XMP: %v", err)
+		default:
+			found = true
+			v.checkMetaSanity("XMP", xmp.offset, meta)
+		}
+	}
+
+	if found {
+		return
+	}
+	segs := &MetadataSegments{}
+	if s := find(primarySegs, markerAPP1, xmpPrefix); s != nil {
+		segs.PrimaryXMP = s.payload
+	}
+	if s := find(primarySegs, markerAPP2, isoPrefix); s != nil {
+		segs.PrimaryISO = s.payload
+	}
+	if meta := primaryGainmapMetadata(segs); meta != nil {
+		v.add(SeverityWarning, -1, "gainmap metadata is stored on primary image only")
+		v.checkMetaSanity("primary", -1, meta)
+		return
+	}
+	v.add(SeverityFatal, -1, "gainmap metadata missing")
+}
+
+func (v *validator) checkMetaSanity(name string, offset int, meta *GainMapMetadata) {
+	finite := func(f float32) bool {
+		return !math.IsNaN(float64(f)) && !math.IsInf(float64(f), 0)
+	}
+	for i := 0; i < 3; i++ {
+		minB, maxB, gamma := meta.MinContentBoost[i], meta.MaxContentBoost[i], meta.Gamma[i]
+		if !finite(minB) || !finite(maxB) || !finite(gamma) || !finite(meta.OffsetSDR[i]) || !finite(meta.OffsetHDR[i]) {
+			v.add(SeverityFatal, offset, "%s: channel %d has non-finite values", name, i)
+			continue
+		}
+		if minB <= 0 || maxB < minB {
+			v.add(SeverityWarning, offset, "%s: channel %d content boost range %g..%g is invalid", name, i, minB, maxB)
+		}
+		if gamma <= 0 {
+			v.add(SeverityWarning, offset, "%s: channel %d gamma %g is not positive", name, i, gamma)
+		}
+	}
+	if !finite(meta.HDRCapacityMin) || !finite(meta.HDRCapacityMax) {
+		v.add(SeverityFatal, offset, "%s: HDR capacity is not finite", name)
+	} else if meta.HDRCapacityMin < 1 || meta.HDRCapacityMax < meta.HDRCapacityMin {
+		v.add(SeverityWarning, offset, "%s: HDR capacity range %g..%g is invalid", name, meta.HDRCapacityMin, meta.HDRCapacityMax)
+	}
+}
+
+// MPFLayout is the image entries of MPF of the first image. Sizes and offsets are as stored,
+// zero offset denotes the first image, other offsets are relative to TIFFHeader.
+type MPFLayout struct {
+	PrimarySize     int
+	PrimaryOffset   int
+	SecondarySize   int
+	SecondaryOffset int
+	TIFFHeader      int // Absolute position of MPF TIFF header in container data.
+}
+
+// DebugContainer describes container structure for assertions in tests. Markers of primary image
+// are followed by markers of gainmap image, e.g. "SOI;APP1:EXIF;APP2:MPF;DQT;SOF0;DHT;SOS;EOI;SOI;APP1:XMP;...".
+// An error is returned with partial results when images can not be found, MPF is missing, or
+// MPF entries do not match actual image ranges. See ValidateContainer for a full check.
+func DebugContainer(data []byte) (markers string, mpf MPFLayout, err error) {
+	ranges, err := scanJPEGs(data)
+	if err != nil {
+		return "", MPFLayout{}, err
+	}
+	var sb strings.Builder
+	for _, r := range ranges {
+		if err := writeMarkerNames(&sb, data[r[0]:r[1]]); err != nil {
+			return sb.String(), MPFLayout{}, err
+		}
+	}
+	markers = sb.String()
+	if len(ranges) < 2 {
+		return markers, MPFLayout{}, ErrNoGainmap
+	}
+
+	primary, secondary := ranges[0], ranges[1]
+	first := min(primary[0], secondary[0])
+	info, tiffHeader, ok := findMPFInfo(data, first)
+	if !ok {
+		return markers, MPFLayout{}, fmt.Errorf("%w: MPF missing", ErrInvalidMPF)
+	}
+	mpf = MPFLayout{
+		PrimarySize:     info.primarySize,
+		PrimaryOffset:   info.primaryOffset,
+		SecondarySize:   info.secondarySize,
+		SecondaryOffset: info.secondaryOffset,
+		TIFFHeader:      tiffHeader,
+	}
+	offset := func(r [2]int) int {
+		if r[0] == first {
+			return 0
+		}
+		return r[0] - tiffHeader
+	}
+	switch {
+	case mpf.PrimaryOffset != offset(primary):
+		err = fmt.Errorf("MPF primary offset %d, actual %d", mpf.PrimaryOffset, offset(primary))
+	case mpf.PrimarySize != primary[1]-primary[0]:
+		err = fmt.Errorf("MPF primary size %d, actual %d", mpf.PrimarySize, primary[1]-primary[0])
+	case mpf.SecondaryOffset != offset(secondary):
+		err = fmt.Errorf("MPF gainmap offset %d, actual %d", mpf.SecondaryOffset, offset(secondary))
+	case mpf.SecondarySize != secondary[1]-secondary[0]:
+		err = fmt.Errorf("MPF gainmap size %d, actual %d", mpf.SecondarySize, secondary[1]-secondary[0])
+	}
+	return markers, mpf, err
+}
+
+// writeMarkerNames writes names of markers of a single JPEG image, markers within
+// entropy-coded data (e.g. DHT of progressive scans) are included, RST markers are not.
+func writeMarkerNames(sb *strings.Builder, img []byte) error {
+	r, err := newSegmentReader(img)
+	if err != nil {
+		return err
+	}
+	sb.WriteString("SOI;")
+	for {
+		seg, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: no EOI found", ErrTruncated)
+		}
+		switch {
+		case seg.marker == markerEOI:
+			sb.WriteString("EOI;")
+			return nil
+		case seg.payload == nil:
+			// Stuffed byte, RST, SOI and TEM.
+		default:
+			sb.WriteString(markerName(seg.marker, seg.payload))
+			sb.WriteByte(';')
+		}
+	}
+}
+
+// markerName names a marker, APP segments are qualified with recognized payload type.
+func markerName(marker byte, payload []byte) string {
+	switch {
+	case marker == markerAPP0 && bytes.HasPrefix(payload, jfifSig):
+		return "APP0:JFIF"
+	case marker == markerAPP1 && bytes.HasPrefix(payload, exifSig):
+		return "APP1:EXIF"
+	case marker == markerAPP1 && bytes.HasPrefix(payload, []byte(xmpNamespace+"\x00")):
+		return "APP1:XMP"
+	case marker == markerAPP2 && bytes.HasPrefix(payload, mpfSig):
+		return "APP2:MPF"
+	case marker == markerAPP2 && bytes.HasPrefix(payload, iccSig):
+		return "APP2:ICC"
+	case marker == markerAPP2 && bytes.HasPrefix(payload, []byte(isoNamespace+"\x00")):
+		return "APP2:ISO"
+	case marker == markerAPP14 && bytes.HasPrefix(payload, adobeSig):
+		return "APP14:Adobe"
+	case marker >= markerAPP0 && marker <= 0xEF:
+		return "APP" + strconv.Itoa(int(marker-markerAPP0))
+	case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+		return "SOF" + strconv.Itoa(int(marker-0xC0))
+	}
+	switch marker {
+	case 0xC4:
+		return "DHT"
+	case 0xDB:
+		return "DQT"
+	case 0xDD:
+		return "DRI"
+	case markerSOS:
+		return "SOS"
+	case markerCOM:
+		return "COM"
+	}
+	return fmt.Sprintf("%02X", marker)
+}
@@ -0,0 +1,181 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+func validationFixture(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/small_uhdr.jpg")
+	if err != nil {
+		t.Fatalf("read uhdr: %v", err)
+	}
+	sr, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	container, err := AssembleWithMetadata(sr.Primary, sr.Gainmap, sr.Meta)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	return container
+}
+
+func findingWith(findings []Finding, s Severity, substr string) *Finding {
+	for i, f := range findings {
+		if f.Severity == s && strings.Contains(f.Message, substr) {
+			return &findings[i]
+		}
+	}
+	return nil
+}
+
+func TestValidateContainerClean(t *testing.T) {
+	for _, name := range []string{"testdata/small_uhdr.jpg", "testdata/uhdr.jpg"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if findings := ValidateContainer(data); MaxSeverity(findings) >= SeverityWarning {
+			t.Fatalf("%s: unexpected findings: %+v", name, findings)
+		}
+	}
+	if findings := ValidateContainer(validationFixture(t)); len(findings) != 0 {
+		t.Fatalf("unexpected findings: %+v", findings)
+	}
+}
+
+func TestValidateContainerCorrupted(t *testing.T) {
+	clean := validationFixture(t)
+	mpfPos := bytes.Index(clean, mpfSig)
+	entries := mpfPos + len(mpfSig) + 8 + 2 + mpfTagCount*mpfTagSize + 4
+	ranges, err := scanJPEGs(clean)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	secondStart := ranges[1][0]
+	gainmapISO := bytes.LastIndex(clean, isoPrefix)
+	itemLength := bytes.LastIndex(clean[:secondStart], []byte("Item:Length="))
+
+	for _, tc := range []struct {
+		name     string
+		corrupt  func(d []byte) []byte
+		severity Severity
+		message  string
+		offset   int
+	}{
+		{
+			name: "mpf gainmap offset",
+			corrupt: func(d []byte) []byte {
+				off := binary.BigEndian.Uint32(d[entries+24:])
+				binary.BigEndian.PutUint32(d[entries+24:], off+10)
+				return d
+			},
+			severity: SeverityFatal, message: "gainmap image offset", offset: mpfPos - 4,
+		},
+		{
+			name: "mpf gainmap size",
+			corrupt: func(d []byte) []byte {
+				size := binary.BigEndian.Uint32(d[entries+20:])
+				binary.BigEndian.PutUint32(d[entries+20:], size-100)
+				return d
+			},
+			severity: SeverityFatal, message: "gainmap image size", offset: mpfPos - 4,
+		},
+		{
+			name: "xmp item length",
+			corrupt: func(d []byte) []byte {
+				pos := itemLength + len(`Item:Length="`)
+				d[pos] = '0' + (d[pos]-'0'+1)%10
+				return d
+			},
+			severity: SeverityWarning, message: "Item:Length", offset: itemLength,
+		},
+		{
+			name: "iso min version",
+			corrupt: func(d []byte) []byte {
+				d[gainmapISO+len(isoPrefix)+1] = 1
+				return d
+			},
+			severity: SeverityFatal, message: "ISO: unsupported iso min_version", offset: gainmapISO - 4,
+		},
+		{
+			name: "segment length",
+			corrupt: func(d []byte) []byte {
+				// First gainmap segment follows SOI.
+				binary.BigEndian.PutUint16(d[secondStart+4:], 0xFFFF)
+				return d
+			},
+			severity: SeverityFatal, message: "exceeds data", offset: secondStart + 2,
+		},
+		{
+			name: "truncated",
+			corrupt: func(d []byte) []byte {
+				return d[:len(d)-100]
+			},
+			severity: SeverityFatal, message: "truncated", offset: secondStart,
+		},
+	} {
+		data := tc.corrupt(append([]byte(nil), clean...))
+		findings := ValidateContainer(data)
+		f := findingWith(findings, tc.severity, tc.message)
+		if f == nil {
+			t.Fatalf("%s: expected %s finding %q, got %+v", tc.name, tc.severity, tc.message, findings)
+		}
+		if tc.offset >= 0 && f.Offset != tc.offset {
+			t.Fatalf("%s: offset %d, want %d", tc.name, f.Offset, tc.offset)
+		}
+	}
+}
+
+func TestDebugContainer(t *testing.T) {
+	container := validationFixture(t)
+	sr := mustSplit(t, container)
+	markers, mpf, err := DebugContainer(container)
+	if err != nil {
+		t.Fatalf("debug: %v", err)
+	}
+	want := "SOI;APP1:EXIF;APP1:XMP;APP2:ISO;APP2:MPF;APP2:ICC;DQT;DQT;SOF0;DHT;DHT;DHT;DHT;SOS;EOI;" +
+		"SOI;APP1:XMP;APP2:ISO;DQT;DQT;SOF0;DHT;DHT;DHT;DHT;SOS;EOI;"
+	if markers != want {
+		t.Fatalf("markers %s, want %s", markers, want)
+	}
+	if mpf.PrimaryOffset != 0 || mpf.PrimarySize != len(sr.Primary) || mpf.SecondarySize != len(sr.Gainmap) ||
+		mpf.TIFFHeader+mpf.SecondaryOffset != len(sr.Primary) {
+		t.Fatalf("unexpected MPF layout %+v", mpf)
+	}
+
+	// Stale MPF after gainmap metadata edit.
+	stale := append(container[:len(sr.Primary):len(sr.Primary)], sr.Gainmap[:2]...)
+	stale = append(append(stale, markerStart, markerCOM, 0, 3, 'x'), sr.Gainmap[2:]...)
+	if markers, _, err = DebugContainer(stale); err == nil || !strings.Contains(err.Error(), "MPF gainmap size") {
+		t.Fatalf("expected MPF size error, got %v", err)
+	}
+	if !strings.Contains(markers, "EOI;SOI;COM;APP1:XMP;") {
+		t.Fatalf("unexpected markers %s", markers)
+	}
+
+	// Markers between progressive scans are listed.
+	err = ResizeHDR(bytes.NewReader(container), ResizeSpec{
+		Width: 40, Height: 30, Progressive: true,
+		ReceiveResult: func(res *Result, err error) {
+			if err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			markers, _, err := DebugContainer(res.Container)
+			if err != nil {
+				t.Fatalf("debug progressive: %v", err)
+			}
+			if !strings.Contains(markers, "SOF2;DHT;DHT;SOS;DHT;SOS;") {
+				t.Fatalf("unexpected progressive markers %s", markers)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+}
@@ -3,11 +3,14 @@ package ultrahdr
 import (
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
+var errXMPNotFinite = errors.New("value is not finite")
+
 var (
 	reVersion       = regexp.MustCompile(`hdrgm:Version="([^"]+)"`)
 	reGainMapMin    = regexp.MustCompile(`hdrgm:GainMapMin="([^"]+)"`)
@@ -21,12 +24,29 @@ var (
 	reGainMapMinSeq = regexp.MustCompile(`(?s)<hdrgm:GainMapMin>.*?<rdf:Seq>(.*?)</rdf:Seq>.*?</hdrgm:GainMapMin>`)
 	reGainMapMaxSeq = regexp.MustCompile(`(?s)<hdrgm:GainMapMax>.*?<rdf:Seq>(.*?)</rdf:Seq>.*?</hdrgm:GainMapMax>`)
 	reGammaSeq      = regexp.MustCompile(`(?s)<hdrgm:Gamma>.*?<rdf:Seq>(.*?)</rdf:Seq>.*?</hdrgm:Gamma>`)
+	reOffsetSDRSeq  = regexp.MustCompile(`(?s)<hdrgm:OffsetSDR>.*?<rdf:Seq>(.*?)</rdf:Seq>.*?</hdrgm:OffsetSDR>`)
+	reOffsetHDRSeq  = regexp.MustCompile(`(?s)<hdrgm:OffsetHDR>.*?<rdf:Seq>(.*?)</rdf:Seq>.*?</hdrgm:OffsetHDR>`)
 	reRdfLi         = regexp.MustCompile(`(?s)<rdf:li>([^<]+)</rdf:li>`)
 )
 
+// ParseGainmapXMP parses Adobe gain map (hdrgm) metadata from XMP APP1 payload that starts with
+// the "http://ns.adobe.com/xap/1.0/\x00" namespace header, e.g. of gainmap image of UltraHDR container
+// or of a plain JPEG exported with gain map XMP. Missing properties take hdrgm default values.
+func ParseGainmapXMP(app1Payload []byte) (*GainMapMetadata, error) {
+	return parseXMP(app1Payload)
+}
+
+// GenerateGainmapXMP returns XMP APP1 payloads, with namespace header, for primary and gainmap images
+// of a container with meta. Item:Length of the gainmap item in primary payload is 0, set it with
+// UpdateContainerGainmapLength once the size of gainmap image (with its metadata segments) is known.
+// Nil payloads are returned for nil meta.
+func GenerateGainmapXMP(meta *GainMapMetadata) (primary, secondary []byte) {
+	return buildPrimaryXMP(meta, 0), buildGainmapXMP(meta)
+}
+
 func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 	if len(app1) < len(xmpNamespace)+2 {
-		return nil, errors.New("xmp block too small")
+		return nil, fmt.Errorf("xmp block %w", ErrTruncated)
 	}
 	if !strings.HasPrefix(string(app1), xmpNamespace+"\x00") {
 		return nil, errors.New("xmp namespace mismatch")
@@ -49,18 +69,18 @@ func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 		}
 		return m[1], true
 	}
-	getFloat := func(re *regexp.Regexp) (float32, bool, error) {
+	getFloat := func(name string, re *regexp.Regexp) (float32, bool, error) {
 		str, ok := getStr(re)
 		if !ok {
 			return 0, false, nil
 		}
-		v, err := strconv.ParseFloat(str, 32)
+		v, err := parseXMPFloat(name, str)
 		if err != nil {
 			return 0, true, err
 		}
-		return float32(v), true, nil
+		return v, true, nil
 	}
-	getSeqFloats := func(re *regexp.Regexp) ([]float32, bool, error) {
+	getSeqFloats := func(name string, re *regexp.Regexp) ([]float32, bool, error) {
 		m := re.FindStringSubmatch(xml)
 		if len(m) != 2 {
 			return nil, false, nil
@@ -70,15 +90,15 @@ func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 			return nil, false, nil
 		}
 		out := make([]float32, 0, len(items))
-		for _, it := range items {
+		for i, it := range items {
 			if len(it) != 2 {
 				continue
 			}
-			v, err := strconv.ParseFloat(strings.TrimSpace(it[1]), 32)
+			v, err := parseXMPFloat(fmt.Sprintf("%s[%d]", name, i), it[1])
 			if err != nil {
 				return nil, true, err
 			}
-			out = append(out, float32(v))
+			out = append(out, v)
 		}
 		if len(out) == 0 {
 			return nil, false, nil
@@ -109,11 +129,11 @@ func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 		return nil, errors.New("xmp missing version")
 	}
 
-	if v, ok, err := getFloat(reGainMapMax); err != nil {
+	if v, ok, err := getFloat("GainMapMax", reGainMapMax); err != nil {
 		return nil, err
 	} else if ok {
 		meta.MaxContentBoost[0] = exp2f(v)
-	} else if seq, ok, err := getSeqFloats(reGainMapMaxSeq); err != nil {
+	} else if seq, ok, err := getSeqFloats("GainMapMax", reGainMapMaxSeq); err != nil {
 		return nil, err
 	} else if ok {
 		var tmp [3]float32
@@ -125,7 +145,7 @@ func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 		return nil, errors.New("xmp missing GainMapMax")
 	}
 
-	if v, ok, err := getFloat(reHDRCapMax); err != nil {
+	if v, ok, err := getFloat("HDRCapacityMax", reHDRCapMax); err != nil {
 		return nil, err
 	} else if ok {
 		meta.HDRCapacityMax = exp2f(v)
@@ -133,11 +153,11 @@ func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 		return nil, errors.New("xmp missing HDRCapacityMax")
 	}
 
-	if v, ok, err := getFloat(reGainMapMin); err != nil {
+	if v, ok, err := getFloat("GainMapMin", reGainMapMin); err != nil {
 		return nil, err
 	} else if ok {
 		meta.MinContentBoost[0] = exp2f(v)
-	} else if seq, ok, err := getSeqFloats(reGainMapMinSeq); err != nil {
+	} else if seq, ok, err := getSeqFloats("GainMapMin", reGainMapMinSeq); err != nil {
 		return nil, err
 	} else if ok {
 		var tmp [3]float32
@@ -146,35 +166,43 @@ func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 			meta.MinContentBoost[i] = exp2f(tmp[i])
 		}
 	}
-	if v, ok, err := getFloat(reGamma); err != nil {
+	if v, ok, err := getFloat("Gamma", reGamma); err != nil {
 		return nil, err
 	} else if ok {
 		meta.Gamma[0] = v
-	} else if seq, ok, err := getSeqFloats(reGammaSeq); err != nil {
+	} else if seq, ok, err := getSeqFloats("Gamma", reGammaSeq); err != nil {
 		return nil, err
 	} else if ok {
 		var tmp [3]float32
 		applySeq(&tmp, seq)
 		meta.Gamma = tmp
 	}
-	if v, ok, err := getFloat(reOffsetSDR); err != nil {
+	if v, ok, err := getFloat("OffsetSDR", reOffsetSDR); err != nil {
 		return nil, err
 	} else if ok {
 		meta.OffsetSDR[0] = v
+	} else if seq, ok, err := getSeqFloats("OffsetSDR", reOffsetSDRSeq); err != nil {
+		return nil, err
+	} else if ok {
+		applySeq(&meta.OffsetSDR, seq)
 	}
-	if v, ok, err := getFloat(reOffsetHDR); err != nil {
+	if v, ok, err := getFloat("OffsetHDR", reOffsetHDR); err != nil {
 		return nil, err
 	} else if ok {
 		meta.OffsetHDR[0] = v
+	} else if seq, ok, err := getSeqFloats("OffsetHDR", reOffsetHDRSeq); err != nil {
+		return nil, err
+	} else if ok {
+		applySeq(&meta.OffsetHDR, seq)
 	}
-	if v, ok, err := getFloat(reHDRCapMin); err != nil {
+	if v, ok, err := getFloat("HDRCapacityMin", reHDRCapMin); err != nil {
 		return nil, err
 	} else if ok {
 		meta.HDRCapacityMin = exp2f(v)
 	}
 	if v, ok := getStr(reBaseIsHDR); ok {
 		if v == "True" {
-			return nil, errors.New("base rendition HDR not supported")
+			return nil, fmt.Errorf("%w: base rendition HDR", ErrUnsupportedMetadata)
 		}
 	}
 
@@ -198,6 +226,23 @@ func parseXMP(app1 []byte) (*GainMapMetadata, error) {
 	return meta, nil
 }
 
+// parseXMPFloat parses hdrgm property value, surrounding whitespace and a single
+// decimal comma (seen from some exporters) are tolerated, NaN and infinities are rejected.
+func parseXMPFloat(name, str string) (float32, error) {
+	s := strings.TrimSpace(str)
+	if strings.Count(s, ",") == 1 && !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	v, err := strconv.ParseFloat(s, 32)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("xmp hdrgm:%s: invalid number %q", name, str)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("xmp hdrgm:%s: %w: %q", name, errXMPNotFinite, str)
+	}
+	return float32(v), nil
+}
+
 func buildGainmapXMP(meta *GainMapMetadata) []byte {
 	if meta == nil {
 		return nil
@@ -205,17 +250,38 @@ func buildGainmapXMP(meta *GainMapMetadata) []byte {
 	format := func(v float32) string {
 		return strconv.FormatFloat(float64(v), 'g', 6, 32)
 	}
-	xml := fmt.Sprintf(
-		`<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="Adobe XMP Core 5.1.2"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="%s" hdrgm:GainMapMin="%s" hdrgm:GainMapMax="%s" hdrgm:Gamma="%s" hdrgm:OffsetSDR="%s" hdrgm:OffsetHDR="%s" hdrgm:HDRCapacityMin="%s" hdrgm:HDRCapacityMax="%s" hdrgm:BaseRenditionIsHDR="False"/></rdf:RDF></x:xmpmeta>`,
-		meta.Version,
-		format(log2f(meta.MinContentBoost[0])),
-		format(log2f(meta.MaxContentBoost[0])),
-		format(meta.Gamma[0]),
-		format(meta.OffsetSDR[0]),
-		format(meta.OffsetHDR[0]),
-		format(log2f(meta.HDRCapacityMin)),
-		format(log2f(meta.HDRCapacityMax)),
-	)
+	var xml string
+	if metaAllChannelsIdentical(meta) {
+		xml = fmt.Sprintf(
+			`<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="Adobe XMP Core 5.1.2"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="%s" hdrgm:GainMapMin="%s" hdrgm:GainMapMax="%s" hdrgm:Gamma="%s" hdrgm:OffsetSDR="%s" hdrgm:OffsetHDR="%s" hdrgm:HDRCapacityMin="%s" hdrgm:HDRCapacityMax="%s" hdrgm:BaseRenditionIsHDR="False"/></rdf:RDF></x:xmpmeta>`,
+			meta.Version,
+			format(log2f(meta.MinContentBoost[0])),
+			format(log2f(meta.MaxContentBoost[0])),
+			format(meta.Gamma[0]),
+			format(meta.OffsetSDR[0]),
+			format(meta.OffsetHDR[0]),
+			format(log2f(meta.HDRCapacityMin)),
+			format(log2f(meta.HDRCapacityMax)),
+		)
+	} else {
+		// Per-channel values are written as rdf:Seq elements.
+		seq := func(name string, v [3]float32, f func(float32) float32) string {
+			return fmt.Sprintf(`<hdrgm:%s><rdf:Seq><rdf:li>%s</rdf:li><rdf:li>%s</rdf:li><rdf:li>%s</rdf:li></rdf:Seq></hdrgm:%s>`,
+				name, format(f(v[0])), format(f(v[1])), format(f(v[2])), name)
+		}
+		same := func(v float32) float32 { return v }
+		xml = fmt.Sprintf(
+			`<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="Adobe XMP Core 5.1.2"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="%s" hdrgm:HDRCapacityMin="%s" hdrgm:HDRCapacityMax="%s" hdrgm:BaseRenditionIsHDR="False">%s%s%s%s%s</rdf:Description></rdf:RDF></x:xmpmeta>`,
+			meta.Version,
+			format(log2f(meta.HDRCapacityMin)),
+			format(log2f(meta.HDRCapacityMax)),
+			seq("GainMapMin", meta.MinContentBoost, log2f),
+			seq("GainMapMax", meta.MaxContentBoost, log2f),
+			seq("Gamma", meta.Gamma, same),
+			seq("OffsetSDR", meta.OffsetSDR, same),
+			seq("OffsetHDR", meta.OffsetHDR, same),
+		)
+	}
 	out := make([]byte, 0, len(xmpNamespace)+1+len(xml))
 	out = append(out, []byte(xmpNamespace)...)
 	out = append(out, 0)
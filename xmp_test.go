@@ -0,0 +1,151 @@
+package ultrahdr
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseXMPNumbers(t *testing.T) {
+	packet := func(attrs, body string) []byte {
+		xml := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+			`<rdf:Description xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="1.0" ` + attrs + `>` +
+			body + `</rdf:Description></rdf:RDF></x:xmpmeta>`
+		return append([]byte(xmpNamespace+"\x00"), xml...)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		attrs   string
+		body    string
+		maxLog  float64
+		gamma   float32
+		wantErr string
+		notFin  bool
+	}{
+		{name: "plain", attrs: `hdrgm:GainMapMax="2" hdrgm:HDRCapacityMax="2"`, maxLog: 2, gamma: 1},
+		{name: "whitespace", attrs: `hdrgm:GainMapMax=" 2.0 " hdrgm:HDRCapacityMax="2" hdrgm:Gamma="	1.5 "`, maxLog: 2, gamma: 1.5},
+		{name: "decimal comma", attrs: `hdrgm:GainMapMax="2,5" hdrgm:HDRCapacityMax="2,5"`, maxLog: 2.5, gamma: 1},
+		{name: "exponent", attrs: `hdrgm:GainMapMax="2e+00" hdrgm:HDRCapacityMax="2"`, maxLog: 2, gamma: 1},
+		{
+			name:   "seq whitespace",
+			attrs:  `hdrgm:HDRCapacityMax="3"`,
+			body:   `<hdrgm:GainMapMax><rdf:Seq><rdf:li> 3 </rdf:li><rdf:li>3,0</rdf:li><rdf:li>3.0</rdf:li></rdf:Seq></hdrgm:GainMapMax>`,
+			maxLog: 3, gamma: 1,
+		},
+		{name: "inf", attrs: `hdrgm:GainMapMax="INF" hdrgm:HDRCapacityMax="2"`, wantErr: "hdrgm:GainMapMax", notFin: true},
+		{name: "nan", attrs: `hdrgm:GainMapMax="2" hdrgm:HDRCapacityMax="2" hdrgm:Gamma="NaN"`, wantErr: "hdrgm:Gamma", notFin: true},
+		{name: "overflow", attrs: `hdrgm:GainMapMax="2" hdrgm:HDRCapacityMax="1e50"`, wantErr: "hdrgm:HDRCapacityMax", notFin: true},
+		{name: "garbage", attrs: `hdrgm:GainMapMax="2" hdrgm:HDRCapacityMax="2" hdrgm:OffsetSDR="0.1.2"`, wantErr: `hdrgm:OffsetSDR: invalid number "0.1.2"`},
+		{name: "thousands", attrs: `hdrgm:GainMapMax="1,000,0" hdrgm:HDRCapacityMax="2"`, wantErr: "hdrgm:GainMapMax"},
+		{
+			name:    "seq item",
+			attrs:   `hdrgm:GainMapMax="2" hdrgm:HDRCapacityMax="2"`,
+			body:    `<hdrgm:OffsetHDR><rdf:Seq><rdf:li>0</rdf:li><rdf:li>x</rdf:li><rdf:li>0</rdf:li></rdf:Seq></hdrgm:OffsetHDR>`,
+			wantErr: "hdrgm:OffsetHDR[1]",
+		},
+	} {
+		meta, err := ParseGainmapXMP(packet(tc.attrs, tc.body))
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("%s: expected error with %q, got %v", tc.name, tc.wantErr, err)
+			}
+			if errors.Is(err, errXMPNotFinite) != tc.notFin {
+				t.Fatalf("%s: unexpected error kind: %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for c := range 3 {
+			if got := math.Log2(float64(meta.MaxContentBoost[c])); math.Abs(got-tc.maxLog) > 1e-6 {
+				t.Fatalf("%s: channel %d max boost log2 %v, want %v", tc.name, c, got, tc.maxLog)
+			}
+			if meta.Gamma[c] != tc.gamma {
+				t.Fatalf("%s: channel %d gamma %v, want %v", tc.name, c, meta.Gamma[c], tc.gamma)
+			}
+		}
+	}
+}
+
+func TestGenerateGainmapXMP(t *testing.T) {
+	single := &GainMapMetadata{
+		Version:         "1.0",
+		MaxContentBoost: [3]float32{4, 4, 4},
+		MinContentBoost: [3]float32{1, 1, 1},
+		Gamma:           [3]float32{1, 1, 1},
+		OffsetSDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		OffsetHDR:       [3]float32{1.0 / 64, 1.0 / 64, 1.0 / 64},
+		HDRCapacityMin:  1,
+		HDRCapacityMax:  4,
+		UseBaseCG:       true,
+	}
+	multi := *single
+	multi.MaxContentBoost = [3]float32{4, 2, 8}
+	multi.Gamma = [3]float32{1, 0.5, 2}
+	multi.HDRCapacityMax = 8
+
+	for _, meta := range []*GainMapMetadata{single, &multi} {
+		primary, secondary := GenerateGainmapXMP(meta)
+		for _, p := range [][]byte{primary, secondary} {
+			if !bytes.HasPrefix(p, xmpPrefix) {
+				t.Fatalf("payload without namespace header: %q", p)
+			}
+		}
+		if !bytes.Contains(primary, []byte(`Item:Length="0"`)) {
+			t.Fatalf("unexpected primary payload: %s", primary)
+		}
+		updated, err := UpdateContainerGainmapLength(primary, 1234)
+		if err != nil || !bytes.Contains(updated, []byte(`Item:Length="1234"`)) {
+			t.Fatalf("update length: %v", err)
+		}
+		got, err := ParseGainmapXMP(secondary)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		for c := range 3 {
+			for _, v := range [][2]float32{
+				{got.MaxContentBoost[c], meta.MaxContentBoost[c]},
+				{got.MinContentBoost[c], meta.MinContentBoost[c]},
+				{got.Gamma[c], meta.Gamma[c]},
+				{got.OffsetSDR[c], meta.OffsetSDR[c]},
+				{got.OffsetHDR[c], meta.OffsetHDR[c]},
+			} {
+				if math.Abs(float64(v[0]-v[1])) > 1e-5*float64(v[1]) {
+					t.Fatalf("channel %d: round trip %+v, want %+v", c, got, meta)
+				}
+			}
+		}
+		if got.HDRCapacityMax != meta.HDRCapacityMax || got.HDRCapacityMin != meta.HDRCapacityMin {
+			t.Fatalf("capacity %v..%v, want %v..%v", got.HDRCapacityMin, got.HDRCapacityMax, meta.HDRCapacityMin, meta.HDRCapacityMax)
+		}
+	}
+
+	if primary, secondary := GenerateGainmapXMP(nil); primary != nil || secondary != nil {
+		t.Fatalf("expected nil payloads for nil metadata")
+	}
+	if _, err := ParseGainmapXMP([]byte("<x:xmpmeta/>")); err == nil {
+		t.Fatalf("expected error without namespace header")
+	}
+}
+
+func FuzzParseXMP(f *testing.F) {
+	f.Add([]byte(xmpNamespace + "\x00"))
+	addTestdataSeeds(f, func(data []byte) [][]byte {
+		return segmentSeeds(data, func(p []byte) bool { return bytes.HasPrefix(p, []byte(xmpNamespace+"\x00")) })
+	})
+
+	f.Fuzz(func(t *testing.T, app1 []byte) {
+		var (
+			meta *GainMapMetadata
+			err  error
+		)
+		checkAllocBound(t, len(app1), func() { meta, err = parseXMP(app1) })
+		if err == nil && meta == nil {
+			t.Fatalf("nil metadata without error")
+		}
+	})
+}